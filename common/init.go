@@ -97,6 +97,10 @@ func InitEnv() {
 	GeminiSafetySetting = GetEnvOrDefaultString("GEMINI_SAFETY_SETTING", "BLOCK_NONE")
 	CohereSafetySetting = GetEnvOrDefaultString("COHERE_SAFETY_SETTING", "NONE")
 
+	// 日志 / 审计中的用户标识脱敏
+	PIIHashEnabled = GetEnvOrDefaultBool("PII_HASH_ENABLED", false)
+	PIIHashSalt = GetEnvOrDefaultString("PII_HASH_SALT", "")
+
 	// Initialize rate limit variables
 	GlobalApiRateLimitEnable = GetEnvOrDefaultBool("GLOBAL_API_RATE_LIMIT_ENABLE", true)
 	GlobalApiRateLimitNum = GetEnvOrDefault("GLOBAL_API_RATE_LIMIT", 180)
@@ -135,6 +139,21 @@ func initConstantEnv() {
 	constant.ErrorLogEnabled = GetEnvOrDefaultBool("ERROR_LOG_ENABLED", false)
 	// 任务轮询时查询的最大数量
 	constant.TaskQueryLimit = GetEnvOrDefault("TASK_QUERY_LIMIT", 1000)
+	// Prometheus 指标接口
+	constant.MetricsEnabled = GetEnvOrDefaultBool("METRICS_ENABLED", false)
+	constant.MetricsToken = GetEnvOrDefaultString("METRICS_TOKEN", "")
+	// 跨域来源白名单
+	constant.CORSAllowedOrigins = GetEnvOrDefaultString("ALLOWED_ORIGINS", "")
+	constant.CORSAllowCredentials = GetEnvOrDefaultBool("CORS_ALLOW_CREDENTIALS", false)
+	constant.CORSExposeHeaders = GetEnvOrDefaultString("CORS_EXPOSE_HEADERS", "")
+	// 渠道速率限制计数快照 (单实例无 Redis 时使计数在重启后保留)
+	constant.ChannelRateLimitSnapshotPath = GetEnvOrDefaultString("CHANNEL_RATE_LIMIT_SNAPSHOT_PATH", "")
+	constant.ChannelRateLimitSnapshotIntervalSeconds = GetEnvOrDefault("CHANNEL_RATE_LIMIT_SNAPSHOT_INTERVAL", 60)
+	constant.ChannelRateLimitSweepIntervalSeconds = GetEnvOrDefault("CHANNEL_RATE_LIMIT_SWEEP_INTERVAL", 600)
+	// 渠道全局默认速率限制 (渠道未单独启用速率限制时生效)
+	constant.ChannelRateLimitDefaultEnabled = GetEnvOrDefaultBool("CHANNEL_RATE_LIMIT_DEFAULT_ENABLED", false)
+	constant.ChannelRateLimitDefaultRPM = GetEnvOrDefault("CHANNEL_RATE_LIMIT_DEFAULT_RPM", 0)
+	constant.ChannelRateLimitDefaultRPD = GetEnvOrDefault("CHANNEL_RATE_LIMIT_DEFAULT_RPD", 0)
 
 	soraPatchStr := GetEnvOrDefaultString("TASK_PRICE_PATCH", "")
 	if soraPatchStr != "" {
@@ -162,5 +181,63 @@ func initConstantEnv() {
 	constant.ExternalUserRedisURL = externalRedisURL
 	constant.ExternalUserRedisToken = GetEnvOrDefaultString("UPSTASH_REDIS_REST_TOKEN", GetEnvOrDefaultString("EXTERNAL_USER_REDIS_TOKEN", ""))
 	constant.ExternalUserJWTSecret = GetEnvOrDefaultString("EXTERNAL_USER_JWT_SECRET", "")
+	constant.ExternalUserTokenHeader = GetEnvOrDefaultString("EXTERNAL_USER_TOKEN_HEADER", "X-External-User-Token")
+	constant.ExternalUserTokenPrefix = GetEnvOrDefaultString("EXTERNAL_USER_TOKEN_PREFIX", "")
+	constant.ExternalUserTokenCookie = GetEnvOrDefaultString("EXTERNAL_USER_TOKEN_COOKIE", "")
+	constant.ExternalUserAllowQueryToken = GetEnvOrDefaultBool("EXTERNAL_USER_ALLOW_QUERY_TOKEN", false)
+	constant.ExternalUserTokenQueryParam = GetEnvOrDefaultString("EXTERNAL_USER_TOKEN_QUERY_PARAM", "access_token")
+	constant.ExternalUserJWTPreviousSecrets = GetEnvOrDefaultString("EXTERNAL_USER_JWT_PREVIOUS_SECRETS", "")
 	constant.ExternalUserMonthlyQuota = GetEnvOrDefault("EXTERNAL_USER_MONTHLY_QUOTA", 30)
+	constant.ExternalUserMonthlyTokenQuota = GetEnvOrDefault("EXTERNAL_USER_MONTHLY_TOKEN_QUOTA", 0)
+	constant.ExternalUserDailyQuota = GetEnvOrDefault("EXTERNAL_USER_DAILY_QUOTA", 0)
+	constant.ExternalUserQuotaResetDay = GetEnvOrDefault("EXTERNAL_USER_QUOTA_RESET_DAY", 1)
+	constant.ExternalUserJWTPublicKeyPEM = GetEnvOrDefaultString("EXTERNAL_USER_JWT_PUBLIC_KEY", "")
+	constant.ExternalUserJWTAlgorithm = GetEnvOrDefaultString("EXTERNAL_USER_JWT_ALGORITHM", "")
+	constant.ExternalUserJWTLeewaySeconds = GetEnvOrDefault("EXTERNAL_USER_JWT_LEEWAY_SECONDS", 60)
+	constant.ExternalUserJWTIssuer = GetEnvOrDefaultString("EXTERNAL_USER_JWT_ISSUER", "")
+	constant.ExternalUserJWTAudience = GetEnvOrDefaultString("EXTERNAL_USER_JWT_AUDIENCE", "")
+	constant.ExternalUserAllowUnsignedTokens = GetEnvOrDefaultBool("EXTERNAL_USER_ALLOW_UNSIGNED_TOKENS", false)
+	constant.ExternalUserStrictLookup = GetEnvOrDefaultBool("EXTERNAL_USER_STRICT_LOOKUP", false)
+	constant.ExternalUserMaxChannelsPerUser = GetEnvOrDefault("EXTERNAL_USER_MAX_CHANNELS_PER_USER", 0)
+	constant.ExternalUserTrackVIPUsage = GetEnvOrDefaultBool("EXTERNAL_USER_TRACK_VIP_USAGE", false)
+	constant.ExternalUserTrialQuota = GetEnvOrDefault("EXTERNAL_USER_TRIAL_QUOTA", 0)
+	constant.ExternalUserQuotaRolloverMax = GetEnvOrDefault("EXTERNAL_USER_QUOTA_ROLLOVER_MAX", 0)
+	constant.ExternalUserPromoStart = int64(GetEnvOrDefault("EXTERNAL_USER_PROMO_START", 0))
+	constant.ExternalUserPromoEnd = int64(GetEnvOrDefault("EXTERNAL_USER_PROMO_END", 0))
+	constant.ExternalUserPromoCountUsage = GetEnvOrDefaultBool("EXTERNAL_USER_PROMO_COUNT_USAGE", false)
+	constant.ExternalUserAdminIDs = GetEnvOrDefaultString("EXTERNAL_USER_ADMIN_IDS", "")
+	constant.ExternalUserAdminUsernames = GetEnvOrDefaultString("EXTERNAL_USER_ADMIN_USERNAMES", "admin")
+	constant.ExternalUserAdminByUsername = GetEnvOrDefaultBool("EXTERNAL_USER_ADMIN_BY_USERNAME", false)
+	constant.ExternalUserRedisTimeoutMs = GetEnvOrDefault("EXTERNAL_USER_REDIS_TIMEOUT_MS", 0)
+	constant.ExternalUserUpstashTimeoutMs = GetEnvOrDefault("EXTERNAL_USER_UPSTASH_TIMEOUT_MS", 0)
+	constant.ExternalUserRedisMaxAttempts = GetEnvOrDefault("EXTERNAL_USER_REDIS_MAX_ATTEMPTS", 3)
+	constant.ExternalUserUpstashMaxConcurrency = GetEnvOrDefault("EXTERNAL_USER_UPSTASH_MAX_CONCURRENCY", 8)
+	constant.ExternalUserFailOpen = GetEnvOrDefaultBool("EXTERNAL_USER_FAIL_OPEN", false)
+	// 未设置时跟随 EXTERNAL_USER_FAIL_OPEN
+	constant.ExternalUserStorageFailurePolicy = GetEnvOrDefaultString("EXTERNAL_USER_STORAGE_FAILURE_POLICY", "")
+	constant.ExternalUserTierQuotas = GetEnvOrDefaultString("EXTERNAL_USER_TIER_QUOTAS", "")
+	constant.ExternalUserQuotaWarningPercent = GetEnvOrDefault("EXTERNAL_USER_QUOTA_WARNING_PERCENT", 80)
+	constant.ExternalUserTierWarningPercents = GetEnvOrDefaultString("EXTERNAL_USER_TIER_WARNING_PERCENTS", "")
+	constant.ExternalUserDeniedModels = GetEnvOrDefaultString("EXTERNAL_USER_DENIED_MODELS", "")
+	constant.ExternalUserTierAllowedModels = GetEnvOrDefaultString("EXTERNAL_USER_TIER_ALLOWED_MODELS", "")
+	constant.ExternalUserModelQuotas = GetEnvOrDefaultString("EXTERNAL_USER_MODEL_QUOTAS", "")
+	constant.ExternalUserLifetimeCaps = GetEnvOrDefaultString("EXTERNAL_USER_LIFETIME_CAPS", "")
+	constant.ExternalUserTrustedCostNetworks = GetEnvOrDefaultString("EXTERNAL_USER_TRUSTED_COST_NETWORKS", "")
+	constant.ExternalUserMaxRequestCost = GetEnvOrDefault("EXTERNAL_USER_MAX_REQUEST_COST", 100)
+	constant.ExternalUserMinTokenLength = GetEnvOrDefault("EXTERNAL_USER_MIN_TOKEN_LENGTH", 20)
+	constant.ExternalUserAuthFailWindowSeconds = GetEnvOrDefault("EXTERNAL_USER_AUTH_FAIL_WINDOW", 900)
+	constant.ExternalUserAuthFailBlockThreshold = GetEnvOrDefault("EXTERNAL_USER_AUTH_FAIL_BLOCK_THRESHOLD", 0)
+	constant.ExternalUserAuthFailBlockSeconds = GetEnvOrDefault("EXTERNAL_USER_AUTH_FAIL_BLOCK_SECONDS", 1800)
+	constant.ExternalUserStatusMaxAgeSeconds = GetEnvOrDefault("EXTERNAL_USER_STATUS_MAX_AGE", 10)
+	constant.ExternalUserStatsCacheSeconds = GetEnvOrDefault("EXTERNAL_USER_STATS_CACHE_TTL", 30)
+	constant.ExternalUserQuotaResetSeconds = GetEnvOrDefault("EXTERNAL_USER_QUOTA_RESET_INTERVAL", 3600)
+	constant.ExternalUserTarpitBaseMs = GetEnvOrDefault("EXTERNAL_USER_TARPIT_BASE_MS", 0)
+	constant.ExternalUserTarpitMaxMs = GetEnvOrDefault("EXTERNAL_USER_TARPIT_MAX_MS", 10000)
+	constant.ExternalUserTarpitWindowSeconds = GetEnvOrDefault("EXTERNAL_USER_TARPIT_WINDOW", 600)
+	constant.ExternalUserVIPGraceSeconds = GetEnvOrDefault("EXTERNAL_USER_VIP_GRACE_SECONDS", 0)
+	constant.ExternalUserRPMLimit = GetEnvOrDefault("EXTERNAL_USER_RPM_LIMIT", 0)
+	constant.ExternalUserMaxConcurrentPerUser = GetEnvOrDefault("EXTERNAL_USER_MAX_CONCURRENT", 0)
+	constant.ExternalUserCacheTTLSeconds = GetEnvOrDefault("EXTERNAL_USER_CACHE_TTL_SECONDS", 0)
+	constant.ExternalUserCacheSize = GetEnvOrDefault("EXTERNAL_USER_CACHE_SIZE", 10000)
+	constant.ExternalUserMetricChannels = GetEnvOrDefaultString("EXTERNAL_USER_METRIC_CHANNELS", "")
 }
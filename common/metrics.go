@@ -0,0 +1,56 @@
+package common
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus 指标
+// 使用独立的 Registry (而不是默认 Registry)，只暴露下面注册的指标与进程 / Go 运行时指标。
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	// ExternalUserRequestsTotal 经过外部用户验证的请求数，result: allowed / denied_quota / denied_auth
+	ExternalUserRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "external_user_requests_total",
+		Help: "Requests handled by external user auth, by result.",
+	}, []string{"result"})
+
+	// ExternalUserQuotaUsed 本进程计入的外部用户周期配额消耗 (按渠道累计)
+	// 渠道 ID 来自客户端 header，只有 EXTERNAL_USER_METRIC_CHANNELS 中配置的渠道单独计数，其余计入 other，避免指标序列无限增长
+	ExternalUserQuotaUsed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "external_user_quota_used",
+		Help: "Quota units charged to external users, by channel.",
+	}, []string{"channel"})
+
+	// ChannelRateLimitRejectionsTotal 渠道速率限制拒绝的请求数
+	ChannelRateLimitRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "channel_rate_limit_rejections_total",
+		Help: "Requests rejected by channel rate limits, by channel and key.",
+	}, []string{"channel", "key"})
+
+	// ChannelRPMCurrent 渠道 key 当前窗口内的请求数 (每次计数后更新)
+	ChannelRPMCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "channel_rpm_current",
+		Help: "Requests counted in the current rate limit window, by channel and key.",
+	}, []string{"channel", "key"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		ExternalUserRequestsTotal,
+		ExternalUserQuotaUsed,
+		ChannelRateLimitRejectionsTotal,
+		ChannelRPMCurrent,
+	)
+}
+
+// MetricsHandler 输出 MetricsRegistry 中的指标 (Prometheus 文本格式)
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,22 @@
+package common
+
+import "encoding/hex"
+
+// 用户标识 (userId / email) 脱敏
+// 开启 PIIHashEnabled 后，日志、审计记录等位置统一输出加盐 SHA-256 的前 16 位十六进制，
+// 同一标识在相同盐值下结果一致，可用于关联同一用户而不暴露原值；开发环境可关闭以查看原始值。
+var (
+	PIIHashEnabled bool
+	PIIHashSalt    string
+)
+
+const piiHashPrefix = "pii_"
+
+// HashPII 对用户标识脱敏，未开启或值为空时原样返回
+func HashPII(value string) string {
+	if !PIIHashEnabled || value == "" {
+		return value
+	}
+	sum := Sha256Raw([]byte(PIIHashSalt + value))
+	return piiHashPrefix + hex.EncodeToString(sum[:8])
+}
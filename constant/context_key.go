@@ -37,6 +37,7 @@ const (
 	ContextKeyChannelIsMultiKey        ContextKey = "channel_is_multi_key"
 	ContextKeyChannelMultiKeyIndex     ContextKey = "channel_multi_key_index"
 	ContextKeyChannelKey               ContextKey = "channel_key"
+	ContextKeyChannelSlotRelease       ContextKey = "channel_slot_release" // 释放当前渠道 key 并发名额的函数
 
 	ContextKeyAutoGroup           ContextKey = "auto_group"
 	ContextKeyAutoGroupIndex      ContextKey = "auto_group_index"
@@ -52,6 +53,19 @@ const (
 	ContextKeyUsingGroup  ContextKey = "group"
 	ContextKeyUserName    ContextKey = "username"
 
+	/* external user related keys (由 middleware.ExternalUserAuth 设置，供消费日志使用) */
+	ContextKeyExternalUserId         ContextKey = "external_user_id"              // 外部用户 ID
+	ContextKeyExternalUserEmail      ContextKey = "external_user_email"           // 外部用户邮箱
+	ContextKeyExternalUserVIP        ContextKey = "external_user_vip"             // 是否为 VIP/管理员
+	ContextKeyExternalQuotaChannelId ContextKey = "external_user_channel_id"      // 计量配额的渠道 ID
+	ContextKeyExternalQuotaCharged   ContextKey = "external_user_quota_charged"   // 本次请求扣除的配额
+	ContextKeyExternalQuotaUsed      ContextKey = "external_user_quota_used"      // 扣除后的已用配额
+	ContextKeyExternalQuotaTotal     ContextKey = "external_user_quota_total"     // 当前周期配额上限
+	ContextKeyExternalQuotaRemaining ContextKey = "external_user_quota_remaining" // 扣除后的剩余配额
+	ContextKeyExternalQuotaSaved     ContextKey = "external_quota_saved"          // 配额是否成功写入 Redis
+	ContextKeyExternalQuotaError     ContextKey = "external_quota_error"          // 配额写入失败的错误信息
+	ContextKeyExternalQuotaTokens    ContextKey = "external_user_quota_tokens"    // 本次请求消耗的 token 数 (由消费日志写入，供 token 配额累计)
+
 	ContextKeyLocalCountTokens ContextKey = "local_count_tokens"
 
 	ContextKeySystemPromptOverride ContextKey = "system_prompt_override"
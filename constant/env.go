@@ -17,6 +17,17 @@ var NotificationLimitDurationMinute int
 var GenerateDefaultToken bool
 var ErrorLogEnabled bool
 var TaskQueryLimit int
+var ChannelRateLimitSnapshotPath string         // 渠道速率限制快照文件路径，为空表示不持久化
+var ChannelRateLimitSnapshotIntervalSeconds int // 快照保存间隔 (秒)
+var ChannelRateLimitSweepIntervalSeconds int    // 过期速率限制记录清理间隔 (秒)
+var ChannelRateLimitDefaultEnabled bool         // 未启用速率限制的渠道是否使用全局默认限制
+var ChannelRateLimitDefaultRPM int              // 全局默认每分钟请求数限制，0 表示不限制
+var ChannelRateLimitDefaultRPD int              // 全局默认每天请求数限制，0 表示不限制
+var MetricsEnabled bool                         // 是否开放 Prometheus 指标接口 /metrics
+var MetricsToken string                         // 访问 /metrics 需携带的 Bearer token，为空时不校验
+var CORSAllowedOrigins string                   // 允许跨域访问的来源，逗号分隔 (支持 https://*.example.com)，为空时不限来源 (不允许携带凭据)
+var CORSAllowCredentials bool                   // 是否允许跨域请求携带凭据 (Cookie 等)，仅对来源列表中的来源生效
+var CORSExposeHeaders string                    // 额外暴露给前端的响应头，逗号分隔 (与内置的配额响应头合并)
 
 // temporary variable for sora patch, will be removed in future
 var TaskPricePatches []string
@@ -26,4 +37,61 @@ var ExternalUserRedisURL string
 var ExternalUserRedisToken string
 var ExternalUserJWTSecret string
 var ExternalUserMonthlyQuota int
-var ExternalUserAuthEnabled bool // 由 middleware 初始化时设置
+var ExternalUserMonthlyTokenQuota int       // 普通用户每月 token 配额，0 表示不限制
+var ExternalUserDailyQuota int              // 普通用户每日配额，0 表示不限制
+var ExternalUserJWTPublicKeyPEM string      // RS256 验签公钥 (PEM)
+var ExternalUserJWTAlgorithm string         // 允许的 JWT 签名算法 (HS256 / RS256，逗号分隔)，为空时按已配置的密钥推导
+var ExternalUserAllowUnsignedTokens bool    // 未配置 JWT 密钥时是否跳过签名校验 (默认拒绝)
+var ExternalUserTokenHeader string          // 读取外部用户 token 的 header 名称
+var ExternalUserTokenPrefix string          // 验证前从 token header 中去掉的前缀 (如 "Bearer ")
+var ExternalUserTokenCookie string          // header 缺失时读取 token 的 cookie 名称
+var ExternalUserAllowQueryToken bool        // header 与 cookie 都缺失时是否读取 query 参数中的 token
+var ExternalUserTokenQueryParam string      // 读取 token 的 query 参数名
+var ExternalUserJWTPreviousSecrets string   // 密钥轮换后仍接受的旧 JWT 密钥，逗号分隔 (仅用于验证)
+var ExternalUserJWTLeewaySeconds int        // JWT exp / nbf / iat 校验允许的时钟偏差 (秒)
+var ExternalUserJWTIssuer string            // 要求的 JWT iss，为空时不校验
+var ExternalUserJWTAudience string          // 要求的 JWT aud，为空时不校验
+var ExternalUserStrictLookup bool           // 严格模式: 拒绝 Redis 中不存在的用户
+var ExternalUserMaxChannelsPerUser int      // 每个用户可使用的渠道数上限，0 表示不限制
+var ExternalUserQuotaResetDay int           // 配额周期锚定日 (1-31)
+var ExternalUserUpstashMaxConcurrency int   // Upstash REST 最大并发请求数
+var ExternalUserStorageFailurePolicy string // Redis 写入被拒绝 (OOM / 只读) 时的策略: open 或 closed，为空时跟随 ExternalUserFailOpen
+var ExternalUserFailOpen bool               // 读写配额时 Redis 出错是否放行请求 (跳过配额计数)，默认拒绝
+var ExternalUserTierQuotas string           // 按用户等级的每周期配额 (如 bronze:500,gold:-1)
+var ExternalUserQuotaWarningPercent int     // 配额预警阈值 (已用百分比)，0 表示不预警
+var ExternalUserTierWarningPercents string  // 按用户等级的预警阈值 (如 default:50,gold:90)
+var ExternalUserDeniedModels string         // 非 VIP 用户禁止调用的模型，逗号分隔
+var ExternalUserTierAllowedModels string    // 按用户等级允许调用的模型 (如 default:gpt-4o-mini|gpt-3.5-turbo)
+var ExternalUserModelQuotas string          // 按模型独立计量的每周期配额 (如 gpt-4o:10)
+var ExternalUserLifetimeCaps string         // 按用户等级的终身调用上限 (如 default:1000,bronze:5000)
+var ExternalUserTrustedCostNetworks string  // 允许通过 X-Request-Cost 指定消耗的来源 (逗号分隔 CIDR / IP)
+var ExternalUserMaxRequestCost int          // 单次请求允许的最大消耗
+var ExternalUserMinTokenLength int          // token 最小长度，低于该值直接判定为格式错误
+var ExternalUserAuthFailWindowSeconds int   // 验证失败计数统计窗口 (秒)
+var ExternalUserAuthFailBlockThreshold int  // 验证失败封禁阈值，0 表示不封禁
+var ExternalUserAuthFailBlockSeconds int    // 验证失败封禁时长 (秒)
+var ExternalUserTarpitBaseMs int            // 首次超额的延迟响应 (毫秒)，0 表示不启用
+var ExternalUserTarpitMaxMs int             // 超额延迟上限 (毫秒)
+var ExternalUserTarpitWindowSeconds int     // 超额违规计数统计窗口 (秒)
+var ExternalUserTrackVIPUsage bool          // 是否统计 VIP 用户实际用量
+var ExternalUserMaxConcurrentPerUser int    // 每个外部用户同时进行中的请求数上限，0 表示不限制
+var ExternalUserRPMLimit int                // 每个外部用户每分钟请求数上限，0 表示不限制
+var ExternalUserCacheTTLSeconds int         // 外部用户记录进程内缓存有效期 (秒)，默认 0 不缓存；开启后其他实例的修改最多延迟一个 TTL 生效
+var ExternalUserCacheSize int               // 外部用户记录进程内缓存容量
+var ExternalUserMetricChannels string       // 配额消耗指标中单独计数的渠道 ID，逗号分隔，其余渠道计入 other
+var ExternalUserVIPGraceSeconds int         // VIP 过期后的宽限期 (秒)，宽限期内保持 VIP 权限，0 表示不启用
+var ExternalUserPromoStart int64            // 活动开始时间 (Unix 秒)，活动期间暂停配额限制
+var ExternalUserPromoEnd int64              // 活动结束时间 (Unix 秒)
+var ExternalUserPromoCountUsage bool        // 活动期间是否仍统计实际用量
+var ExternalUserTrialQuota int              // 首个周期试用配额，0 表示不启用
+var ExternalUserQuotaRolloverMax int        // 未用完的周期配额结转到下个周期的上限，0 表示不结转
+var ExternalUserAdminIDs string             // 视为管理员的用户 ID，逗号分隔
+var ExternalUserAdminUsernames string       // 视为管理员的用户名，逗号分隔 (仅在 ExternalUserAdminByUsername 开启时生效)
+var ExternalUserAdminByUsername bool        // 兼容旧版: 按用户名识别管理员 (用户名可被外部注册，不安全)
+var ExternalUserRedisTimeoutMs int          // 本地 Redis 读写超时 (毫秒)
+var ExternalUserUpstashTimeoutMs int        // Upstash REST 请求超时 (毫秒)
+var ExternalUserRedisMaxAttempts int        // 配额读写遇到网络错误或 5xx 时的最大尝试次数 (含首次)
+var ExternalUserStatusMaxAgeSeconds int     // 自身配额查询接口的客户端缓存时间 (秒)，0 表示不缓存
+var ExternalUserStatsCacheSeconds int       // 用户汇总统计接口的服务端缓存时间 (秒)，0 表示不缓存
+var ExternalUserQuotaResetSeconds int       // 过期周期配额定时重置间隔 (秒)，0 表示不启用
+var ExternalUserAuthEnabled bool            // 由 middleware 初始化时设置
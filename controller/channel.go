@@ -546,6 +546,9 @@ func validateChannel(channel *model.Channel, isAdd bool) error {
 	if err := channel.ValidateSettings(); err != nil {
 		return fmt.Errorf("渠道额外设置[channel setting] 格式错误：%s", err.Error())
 	}
+	if err := channel.GetSetting().ValidateRateLimit(); err != nil {
+		return fmt.Errorf("渠道「%s」速率限制设置错误：%s", channel.Name, err.Error())
+	}
 
 	// 如果是添加操作，检查 channel 和 key 是否为空
 	if isAdd {
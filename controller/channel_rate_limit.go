@@ -1,26 +1,46 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/model"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/gin-gonic/gin"
 )
 
-// ChannelRateLimitResponse 渠道速率限制响应
+// ChannelRateLimitResponse 渠道速率限制响应 (计数与剩余量为按请求权重累计的值)
 type ChannelRateLimitResponse struct {
-	ChannelID    int    `json:"channel_id"`
-	ChannelName  string `json:"channel_name"`
-	KeyIndex     int    `json:"key_index"`
-	RPMLimit     int    `json:"rpm_limit"`
-	RPDLimit     int    `json:"rpd_limit"`
-	RPMCount     int    `json:"rpm_count"`
-	RPDCount     int    `json:"rpd_count"`
-	RPMRemaining int    `json:"rpm_remaining"`
-	RPDRemaining int    `json:"rpd_remaining"`
-	Enabled      bool   `json:"enabled"`
+	ChannelID    int     `json:"channel_id"`
+	ChannelName  string  `json:"channel_name"`
+	KeyIndex     int     `json:"key_index"`
+	RPMLimit     int     `json:"rpm_limit"`
+	RPDLimit     int     `json:"rpd_limit"`
+	RPMCount     int     `json:"rpm_count"`
+	RPDCount     int     `json:"rpd_count"`
+	RPMRemaining int     `json:"rpm_remaining"`
+	RPDRemaining int     `json:"rpd_remaining"`
+	WindowSecs   int     `json:"window_seconds"`
+	RPMResetAt   int64   `json:"rpm_reset_at"`
+	RPDResetAt   int64   `json:"rpd_reset_at"`
+	RPHLimit     int     `json:"rph_limit"`
+	RPHCount     int     `json:"rph_count"`
+	RPHRemaining int     `json:"rph_remaining"`
+	RPHResetAt   int64   `json:"rph_reset_at"`
+	LeakyBucket  bool    `json:"leaky_bucket"`
+	BucketLevel  float64 `json:"bucket_level"`
+	BucketSize   int     `json:"bucket_size"`
+	TokenBucket  bool    `json:"token_bucket"`
+	Tokens       float64 `json:"tokens"`
+	BurstSize    int     `json:"burst_size"`
+	Concurrency  int     `json:"concurrency"`
+	MaxConcurr   int     `json:"max_concurrency"`
+	Enabled      bool    `json:"enabled"`   // 实际是否限流 (含继承的全局默认限制)
+	Inherited    bool    `json:"inherited"` // 限制是否继承自全局默认值
 }
 
 // GetChannelRateLimitInfo 获取渠道速率限制信息
@@ -44,53 +64,104 @@ func GetChannelRateLimitInfo(c *gin.Context) {
 		return
 	}
 
-	setting := channel.GetSetting()
-	
-	var responses []ChannelRateLimitResponse
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    buildChannelRateLimitResponses(channel),
+	})
+}
+
+// GetChannelRateLimitInfoByName 按渠道名称获取速率限制信息 (名称重复时返回错误)
+func GetChannelRateLimitInfoByName(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "渠道名称不能为空",
+		})
+		return
+	}
 
+	channel, status, err := resolveChannelByName(name)
+	if err != nil {
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    buildChannelRateLimitResponses(channel),
+	})
+}
+
+// resolveChannelByName 将渠道名称解析为唯一的渠道，失败时返回对应的 HTTP 状态码
+func resolveChannelByName(name string) (*model.Channel, int, error) {
+	channels, err := model.GetChannelsByName(name)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("获取渠道失败: %v", err)
+	}
+	switch len(channels) {
+	case 0:
+		return nil, http.StatusNotFound, errors.New("渠道不存在")
+	case 1:
+		return channels[0], http.StatusOK, nil
+	}
+	ids := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		ids = append(ids, strconv.Itoa(channel.Id))
+	}
+	return nil, http.StatusConflict, fmt.Errorf("存在 %d 个同名渠道 (ID: %s)，请使用渠道 ID 查询", len(channels), strings.Join(ids, ", "))
+}
+
+// buildChannelRateLimitResponses 生成渠道 (每个 key) 的速率限制信息，限制值为实际生效的设置
+func buildChannelRateLimitResponses(channel *model.Channel) []ChannelRateLimitResponse {
+	setting, inherited := service.EffectiveChannelRateLimitSetting(channel.GetSetting())
+	keyCount := 1
 	if channel.ChannelInfo.IsMultiKey {
 		// 多 key 模式，获取每个 key 的信息
-		for i := 0; i < channel.ChannelInfo.MultiKeySize; i++ {
-			info := service.GetChannelRateLimitInfo(channelId, i, setting.RateLimitRPM, setting.RateLimitRPD)
-			responses = append(responses, ChannelRateLimitResponse{
-				ChannelID:    channelId,
-				ChannelName:  channel.Name,
-				KeyIndex:     i,
-				RPMLimit:     setting.RateLimitRPM,
-				RPDLimit:     setting.RateLimitRPD,
-				RPMCount:     info.RPMCount,
-				RPDCount:     info.RPDCount,
-				RPMRemaining: info.RPMRemaining,
-				RPDRemaining: info.RPDRemaining,
-				Enabled:      setting.RateLimitEnabled,
-			})
-		}
-	} else {
-		// 单 key 模式
-		info := service.GetChannelRateLimitInfo(channelId, 0, setting.RateLimitRPM, setting.RateLimitRPD)
+		keyCount = channel.ChannelInfo.MultiKeySize
+	}
+
+	var responses []ChannelRateLimitResponse
+	for i := 0; i < keyCount; i++ {
+		info := service.GetChannelRateLimitInfo(channel.Id, i, setting.RateLimitRPM, setting.RateLimitRPD, service.ChannelRateLimitOptionsFromSetting(setting)...)
 		responses = append(responses, ChannelRateLimitResponse{
-			ChannelID:    channelId,
+			ChannelID:    channel.Id,
 			ChannelName:  channel.Name,
-			KeyIndex:     0,
+			KeyIndex:     i,
 			RPMLimit:     setting.RateLimitRPM,
 			RPDLimit:     setting.RateLimitRPD,
 			RPMCount:     info.RPMCount,
 			RPDCount:     info.RPDCount,
 			RPMRemaining: info.RPMRemaining,
 			RPDRemaining: info.RPDRemaining,
+			WindowSecs:   info.WindowSeconds,
+			RPMResetAt:   info.RPMResetAt,
+			RPDResetAt:   info.RPDResetAt,
+			RPHLimit:     info.RPHLimit,
+			RPHCount:     info.RPHCount,
+			RPHRemaining: info.RPHRemaining,
+			RPHResetAt:   info.RPHResetAt,
+			LeakyBucket:  info.LeakyBucket,
+			BucketLevel:  info.BucketLevel,
+			BucketSize:   info.BucketSize,
+			TokenBucket:  info.TokenBucket,
+			Tokens:       info.Tokens,
+			BurstSize:    info.BurstSize,
+			Concurrency:  service.GetChannelConcurrency(channel.Id, i),
+			MaxConcurr:   setting.MaxConcurrency,
 			Enabled:      setting.RateLimitEnabled,
+			Inherited:    inherited,
 		})
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"data":    responses,
-	})
+	return responses
 }
 
 // GetAllChannelRateLimitInfo 获取所有渠道的速率限制信息
 func GetAllChannelRateLimitInfo(c *gin.Context) {
-	// 获取所有启用了速率限制的渠道
+	// 获取所有启用了速率限制 (或继承全局默认限制) 的渠道
 	channels, err := model.GetAllChannels(0, 0, true, false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -103,42 +174,10 @@ func GetAllChannelRateLimitInfo(c *gin.Context) {
 	var responses []ChannelRateLimitResponse
 
 	for _, channel := range channels {
-		setting := channel.GetSetting()
-		if !setting.RateLimitEnabled {
+		if setting, _ := service.EffectiveChannelRateLimitSetting(channel.GetSetting()); !setting.RateLimitEnabled {
 			continue
 		}
-
-		if channel.ChannelInfo.IsMultiKey {
-			for i := 0; i < channel.ChannelInfo.MultiKeySize; i++ {
-				info := service.GetChannelRateLimitInfo(channel.Id, i, setting.RateLimitRPM, setting.RateLimitRPD)
-				responses = append(responses, ChannelRateLimitResponse{
-					ChannelID:    channel.Id,
-					ChannelName:  channel.Name,
-					KeyIndex:     i,
-					RPMLimit:     setting.RateLimitRPM,
-					RPDLimit:     setting.RateLimitRPD,
-					RPMCount:     info.RPMCount,
-					RPDCount:     info.RPDCount,
-					RPMRemaining: info.RPMRemaining,
-					RPDRemaining: info.RPDRemaining,
-					Enabled:      setting.RateLimitEnabled,
-				})
-			}
-		} else {
-			info := service.GetChannelRateLimitInfo(channel.Id, 0, setting.RateLimitRPM, setting.RateLimitRPD)
-			responses = append(responses, ChannelRateLimitResponse{
-				ChannelID:    channel.Id,
-				ChannelName:  channel.Name,
-				KeyIndex:     0,
-				RPMLimit:     setting.RateLimitRPM,
-				RPDLimit:     setting.RateLimitRPD,
-				RPMCount:     info.RPMCount,
-				RPDCount:     info.RPDCount,
-				RPMRemaining: info.RPMRemaining,
-				RPDRemaining: info.RPDRemaining,
-				Enabled:      setting.RateLimitEnabled,
-			})
-		}
+		responses = append(responses, buildChannelRateLimitResponses(channel)...)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -165,8 +204,13 @@ func GetAllChannelsForBatchRateLimit(c *gin.Context) {
 		RateLimitEnabled bool   `json:"rate_limit_enabled"`
 		RateLimitRPM     int    `json:"rate_limit_rpm"`
 		RateLimitRPD     int    `json:"rate_limit_rpd"`
+		RateLimitRPH     int    `json:"rate_limit_rph"`
 	}
 
+	// enabledOnly=true 时只返回启用了速率限制的渠道
+	enabledOnly, _ := strconv.ParseBool(c.Query("enabledOnly"))
+	channels = filterRateLimitChannels(channels, enabledOnly)
+
 	var result []ChannelSimple
 	for _, channel := range channels {
 		setting := channel.GetSetting()
@@ -176,6 +220,7 @@ func GetAllChannelsForBatchRateLimit(c *gin.Context) {
 			RateLimitEnabled: setting.RateLimitEnabled,
 			RateLimitRPM:     setting.RateLimitRPM,
 			RateLimitRPD:     setting.RateLimitRPD,
+			RateLimitRPH:     setting.RateLimitRPH,
 		})
 	}
 
@@ -185,13 +230,35 @@ func GetAllChannelsForBatchRateLimit(c *gin.Context) {
 	})
 }
 
+// filterRateLimitChannels 按是否启用速率限制过滤渠道
+func filterRateLimitChannels(channels []*model.Channel, enabledOnly bool) []*model.Channel {
+	if !enabledOnly {
+		return channels
+	}
+	filtered := make([]*model.Channel, 0, len(channels))
+	for _, channel := range channels {
+		if channel.GetSetting().RateLimitEnabled {
+			filtered = append(filtered, channel)
+		}
+	}
+	return filtered
+}
+
 // BatchSetChannelRateLimit 批量设置渠道速率限制
 func BatchSetChannelRateLimit(c *gin.Context) {
 	var req struct {
 		Ids              []int `json:"ids" binding:"required"`
 		RateLimitRPM     int   `json:"rate_limit_rpm"`
 		RateLimitRPD     int   `json:"rate_limit_rpd"`
+		RateLimitRPH     *int  `json:"rate_limit_rph"`
 		RateLimitEnabled *bool `json:"rate_limit_enabled"`
+		WindowSeconds    *int  `json:"rate_limit_window_seconds"`
+		LeakyBucket      *bool `json:"rate_limit_leaky_bucket"`
+		BucketSize       *int  `json:"rate_limit_bucket_size"`
+		LeakRate         *int  `json:"rate_limit_leak_rate"`
+		TokenBucket      *bool `json:"rate_limit_token_bucket"`
+		BurstSize        *int  `json:"rate_limit_burst_size"`
+		MaxConcurrency   *int  `json:"max_concurrency"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -220,8 +287,9 @@ func BatchSetChannelRateLimit(c *gin.Context) {
 		return
 	}
 
-	successCount := 0
-	for _, channel := range channels {
+	// 先计算并校验所有渠道的新设置，任一渠道不合法时不保存任何渠道
+	settings := make([]dto.ChannelSettings, len(channels))
+	for i, channel := range channels {
 		setting := channel.GetSetting()
 
 		// 更新速率限制设置
@@ -231,12 +299,47 @@ func BatchSetChannelRateLimit(c *gin.Context) {
 		if req.RateLimitRPD >= 0 {
 			setting.RateLimitRPD = req.RateLimitRPD
 		}
+		if req.RateLimitRPH != nil && *req.RateLimitRPH >= 0 {
+			setting.RateLimitRPH = *req.RateLimitRPH
+		}
 		if req.RateLimitEnabled != nil {
 			setting.RateLimitEnabled = *req.RateLimitEnabled
 		}
+		if req.WindowSeconds != nil && *req.WindowSeconds >= 0 {
+			setting.RateLimitWindowSeconds = *req.WindowSeconds
+		}
+		if req.LeakyBucket != nil {
+			setting.RateLimitLeakyBucket = *req.LeakyBucket
+		}
+		if req.BucketSize != nil && *req.BucketSize >= 0 {
+			setting.RateLimitBucketSize = *req.BucketSize
+		}
+		if req.LeakRate != nil && *req.LeakRate >= 0 {
+			setting.RateLimitLeakRate = *req.LeakRate
+		}
+		if req.TokenBucket != nil {
+			setting.RateLimitTokenBucket = *req.TokenBucket
+		}
+		if req.BurstSize != nil && *req.BurstSize >= 0 {
+			setting.RateLimitBurstSize = *req.BurstSize
+		}
+		if req.MaxConcurrency != nil && *req.MaxConcurrency >= 0 {
+			setting.MaxConcurrency = *req.MaxConcurrency
+		}
+		if err := setting.ValidateRateLimit(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"message": fmt.Sprintf("渠道 #%d (%s) 速率限制设置错误: %s", channel.Id, channel.Name, err.Error()),
+			})
+			return
+		}
+		settings[i] = setting
+	}
 
+	successCount := 0
+	for i, channel := range channels {
 		// 保存设置
-		channel.SetSetting(setting)
+		channel.SetSetting(settings[i])
 		if err := channel.Save(); err != nil {
 			continue
 		}
@@ -250,6 +353,29 @@ func BatchSetChannelRateLimit(c *gin.Context) {
 	})
 }
 
+// ResetAllChannelRateLimits 重置所有渠道的速率限制计数 (需在请求体中传入 confirm: true)
+func ResetAllChannelRateLimits(c *gin.Context) {
+	var req struct {
+		Confirm bool `json:"confirm"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !req.Confirm {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "重置所有渠道的速率限制计数需要确认 (confirm: true)",
+		})
+		return
+	}
+
+	cleared := service.ResetAllChannelRateLimits()
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": fmt.Sprintf("已重置 %d 个速率限制计数", cleared),
+		"data": gin.H{
+			"cleared": cleared,
+		},
+	})
+}
+
 // ResetChannelRateLimit 重置渠道速率限制计数
 func ResetChannelRateLimit(c *gin.Context) {
 	channelIdStr := c.Param("id")
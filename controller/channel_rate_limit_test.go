@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func newRateLimitTestChannel(id int, enabled bool) *model.Channel {
+	channel := &model.Channel{Id: id, Name: "channel"}
+	channel.SetSetting(dto.ChannelSettings{RateLimitEnabled: enabled, RateLimitRPM: 10})
+	return channel
+}
+
+func TestFilterRateLimitChannelsEnabledOnly(t *testing.T) {
+	channels := []*model.Channel{
+		newRateLimitTestChannel(1, true),
+		newRateLimitTestChannel(2, false),
+		newRateLimitTestChannel(3, true),
+	}
+
+	if got := filterRateLimitChannels(channels, false); len(got) != 3 {
+		t.Fatalf("default should return all channels, got %d", len(got))
+	}
+
+	got := filterRateLimitChannels(channels, true)
+	if len(got) != 2 || got[0].Id != 1 || got[1].Id != 3 {
+		t.Fatalf("enabledOnly should keep channels 1 and 3, got %+v", got)
+	}
+}
+
+// useTestChannelDB 使用内存 SQLite 作为渠道数据库，测试结束后恢复
+func useTestChannelDB(t *testing.T, channels ...*model.Channel) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.Channel{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, channel := range channels {
+		if err := db.Create(channel).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	prev := model.DB
+	model.DB = db
+	t.Cleanup(func() { model.DB = prev })
+}
+
+func TestGetChannelRateLimitInfoByName(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	unique := newRateLimitTestChannel(1, true)
+	unique.Name = "primary"
+	dupA := newRateLimitTestChannel(2, true)
+	dupA.Name = "backup"
+	dupB := newRateLimitTestChannel(3, false)
+	dupB.Name = "backup"
+	useTestChannelDB(t, unique, dupA, dupB)
+
+	router := gin.New()
+	router.GET("/rate_limit/by_name", GetChannelRateLimitInfoByName)
+	request := func(name string) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rate_limit/by_name?name="+name, nil))
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+		}
+		return w, body
+	}
+
+	w, body := request("primary")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unique name should resolve, got %d: %s", w.Code, w.Body.String())
+	}
+	var data []ChannelRateLimitResponse
+	if err := json.Unmarshal(body["data"], &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0].ChannelID != 1 || data[0].ChannelName != "primary" || data[0].RPMLimit != 10 {
+		t.Fatalf("unexpected rate limit info: %+v", data)
+	}
+
+	if w, _ := request("missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("nonexistent name should be 404, got %d", w.Code)
+	}
+
+	if w, _ := request("backup"); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate name should be rejected as ambiguous, got %d", w.Code)
+	}
+}
+
+func TestChannelRateLimitResetTimes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	active := newRateLimitTestChannel(98701, true)
+	active.Name = "active"
+	idle := newRateLimitTestChannel(98702, true)
+	idle.Name = "idle"
+	windowed := newRateLimitTestChannel(98703, true)
+	windowed.Name = "windowed"
+	windowed.SetSetting(dto.ChannelSettings{RateLimitEnabled: true, RateLimitRPM: 10, RateLimitWindowSeconds: 300})
+	useTestChannelDB(t, active, idle, windowed)
+	for _, id := range []int{98701, 98702, 98703} {
+		defer service.ResetChannelRateLimit(id, 0)
+	}
+	service.IncrementChannelRateLimit(98701, 0, 10, 0)
+
+	router := gin.New()
+	router.GET("/rate_limit", GetAllChannelRateLimitInfo)
+	w := httptest.NewRecorder()
+	now := time.Now()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rate_limit", nil))
+	var body struct {
+		Data []ChannelRateLimitResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Data) != 3 {
+		t.Fatalf("expected 3 channels, got %+v", body.Data)
+	}
+
+	nextMidnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()).Unix()
+	for _, info := range body.Data {
+		window := int64(60)
+		if info.ChannelName == "windowed" {
+			window = 300
+		}
+		if info.RPMResetAt <= now.Unix()-1 || info.RPMResetAt > now.Unix()+window || info.RPMResetAt%window != 0 {
+			t.Errorf("%s: rpm_reset_at %d is not the next %ds boundary after %d", info.ChannelName, info.RPMResetAt, window, now.Unix())
+		}
+		if info.RPDResetAt != nextMidnight {
+			t.Errorf("%s: rpd_reset_at %d, want %d", info.ChannelName, info.RPDResetAt, nextMidnight)
+		}
+	}
+}
+
+func TestBatchSetChannelRateLimitValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	first := newRateLimitTestChannel(1, true)
+	first.Name = "first"
+	second := newRateLimitTestChannel(2, true)
+	second.Name = "second"
+	second.SetSetting(dto.ChannelSettings{RateLimitEnabled: true, RateLimitRPM: 10, RateLimitRPH: 50})
+	useTestChannelDB(t, first, second)
+
+	router := gin.New()
+	router.POST("/rate_limit/batch", BatchSetChannelRateLimit)
+	request := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/rate_limit/batch", strings.NewReader(body)))
+		return w
+	}
+
+	for _, tc := range []struct {
+		name    string
+		body    string
+		channel string
+	}{
+		{"rpd below rpm", `{"ids":[1,2],"rate_limit_rpm":100,"rate_limit_rpd":50}`, "#1 (first)"},
+		{"out of range", `{"ids":[1,2],"rate_limit_rpm":20000000}`, "#1 (first)"},
+		// 沿用渠道已有的 RPH 时同样检查一致性
+		{"rph below rpm", `{"ids":[1,2],"rate_limit_rpm":60}`, "#2 (second)"},
+	} {
+		w := request(tc.body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.channel) {
+			t.Fatalf("%s: expected 400 naming channel %s, got %d: %s", tc.name, tc.channel, w.Code, w.Body.String())
+		}
+	}
+	for _, id := range []int{1, 2} {
+		channel, err := model.GetChannelById(id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rpm := channel.GetSetting().RateLimitRPM; rpm != 10 {
+			t.Fatalf("rejected batch should not change channel %d, rpm=%d", id, rpm)
+		}
+	}
+
+	if w := request(`{"ids":[1,2],"rate_limit_rpm":20,"rate_limit_rpd":1000}`); w.Code != http.StatusOK {
+		t.Fatalf("consistent settings should be saved, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateChannelRateLimit(t *testing.T) {
+	channel := &model.Channel{Name: "single"}
+	channel.SetSetting(dto.ChannelSettings{RateLimitRPM: 100, RateLimitRPD: 10})
+	if err := validateChannel(channel, false); err == nil || !strings.Contains(err.Error(), "single") {
+		t.Fatalf("inconsistent single-channel update should be rejected, got %v", err)
+	}
+	channel.SetSetting(dto.ChannelSettings{RateLimitWindowSeconds: 7 * 86400})
+	if err := validateChannel(channel, false); err == nil {
+		t.Fatal("window longer than a day should be rejected")
+	}
+	channel.SetSetting(dto.ChannelSettings{RateLimitRPM: 100, RateLimitRPD: 0})
+	if err := validateChannel(channel, false); err != nil {
+		t.Fatalf("unlimited RPD should be allowed, got %v", err)
+	}
+	channel.SetSetting(dto.ChannelSettings{RateLimitModelWeights: map[string]int{"gpt-4-32k": 0}})
+	if err := validateChannel(channel, false); err == nil {
+		t.Fatal("model weight below 1 should be rejected")
+	}
+}
+
+func TestChannelRateLimitInheritsGlobalDefault(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prevEnabled, prevRPM, prevRPD := constant.ChannelRateLimitDefaultEnabled, constant.ChannelRateLimitDefaultRPM, constant.ChannelRateLimitDefaultRPD
+	constant.ChannelRateLimitDefaultEnabled, constant.ChannelRateLimitDefaultRPM, constant.ChannelRateLimitDefaultRPD = true, 30, 1000
+	defer func() {
+		constant.ChannelRateLimitDefaultEnabled, constant.ChannelRateLimitDefaultRPM, constant.ChannelRateLimitDefaultRPD = prevEnabled, prevRPM, prevRPD
+	}()
+
+	inherited := newRateLimitTestChannel(1, false)
+	inherited.Name = "inherited"
+	overridden := newRateLimitTestChannel(2, true)
+	overridden.Name = "overridden"
+	useTestChannelDB(t, inherited, overridden)
+
+	router := gin.New()
+	router.GET("/rate_limit", GetAllChannelRateLimitInfo)
+	fetch := func() map[string]ChannelRateLimitResponse {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rate_limit", nil))
+		var body struct {
+			Data []ChannelRateLimitResponse `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		byName := map[string]ChannelRateLimitResponse{}
+		for _, info := range body.Data {
+			byName[info.ChannelName] = info
+		}
+		return byName
+	}
+
+	got := fetch()
+	if info := got["inherited"]; !info.Enabled || !info.Inherited || info.RPMLimit != 30 || info.RPDLimit != 1000 {
+		t.Fatalf("channel without its own limit should inherit the global default, got %+v", info)
+	}
+	if info := got["overridden"]; !info.Enabled || info.Inherited || info.RPMLimit != 10 || info.RPDLimit != 0 {
+		t.Fatalf("channel settings should override the global default, got %+v", info)
+	}
+
+	constant.ChannelRateLimitDefaultEnabled = false
+	if got := fetch(); len(got) != 1 || got["overridden"].ChannelID != 2 {
+		t.Fatalf("without enforcement only channels with their own limit are listed, got %+v", got)
+	}
+}
+
+func TestResetAllChannelRateLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/rate_limit/reset_all", ResetAllChannelRateLimits)
+	reset := func(body string) (int, int) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/rate_limit/reset_all", strings.NewReader(body)))
+		var resp struct {
+			Data struct {
+				Cleared int `json:"cleared"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data.Cleared
+	}
+
+	service.IncrementChannelRateLimit(98711, 0, 10, 0)
+	service.IncrementChannelRateLimit(98712, 0, 10, 0)
+	for _, body := range []string{"", `{}`, `{"confirm":false}`} {
+		if code, _ := reset(body); code != http.StatusBadRequest {
+			t.Fatalf("body %q: reset without confirm should be rejected, got %d", body, code)
+		}
+	}
+	if info := service.GetChannelRateLimitInfo(98711, 0, 10, 0); info.RPMCount != 1 {
+		t.Fatalf("rejected reset should keep counters, got %d", info.RPMCount)
+	}
+
+	if code, cleared := reset(`{"confirm":true}`); code != http.StatusOK || cleared < 2 {
+		t.Fatalf("confirmed reset should clear counters, got %d cleared=%d", code, cleared)
+	}
+	if n := len(service.GetAllChannelRateLimitInfo()); n != 0 {
+		t.Fatalf("store should be empty, got %d entries", n)
+	}
+	if code, cleared := reset(`{"confirm":true}`); code != http.StatusOK || cleared != 0 {
+		t.Fatalf("reset on an empty store should be a no-op, got %d cleared=%d", code, cleared)
+	}
+}
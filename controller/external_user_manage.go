@@ -2,28 +2,46 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/middleware"
+	"github.com/QuantumNous/new-api/model"
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/errgroup"
 )
 
 // ExternalUserInfo 外部用户信息
 type ExternalUserInfo struct {
-	ID           string `json:"id"`
-	Email        string `json:"email"`
-	Username     string `json:"username"`
-	IsVIP        bool   `json:"isVip"`
-	VIPExpiresAt int64  `json:"vipExpiresAt"`
-	QuotaUsed    int    `json:"quotaUsed"`
-	QuotaTotal   int    `json:"quotaTotal"`
-	MonthKey     string `json:"monthKey"`
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	Username      string `json:"username"`
+	IsVIP         bool   `json:"isVip"`
+	VIPExpiresAt  int64  `json:"vipExpiresAt"`
+	QuotaUsed     int    `json:"quotaUsed"`
+	QuotaTotal    int    `json:"quotaTotal"`
+	MonthKey      string `json:"monthKey"`
+	ResetDay      int    `json:"resetDay,omitempty"`
+	Tier          string `json:"tier,omitempty"`
+	TierExpiresAt int64  `json:"tierExpiresAt,omitempty"`
+	LifetimeCount int64  `json:"lifetimeCount"`
+	LastSeen      int64  `json:"lastSeen"` // 最近活跃时间 (Unix 秒)，0 表示从未活跃
+
+	Channels []middleware.UserChannelQuota `json:"channels,omitempty"` // 各渠道配额使用情况 (仅用户详情返回)
+
+	record middleware.ExternalUserData // 用户记录，用于按与鉴权相同的规则计算各渠道限额
 }
 
 // UserQuotaData 用户配额数据
@@ -33,13 +51,12 @@ type UserQuotaData struct {
 	LastResetAt int64  `json:"lastResetAt"`
 }
 
-// GetExternalUsers 获取所有外部用户列表
+// GetExternalUsers 获取外部用户列表
+// 可选参数: inactiveDays 筛选超过指定天数未活跃的用户，email 按邮箱子串筛选 (不区分大小写)，vip=true/false 按 VIP 状态筛选。
+// 传入 pageSize 或 cursor 时分页返回: cursor 为上一页返回的 nextCursor (首页不传)，nextCursor 为 "0" 表示没有更多数据。
+// Redis SCAN 以批为单位推进，一页可能略多于 pageSize；未分页时返回全部用户。
 func GetExternalUsers(c *gin.Context) {
-	// 检查是否使用本地 Redis
-	isLocalRedis := len(constant.ExternalUserRedisURL) > 0 && 
-		(len(constant.ExternalUserRedisURL) >= 8 && constant.ExternalUserRedisURL[:8] == "redis://")
-	
-	if constant.ExternalUserRedisURL == "" || (!isLocalRedis && constant.ExternalUserRedisToken == "") {
+	if !middleware.IsExternalUserEnabled() {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
 			"message": "Redis 未配置",
@@ -47,45 +64,125 @@ func GetExternalUsers(c *gin.Context) {
 		return
 	}
 
-	// 如果是本地 Redis，使用 go-redis 客户端
-	if isLocalRedis {
-		users, err := getExternalUsersFromLocalRedis()
+	filter := externalUserFilter{Email: strings.ToLower(strings.TrimSpace(c.Query("email")))}
+	if vip, err := strconv.ParseBool(c.Query("vip")); err == nil {
+		filter.VIP = &vip
+	}
+	inactiveDays := parseIntParam(c.Query("inactiveDays"), 0)
+
+	cursor := c.Query("cursor")
+	pageSize := parseIntParam(c.Query("pageSize"), 0)
+	paged := cursor != "" || pageSize > 0
+	if cursor == "" {
+		cursor = "0"
+	}
+	if pageSize <= 0 {
+		pageSize = defaultExternalUserPageSize
+	} else if pageSize > maxExternalUserPageSize {
+		pageSize = maxExternalUserPageSize
+	}
+
+	fetch := func(userId string) (*ExternalUserInfo, error) {
+		return getExternalUserInfo(c.Request.Context(), userId)
+	}
+	users := []ExternalUserInfo{}
+	for {
+		userIds, nextCursor, err := scanExternalUserIds(c.Request.Context(), cursor, pageSize)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
 			return
 		}
+		batch := filterInactiveUsers(filter.apply(loadExternalUsers(userIds, fetch)), inactiveDays)
+		users = append(users, batch...)
+
+		// cursor 为 "0" 表示扫描完成
+		cursor = nextCursor
+		if cursor == "0" || (paged && len(users) >= pageSize) {
+			break
+		}
+	}
+
+	if paged {
 		c.JSON(http.StatusOK, gin.H{
-			"success": true,
-			"data":    users,
-			"total":   len(users),
+			"success":    true,
+			"data":       users,
+			"total":      len(users), // 本页条数 (SCAN 无法高效统计总数)
+			"nextCursor": cursor,
+			"hasMore":    cursor != "0",
 		})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    users,
+		"total":   len(users),
+	})
+}
 
-	// Upstash REST API 方式 (原有逻辑)
-	// 使用 SCAN 命令获取所有 user:* 键
-	users := []ExternalUserInfo{}
-	cursor := "0"
-	
-	for {
-		// Upstash REST API: POST with ["SCAN", cursor, "MATCH", "user:*", "COUNT", "100"]
-		cmdBody, _ := json.Marshal([]interface{}{"SCAN", cursor, "MATCH", "user:*", "COUNT", "100"})
-		
-		req, err := http.NewRequest("POST", constant.ExternalUserRedisURL, bytes.NewReader(cmdBody))
+const (
+	defaultExternalUserPageSize = 20
+	maxExternalUserPageSize     = 100
+)
+
+// externalUserFilter 用户列表筛选条件
+type externalUserFilter struct {
+	Email string // 邮箱包含的子串 (小写)，为空表示不筛选
+	VIP   *bool  // 是否为有效 VIP (含宽限期内)，nil 表示不筛选
+}
+
+// apply 返回满足筛选条件的用户
+func (f externalUserFilter) apply(users []ExternalUserInfo) []ExternalUserInfo {
+	if f.Email == "" && f.VIP == nil {
+		return users
+	}
+	now := time.Now()
+	matched := make([]ExternalUserInfo, 0, len(users))
+	for _, user := range users {
+		if f.Email != "" && !strings.Contains(strings.ToLower(user.Email), f.Email) {
+			continue
+		}
+		if f.VIP != nil && middleware.HasVIPAccess(&middleware.ExternalUserData{IsVIP: user.IsVIP, VIPExpiresAt: user.VIPExpiresAt}, now) != *f.VIP {
+			continue
+		}
+		matched = append(matched, user)
+	}
+	return matched
+}
+
+// scanExternalUserIds 从 cursor 开始扫描一批 user:* key，返回用户 ID 与下一个 cursor ("0" 表示扫描完成)
+func scanExternalUserIds(reqCtx context.Context, cursor string, count int) ([]string, string, error) {
+	var keys []string
+	if middleware.IsUsingLocalRedis() {
+		redisClient := middleware.GetRedisClient()
+		if redisClient == nil {
+			return nil, "", fmt.Errorf("Redis 客户端未初始化")
+		}
+		start, err := strconv.ParseUint(cursor, 10, 64)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
-			return
+			return nil, "", fmt.Errorf("无效的 cursor: %s", cursor)
+		}
+		batch, next, err := redisClient.Scan(reqCtx, start, "user:*", int64(count)).Result()
+		if err != nil {
+			return nil, "", fmt.Errorf("扫描 Redis 失败: %v", err)
+		}
+		keys = batch
+		cursor = strconv.FormatUint(next, 10)
+	} else {
+		// Upstash REST API: POST with ["SCAN", cursor, "MATCH", "user:*", "COUNT", count]
+		cmdBody, _ := json.Marshal([]interface{}{"SCAN", cursor, "MATCH", "user:*", "COUNT", strconv.Itoa(count)})
+
+		req, err := http.NewRequestWithContext(reqCtx, "POST", constant.ExternalUserRedisURL, bytes.NewReader(cmdBody))
+		if err != nil {
+			return nil, "", err
 		}
 		req.Header.Set("Authorization", "Bearer "+constant.ExternalUserRedisToken)
 		req.Header.Set("Content-Type", "application/json")
 
-		client := &http.Client{Timeout: 10 * time.Second}
+		client := middleware.UpstashHTTPClient()
 		resp, err := client.Do(req)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
-			return
+			return nil, "", err
 		}
-		
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
 
@@ -93,55 +190,76 @@ func GetExternalUsers(c *gin.Context) {
 			Result []interface{} `json:"result"`
 		}
 		if err := json.Unmarshal(body, &result); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "解析 Redis 响应失败"})
-			return
+			return nil, "", fmt.Errorf("解析 Redis 响应失败")
 		}
-
 		if len(result.Result) < 2 {
-			break
+			return nil, "0", nil
 		}
-
-		// 获取下一个 cursor
 		cursor = fmt.Sprintf("%v", result.Result[0])
-		
-		// 获取 keys
-		keys, ok := result.Result[1].([]interface{})
-		if !ok {
-			break
+		batch, _ := result.Result[1].([]interface{})
+		for _, k := range batch {
+			keys = append(keys, fmt.Sprintf("%v", k))
 		}
+	}
 
-		// 获取每个用户的详细信息
-		for _, k := range keys {
-			key := fmt.Sprintf("%v", k)
-			if len(key) <= 5 { // "user:" 长度
-				continue
-			}
-			userId := key[5:] // 去掉 "user:" 前缀
-			
-			userInfo, err := getExternalUserInfo(userId)
-			if err == nil && userInfo != nil {
-				users = append(users, *userInfo)
-			}
+	userIds := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if len(key) <= 5 { // "user:" 长度
+			continue
 		}
+		userIds = append(userIds, key[5:]) // 去掉 "user:" 前缀
+	}
+	return userIds, cursor, nil
+}
 
-		// cursor 为 "0" 表示扫描完成
-		if cursor == "0" {
-			break
+// externalUserFetchConcurrency 获取用户详情的最大并发数 (Upstash 模式下还受出站并发限制约束)
+const externalUserFetchConcurrency = 16
+
+// loadExternalUsers 并发获取一批用户的详细信息，结果保持 userIds 的顺序，获取失败的用户跳过
+func loadExternalUsers(userIds []string, fetch func(userId string) (*ExternalUserInfo, error)) []ExternalUserInfo {
+	pageUsers := make([]*ExternalUserInfo, len(userIds))
+	var g errgroup.Group
+	g.SetLimit(externalUserFetchConcurrency)
+	for i, userId := range userIds {
+		i, userId := i, userId
+		g.Go(func() error {
+			if userInfo, err := fetch(userId); err == nil {
+				pageUsers[i] = userInfo
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	users := make([]ExternalUserInfo, 0, len(userIds))
+	for _, userInfo := range pageUsers {
+		if userInfo != nil {
+			users = append(users, *userInfo)
 		}
 	}
+	return users
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"data":    users,
-		"total":   len(users),
-	})
+// filterInactiveUsers 筛选超过 days 天未活跃 (或从未活跃) 的用户，days <= 0 时不筛选
+func filterInactiveUsers(users []ExternalUserInfo, days int) []ExternalUserInfo {
+	if days <= 0 {
+		return users
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+	inactive := make([]ExternalUserInfo, 0, len(users))
+	for _, user := range users {
+		if user.LastSeen < cutoff {
+			inactive = append(inactive, user)
+		}
+	}
+	return inactive
 }
 
 // getExternalUserInfo 获取单个用户的完整信息
-func getExternalUserInfo(userId string) (*ExternalUserInfo, error) {
+func getExternalUserInfo(reqCtx context.Context, userId string) (*ExternalUserInfo, error) {
 	// 获取用户基本信息
 	userKey := "user:" + userId
-	userData, err := redisGet(userKey)
+	userData, err := redisGet(reqCtx, userKey)
 	if err != nil {
 		return nil, err
 	}
@@ -151,16 +269,23 @@ func getExternalUserInfo(userId string) (*ExternalUserInfo, error) {
 		return nil, err
 	}
 	user.ID = userId
+	// 配额上限按与请求鉴权相同的规则计算 (自定义配额、等级配额、VIP 宽限期)
+	record := &user.record
+	_ = json.Unmarshal([]byte(userData), record)
+	record.ID = userId
 
 	// 获取用户配额
 	quotaKey := "quota:" + userId
-	quotaData, err := redisGet(quotaKey)
+	quotaData, err := redisGet(reqCtx, quotaKey)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, err
+	}
 	if err == nil && quotaData != "" {
 		var quota UserQuotaData
 		if json.Unmarshal([]byte(quotaData), &quota) == nil {
-			// 检查月份是否需要重置
-			currentMonth := time.Now().Format("2006-01")
-			if quota.MonthKey == currentMonth {
+			// 检查周期是否需要重置 (按用户锚定日计算)
+			currentPeriod := middleware.CurrentQuotaPeriodKey(user.ResetDay)
+			if quota.MonthKey == currentPeriod {
 				user.QuotaUsed = quota.UsedCount
 			} else {
 				user.QuotaUsed = 0
@@ -169,11 +294,14 @@ func getExternalUserInfo(userId string) (*ExternalUserInfo, error) {
 		}
 	}
 	
-	// VIP 用户显示无限配额，普通用户显示月度配额
-	if user.IsVIP && user.VIPExpiresAt > time.Now().Unix() {
+	user.LifetimeCount, _ = middleware.GetLifetimeCount(userId)
+	user.LastSeen = middleware.GetLastSeen(userId)
+
+	// 管理员与不按等级限额的 VIP (含宽限期内) 显示无限配额，其余用户显示自定义 / 等级 / 全局配额
+	if middleware.IsUnlimitedUser(record, time.Now()) {
 		user.QuotaTotal = -1 // -1 表示无限
 	} else {
-		user.QuotaTotal = constant.ExternalUserMonthlyQuota
+		user.QuotaTotal, _ = middleware.ResolveUserQuotaLimit(record, constant.ExternalUserMonthlyQuota, "")
 	}
 
 	return &user, nil
@@ -198,10 +326,10 @@ func UpdateExternalUserQuota(c *gin.Context) {
 
 	// 获取当前配额
 	quotaKey := "quota:" + userId
-	currentMonth := time.Now().Format("2006-01")
+	currentPeriod := externalUserPeriodKey(c.Request.Context(), userId)
 	
 	quota := UserQuotaData{
-		MonthKey:    currentMonth,
+		MonthKey:    currentPeriod,
 		LastResetAt: time.Now().Unix(),
 	}
 
@@ -213,8 +341,8 @@ func UpdateExternalUserQuota(c *gin.Context) {
 
 	// 保存配额
 	quotaJSON, _ := json.Marshal(quota)
-	if err := redisSet(quotaKey, string(quotaJSON)); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "保存配额失败: " + err.Error()})
+	if err := redisSet(c.Request.Context(), quotaKey, string(quotaJSON)); err != nil {
+		c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "保存配额失败: " + err.Error()})
 		return
 	}
 
@@ -249,9 +377,13 @@ func UpdateExternalUserVIP(c *gin.Context) {
 
 	// 获取用户数据
 	userKey := "user:" + userId
-	userData, err := redisGet(userKey)
+	userData, err := redisGet(c.Request.Context(), userKey)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "用户不存在"})
+		if errors.Is(err, ErrKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "用户不存在"})
+			return
+		}
+		c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "读取用户失败: " + err.Error()})
 		return
 	}
 
@@ -262,21 +394,15 @@ func UpdateExternalUserVIP(c *gin.Context) {
 	}
 
 	// 更新 VIP 状态
-	user["isVip"] = req.IsVIP
-	if req.VIPDays > 0 {
-		user["vipExpiresAt"] = time.Now().Add(time.Duration(req.VIPDays) * 24 * time.Hour).Unix()
-	} else if req.VIPExpiresAt > 0 {
-		user["vipExpiresAt"] = req.VIPExpiresAt
-	} else if !req.IsVIP {
-		user["vipExpiresAt"] = 0
-	}
+	applyVIPUpdate(user, req.IsVIP, req.VIPDays, req.VIPExpiresAt)
 
 	// 保存用户数据
 	userJSON, _ := json.Marshal(user)
-	if err := redisSet(userKey, string(userJSON)); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "保存用户数据失败: " + err.Error()})
+	if err := redisSet(c.Request.Context(), userKey, string(userJSON)); err != nil {
+		c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "保存用户数据失败: " + err.Error()})
 		return
 	}
+	middleware.InvalidateExternalUserCache(userId)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -285,64 +411,635 @@ func UpdateExternalUserVIP(c *gin.Context) {
 	})
 }
 
-// redisGet 从 Redis 获取值
-func redisGet(key string) (string, error) {
-	cmdBody, _ := json.Marshal([]string{"GET", key})
-	
-	req, err := http.NewRequest("POST", constant.ExternalUserRedisURL, bytes.NewReader(cmdBody))
+// applyVIPUpdate 按 isVip / vipDays / vipExpiresAt 更新用户记录的 VIP 字段
+// vipDays 优先于 vipExpiresAt；两者都未指定时取消 VIP 会清除到期时间，设置 VIP 则保留原到期时间。
+func applyVIPUpdate(user map[string]interface{}, isVIP bool, vipDays int, vipExpiresAt int64) {
+	user["isVip"] = isVIP
+	if vipDays > 0 {
+		user["vipExpiresAt"] = time.Now().Add(time.Duration(vipDays) * 24 * time.Hour).Unix()
+	} else if vipExpiresAt > 0 {
+		user["vipExpiresAt"] = vipExpiresAt
+	} else if !isVIP {
+		user["vipExpiresAt"] = 0
+	}
+}
+
+// BatchUpdateVIP 批量设置 VIP 状态，每个用户的处理规则与 UpdateExternalUserVIP 相同
+// 先逐个读取用户记录，再一次性写回 (本地 Redis 使用 pipeline，Upstash 使用 /pipeline 接口)。
+func BatchUpdateVIP(c *gin.Context) {
+	var req struct {
+		UserIds      []string `json:"userIds"`
+		IsVIP        bool     `json:"isVip"`
+		VIPExpiresAt int64    `json:"vipExpiresAt"` // Unix 时间戳
+		VIPDays      int      `json:"vipDays"`      // 或者指定天数
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "参数错误"})
+		return
+	}
+
+	type userResult struct {
+		UserId  string `json:"userId"`
+		Success bool   `json:"success"`
+		Message string `json:"message,omitempty"`
+	}
+	results := make([]userResult, len(req.UserIds))
+	keys := make([]string, 0, len(req.UserIds))
+	values := make([]string, 0, len(req.UserIds))
+	pending := make([]int, 0, len(req.UserIds)) // 待写入的用户在 results 中的下标
+
+	for i, userId := range req.UserIds {
+		results[i].UserId = userId
+		userData, err := redisGet(c.Request.Context(), "user:"+userId)
+		if err != nil {
+			if errors.Is(err, ErrKeyNotFound) {
+				results[i].Message = "用户不存在"
+			} else {
+				results[i].Message = "读取用户失败: " + err.Error()
+			}
+			continue
+		}
+		var user map[string]interface{}
+		if err := json.Unmarshal([]byte(userData), &user); err != nil {
+			results[i].Message = "解析用户数据失败"
+			continue
+		}
+		applyVIPUpdate(user, req.IsVIP, req.VIPDays, req.VIPExpiresAt)
+		userJSON, _ := json.Marshal(user)
+		keys = append(keys, "user:"+userId)
+		values = append(values, string(userJSON))
+		pending = append(pending, i)
+	}
+
+	_, errs := redisSetMany(c.Request.Context(), keys, values, false)
+	for j, err := range errs {
+		i := pending[j]
+		if err != nil {
+			results[i].Message = "保存用户数据失败: " + err.Error()
+			continue
+		}
+		results[i].Success = true
+		middleware.InvalidateExternalUserCache(results[i].UserId)
+	}
+
+	successCount := 0
+	failedUsers := []string{}
+	for _, result := range results {
+		if result.Success {
+			successCount++
+		} else {
+			failedUsers = append(failedUsers, result.UserId)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":      len(failedUsers) == 0,
+		"message":      fmt.Sprintf("成功更新 %d 个用户，失败 %d 个", successCount, len(failedUsers)),
+		"successCount": successCount,
+		"failedUsers":  failedUsers,
+		"results":      results,
+	})
+}
+
+// GetExternalUserTier 获取用户当前生效的等级
+func GetExternalUserTier(c *gin.Context) {
+	userId := c.Param("userId")
+	if userId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "缺少用户 ID"})
+		return
+	}
+
+	tier, expiresAt, err := middleware.GetUserTier(userId)
 	if err != nil {
-		return "", err
+		if middleware.IsExternalUserNotFound(err) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "用户不存在"})
+			return
+		}
+		c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "读取用户失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    gin.H{"tier": tier, "tierExpiresAt": expiresAt},
+	})
+}
+
+// UpdateExternalUserTier 设置用户等级 (tier 为空时清除)，可指定到期时间或天数
+func UpdateExternalUserTier(c *gin.Context) {
+	userId := c.Param("userId")
+	if userId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "缺少用户 ID"})
+		return
+	}
+
+	var req struct {
+		Tier          string `json:"tier"`
+		TierExpiresAt int64  `json:"tierExpiresAt"` // Unix 时间戳，0 表示不过期
+		TierDays      int    `json:"tierDays"`      // 或者指定天数
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "参数错误"})
+		return
+	}
+	expiresAt := req.TierExpiresAt
+	if req.TierDays > 0 {
+		expiresAt = time.Now().Add(time.Duration(req.TierDays) * 24 * time.Hour).Unix()
+	}
+
+	if err := middleware.SetUserTier(c.Request.Context(), userId, req.Tier, expiresAt); err != nil {
+		if errors.Is(err, middleware.ErrInvalidTierName) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+			return
+		}
+		if middleware.IsExternalUserNotFound(err) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "用户不存在"})
+			return
+		}
+		c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "保存用户等级失败: " + err.Error()})
+		return
+	}
+
+	tier, expiresAt, _ := middleware.GetUserTier(userId)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "用户等级更新成功",
+		"data":    gin.H{"tier": tier, "tierExpiresAt": expiresAt},
+	})
+}
+
+// CreateExternalUser 创建外部用户记录 (管理端预置用户，无需等待外部系统写入)
+// 用户已存在时拒绝创建，传入 overwrite=true 时覆盖原有记录
+func CreateExternalUser(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	var req struct {
+		ID           string `json:"id"`
+		Email        string `json:"email"`
+		Username     string `json:"username"`
+		IsVIP        bool   `json:"isVip"`
+		VIPExpiresAt int64  `json:"vipExpiresAt"`
+		Overwrite    bool   `json:"overwrite"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "参数错误"})
+		return
+	}
+	req.ID = strings.TrimSpace(req.ID)
+	req.Email = strings.TrimSpace(req.Email)
+	if req.ID == "" || req.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "用户 ID 和邮箱不能为空"})
+		return
+	}
+	if err := common.Validate.Var(req.Email, "email"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "邮箱格式不正确"})
+		return
+	}
+
+	userJSON, _ := json.Marshal(middleware.ExternalUserData{
+		ID:           req.ID,
+		Email:        req.Email,
+		Username:     req.Username,
+		IsVIP:        req.IsVIP,
+		VIPExpiresAt: req.VIPExpiresAt,
+	})
+	userKey := "user:" + req.ID
+	if req.Overwrite {
+		if err := redisSet(c.Request.Context(), userKey, string(userJSON)); err != nil {
+			c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "保存用户数据失败: " + err.Error()})
+			return
+		}
+		middleware.InvalidateExternalUserCache(req.ID)
+	} else {
+		created, err := redisSetNX(c.Request.Context(), userKey, string(userJSON))
+		if err != nil {
+			c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "保存用户数据失败: " + err.Error()})
+			return
+		}
+		if !created {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "message": "用户已存在"})
+			return
+		}
+	}
+
+	userInfo, err := getExternalUserInfo(c.Request.Context(), req.ID)
+	if err != nil {
+		c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "读取用户数据失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "用户创建成功",
+		"data":    userInfo,
+	})
+}
+
+// ImportExternalUsers 批量导入外部用户记录 (请求体为用户数组，格式与 CreateExternalUser 相同)
+// 默认跳过已存在的用户，传入 ?overwrite=true 时覆盖原有记录 (覆盖的用户计入 created)。
+// 每条记录单独校验，无效记录只计入 failed，不影响其他记录的导入。
+func ImportExternalUsers(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	var records []struct {
+		ID           string `json:"id"`
+		Email        string `json:"email"`
+		Username     string `json:"username"`
+		IsVIP        bool   `json:"isVip"`
+		VIPExpiresAt int64  `json:"vipExpiresAt"`
+	}
+	if err := c.ShouldBindJSON(&records); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "参数错误"})
+		return
+	}
+	overwrite := c.Query("overwrite") == "true"
+
+	type importResult struct {
+		Index   int    `json:"index"`
+		UserId  string `json:"userId"`
+		Status  string `json:"status"` // created / skipped / failed
+		Message string `json:"message,omitempty"`
+	}
+	results := make([]importResult, len(records))
+	keys := make([]string, 0, len(records))
+	values := make([]string, 0, len(records))
+	pending := make([]int, 0, len(records)) // 待写入的记录在 results 中的下标
+	seen := make(map[string]bool, len(records))
+
+	for i, record := range records {
+		id := strings.TrimSpace(record.ID)
+		email := strings.TrimSpace(record.Email)
+		results[i] = importResult{Index: i, UserId: id, Status: "failed"}
+		if id == "" || email == "" {
+			results[i].Message = "用户 ID 和邮箱不能为空"
+			continue
+		}
+		if err := common.Validate.Var(email, "email"); err != nil {
+			results[i].Message = "邮箱格式不正确"
+			continue
+		}
+		if record.VIPExpiresAt < 0 {
+			results[i].Message = "VIP 到期时间不能为负数"
+			continue
+		}
+		if seen[id] {
+			results[i].Message = "用户 ID 重复"
+			continue
+		}
+		seen[id] = true
+
+		userJSON, _ := json.Marshal(middleware.ExternalUserData{
+			ID:           id,
+			Email:        email,
+			Username:     record.Username,
+			IsVIP:        record.IsVIP,
+			VIPExpiresAt: record.VIPExpiresAt,
+		})
+		keys = append(keys, "user:"+id)
+		values = append(values, string(userJSON))
+		pending = append(pending, i)
+	}
+
+	written, errs := redisSetMany(c.Request.Context(), keys, values, !overwrite)
+	for j, err := range errs {
+		i := pending[j]
+		switch {
+		case err != nil:
+			results[i].Message = "保存用户数据失败: " + err.Error()
+		case !written[j]:
+			results[i].Status = "skipped"
+			results[i].Message = "用户已存在"
+		default:
+			results[i].Status = "created"
+			if overwrite {
+				middleware.InvalidateExternalUserCache(results[i].UserId)
+			}
+		}
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": counts["failed"] == 0,
+		"message": fmt.Sprintf("导入 %d 个用户，跳过 %d 个，失败 %d 个", counts["created"], counts["skipped"], counts["failed"]),
+		"created": counts["created"],
+		"skipped": counts["skipped"],
+		"failed":  counts["failed"],
+		"results": results,
+	})
+}
+
+// DeleteExternalUser 删除外部用户及其配额数据 (幂等，用户不存在时返回成功且删除数为 0)
+func DeleteExternalUser(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	userId := c.Param("userId")
+	removed, err := middleware.DeleteExternalUserData(userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "删除用户失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": fmt.Sprintf("已删除 %d 个 key", removed),
+		"data": gin.H{
+			"userId":  userId,
+			"removed": removed,
+		},
+	})
+}
+
+// 管理接口访问 Redis 的错误类型，调用方据此区分 404 / 500 / 503
+var (
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrRedisUnauthorized  = errors.New("Redis 认证失败")
+	ErrRedisUnavailable   = errors.New("Redis 不可用")
+	ErrRedisNotConfigured = errors.New("Redis 客户端未初始化")
+)
+
+// externalRedisErrorStatus 将 Redis 错误映射为 HTTP 状态码
+func externalRedisErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrRedisUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// localRedisError 将 go-redis 错误转换为管理接口的错误类型
+func localRedisError(err error) error {
+	if err == redis.Nil {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRedisUnavailable, err)
+	}
+	return nil
+}
+
+// upstashCommand 通过 Upstash REST API 执行一条命令，返回命令结果 (key 不存在时为 nil)
+// HTTP 401/403 返回 ErrRedisUnauthorized，网络错误、429 与 5xx 返回 ErrRedisUnavailable；
+// 其中网络错误与 5xx 同时标记为 middleware.ErrRedisTransient，可由调用方重试。
+func upstashCommand(reqCtx context.Context, args ...string) (interface{}, error) {
+	cmdBody, _ := json.Marshal(args)
+	req, err := http.NewRequestWithContext(reqCtx, "POST", constant.ExternalUserRedisURL, bytes.NewReader(cmdBody))
+	if err != nil {
+		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+constant.ExternalUserRedisToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := middleware.UpstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%w: %w", ErrRedisUnavailable, err)
 	}
 	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-	
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRedisUnavailable, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("%w: HTTP %d", ErrRedisUnauthorized, resp.StatusCode)
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("%w: %w: HTTP %d %s", ErrRedisUnavailable, middleware.ErrRedisTransient, resp.StatusCode, string(body))
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%w: HTTP %d %s", ErrRedisUnavailable, resp.StatusCode, string(body))
+	}
+
 	var result struct {
 		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
 	}
 	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("解析 Redis 响应失败 (HTTP %d): %s", resp.StatusCode, string(body))
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("Redis 返回错误: %s", result.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Redis 返回 HTTP %d: %s", resp.StatusCode, string(body))
+	}
+	return result.Result, nil
+}
+
+// redisGet 从 Redis 获取值 (本地 Redis 使用 go-redis，否则使用 Upstash REST API)，临时性错误自动重试
+func redisGet(reqCtx context.Context, key string) (string, error) {
+	var val string
+	err := middleware.WithExternalRedisRetry(reqCtx, func() error {
+		var err error
+		val, err = redisGetOnce(reqCtx, key)
+		return err
+	})
+	return val, err
+}
+
+// redisGetOnce 读取一次 (不重试)
+func redisGetOnce(reqCtx context.Context, key string) (string, error) {
+	if middleware.IsUsingLocalRedis() {
+		redisClient := middleware.GetRedisClient()
+		if redisClient == nil {
+			return "", ErrRedisNotConfigured
+		}
+		val, err := redisClient.Get(reqCtx, key).Result()
+		return val, localRedisError(err)
+	}
+
+	result, err := upstashCommand(reqCtx, "GET", key)
+	if err != nil {
 		return "", err
 	}
+	if result == nil {
+		return "", ErrKeyNotFound
+	}
+	return fmt.Sprintf("%v", result), nil
+}
+
+// redisSet 设置 Redis 值 (本地 Redis 使用 go-redis，否则使用 Upstash REST API)，临时性错误自动重试
+func redisSet(reqCtx context.Context, key, value string) error {
+	return middleware.WithExternalRedisRetry(reqCtx, func() error {
+		return redisSetOnce(reqCtx, key, value)
+	})
+}
 
-	if result.Result == nil {
-		return "", fmt.Errorf("key not found")
+// redisSetOnce 写入一次 (不重试)
+func redisSetOnce(reqCtx context.Context, key, value string) error {
+	if middleware.IsUsingLocalRedis() {
+		redisClient := middleware.GetRedisClient()
+		if redisClient == nil {
+			return ErrRedisNotConfigured
+		}
+		return localRedisError(redisClient.Set(reqCtx, key, value, 0).Err())
 	}
 
-	return fmt.Sprintf("%v", result.Result), nil
+	_, err := upstashCommand(reqCtx, "SET", key, value)
+	return err
 }
 
-// redisSet 设置 Redis 值
-func redisSet(key, value string) error {
-	cmdBody, _ := json.Marshal([]string{"SET", key, value})
-	
-	req, err := http.NewRequest("POST", constant.ExternalUserRedisURL, bytes.NewReader(cmdBody))
+// upstashPipelineBatchSize 单次 Upstash pipeline 请求包含的命令数上限
+const upstashPipelineBatchSize = 100
+
+// redisSetMany 批量写入 keys[i] = values[i]，返回每个 key 是否写入及写入错误 (与 keys 顺序一致)
+// onlyIfAbsent 为 true 时使用 SET NX，已存在的 key 不写入 (written 为 false)。
+// 本地 Redis 使用 pipeline，Upstash 按 upstashPipelineBatchSize 分批调用 /pipeline；
+// 临时性错误整批重试，SET NX 与 redisSetNX 一样不重试。
+func redisSetMany(reqCtx context.Context, keys []string, values []string, onlyIfAbsent bool) ([]bool, []error) {
+	written := make([]bool, len(keys))
+	errs := make([]error, len(keys))
+	if len(keys) == 0 {
+		return written, errs
+	}
+	if middleware.IsUsingLocalRedis() {
+		redisClient := middleware.GetRedisClient()
+		if redisClient == nil {
+			for i := range errs {
+				errs[i] = ErrRedisNotConfigured
+			}
+			return written, errs
+		}
+		cmds, _ := redisClient.Pipelined(reqCtx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				if onlyIfAbsent {
+					pipe.SetNX(reqCtx, key, values[i], 0)
+				} else {
+					pipe.Set(reqCtx, key, values[i], 0)
+				}
+			}
+			return nil
+		})
+		for i, cmd := range cmds {
+			errs[i] = localRedisError(cmd.Err())
+			if boolCmd, ok := cmd.(*redis.BoolCmd); ok {
+				written[i] = errs[i] == nil && boolCmd.Val()
+			} else {
+				written[i] = errs[i] == nil
+			}
+		}
+		return written, errs
+	}
+
+	for start := 0; start < len(keys); start += upstashPipelineBatchSize {
+		end := start + upstashPipelineBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		commands := make([][]string, 0, end-start)
+		for i := start; i < end; i++ {
+			command := []string{"SET", keys[i], values[i]}
+			if onlyIfAbsent {
+				command = append(command, "NX")
+			}
+			commands = append(commands, command)
+		}
+		var results []interface{}
+		var batchErrs []error
+		pipeline := func() error {
+			var err error
+			results, batchErrs, err = upstashPipeline(reqCtx, commands)
+			return err
+		}
+		var err error
+		if onlyIfAbsent {
+			err = pipeline()
+		} else {
+			err = middleware.WithExternalRedisRetry(reqCtx, pipeline)
+		}
+		for i := start; i < end; i++ {
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			// key 已存在时 SET NX 返回 null
+			errs[i] = batchErrs[i-start]
+			written[i] = errs[i] == nil && results[i-start] != nil
+		}
+	}
+	return written, errs
+}
+
+// upstashPipeline 通过 Upstash REST API 的 /pipeline 接口在一次请求中执行多条命令，返回每条命令的结果与错误
+// 请求本身失败时返回的错误与 upstashCommand 相同。
+func upstashPipeline(reqCtx context.Context, commands [][]string) ([]interface{}, []error, error) {
+	cmdBody, _ := json.Marshal(commands)
+	req, err := http.NewRequestWithContext(reqCtx, "POST", strings.TrimRight(constant.ExternalUserRedisURL, "/")+"/pipeline", bytes.NewReader(cmdBody))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+constant.ExternalUserRedisToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := middleware.UpstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("%w: %w", ErrRedisUnavailable, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("Redis error: %s", string(body))
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrRedisUnavailable, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, nil, fmt.Errorf("%w: HTTP %d", ErrRedisUnauthorized, resp.StatusCode)
+	case resp.StatusCode >= 500:
+		return nil, nil, fmt.Errorf("%w: %w: HTTP %d %s", ErrRedisUnavailable, middleware.ErrRedisTransient, resp.StatusCode, string(body))
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, nil, fmt.Errorf("%w: HTTP %d %s", ErrRedisUnavailable, resp.StatusCode, string(body))
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, fmt.Errorf("Redis 返回 HTTP %d: %s", resp.StatusCode, string(body))
 	}
 
-	return nil
+	var results []struct {
+		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
+	}
+	if err := json.Unmarshal(body, &results); err != nil || len(results) != len(commands) {
+		return nil, nil, fmt.Errorf("解析 Redis pipeline 响应失败: %s", string(body))
+	}
+	values := make([]interface{}, len(results))
+	errs := make([]error, len(results))
+	for i, result := range results {
+		values[i] = result.Result
+		if result.Error != "" {
+			errs[i] = fmt.Errorf("Redis 返回错误: %s", result.Error)
+		}
+	}
+	return values, errs, nil
+}
+
+// redisSetNX 仅在 key 不存在时设置值，返回是否设置成功
+// 不自动重试: 首次写入成功但响应丢失时，重试会误报用户已存在。
+func redisSetNX(reqCtx context.Context, key, value string) (bool, error) {
+	if middleware.IsUsingLocalRedis() {
+		redisClient := middleware.GetRedisClient()
+		if redisClient == nil {
+			return false, ErrRedisNotConfigured
+		}
+		created, err := redisClient.SetNX(reqCtx, key, value, 0).Result()
+		return created, localRedisError(err)
+	}
+
+	result, err := upstashCommand(reqCtx, "SET", key, value, "NX")
+	if err != nil {
+		return false, err
+	}
+	// key 已存在时 SET NX 返回 null
+	return result != nil, nil
 }
 
 // GetExternalUserDetail 获取单个用户详情
@@ -353,12 +1050,26 @@ func GetExternalUserDetail(c *gin.Context) {
 		return
 	}
 
-	userInfo, err := getExternalUserInfo(userId)
+	userInfo, err := getExternalUserInfo(c.Request.Context(), userId)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "用户不存在: " + err.Error()})
+		if errors.Is(err, ErrKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "用户不存在"})
+			return
+		}
+		c.JSON(externalRedisErrorStatus(err), gin.H{"success": false, "message": "读取用户失败: " + err.Error()})
 		return
 	}
 
+	// 各渠道配额明细 (QuotaUsed 仍为旧版未分渠道 key 的用量)
+	channels, err := middleware.GetUserChannelQuotas(userId, userInfo.ResetDay)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "读取渠道配额失败: " + err.Error()})
+		return
+	}
+	// 各渠道上限按渠道配置 (未传递时为全局配额) 与用户自定义 / 等级 / 模型配额计算，与请求鉴权一致
+	middleware.ApplyUserChannelQuotaLimits(&userInfo.record, channels, middleware.ChannelQuotaLimit(c), time.Now())
+	userInfo.Channels = channels
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data":    userInfo,
@@ -366,38 +1077,54 @@ func GetExternalUserDetail(c *gin.Context) {
 }
 
 // BatchUpdateQuota 批量更新配额
+// channelId 为空时只更新旧版 quota:<userId> key (兼容旧行为)；指定渠道时更新该渠道的配额，为 "all" 时更新用户所有渠道的配额。
 func BatchUpdateQuota(c *gin.Context) {
 	var req struct {
 		UserIds   []string `json:"userIds"`
 		UsedCount int      `json:"usedCount"`
 		Reset     bool     `json:"reset"`
+		ChannelId string   `json:"channelId"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "参数错误"})
 		return
 	}
+	if req.Reset {
+		req.UsedCount = 0
+	}
 
-	currentMonth := time.Now().Format("2006-01")
+	type userResult struct {
+		UserId   string   `json:"userId"`
+		Success  bool     `json:"success"`
+		Channels []string `json:"channels,omitempty"` // 已更新的渠道
+		Message  string   `json:"message,omitempty"`
+	}
 	successCount := 0
 	failedUsers := []string{}
+	results := make([]userResult, 0, len(req.UserIds))
 
 	for _, userId := range req.UserIds {
-		quota := UserQuotaData{
-			MonthKey:    currentMonth,
-			LastResetAt: time.Now().Unix(),
-		}
-		if req.Reset {
-			quota.UsedCount = 0
+		result := userResult{UserId: userId}
+		var err error
+		if req.ChannelId == "" {
+			quota := UserQuotaData{
+				UsedCount:   req.UsedCount,
+				MonthKey:    externalUserPeriodKey(c.Request.Context(), userId),
+				LastResetAt: time.Now().Unix(),
+			}
+			quotaJSON, _ := json.Marshal(quota)
+			err = redisSet(c.Request.Context(), "quota:"+userId, string(quotaJSON))
 		} else {
-			quota.UsedCount = req.UsedCount
+			result.Channels, err = middleware.SetUserChannelQuotas(userId, req.ChannelId, req.UsedCount)
 		}
-
-		quotaJSON, _ := json.Marshal(quota)
-		if err := redisSet("quota:"+userId, string(quotaJSON)); err != nil {
+		if err != nil {
+			result.Message = err.Error()
 			failedUsers = append(failedUsers, userId)
 		} else {
+			result.Success = true
 			successCount++
 		}
+		results = append(results, result)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -405,85 +1132,292 @@ func BatchUpdateQuota(c *gin.Context) {
 		"message":      fmt.Sprintf("成功更新 %d 个用户，失败 %d 个", successCount, len(failedUsers)),
 		"successCount": successCount,
 		"failedUsers":  failedUsers,
+		"results":      results,
 	})
 }
 
-// parseIntParam 解析整数参数
-func parseIntParam(s string, defaultVal int) int {
-	if s == "" {
-		return defaultVal
+// externalUserPeriodKey 获取用户当前配额周期 key (用户记录不可读时使用全局锚定日)
+func externalUserPeriodKey(reqCtx context.Context, userId string) string {
+	var user ExternalUserInfo
+	if userData, err := redisGet(reqCtx, "user:"+userId); err == nil {
+		_ = json.Unmarshal([]byte(userData), &user)
 	}
-	val, err := strconv.Atoi(s)
+	return middleware.CurrentQuotaPeriodKey(user.ResetDay)
+}
+
+// TransferExternalUserQuota 在两个用户之间转移当前周期的剩余配额
+func TransferExternalUserQuota(c *gin.Context) {
+	var req struct {
+		FromUserId string `json:"fromUserId"`
+		ToUserId   string `json:"toUserId"`
+		ChannelId  string `json:"channelId"` // 为空时使用旧版 quota:<userId> key
+		Amount     int    `json:"amount"`
+		PeriodKey  string `json:"periodKey"` // 可选，指定时必须为当前周期
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "参数错误"})
+		return
+	}
+
+	// 渠道配额按 X-Channel-Quota-Limit 读取 (与鉴权相同)，用户的自定义配额与等级配额由 TransferUserQuota 应用
+	result, err := middleware.TransferUserQuota(req.FromUserId, req.ToUserId, req.ChannelId, req.Amount, middleware.ChannelQuotaLimit(c), req.PeriodKey)
 	if err != nil {
-		return defaultVal
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, middleware.ErrQuotaTransferInvalid),
+			errors.Is(err, middleware.ErrQuotaTransferCrossPeriod),
+			errors.Is(err, middleware.ErrQuotaTransferInsufficient):
+			status = http.StatusBadRequest
+		case errors.Is(err, middleware.ErrQuotaTransferBusy):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"success": false, "message": err.Error()})
+		return
 	}
-	return val
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "配额转移成功",
+		"data":    result,
+	})
 }
 
-// getExternalUsersFromLocalRedis 从本地 Redis 获取外部用户列表
-func getExternalUsersFromLocalRedis() ([]ExternalUserInfo, error) {
-	redisClient := middleware.GetRedisClient()
-	if redisClient == nil {
-		return nil, fmt.Errorf("Redis 客户端未初始化")
+// ResetStaleExternalUserQuotas 立即执行一次过期周期配额重置 (与定时任务相同，可重复执行)
+func ResetStaleExternalUserQuotas(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
 	}
 
-	ctx := redisClient.Context()
-	users := []ExternalUserInfo{}
-
-	// 使用 SCAN 获取所有 user:* 键
-	var cursor uint64
-	for {
-		keys, nextCursor, err := redisClient.Scan(ctx, cursor, "user:*", 100).Result()
-		if err != nil {
-			return nil, fmt.Errorf("扫描 Redis 失败: %v", err)
+	reset, err := middleware.ResetStaleQuotas()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, middleware.ErrQuotaResetBusy) {
+			status = http.StatusConflict
 		}
+		c.JSON(status, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": fmt.Sprintf("已重置 %d 条配额记录", reset),
+		"data":    gin.H{"reset": reset},
+	})
+}
 
-		for _, key := range keys {
-			if len(key) <= 5 {
-				continue
-			}
-			userId := key[5:] // 去掉 "user:" 前缀
+// BanExternalUser 封禁外部用户 (立即生效，无需等待 token 过期)
+// 可选参数: reason 封禁原因、duration 封禁时长 (秒，0 或不传为永久)
+func BanExternalUser(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
 
-			// 获取用户数据
-			userData, err := redisClient.Get(ctx, key).Result()
-			if err != nil {
-				continue
-			}
+	var req struct {
+		Reason   string `json:"reason"`
+		Duration int64  `json:"duration"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "参数错误"})
+		return
+	}
+	if req.Duration < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "封禁时长不能为负数"})
+		return
+	}
 
-			var user ExternalUserInfo
-			if err := json.Unmarshal([]byte(userData), &user); err != nil {
-				continue
+	ban, err := middleware.BanExternalUser(c.Param("userId"), req.Reason, time.Duration(req.Duration)*time.Second)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "已封禁用户",
+		"data":    ban,
+	})
+}
+
+// UnbanExternalUser 解除外部用户封禁
+func UnbanExternalUser(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	removed, err := middleware.UnbanExternalUser(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "用户未被封禁"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "已解除封禁"})
+}
+
+// GetExternalUserAuthFailures 获取验证失败次数较多的 userId / IP (滥用检测)
+func GetExternalUserAuthFailures(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	records, err := middleware.GetAuthFailureOffenders()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Count > records[j].Count })
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    records,
+		"total":   len(records),
+	})
+}
+
+// GetExternalUserChannelUsage 获取所有外部用户当前周期按渠道聚合的调用次数 (容量规划)
+func GetExternalUserChannelUsage(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	report, err := middleware.AggregateChannelUsage()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+
+	// 解析渠道名称
+	ids := make([]int, 0, len(report.Channels))
+	for _, summary := range report.Channels {
+		if id, err := strconv.Atoi(summary.ChannelId); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		channels, err := model.GetChannelsByIds(ids)
+		if err == nil {
+			names := make(map[string]string, len(channels))
+			for _, channel := range channels {
+				names[strconv.Itoa(channel.Id)] = channel.Name
 			}
-			user.ID = userId
-
-			// 获取配额数据
-			quotaData, err := redisClient.Get(ctx, "quota:"+userId).Result()
-			if err == nil && quotaData != "" {
-				var quota UserQuotaData
-				if json.Unmarshal([]byte(quotaData), &quota) == nil {
-					currentMonth := time.Now().Format("2006-01")
-					if quota.MonthKey == currentMonth {
-						user.QuotaUsed = quota.UsedCount
-					}
-					user.MonthKey = quota.MonthKey
-				}
+			for i := range report.Channels {
+				report.Channels[i].ChannelName = names[report.Channels[i].ChannelId]
 			}
+		}
+	}
 
-			// 设置配额总量
-			if user.IsVIP && user.VIPExpiresAt > time.Now().Unix() {
-				user.QuotaTotal = -1
-			} else {
-				user.QuotaTotal = constant.ExternalUserMonthlyQuota
-			}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    report,
+		"total":   len(report.Channels),
+	})
+}
 
-			users = append(users, user)
-		}
+// externalUserStatsCache 汇总统计缓存，避免仪表盘频繁刷新时反复遍历 Redis
+// 计算期间持有锁，并发请求等待同一次计算结果。
+var externalUserStatsCache struct {
+	sync.Mutex
+	stats     *middleware.ExternalUserStats
+	expiresAt time.Time
+}
 
-		cursor = nextCursor
-		if cursor == 0 {
-			break
+// GetExternalUserStats 获取外部用户汇总统计 (用户数、VIP 数、当前周期用量及用量分布)
+func GetExternalUserStats(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	cache := &externalUserStatsCache
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.stats == nil || !time.Now().Before(cache.expiresAt) {
+		stats, err := middleware.ComputeExternalUserStats()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+			return
 		}
+		cache.stats = stats
+		cache.expiresAt = time.Now().Add(time.Duration(constant.ExternalUserStatsCacheSeconds) * time.Second)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    cache.stats,
+	})
+}
+
+// ExportExternalUserAuditLog 以 NDJSON 格式流式导出审计日志 (供日志采集使用)
+// 可选参数: start / end (Unix 秒)、userId
+func ExportExternalUserAuditLog(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	filter := middleware.AuditFilter{
+		Start:  int64(parseIntParam(c.Query("start"), 0)),
+		End:    int64(parseIntParam(c.Query("end"), 0)),
+		UserId: c.Query("userId"),
 	}
 
-	return users, nil
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	if _, err := middleware.ExportAuditLogNDJSON(c.Writer, filter); err != nil {
+		// 响应已开始写出，只能记录错误
+		common.SysError(fmt.Sprintf("failed to export external user audit log: %v", err))
+	}
+}
+
+// GetExternalUserAuditLog 按时间倒序分页查看指定用户最近的审计记录
+// 可选参数: pageSize、cursor (上一页返回的 nextCursor)；hasMore 为 false 表示没有更多记录。
+func GetExternalUserAuditLog(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusOK, gin.H{"success": false, "message": "Redis 未配置"})
+		return
+	}
+
+	pageSize := parseIntParam(c.Query("pageSize"), defaultExternalUserPageSize)
+	if pageSize <= 0 {
+		pageSize = defaultExternalUserPageSize
+	} else if pageSize > maxExternalUserPageSize {
+		pageSize = maxExternalUserPageSize
+	}
+
+	entries, nextCursor, err := middleware.GetUserAuditLog(c.Param("userId"), c.Query("cursor"), pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "读取审计日志失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"data":       entries,
+		"nextCursor": nextCursor,
+		"hasMore":    nextCursor != "",
+	})
+}
+
+// GetExternalUserExemptIdentities 获取当前生效的特权身份配置 (管理员、豁免用户等)
+func GetExternalUserExemptIdentities(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    middleware.GetExemptIdentities(),
+	})
+}
+
+// parseIntParam 解析整数参数
+func parseIntParam(s string, defaultVal int) int {
+	if s == "" {
+		return defaultVal
+	}
+	val, err := strconv.Atoi(s)
+	if err != nil {
+		return defaultVal
+	}
+	return val
 }
@@ -0,0 +1,976 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// useTestExternalRedis 使用内存 Redis (本地 redis:// 模式) 作为外部用户存储，测试结束后关闭外部用户验证
+func useTestExternalRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	prevURL, prevToken := constant.ExternalUserRedisURL, constant.ExternalUserRedisToken
+	constant.ExternalUserRedisURL = "redis://" + mr.Addr()
+	constant.ExternalUserRedisToken = ""
+	middleware.InitExternalUserAuth(constant.ExternalUserRedisURL, "", "test-secret", 30)
+	t.Cleanup(func() {
+		constant.ExternalUserRedisURL, constant.ExternalUserRedisToken = prevURL, prevToken
+		middleware.InitExternalUserAuth("", "", "", 0)
+	})
+	return mr
+}
+
+// useTestUpstash 使用模拟的 Upstash REST API (数据保存在内存 Redis 中) 作为外部用户存储
+func useTestUpstash(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/pipeline" {
+			var commands [][]interface{}
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &commands); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			results := make([]map[string]interface{}, 0, len(commands))
+			for _, args := range commands {
+				result, err := client.Do(context.Background(), args...).Result()
+				if err != nil && err != redis.Nil {
+					results = append(results, map[string]interface{}{"error": err.Error()})
+				} else {
+					results = append(results, map[string]interface{}{"result": result})
+				}
+			}
+			_ = json.NewEncoder(w).Encode(results)
+			return
+		}
+		// 支持 POST ["CMD", args...] 与 GET /cmd/arg1/arg2 两种形式
+		var args []interface{}
+		if r.Method == http.MethodPost {
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &args); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		} else {
+			for _, part := range strings.Split(strings.Trim(r.URL.Path, "/"), "/") {
+				args = append(args, part)
+			}
+		}
+		result, err := client.Do(context.Background(), args...).Result()
+		if err != nil && err != redis.Nil {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+	}))
+	t.Cleanup(server.Close)
+
+	prevURL, prevToken := constant.ExternalUserRedisURL, constant.ExternalUserRedisToken
+	constant.ExternalUserRedisURL, constant.ExternalUserRedisToken = server.URL, "test-token"
+	middleware.InitExternalUserAuth(server.URL, "test-token", "test-secret", 30)
+	t.Cleanup(func() {
+		constant.ExternalUserRedisURL, constant.ExternalUserRedisToken = prevURL, prevToken
+		middleware.InitExternalUserAuth("", "", "", 0)
+	})
+	return mr
+}
+
+// externalRedisBackends 管理接口支持的两种 Redis 后端
+var externalRedisBackends = map[string]func(t *testing.T) *miniredis.Miniredis{
+	"local":   useTestExternalRedis,
+	"upstash": useTestUpstash,
+}
+
+// seedExternalUsers 写入 n 个用户 (ID 为 u000...)，偶数编号为有效 VIP
+func seedExternalUsers(t *testing.T, mr *miniredis.Miniredis, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		user := ExternalUserInfo{Email: fmt.Sprintf("user%03d@example.com", i)}
+		if i%2 == 0 {
+			user.IsVIP = true
+			user.VIPExpiresAt = time.Now().Add(time.Hour).Unix()
+		}
+		data, _ := json.Marshal(user)
+		if err := mr.Set(fmt.Sprintf("user:u%03d", i), string(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type externalUsersResponse struct {
+	Success    bool               `json:"success"`
+	Data       []ExternalUserInfo `json:"data"`
+	NextCursor string             `json:"nextCursor"`
+	HasMore    bool               `json:"hasMore"`
+}
+
+func getExternalUsersPage(t *testing.T, query string) externalUsersResponse {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/external-users/", GetExternalUsers)
+	req := httptest.NewRequest(http.MethodGet, "/api/external-users/?"+query, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var resp externalUsersResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Success {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	return resp
+}
+
+func TestGetExternalUsersPagination(t *testing.T) {
+	mr := useTestExternalRedis(t)
+	seedExternalUsers(t, mr, 45)
+
+	seen := map[string]bool{}
+	cursor := ""
+	pages := 0
+	for {
+		query := "pageSize=10"
+		if cursor != "" {
+			query += "&cursor=" + cursor
+		}
+		resp := getExternalUsersPage(t, query)
+		pages++
+		for _, user := range resp.Data {
+			if seen[user.ID] {
+				t.Fatalf("user %s returned twice", user.ID)
+			}
+			seen[user.ID] = true
+		}
+		if !resp.HasMore {
+			if resp.NextCursor != "0" {
+				t.Fatalf("last page should return cursor 0, got %q", resp.NextCursor)
+			}
+			break
+		}
+		if len(resp.Data) < 10 {
+			t.Fatalf("non-final page should be filled, got %d", len(resp.Data))
+		}
+		cursor = resp.NextCursor
+		if pages > 45 {
+			t.Fatal("pagination did not terminate")
+		}
+	}
+	if len(seen) != 45 || pages < 2 {
+		t.Fatalf("expected to page through all 45 users in several pages, got %d users in %d pages", len(seen), pages)
+	}
+
+	// 不分页时返回全部用户
+	if resp := getExternalUsersPage(t, ""); len(resp.Data) != 45 {
+		t.Fatalf("unpaged listing should return all users, got %d", len(resp.Data))
+	}
+}
+
+func TestGetExternalUsersFilter(t *testing.T) {
+	mr := useTestExternalRedis(t)
+	seedExternalUsers(t, mr, 20)
+
+	resp := getExternalUsersPage(t, "vip=true")
+	if len(resp.Data) != 10 {
+		t.Fatalf("expected 10 VIP users, got %d", len(resp.Data))
+	}
+	for _, user := range resp.Data {
+		if !user.IsVIP || user.QuotaTotal != -1 {
+			t.Fatalf("non-VIP user %s returned by vip filter", user.ID)
+		}
+	}
+	if resp := getExternalUsersPage(t, "vip=false"); len(resp.Data) != 10 {
+		t.Fatalf("expected 10 non-VIP users, got %d", len(resp.Data))
+	}
+
+	resp = getExternalUsersPage(t, "email=USER01&vip=false")
+	if len(resp.Data) != 5 { // user011, 013, 015, 017, 019
+		t.Fatalf("expected 5 users matching email and vip filters, got %d", len(resp.Data))
+	}
+}
+
+// useTestQuotaConfig 设置等级配额与 VIP 宽限期后初始化外部用户存储，测试结束后恢复
+func useTestQuotaConfig(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	prevQuota, prevTiers, prevGrace := constant.ExternalUserMonthlyQuota, constant.ExternalUserTierQuotas, constant.ExternalUserVIPGraceSeconds
+	constant.ExternalUserMonthlyQuota = 30
+	constant.ExternalUserTierQuotas = "bronze:500,gold:-1"
+	constant.ExternalUserVIPGraceSeconds = 3600
+	t.Cleanup(func() {
+		constant.ExternalUserMonthlyQuota, constant.ExternalUserTierQuotas, constant.ExternalUserVIPGraceSeconds = prevQuota, prevTiers, prevGrace
+		middleware.InitExternalUserAuth("", "", "", 0)
+	})
+	return useTestExternalRedis(t)
+}
+
+func TestExternalUserInfoQuotaTotal(t *testing.T) {
+	mr := useTestQuotaConfig(t)
+	now := time.Now()
+	users := map[string]middleware.ExternalUserData{
+		"plain":  {},
+		"custom": {QuotaLimit: 42},
+		"bronze": {IsVIP: true, VIPExpiresAt: now.Add(time.Hour).Unix(), Tier: "bronze"},
+		"gold":   {IsVIP: true, VIPExpiresAt: now.Add(time.Hour).Unix(), Tier: "gold"},
+		"grace":  {IsVIP: true, VIPExpiresAt: now.Add(-10 * time.Minute).Unix()},
+		"lapsed": {IsVIP: true, VIPExpiresAt: now.Add(-2 * time.Hour).Unix()},
+	}
+	for id, user := range users {
+		data, _ := json.Marshal(user)
+		mr.Set("user:"+id, string(data))
+	}
+
+	want := map[string]int{"plain": 30, "custom": 42, "bronze": 500, "gold": -1, "grace": -1, "lapsed": 30}
+	for id, total := range want {
+		info, err := getExternalUserInfo(context.Background(), id)
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if info.QuotaTotal != total {
+			t.Errorf("%s: expected quota total %d, got %d", id, total, info.QuotaTotal)
+		}
+	}
+
+	// 宽限期内的用户仍按 VIP 筛选
+	vips := map[string]bool{}
+	for _, user := range getExternalUsersPage(t, "vip=true").Data {
+		vips[user.ID] = true
+	}
+	if len(vips) != 3 || !vips["bronze"] || !vips["gold"] || !vips["grace"] {
+		t.Fatalf("expected bronze, gold and grace in the VIP list, got %v", vips)
+	}
+}
+
+func TestLoadExternalUsersConcurrentFetch(t *testing.T) {
+	userIds := make([]string, 100)
+	for i := range userIds {
+		userIds[i] = fmt.Sprintf("u%03d", i)
+	}
+	// 模拟每次 Redis 往返 5ms，编号为 7 的倍数的用户获取失败
+	const roundTrip = 5 * time.Millisecond
+	fetch := func(userId string) (*ExternalUserInfo, error) {
+		time.Sleep(roundTrip)
+		var n int
+		fmt.Sscanf(userId, "u%d", &n)
+		if n%7 == 0 {
+			return nil, fmt.Errorf("fetch %s failed", userId)
+		}
+		return &ExternalUserInfo{ID: userId}, nil
+	}
+
+	start := time.Now()
+	users := loadExternalUsers(userIds, fetch)
+	elapsed := time.Since(start)
+
+	serial := time.Duration(len(userIds)) * roundTrip
+	if elapsed > serial/4 {
+		t.Fatalf("batched fetch took %v, expected well under the serial %v", elapsed, serial)
+	}
+	if len(users) != 85 {
+		t.Fatalf("failed users should be skipped, got %d users", len(users))
+	}
+	for i := 1; i < len(users); i++ {
+		if users[i-1].ID >= users[i].ID {
+			t.Fatalf("output order should follow the scanned keys, got %s before %s", users[i-1].ID, users[i].ID)
+		}
+	}
+}
+
+func TestExternalUserManagementBackends(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			seedExternalUsers(t, mr, 3)
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/api/external-users/:userId", GetExternalUserDetail)
+			router.PUT("/api/external-users/:userId/vip", UpdateExternalUserVIP)
+			router.PUT("/api/external-users/:userId/quota", UpdateExternalUserQuota)
+			do := func(method string, path string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, path, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			if w := do(http.MethodPut, "/api/external-users/u001/vip", `{"isVip":true,"vipDays":1}`); w.Code != http.StatusOK {
+				t.Fatalf("update vip failed: %d %s", w.Code, w.Body.String())
+			}
+			if w := do(http.MethodPut, "/api/external-users/u001/quota", `{"usedCount":7}`); w.Code != http.StatusOK {
+				t.Fatalf("update quota failed: %d %s", w.Code, w.Body.String())
+			}
+
+			w := do(http.MethodGet, "/api/external-users/u001", "")
+			var detail struct {
+				Success bool             `json:"success"`
+				Data    ExternalUserInfo `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil || !detail.Success {
+				t.Fatalf("get detail failed: %d %s", w.Code, w.Body.String())
+			}
+			if !detail.Data.IsVIP || detail.Data.QuotaUsed != 7 || detail.Data.Email != "user001@example.com" {
+				t.Fatalf("unexpected user detail: %+v", detail.Data)
+			}
+			if w := do(http.MethodGet, "/api/external-users/missing", ""); w.Code != http.StatusNotFound {
+				t.Fatalf("missing user should return 404, got %d", w.Code)
+			}
+
+			if resp := getExternalUsersPage(t, ""); len(resp.Data) != 3 {
+				t.Fatalf("expected 3 users listed, got %d", len(resp.Data))
+			}
+		})
+	}
+}
+
+func TestExternalUserTierRoundTrip(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			seedExternalUsers(t, mr, 2)
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/api/external-users/:userId/tier", GetExternalUserTier)
+			router.PUT("/api/external-users/:userId/tier", UpdateExternalUserTier)
+			do := func(method string, path string, body string) (int, string, int64) {
+				req := httptest.NewRequest(method, path, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				var resp struct {
+					Data struct {
+						Tier          string `json:"tier"`
+						TierExpiresAt int64  `json:"tierExpiresAt"`
+					} `json:"data"`
+				}
+				_ = json.Unmarshal(w.Body.Bytes(), &resp)
+				return w.Code, resp.Data.Tier, resp.Data.TierExpiresAt
+			}
+
+			expiresAt := time.Now().Add(time.Hour).Unix()
+			if code, _, _ := do(http.MethodPut, "/api/external-users/u001/tier", fmt.Sprintf(`{"tier":"gold","tierExpiresAt":%d}`, expiresAt)); code != http.StatusOK {
+				t.Fatalf("set tier failed: %d", code)
+			}
+			if code, tier, gotExpiry := do(http.MethodGet, "/api/external-users/u001/tier", ""); code != http.StatusOK || tier != "gold" || gotExpiry != expiresAt {
+				t.Fatalf("expected gold until %d, got %d %q %d", expiresAt, code, tier, gotExpiry)
+			}
+			// 其他字段保持不变
+			var stored ExternalUserInfo
+			raw, _ := mr.Get("user:u001")
+			if err := json.Unmarshal([]byte(raw), &stored); err != nil || stored.Email != "user001@example.com" || stored.Tier != "gold" {
+				t.Fatalf("tier should be persisted without touching other fields, got %s", raw)
+			}
+
+			if code, tier, _ := do(http.MethodPut, "/api/external-users/u001/tier", `{"tier":""}`); code != http.StatusOK || tier != "" {
+				t.Fatalf("empty tier should clear the assignment, got %d %q", code, tier)
+			}
+			if code, _, _ := do(http.MethodPut, "/api/external-users/u001/tier", `{"tier":"gold:1"}`); code != http.StatusBadRequest {
+				t.Fatalf("tier name with separators should be rejected, got %d", code)
+			}
+			if code, _, _ := do(http.MethodGet, "/api/external-users/missing/tier", ""); code != http.StatusNotFound {
+				t.Fatalf("missing user should return 404, got %d", code)
+			}
+		})
+	}
+}
+
+func TestCreateExternalUser(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/api/external-users/", CreateExternalUser)
+			create := func(body string) (int, ExternalUserInfo) {
+				req := httptest.NewRequest(http.MethodPost, "/api/external-users/", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				var resp struct {
+					Data ExternalUserInfo `json:"data"`
+				}
+				_ = json.Unmarshal(w.Body.Bytes(), &resp)
+				return w.Code, resp.Data
+			}
+
+			code, user := create(`{"id":"u1","email":"a@example.com","username":"alice","isVip":true,"vipExpiresAt":4102444800}`)
+			if code != http.StatusOK || user.ID != "u1" || user.Email != "a@example.com" || !user.IsVIP || user.QuotaTotal != -1 {
+				t.Fatalf("unexpected create result: %d %+v", code, user)
+			}
+
+			if code, _ := create(`{"id":"u1","email":"b@example.com","username":"bob"}`); code != http.StatusConflict {
+				t.Fatalf("duplicate create should be rejected, got %d", code)
+			}
+			stored, _ := mr.Get("user:u1")
+			if !strings.Contains(stored, "a@example.com") {
+				t.Fatalf("duplicate create must not modify the record: %s", stored)
+			}
+
+			code, user = create(`{"id":"u1","email":"b@example.com","username":"bob","overwrite":true}`)
+			if code != http.StatusOK || user.Email != "b@example.com" || user.Username != "bob" || user.IsVIP {
+				t.Fatalf("unexpected overwrite result: %d %+v", code, user)
+			}
+
+			for _, body := range []string{
+				`{"id":"","email":"c@example.com"}`,
+				`{"id":"u2","email":""}`,
+				`{"id":"u2","email":"not-an-email"}`,
+			} {
+				if code, _ := create(body); code != http.StatusBadRequest {
+					t.Fatalf("invalid request %s should return 400, got %d", body, code)
+				}
+			}
+			if mr.Exists("user:u2") {
+				t.Fatal("invalid request must not create a user")
+			}
+		})
+	}
+}
+
+func TestDeleteExternalUser(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			seedExternalUsers(t, mr, 2)
+			for _, key := range []string{"quota:u000", "quota:u000:channel:1", "quota:u000:channel:2", "quota:u001:channel:1"} {
+				mr.Set(key, `{"usedCount":1,"monthKey":"2000-01"}`)
+			}
+			mr.SAdd("channels:u000", "1", "2")
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.DELETE("/api/external-users/:userId", DeleteExternalUser)
+			remove := func(userId string) int64 {
+				req := httptest.NewRequest(http.MethodDelete, "/api/external-users/"+userId, nil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				var resp struct {
+					Success bool `json:"success"`
+					Data    struct {
+						Removed int64 `json:"removed"`
+					} `json:"data"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK || !resp.Success {
+					t.Fatalf("delete %s failed: %d %s", userId, w.Code, w.Body.String())
+				}
+				return resp.Data.Removed
+			}
+
+			if removed := remove("u000"); removed != 5 {
+				t.Fatalf("expected 5 keys removed, got %d", removed)
+			}
+			for _, key := range []string{"user:u000", "quota:u000", "quota:u000:channel:1", "quota:u000:channel:2", "channels:u000"} {
+				if mr.Exists(key) {
+					t.Fatalf("key %s should be deleted", key)
+				}
+			}
+			if !mr.Exists("user:u001") || !mr.Exists("quota:u001:channel:1") {
+				t.Fatal("other users' keys must be kept")
+			}
+
+			if removed := remove("u000"); removed != 0 {
+				t.Fatalf("deleting again should remove nothing, got %d", removed)
+			}
+		})
+	}
+}
+
+func TestGetExternalUserDetailChannelBreakdown(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			seedExternalUsers(t, mr, 2)
+			current := middleware.CurrentQuotaPeriodKey(0)
+			seed := func(key string, used int, monthKey string) {
+				mr.Set(key, fmt.Sprintf(`{"usedCount":%d,"monthKey":"%s"}`, used, monthKey))
+			}
+			seed("quota:u001", 1, current)
+			seed("quota:u001:channel:1", 3, current)
+			seed("quota:u001:channel:2", 9, "2000-01") // 过期周期按 0 计
+			seed("quota:u001:channel:2:model:gpt-4o", 2, current)
+			seed("quota:u000:channel:1", 7, current) // 其他用户
+			mr.Set("quota:u001:channel:1:day:"+time.Now().Format("2006-01-02"), "3")
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/api/external-users/:userId", GetExternalUserDetail)
+			req := httptest.NewRequest(http.MethodGet, "/api/external-users/u001", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var resp struct {
+				Success bool             `json:"success"`
+				Data    ExternalUserInfo `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Success {
+				t.Fatalf("get detail failed: %d %s", w.Code, w.Body.String())
+			}
+			if resp.Data.QuotaUsed != 1 {
+				t.Fatalf("aggregate quota should come from the legacy key, got %d", resp.Data.QuotaUsed)
+			}
+			expected := []middleware.UserChannelQuota{
+				{ChannelId: "1", UsedCount: 3, MonthKey: current, QuotaLimit: 30, Remaining: 27},
+				{ChannelId: "2", UsedCount: 0, MonthKey: "2000-01", QuotaLimit: 30, Remaining: 30},
+				{ChannelId: "2", Model: "gpt-4o", UsedCount: 2, MonthKey: current, QuotaLimit: 30, Remaining: 28},
+			}
+			if len(resp.Data.Channels) != len(expected) {
+				t.Fatalf("unexpected channel breakdown: %+v", resp.Data.Channels)
+			}
+			for i, item := range expected {
+				if resp.Data.Channels[i] != item {
+					t.Fatalf("channel %d: expected %+v, got %+v", i, item, resp.Data.Channels[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetExternalUserDetailChannelLimits(t *testing.T) {
+	prevModels := constant.ExternalUserModelQuotas
+	constant.ExternalUserModelQuotas = "gpt-4o:5"
+	t.Cleanup(func() { constant.ExternalUserModelQuotas = prevModels })
+	mr := useTestQuotaConfig(t)
+
+	now := time.Now()
+	current := middleware.CurrentQuotaPeriodKey(0)
+	users := map[string]middleware.ExternalUserData{
+		"plain":  {},
+		"bronze": {IsVIP: true, VIPExpiresAt: now.Add(time.Hour).Unix(), Tier: "bronze"},
+		"gold":   {IsVIP: true, VIPExpiresAt: now.Add(time.Hour).Unix(), Tier: "gold"},
+	}
+	for id, user := range users {
+		data, _ := json.Marshal(user)
+		mr.Set("user:"+id, string(data))
+		mr.Set("quota:"+id+":channel:1", fmt.Sprintf(`{"usedCount":40,"monthKey":"%s","rolloverCredit":2}`, current))
+		mr.Set("quota:"+id+":channel:1:model:gpt-4o", fmt.Sprintf(`{"usedCount":3,"monthKey":"%s"}`, current))
+	}
+
+	router := gin.New()
+	router.GET("/api/external-users/:userId", GetExternalUserDetail)
+	cases := []struct {
+		userId       string
+		channelLimit string
+		channel      [2]int // 渠道桶的上限与剩余次数
+		model        [2]int // 模型配额桶的上限与剩余次数
+	}{
+		{"plain", "", [2]int{30, 0}, [2]int{5, 2}},
+		{"plain", "100", [2]int{100, 62}, [2]int{5, 2}},
+		{"bronze", "100", [2]int{500, 462}, [2]int{5, 2}},
+		{"gold", "", [2]int{-1, -1}, [2]int{-1, -1}},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/api/external-users/"+tc.userId, nil)
+		if tc.channelLimit != "" {
+			req.Header.Set("X-Channel-Quota-Limit", tc.channelLimit)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var resp struct {
+			Success bool             `json:"success"`
+			Data    ExternalUserInfo `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Success || len(resp.Data.Channels) != 2 {
+			t.Fatalf("%s: get detail failed: %d %s", tc.userId, w.Code, w.Body.String())
+		}
+		channel, model := resp.Data.Channels[0], resp.Data.Channels[1]
+		if got := [2]int{channel.QuotaLimit, channel.Remaining}; got != tc.channel {
+			t.Fatalf("%s (limit %q): expected channel limit/remaining %v, got %v", tc.userId, tc.channelLimit, tc.channel, got)
+		}
+		if got := [2]int{model.QuotaLimit, model.Remaining}; got != tc.model {
+			t.Fatalf("%s (limit %q): expected model limit/remaining %v, got %v", tc.userId, tc.channelLimit, tc.model, got)
+		}
+	}
+}
+
+func TestGetExternalUserStats(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			prevTTL := constant.ExternalUserStatsCacheSeconds
+			constant.ExternalUserStatsCacheSeconds = 60
+			externalUserStatsCache.stats = nil
+			t.Cleanup(func() {
+				constant.ExternalUserStatsCacheSeconds = prevTTL
+				externalUserStatsCache.stats = nil
+			})
+
+			now := time.Now().Unix()
+			current := middleware.CurrentQuotaPeriodKey(0)
+			users := []struct {
+				vip       bool
+				expiresAt int64
+				used      int
+				monthKey  string
+			}{
+				{true, now + 3600, 0, ""},
+				{true, now - 3600, 5, current},
+				{false, 0, 12, current},
+				{false, 0, 40, current},
+				{false, 0, 150, current},
+				{false, 0, 99, "2000-01"}, // 过期周期按 0 计
+			}
+			for i, u := range users {
+				id := fmt.Sprintf("s%d", i)
+				mr.Set("user:"+id, fmt.Sprintf(`{"id":"%s","email":"%s@example.com","isVip":%t,"vipExpiresAt":%d}`, id, id, u.vip, u.expiresAt))
+				if u.monthKey != "" {
+					mr.Set("quota:"+id, fmt.Sprintf(`{"usedCount":%d,"monthKey":"%s"}`, u.used, u.monthKey))
+				}
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/api/external-users/stats", GetExternalUserStats)
+			fetch := func() middleware.ExternalUserStats {
+				req := httptest.NewRequest(http.MethodGet, "/api/external-users/stats", nil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				var resp struct {
+					Success bool                         `json:"success"`
+					Data    middleware.ExternalUserStats `json:"data"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Success {
+					t.Fatalf("get stats failed: %d %s", w.Code, w.Body.String())
+				}
+				return resp.Data
+			}
+
+			stats := fetch()
+			if stats.TotalUsers != 6 || stats.ActiveVIPs != 1 || stats.ExpiredVIPs != 1 || stats.QuotaUsed != 207 {
+				t.Fatalf("unexpected stats: %+v", stats)
+			}
+			expected := map[string]int{"0": 2, "1-9": 1, "10-29": 1, "30-99": 1, "100+": 1}
+			for _, bucket := range stats.Histogram {
+				if bucket.Users != expected[bucket.Label] {
+					t.Fatalf("bucket %s: expected %d users, got %d", bucket.Label, expected[bucket.Label], bucket.Users)
+				}
+			}
+
+			// 缓存有效期内不重新统计
+			mr.Set("user:s9", `{"id":"s9","email":"s9@example.com"}`)
+			if stats := fetch(); stats.TotalUsers != 6 {
+				t.Fatalf("cached stats should be returned, got %d users", stats.TotalUsers)
+			}
+			externalUserStatsCache.expiresAt = time.Now()
+			if stats := fetch(); stats.TotalUsers != 7 {
+				t.Fatalf("expired cache should be refreshed, got %d users", stats.TotalUsers)
+			}
+		})
+	}
+}
+
+func TestBatchUpdateQuotaAllChannels(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			seedExternalUsers(t, mr, 3)
+			current := middleware.CurrentQuotaPeriodKey(0)
+			seed := func(key string, used int) {
+				mr.Set(key, fmt.Sprintf(`{"usedCount":%d,"monthKey":"%s","firstPeriodKey":"2000-01","tokenCount":50}`, used, current))
+			}
+			seed("quota:u000", 4)
+			seed("quota:u000:channel:1", 5)
+			seed("quota:u000:channel:2:model:gpt-4o", 6)
+			seed("quota:u001:channel:3", 7)
+			seed("quota:u002:channel:1", 8) // 不在本次批量更新中
+			dailyKey := "quota:u000:channel:1:day:" + time.Now().Format("2006-01-02")
+			mr.Set(dailyKey, "5")
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/api/external-users/batch-quota", BatchUpdateQuota)
+			req := httptest.NewRequest(http.MethodPost, "/api/external-users/batch-quota",
+				strings.NewReader(`{"userIds":["u000","u001"],"reset":true,"channelId":"all"}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var resp struct {
+				Success bool `json:"success"`
+				Results []struct {
+					UserId   string   `json:"userId"`
+					Success  bool     `json:"success"`
+					Channels []string `json:"channels"`
+				} `json:"results"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Success || len(resp.Results) != 2 {
+				t.Fatalf("batch update failed: %d %s", w.Code, w.Body.String())
+			}
+			if r := resp.Results[0]; r.UserId != "u000" || !r.Success || strings.Join(r.Channels, ",") != "1,2:model:gpt-4o" {
+				t.Fatalf("unexpected result for u000: %+v", r)
+			}
+			if r := resp.Results[1]; r.UserId != "u001" || !r.Success || strings.Join(r.Channels, ",") != "3" {
+				t.Fatalf("unexpected result for u001: %+v", r)
+			}
+
+			readQuota := func(key string) middleware.UserQuota {
+				raw, err := mr.Get(key)
+				if err != nil {
+					t.Fatalf("read %s: %v", key, err)
+				}
+				var quota middleware.UserQuota
+				_ = json.Unmarshal([]byte(raw), &quota)
+				return quota
+			}
+			for _, key := range []string{"quota:u000:channel:1", "quota:u000:channel:2:model:gpt-4o", "quota:u001:channel:3"} {
+				if q := readQuota(key); q.UsedCount != 0 || q.TokenCount != 0 || q.MonthKey != current || q.FirstPeriodKey != "2000-01" {
+					t.Fatalf("%s not reset correctly: %+v", key, q)
+				}
+			}
+			if q := readQuota("quota:u000"); q.UsedCount != 4 {
+				t.Fatalf("legacy key must be untouched when resetting channels, got %+v", q)
+			}
+			if q := readQuota("quota:u002:channel:1"); q.UsedCount != 8 {
+				t.Fatalf("unlisted user must be untouched, got %+v", q)
+			}
+			if v, _ := mr.Get(dailyKey); v != "5" {
+				t.Fatalf("daily counter must be untouched, got %q", v)
+			}
+		})
+	}
+}
+
+func TestBatchUpdateVIPMixedBatch(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			seedExternalUsers(t, mr, 3) // u000 与 u002 为 VIP
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/api/external-users/batch-vip", BatchUpdateVIP)
+			req := httptest.NewRequest(http.MethodPost, "/api/external-users/batch-vip",
+				strings.NewReader(`{"userIds":["u000","missing","u001"],"isVip":true,"vipDays":30}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			var resp struct {
+				Success      bool     `json:"success"`
+				SuccessCount int      `json:"successCount"`
+				FailedUsers  []string `json:"failedUsers"`
+				Results      []struct {
+					UserId  string `json:"userId"`
+					Success bool   `json:"success"`
+					Message string `json:"message"`
+				} `json:"results"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+			}
+			if resp.Success || resp.SuccessCount != 2 || len(resp.FailedUsers) != 1 || resp.FailedUsers[0] != "missing" {
+				t.Fatalf("expected 2 updated and missing reported as failed, got %+v", resp)
+			}
+			if len(resp.Results) != 3 || resp.Results[1].UserId != "missing" || resp.Results[1].Success || resp.Results[1].Message == "" {
+				t.Fatalf("results should keep request order with a failure message, got %+v", resp.Results)
+			}
+			if mr.Exists("user:missing") {
+				t.Fatal("missing users should not be created")
+			}
+
+			minExpiry := time.Now().Add(29 * 24 * time.Hour).Unix()
+			for _, userId := range []string{"u000", "u001"} {
+				var user ExternalUserInfo
+				raw, _ := mr.Get("user:" + userId)
+				if err := json.Unmarshal([]byte(raw), &user); err != nil || !user.IsVIP || user.VIPExpiresAt < minExpiry || user.Email == "" {
+					t.Fatalf("%s: expected VIP for 30 days with other fields kept, got %s", userId, raw)
+				}
+			}
+		})
+	}
+}
+
+func TestImportExternalUsers(t *testing.T) {
+	for name, setup := range externalRedisBackends {
+		t.Run(name, func(t *testing.T) {
+			mr := setup(t)
+			seedExternalUsers(t, mr, 1) // u000 已存在
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/api/external-users/import", ImportExternalUsers)
+			type importResponse struct {
+				Success bool `json:"success"`
+				Created int  `json:"created"`
+				Skipped int  `json:"skipped"`
+				Failed  int  `json:"failed"`
+				Results []struct {
+					UserId  string `json:"userId"`
+					Status  string `json:"status"`
+					Message string `json:"message"`
+				} `json:"results"`
+			}
+			doImport := func(query string, body string) importResponse {
+				req := httptest.NewRequest(http.MethodPost, "/api/external-users/import"+query, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				var resp importResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+					t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+				}
+				return resp
+			}
+
+			body := `[
+				{"id":"new1","email":"new1@example.com","username":"New One","isVip":true,"vipExpiresAt":4102444800},
+				{"id":"u000","email":"replaced@example.com"},
+				{"id":"bad","email":"not-an-email"},
+				{"id":"new2","email":"new2@example.com"}
+			]`
+			resp := doImport("", body)
+			if resp.Success || resp.Created != 2 || resp.Skipped != 1 || resp.Failed != 1 {
+				t.Fatalf("expected 2 created, 1 skipped, 1 failed, got %+v", resp)
+			}
+			if len(resp.Results) != 4 || resp.Results[1].Status != "skipped" || resp.Results[2].Status != "failed" || resp.Results[2].Message == "" {
+				t.Fatalf("results should keep request order with per-record status, got %+v", resp.Results)
+			}
+			if mr.Exists("user:bad") {
+				t.Fatal("invalid records should not be written")
+			}
+			var user ExternalUserInfo
+			raw, _ := mr.Get("user:new1")
+			if err := json.Unmarshal([]byte(raw), &user); err != nil || !user.IsVIP || user.VIPExpiresAt != 4102444800 || user.Username != "New One" {
+				t.Fatalf("imported user should keep all fields, got %s", raw)
+			}
+			if raw, _ := mr.Get("user:u000"); strings.Contains(raw, "replaced@example.com") {
+				t.Fatalf("existing user should be skipped by default, got %s", raw)
+			}
+
+			resp = doImport("?overwrite=true", body)
+			if resp.Created != 3 || resp.Skipped != 0 || resp.Failed != 1 {
+				t.Fatalf("overwrite should replace existing users, got %+v", resp)
+			}
+			if raw, _ := mr.Get("user:u000"); !strings.Contains(raw, "replaced@example.com") {
+				t.Fatalf("existing user should be overwritten, got %s", raw)
+			}
+		})
+	}
+}
+
+func TestExternalRedisTypedErrors(t *testing.T) {
+	mr := useTestUpstash(t)
+	seedExternalUsers(t, mr, 1)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/external-users/:userId", GetExternalUserDetail)
+	getDetail := func(userId string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/external-users/"+userId, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if _, err := redisGet(context.Background(), "user:missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("missing key should be ErrKeyNotFound, got %v", err)
+	}
+	if code := getDetail("missing"); code != http.StatusNotFound {
+		t.Fatalf("missing user should return 404, got %d", code)
+	}
+
+	constant.ExternalUserRedisToken = "wrong-token"
+	if _, err := redisGet(context.Background(), "user:u000"); !errors.Is(err, ErrRedisUnauthorized) {
+		t.Fatalf("401 should surface as ErrRedisUnauthorized, got %v", err)
+	}
+	if err := redisSet(context.Background(), "user:u000", "{}"); !errors.Is(err, ErrRedisUnauthorized) {
+		t.Fatalf("401 on SET should surface as ErrRedisUnauthorized, got %v", err)
+	}
+	if code := getDetail("u000"); code != http.StatusInternalServerError {
+		t.Fatalf("unauthorized should return 500, got %d", code)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	constant.ExternalUserRedisURL = closed.URL
+	if _, err := redisGet(context.Background(), "user:u000"); !errors.Is(err, ErrRedisUnavailable) {
+		t.Fatalf("network error should surface as ErrRedisUnavailable, got %v", err)
+	}
+	if code := getDetail("u000"); code != http.StatusServiceUnavailable {
+		t.Fatalf("unavailable Redis should return 503, got %d", code)
+	}
+}
+
+func TestRedisGetRetriesTransientUpstashFailure(t *testing.T) {
+	mr := useTestUpstash(t)
+	seedExternalUsers(t, mr, 1)
+	upstream := constant.ExternalUserRedisURL
+	var calls int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		proxyReq, _ := http.NewRequest(r.Method, upstream+r.URL.Path, r.Body)
+		proxyReq.Header = r.Header.Clone()
+		resp, err := http.DefaultClient.Do(proxyReq)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	defer flaky.Close()
+	constant.ExternalUserRedisURL = flaky.URL
+
+	val, err := redisGet(context.Background(), "user:u000")
+	if err != nil || !strings.Contains(val, "user000@example.com") {
+		t.Fatalf("expected success after retry, got %q %v", val, err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Fatalf("expected 2 attempts, got %d", n)
+	}
+}
+
+func TestRedisHelpersHonourRequestContext(t *testing.T) {
+	useTestUpstash(t)
+	hung := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hung:
+		}
+	}))
+	defer slow.Close()
+	defer close(hung)
+	constant.ExternalUserRedisURL = slow.URL
+
+	// 管理请求被取消 (客户端断开) 后不再等待 Upstash 响应
+	reqCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := redisGet(reqCtx, "user:u000"); err == nil {
+		t.Fatal("expected an error once the request context is done")
+	}
+	if _, _, err := scanExternalUserIds(reqCtx, "0", 10); err == nil {
+		t.Fatal("expected scan to fail once the request context is done")
+	}
+	if _, _, err := upstashPipeline(reqCtx, [][]string{{"GET", "user:u000"}}); err == nil {
+		t.Fatal("expected pipeline to fail once the request context is done")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("helpers should return when the request context ends, took %v", elapsed)
+	}
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/gin-gonic/gin"
+)
+
+// GetExternalUserAllowedModels 返回当前外部用户 (X-External-User-Token) 可调用的模型列表
+func GetExternalUserAllowedModels(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"message": "外部用户验证未启用",
+		})
+		return
+	}
+
+	token := middleware.ExternalUserToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"message": "缺少用户认证信息",
+		})
+		return
+	}
+
+	models, err := middleware.FilterExternalUserModels(token, model.GetEnabledModels())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"message": "用户认证失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    models,
+	})
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// GetExternalUserSelfStatus 外部用户查询自身配额 (凭外部用户 token，可选 channelId，为 all 时附带各渠道用量)
+// 响应带 Cache-Control 与 ETag，客户端轮询时可通过 If-None-Match 获得 304
+func GetExternalUserSelfStatus(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"message": "外部用户验证未启用",
+		})
+		return
+	}
+
+	token := middleware.ExternalUserToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"message": "缺少用户认证信息",
+		})
+		return
+	}
+
+	status, err := middleware.GetExternalUserSelfStatus(token, c.Query("channelId"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"message": "获取配额失败: " + err.Error(),
+		})
+		return
+	}
+
+	writeCachedJSON(c, constant.ExternalUserStatusMaxAgeSeconds, gin.H{
+		"success": true,
+		"data":    status,
+	})
+}
+
+// PreviewExternalUserQuota 预览携带相同 header (与请求体) 发起请求时的配额结果，不扣除配额
+func PreviewExternalUserQuota(c *gin.Context) {
+	if !middleware.IsExternalUserEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"success": false,
+			"message": "外部用户验证未启用",
+		})
+		return
+	}
+
+	token := middleware.ExternalUserToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"message": "缺少用户认证信息",
+		})
+		return
+	}
+
+	preview, err := middleware.PreviewExternalUserQuota(c, token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"message": "预览配额失败: " + err.Error(),
+		})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    preview,
+	})
+}
+
+// writeCachedJSON 输出带 ETag 与 max-age 的 JSON，If-None-Match 命中时返回 304
+// 响应因 token 而异，只允许客户端私有缓存
+func writeCachedJSON(c *gin.Context, maxAge int, payload any) {
+	body, err := common.Marshal(payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Vary", middleware.ExternalUserTokenHeader())
+	if maxAge > 0 {
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// etagMatches 判断 If-None-Match 是否包含 etag (支持多个值、弱校验与 *)
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteCachedJSONConditionalRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	payload := gin.H{"success": true, "data": gin.H{"used": 3, "total": 30}}
+	router := gin.New()
+	router.GET("/quota", func(c *gin.Context) {
+		writeCachedJSON(c, 15, payload)
+	})
+	request := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/quota", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d etag=%q", w.Code, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=15" {
+		t.Fatalf("unexpected Cache-Control %q", got)
+	}
+
+	w = request(etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("unchanged conditional request should be 304 without body, got %d (%d bytes)", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("ETag") != etag {
+		t.Fatal("304 should repeat the ETag")
+	}
+
+	// 数据变化后 ETag 随之改变
+	payload["data"] = gin.H{"used": 4, "total": 30}
+	w = request(etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("changed data should return 200 with a new ETag, got %d", w.Code)
+	}
+}
+
+// signExternalUserToken 使用测试密钥 (见 useTestExternalRedis) 签发外部用户 token
+func signExternalUserToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte("test-secret"))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestGetExternalUserSelfStatus(t *testing.T) {
+	mr := useTestExternalRedis(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/external-user/quota", GetExternalUserSelfStatus)
+	period := middleware.CurrentQuotaPeriodKey(0)
+	seed := func(key string, value any) {
+		data, _ := json.Marshal(value)
+		if err := mr.Set(key, string(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seed("user:u1", map[string]any{"id": "u1"})
+	seed("quota:u1", map[string]any{"usedCount": 12, "monthKey": period})
+	seed("quota:u1:channel:ch-a", map[string]any{"usedCount": 4, "monthKey": period})
+	seed("user:vip1", map[string]any{"id": "vip1", "isVip": true, "vipExpiresAt": time.Now().Add(time.Hour).Unix()})
+	seed("quota:vip1", map[string]any{"usedCount": 50, "monthKey": period})
+
+	query := func(token string, channelId string) (int, middleware.ExternalUserSelfStatus) {
+		req := httptest.NewRequest(http.MethodGet, "/api/external-user/quota?channelId="+channelId, nil)
+		req.Header.Set(middleware.ExternalUserTokenHeader(), token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp struct {
+			Data middleware.ExternalUserSelfStatus `json:"data"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data
+	}
+
+	token := signExternalUserToken(map[string]interface{}{"userId": "u1"})
+	if code, status := query(token, ""); code != http.StatusOK || status.IsVIP || status.Used != 12 || status.Total != 30 || status.Remaining != 18 {
+		t.Fatalf("normal user: unexpected %d %+v", code, status)
+	}
+	if code, status := query(token, "ch-a"); code != http.StatusOK || status.Used != 4 || status.Remaining != 26 {
+		t.Fatalf("channel quota: unexpected %d %+v", code, status)
+	}
+	code, status := query(token, middleware.AllChannels)
+	if code != http.StatusOK || status.Used != 12 || len(status.Channels) != 1 || status.Channels[0].ChannelId != "ch-a" || status.Channels[0].UsedCount != 4 {
+		t.Fatalf("all channels: unexpected %d %+v", code, status)
+	}
+
+	vipToken := signExternalUserToken(map[string]interface{}{"userId": "vip1"})
+	if code, status := query(vipToken, ""); code != http.StatusOK || !status.IsVIP || status.Total != -1 || status.Remaining != -1 {
+		t.Fatalf("vip: unexpected %d %+v", code, status)
+	}
+
+	if code, _ := query(token+"x", ""); code != http.StatusUnauthorized {
+		t.Fatalf("invalid token should be rejected, got %d", code)
+	}
+}
@@ -3,9 +3,9 @@ package controller
 import (
 	"net/http"
 	"os"
-	"strings"
 
 	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/middleware"
 	"github.com/gin-gonic/gin"
 )
 
@@ -14,6 +14,9 @@ type ExternalUserAuthStatus struct {
 	Enabled           bool   `json:"enabled"`
 	RedisConfigured   bool   `json:"redisConfigured"`
 	RedisType         string `json:"redisType"` // "local" 或 "upstash"
+	RedisReachable    bool   `json:"redisReachable"`
+	RedisLatencyMs    int64  `json:"redisLatencyMs"`
+	RedisError        string `json:"redisError,omitempty"`
 	JWTConfigured     bool   `json:"jwtConfigured"`
 	MonthlyQuota      int    `json:"monthlyQuota"`
 	DisabledReason    string `json:"disabledReason,omitempty"`
@@ -36,9 +39,9 @@ func GetExternalUserAuthStatus(c *gin.Context) {
 	status.DiagRedisTokenSet = constant.ExternalUserRedisToken != ""
 	
 	// 判断 Redis 类型和配置状态
-	// 本地 Redis (redis:// 开头) 不需要 Token
+	// 本地 Redis (redis:// 或 rediss:// 开头) 不需要 Token
 	// Upstash REST API 需要 URL 和 Token
-	isLocalRedis := strings.HasPrefix(constant.ExternalUserRedisURL, "redis://")
+	isLocalRedis := middleware.IsLocalRedisURL(constant.ExternalUserRedisURL)
 	if isLocalRedis {
 		status.RedisType = "local"
 		status.RedisConfigured = constant.ExternalUserRedisURL != ""
@@ -47,7 +50,7 @@ func GetExternalUserAuthStatus(c *gin.Context) {
 		status.RedisConfigured = constant.ExternalUserRedisURL != "" && constant.ExternalUserRedisToken != ""
 	}
 	
-	// 检查 JWT 配置 (可选，用于未来的签名验证)
+	// 检查 JWT 配置 (用于 token 签名验证，未配置时默认拒绝所有 token)
 	status.JWTConfigured = constant.ExternalUserJWTSecret != ""
 	status.DiagJWTSecretSet = constant.ExternalUserJWTSecret != ""
 	
@@ -68,6 +71,14 @@ func GetExternalUserAuthStatus(c *gin.Context) {
 	// 使用 constant 包中的状态变量
 	status.Enabled = constant.ExternalUserAuthEnabled
 
+	// 实际探测 Redis 连通性 (结果短暂缓存)
+	if status.Enabled {
+		health := middleware.ProbeExternalRedis()
+		status.RedisReachable = health.Reachable
+		status.RedisLatencyMs = health.LatencyMs
+		status.RedisError = health.Error
+	}
+
 	// 设置禁用原因
 	if !status.Enabled {
 		if !status.DiagRedisURLSet {
@@ -89,10 +100,13 @@ func GetExternalUserAuthStatus(c *gin.Context) {
 // getStatusMessage 根据状态生成诊断消息
 func getStatusMessage(status ExternalUserAuthStatus) string {
 	if status.Enabled {
+		if !status.RedisReachable {
+			return "外部用户验证已启用，但 Redis 当前无法连接: " + status.RedisError
+		}
 		if status.JWTConfigured {
 			return "外部用户验证已启用，配置完整"
 		}
-		return "外部用户验证已启用，但 JWT_SECRET 未配置 (可选)"
+		return "外部用户验证已启用，但 JWT_SECRET 未配置，token 签名无法验证"
 	}
 	return "外部用户验证未启用，请检查 Redis 配置"
 }
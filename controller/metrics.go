@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/gin-gonic/gin"
+)
+
+// GetMetrics 输出 Prometheus 指标 (METRICS_ENABLED 开启时注册)
+// 配置了 METRICS_TOKEN 时需携带 Authorization: Bearer <token>
+func GetMetrics(c *gin.Context) {
+	if constant.MetricsToken != "" {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(constant.MetricsToken)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"message": "无权访问指标接口",
+			})
+			return
+		}
+	}
+	common.MetricsHandler().ServeHTTP(c.Writer, c.Request)
+}
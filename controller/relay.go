@@ -297,6 +297,9 @@ func getChannel(c *gin.Context, info *relaycommon.RelayInfo, retryParam *service
 	if newAPIError != nil {
 		return nil, newAPIError
 	}
+	if newAPIError := middleware.ConsumeChannelRateLimit(c); newAPIError != nil {
+		return nil, newAPIError
+	}
 	return channel, nil
 }
 
@@ -1,5 +1,7 @@
 package dto
 
+import "fmt"
+
 type ChannelSettings struct {
 	ForceFormat            bool   `json:"force_format,omitempty"`
 	ThinkingToContent      bool   `json:"thinking_to_content,omitempty"`
@@ -8,9 +10,87 @@ type ChannelSettings struct {
 	SystemPrompt           string `json:"system_prompt,omitempty"`
 	SystemPromptOverride   bool   `json:"system_prompt_override,omitempty"`
 	// 渠道级别速率限制
-	RateLimitRPM           int    `json:"rate_limit_rpm,omitempty"`           // 每分钟请求数限制，0 表示不限制
-	RateLimitRPD           int    `json:"rate_limit_rpd,omitempty"`           // 每天请求数限制，0 表示不限制
-	RateLimitEnabled       bool   `json:"rate_limit_enabled,omitempty"`       // 是否启用速率限制
+	RateLimitRPM           int  `json:"rate_limit_rpm,omitempty"`            // 每分钟请求数限制，0 表示不限制
+	RateLimitRPD           int  `json:"rate_limit_rpd,omitempty"`            // 每天请求数限制，0 表示不限制
+	RateLimitRPH           int  `json:"rate_limit_rph,omitempty"`            // 每小时请求数限制，0 表示不限制
+	RateLimitEnabled       bool `json:"rate_limit_enabled,omitempty"`        // 是否启用速率限制
+	RateLimitWindowSeconds int  `json:"rate_limit_window_seconds,omitempty"` // RPM 统计窗口 (秒)，0 表示默认 60 秒
+	RateLimitLeakyBucket   bool `json:"rate_limit_leaky_bucket,omitempty"`   // 使用漏桶限流代替固定窗口 RPM
+	RateLimitBucketSize    int  `json:"rate_limit_bucket_size,omitempty"`    // 漏桶容量 (允许的突发请求数)，0 表示等于 RPM
+	RateLimitLeakRate      int  `json:"rate_limit_leak_rate,omitempty"`      // 每分钟漏出的请求数，0 表示等于 RPM
+	RateLimitTokenBucket   bool `json:"rate_limit_token_bucket,omitempty"`   // 使用令牌桶限流代替固定窗口 RPM (按 RPM 匀速补充令牌)
+	RateLimitBurstSize     int  `json:"rate_limit_burst_size,omitempty"`     // 令牌桶容量 (允许的突发请求数)，0 表示等于 RPM
+	MaxConcurrency         int  `json:"max_concurrency,omitempty"`           // 每个 key 同时进行中的请求数上限，0 表示不限制
+
+	// 按模型覆盖 RPM / RPD，覆盖的模型单独计数，其他模型使用渠道整体限制
+	RateLimitModels map[string]ChannelModelRateLimit `json:"rate_limit_models,omitempty"`
+
+	// 按模型设置请求权重，一次请求计为权重数量的请求 (如长上下文模型计为 5 次)，未设置的模型计为 1 次
+	RateLimitModelWeights map[string]int `json:"rate_limit_model_weights,omitempty"`
+}
+
+// ChannelModelRateLimit 渠道内单个模型的速率限制
+type ChannelModelRateLimit struct {
+	RPM int `json:"rpm"` // 每分钟请求数限制，0 表示不限制
+	RPD int `json:"rpd"` // 每天请求数限制，0 表示不限制
+}
+
+// ChannelRateLimitMaxValue 渠道速率限制各项数值的上限，超出时视为误填
+const (
+	ChannelRateLimitMaxValue         = 10000000
+	ChannelRateLimitMaxWindowSeconds = 86400
+)
+
+// ValidateRateLimit 校验速率限制设置: 数值不能为负或超过上限，同时设置时需满足 RPM <= RPH <= RPD
+func (s ChannelSettings) ValidateRateLimit() error {
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"rate_limit_rpm", s.RateLimitRPM},
+		{"rate_limit_rph", s.RateLimitRPH},
+		{"rate_limit_rpd", s.RateLimitRPD},
+		{"rate_limit_bucket_size", s.RateLimitBucketSize},
+		{"rate_limit_leak_rate", s.RateLimitLeakRate},
+		{"rate_limit_burst_size", s.RateLimitBurstSize},
+		{"max_concurrency", s.MaxConcurrency},
+	} {
+		if field.value < 0 || field.value > ChannelRateLimitMaxValue {
+			return fmt.Errorf("%s 必须在 0-%d 之间，当前为 %d", field.name, ChannelRateLimitMaxValue, field.value)
+		}
+	}
+	if s.RateLimitWindowSeconds < 0 || s.RateLimitWindowSeconds > ChannelRateLimitMaxWindowSeconds {
+		return fmt.Errorf("rate_limit_window_seconds 必须在 0-%d 之间，当前为 %d", ChannelRateLimitMaxWindowSeconds, s.RateLimitWindowSeconds)
+	}
+	if s.RateLimitRPM > 0 && s.RateLimitRPH > 0 && s.RateLimitRPH < s.RateLimitRPM {
+		return fmt.Errorf("每小时限制 (%d) 不能小于每分钟限制 (%d)", s.RateLimitRPH, s.RateLimitRPM)
+	}
+	if s.RateLimitRPH > 0 && s.RateLimitRPD > 0 && s.RateLimitRPD < s.RateLimitRPH {
+		return fmt.Errorf("每天限制 (%d) 不能小于每小时限制 (%d)", s.RateLimitRPD, s.RateLimitRPH)
+	}
+	if s.RateLimitRPM > 0 && s.RateLimitRPD > 0 && s.RateLimitRPD < s.RateLimitRPM {
+		return fmt.Errorf("每天限制 (%d) 不能小于每分钟限制 (%d)", s.RateLimitRPD, s.RateLimitRPM)
+	}
+	for model, limit := range s.RateLimitModels {
+		if model == "" {
+			return fmt.Errorf("rate_limit_models 中的模型名称不能为空")
+		}
+		if limit.RPM < 0 || limit.RPM > ChannelRateLimitMaxValue || limit.RPD < 0 || limit.RPD > ChannelRateLimitMaxValue {
+			return fmt.Errorf("模型 %s 的限制必须在 0-%d 之间", model, ChannelRateLimitMaxValue)
+		}
+		if limit.RPM > 0 && limit.RPD > 0 && limit.RPD < limit.RPM {
+			return fmt.Errorf("模型 %s 的每天限制 (%d) 不能小于每分钟限制 (%d)", model, limit.RPD, limit.RPM)
+		}
+	}
+	for model, weight := range s.RateLimitModelWeights {
+		if model == "" {
+			return fmt.Errorf("rate_limit_model_weights 中的模型名称不能为空")
+		}
+		if weight < 1 || weight > ChannelRateLimitMaxValue {
+			return fmt.Errorf("模型 %s 的请求权重必须在 1-%d 之间，当前为 %d", model, ChannelRateLimitMaxValue, weight)
+		}
+	}
+	return nil
 }
 
 type VertexKeyType string
@@ -102,6 +102,11 @@ func main() {
 
 	go controller.AutomaticallyTestChannels()
 
+	service.StartChannelRateLimitSnapshot(constant.ChannelRateLimitSnapshotPath,
+		time.Duration(constant.ChannelRateLimitSnapshotIntervalSeconds)*time.Second)
+	service.StartChannelRateLimitJanitor(time.Duration(constant.ChannelRateLimitSweepIntervalSeconds) * time.Second)
+	middleware.StartQuotaResetJob(time.Duration(constant.ExternalUserQuotaResetSeconds) * time.Second)
+
 	if common.IsMasterNode && constant.UpdateTask {
 		gopool.Go(func() {
 			controller.UpdateMidjourneyTaskBulk()
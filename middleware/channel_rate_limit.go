@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// channelRateLimitReasonHeader 渠道速率限制拒绝原因的响应头
+const channelRateLimitReasonHeader = "X-Channel-RateLimit-Reason"
+
+// ConsumeChannelRateLimit 对 context 中已选定的渠道 (及多 key 模式下的 key) 检查并计入一次速率限制，并占用一个并发名额
+// 未选定渠道或渠道未启用速率限制 (且未继承全局默认限制) 时直接放行；超限时设置 X-Channel-RateLimit-Reason 与 Retry-After 响应头并返回错误
+// 重试切换渠道时先释放上一次尝试占用的并发名额
+func ConsumeChannelRateLimit(c *gin.Context) *types.NewAPIError {
+	ReleaseChannelSlot(c)
+
+	channelId := common.GetContextKeyInt(c, constant.ContextKeyChannelId)
+	if channelId == 0 {
+		return nil
+	}
+	setting, ok := common.GetContextKeyType[dto.ChannelSettings](c, constant.ContextKeyChannelSetting)
+	if !ok {
+		return nil
+	}
+	setting, _ = service.EffectiveChannelRateLimitSetting(setting)
+	if !setting.RateLimitEnabled {
+		return nil
+	}
+	keyIndex := 0
+	if common.GetContextKeyBool(c, constant.ContextKeyChannelIsMultiKey) {
+		keyIndex = common.GetContextKeyInt(c, constant.ContextKeyChannelMultiKeyIndex)
+	}
+
+	if setting.MaxConcurrency > 0 {
+		if !service.AcquireChannelSlot(channelId, keyIndex, setting.MaxConcurrency) {
+			errMsg := fmt.Sprintf("渠道 %d (key %d) 同时进行中的请求已达上限 (%d)", channelId, keyIndex, setting.MaxConcurrency)
+			c.Header(channelRateLimitReasonHeader, errMsg)
+			return types.NewError(errors.New(errMsg), types.ErrorCodeRateLimitExceeded)
+		}
+		common.SetContextKey(c, constant.ContextKeyChannelSlotRelease, func() {
+			service.ReleaseChannelSlot(channelId, keyIndex)
+		})
+	}
+	// 检查并计数（在请求开始时计数，检查与计数在同一次原子操作中完成）
+	// 渠道为请求的模型配置了覆盖限制时按模型单独计数
+	rpmLimit, rpdLimit, opts := service.ChannelRateLimitForModel(setting, common.GetContextKeyString(c, constant.ContextKeyOriginalModel))
+	allowed, errMsg, retryAfter := service.AcquireChannelRateLimit(channelId, keyIndex, rpmLimit, rpdLimit, opts...)
+	if !allowed {
+		ReleaseChannelSlot(c)
+		c.Header(channelRateLimitReasonHeader, errMsg)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		return types.NewError(errors.New(errMsg), types.ErrorCodeRateLimitExceeded)
+	}
+	return nil
+}
+
+// ReleaseChannelSlot 释放当前请求占用的渠道 key 并发名额 (未占用时不做任何处理)
+func ReleaseChannelSlot(c *gin.Context) {
+	release, ok := common.GetContextKeyType[func()](c, constant.ContextKeyChannelSlotRelease)
+	if !ok || release == nil {
+		return
+	}
+	common.SetContextKey(c, constant.ContextKeyChannelSlotRelease, nil)
+	release()
+}
+
+// ChannelRateLimit 渠道级别速率限制中间件，需放在 Distribute 之后
+// 请求结束 (包括客户端中途断开) 时释放占用的并发名额
+func ChannelRateLimit() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		defer ReleaseChannelSlot(c)
+		if newAPIError := ConsumeChannelRateLimit(c); newAPIError != nil {
+			abortWithOpenAiMessage(c, http.StatusTooManyRequests, newAPIError.Error(), string(types.ErrorCodeRateLimitExceeded))
+			return
+		}
+		c.Next()
+	}
+}
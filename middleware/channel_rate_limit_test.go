@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/gin-gonic/gin"
+)
+
+// newChannelRateLimitRouter 模拟 Distribute 选定渠道 (key 索引取自 X-Test-Key-Index) 后经过 ChannelRateLimit
+// block 不为 nil 时处理函数会等待其关闭，用于模拟进行中的请求
+func newChannelRateLimitRouter(channelId int, multiKey bool, setting dto.ChannelSettings, block chan struct{}) *gin.Engine {
+	r := gin.New()
+	stubChannel := func(c *gin.Context) {
+		common.SetContextKey(c, constant.ContextKeyChannelId, channelId)
+		common.SetContextKey(c, constant.ContextKeyChannelSetting, setting)
+		common.SetContextKey(c, constant.ContextKeyChannelIsMultiKey, multiKey)
+		if multiKey {
+			index, _ := strconv.Atoi(c.GetHeader("X-Test-Key-Index"))
+			common.SetContextKey(c, constant.ContextKeyChannelMultiKeyIndex, index)
+		}
+		c.Next()
+	}
+	r.POST("/v1/chat/completions", stubChannel, ChannelRateLimit(), func(c *gin.Context) {
+		if block != nil {
+			<-block
+		}
+		c.String(http.StatusOK, "ok")
+	})
+	return r
+}
+
+func doChannelRequest(r *gin.Engine, keyIndex int) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Header.Set("X-Test-Key-Index", strconv.Itoa(keyIndex))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestChannelRateLimitMiddleware(t *testing.T) {
+	setting := dto.ChannelSettings{RateLimitEnabled: true, RateLimitRPM: 2}
+
+	t.Run("single key", func(t *testing.T) {
+		const channelId = 97701
+		defer service.ResetChannelRateLimit(channelId, 0)
+		r := newChannelRateLimitRouter(channelId, false, setting, nil)
+		for i := 0; i < 2; i++ {
+			if w := doChannelRequest(r, 5); w.Code != http.StatusOK {
+				t.Fatalf("request %d should pass, got %d: %s", i, w.Code, w.Body.String())
+			}
+		}
+		w := doChannelRequest(r, 5)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Channel-RateLimit-Reason") == "" {
+			t.Fatalf("expected 429 with reason header, got %d %v", w.Code, w.Header())
+		}
+		if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 1 || retryAfter > 60 {
+			t.Fatalf("Retry-After should point at the end of the current minute, got %q", w.Header().Get("Retry-After"))
+		}
+		if info := service.GetChannelRateLimitInfo(channelId, 0, 2, 0); info.RPMCount != 2 {
+			t.Fatalf("rejected request should not be counted, got %+v", info)
+		}
+	})
+
+	t.Run("multi key", func(t *testing.T) {
+		const channelId = 97702
+		defer service.ResetChannelRateLimit(channelId, 0)
+		defer service.ResetChannelRateLimit(channelId, 1)
+		r := newChannelRateLimitRouter(channelId, true, setting, nil)
+		for i := 0; i < 2; i++ {
+			if w := doChannelRequest(r, 0); w.Code != http.StatusOK {
+				t.Fatalf("key 0 request %d should pass, got %d", i, w.Code)
+			}
+		}
+		if w := doChannelRequest(r, 0); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("key 0 should be limited, got %d", w.Code)
+		}
+		// 每个 key 单独计数
+		if w := doChannelRequest(r, 1); w.Code != http.StatusOK {
+			t.Fatalf("key 1 should still have room, got %d", w.Code)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		const channelId = 97703
+		defer service.ResetChannelRateLimit(channelId, 0)
+		r := newChannelRateLimitRouter(channelId, false, dto.ChannelSettings{RateLimitRPM: 1}, nil)
+		for i := 0; i < 3; i++ {
+			if w := doChannelRequest(r, 0); w.Code != http.StatusOK {
+				t.Fatalf("rate limit disabled, request %d should pass, got %d", i, w.Code)
+			}
+		}
+	})
+}
+
+func TestChannelRateLimitMiddlewareConcurrency(t *testing.T) {
+	const channelId = 97704
+	defer service.ResetChannelRateLimit(channelId, 0)
+	block := make(chan struct{})
+	r := newChannelRateLimitRouter(channelId, false, dto.ChannelSettings{RateLimitEnabled: true, MaxConcurrency: 1}, block)
+
+	done := make(chan int)
+	go func() { done <- doChannelRequest(r, 0).Code }()
+	deadline := time.Now().Add(time.Second)
+	for service.GetChannelConcurrency(channelId, 0) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("first request should hold a slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := doChannelRequest(r, 0)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Channel-RateLimit-Reason") == "" {
+		t.Fatalf("second concurrent request should be rejected, got %d", w.Code)
+	}
+
+	close(block)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("first request should succeed, got %d", code)
+	}
+	if got := service.GetChannelConcurrency(channelId, 0); got != 0 {
+		t.Fatalf("slot should be released after the request finishes, got %d", got)
+	}
+	if w := doChannelRequest(r, 0); w.Code != http.StatusOK {
+		t.Fatalf("request after release should pass, got %d", w.Code)
+	}
+}
+
+func TestChannelRateLimitGlobalDefault(t *testing.T) {
+	prevEnabled, prevRPM := constant.ChannelRateLimitDefaultEnabled, constant.ChannelRateLimitDefaultRPM
+	constant.ChannelRateLimitDefaultEnabled, constant.ChannelRateLimitDefaultRPM = true, 1
+	defer func() {
+		constant.ChannelRateLimitDefaultEnabled, constant.ChannelRateLimitDefaultRPM = prevEnabled, prevRPM
+	}()
+
+	// 未启用速率限制的渠道使用全局默认 RPM
+	const inheritedId = 97711
+	defer service.ResetChannelRateLimit(inheritedId, 0)
+	r := newChannelRateLimitRouter(inheritedId, false, dto.ChannelSettings{}, nil)
+	if w := doChannelRequest(r, 0); w.Code != http.StatusOK {
+		t.Fatalf("first request should pass, got %d", w.Code)
+	}
+	if w := doChannelRequest(r, 0); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("global default should limit the channel, got %d", w.Code)
+	}
+
+	// 渠道自己的设置优先
+	const overriddenId = 97712
+	defer service.ResetChannelRateLimit(overriddenId, 0)
+	r = newChannelRateLimitRouter(overriddenId, false, dto.ChannelSettings{RateLimitEnabled: true, RateLimitRPM: 3}, nil)
+	for i := 0; i < 3; i++ {
+		if w := doChannelRequest(r, 0); w.Code != http.StatusOK {
+			t.Fatalf("request %d should pass under the channel's own limit, got %d", i, w.Code)
+		}
+	}
+}
@@ -1,24 +1,111 @@
 package middleware
 
 import (
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 func CORS() gin.HandlerFunc {
+	return cors.New(corsConfig(constant.CORSAllowedOrigins, constant.CORSAllowCredentials, constant.CORSExposeHeaders))
+}
+
+// corsConfig 根据来源白名单 (ALLOWED_ORIGINS)、凭据开关 (CORS_ALLOW_CREDENTIALS) 与额外暴露的响应头 (CORS_EXPOSE_HEADERS) 生成跨域配置
+//   - 白名单为空 (或包含 *) 且不允许凭据: 允许任意来源，响应 Access-Control-Allow-Origin: *
+//   - 允许凭据: 只回显白名单中的来源，其他来源的跨域请求返回 403；* 与凭据不能同时使用，会被忽略
+//   - 允许凭据但白名单为空: 不允许任何跨域来源 (同源请求不受影响)
+func corsConfig(allowedOrigins string, allowCredentials bool, extraExposeHeaders string) cors.Config {
 	config := cors.DefaultConfig()
-	config.AllowAllOrigins = true
-	config.AllowCredentials = true
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"*"}
-	// 暴露自定义响应头，让前端可以读取配额信息
-	config.ExposeHeaders = []string{
-		"X-Quota-Status",
-		"X-Quota-Used",
-		"X-Quota-Total",
-		"X-Quota-Remaining",
-		"X-Quota-Reason",
-		"X-Channel-Id",
+	config.ExposeHeaders = mergeExposeHeaders(corsExposeHeaders, extraExposeHeaders)
+
+	origins, allowAll := parseAllowedOrigins(allowedOrigins)
+	if allowAll && allowCredentials {
+		common.SysError("CORS: ALLOWED_ORIGINS 中的 * 不能与 CORS_ALLOW_CREDENTIALS 同时使用，已忽略")
 	}
-	return cors.New(config)
+	switch {
+	case allowCredentials && len(origins) == 0:
+		common.SysError("CORS: 已开启 CORS_ALLOW_CREDENTIALS 但未配置 ALLOWED_ORIGINS，不允许任何跨域来源")
+		config.AllowCredentials = true
+		config.AllowOriginFunc = func(string) bool { return false }
+	case allowCredentials:
+		config.AllowCredentials = true
+		config.AllowOrigins = origins
+		config.AllowWildcard = true
+	case allowAll || len(origins) == 0:
+		config.AllowAllOrigins = true
+	default:
+		config.AllowOrigins = origins
+		config.AllowWildcard = true
+	}
+	return config
+}
+
+// parseAllowedOrigins 解析逗号分隔的来源列表，返回有效来源与是否包含 *
+// 来源需带协议 (如 https://app.example.com)，可包含一个通配符 (如 https://*.example.com)；无效的来源会被忽略。
+func parseAllowedOrigins(raw string) ([]string, bool) {
+	var origins []string
+	allowAll := false
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		switch {
+		case origin == "":
+		case origin == "*":
+			allowAll = true
+		case !strings.Contains(origin, "://") || strings.Count(origin, "*") > 1:
+			common.SysError("CORS: 忽略无效的来源: " + origin)
+		default:
+			origins = append(origins, origin)
+		}
+	}
+	return origins, allowAll
+}
+
+// mergeExposeHeaders 在内置响应头之后追加逗号分隔的额外响应头，按名称去重 (不区分大小写)
+func mergeExposeHeaders(defaults []string, extra string) []string {
+	merged := make([]string, 0, len(defaults))
+	seen := make(map[string]bool, len(defaults))
+	for _, header := range append(append([]string{}, defaults...), strings.Split(extra, ",")...) {
+		header = strings.TrimSpace(header)
+		key := http.CanonicalHeaderKey(header)
+		if header == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, header)
+	}
+	return merged
+}
+
+// corsExposeHeaders 暴露自定义响应头，让前端可以读取配额信息
+var corsExposeHeaders = []string{
+	"X-Quota-Status",
+	"X-Quota-Used",
+	"X-Quota-Total",
+	"X-Quota-Remaining",
+	"X-Quota-Reason",
+	"X-Quota-Reset",
+	"X-Quota-Percent-Used",
+	"X-Quota-Degraded",
+	"X-Quota-Limit-Source",
+	"X-Quota-Rollover",
+	"X-Quota-Model",
+	"X-Quota-Exceeded-Action",
+	"X-Quota-Downgraded-Model",
+	"X-Quota-Warning",
+	"X-Quota-Token-Used",
+	"X-Quota-Token-Total",
+	"X-Quota-Daily-Used",
+	"X-Quota-Daily-Remaining",
+	"X-VIP-Grace-Until",
+	"Retry-After",
+	"X-Channel-RateLimit-Reason",
+	"X-Channel-Id",
+	"X-Channel-Name",
+	"ETag",
 }
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// doCORSRequest 使用指定跨域配置发送一次带 Origin 的请求
+func doCORSRequest(t *testing.T, allowedOrigins string, allowCredentials bool, origin string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := gin.New()
+	r.Use(cors.New(corsConfig(allowedOrigins, allowCredentials, "")))
+	r.GET("/api/status", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	req.Header.Set("Origin", origin)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	const allowlist = "https://app.example.com, https://*.partner.example.com/"
+	for _, tc := range []struct {
+		name        string
+		origin      string
+		wantCode    int
+		wantAllowed string
+	}{
+		{"exact", "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"wildcard", "https://eu.partner.example.com", http.StatusOK, "https://eu.partner.example.com"},
+		{"disallowed", "https://evil.example.net", http.StatusForbidden, ""},
+	} {
+		w := doCORSRequest(t, allowlist, true, tc.origin)
+		if w.Code != tc.wantCode || w.Header().Get("Access-Control-Allow-Origin") != tc.wantAllowed {
+			t.Fatalf("%s: got %d allow-origin=%q", tc.name, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if tc.wantAllowed != "" && w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Fatalf("%s: allowed origin should be allowed to send credentials", tc.name)
+		}
+	}
+}
+
+func TestCORSWildcardWithCredentials(t *testing.T) {
+	// 不允许凭据时 * 与空白名单都允许任意来源
+	for _, allowlist := range []string{"", "*"} {
+		w := doCORSRequest(t, allowlist, false, "https://any.example.org")
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Fatalf("allowlist %q: expected permissive response, got %d allow-origin=%q", allowlist, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Fatalf("allowlist %q: wildcard response must not allow credentials", allowlist)
+		}
+	}
+
+	// 允许凭据时忽略 *，只回显白名单中的来源
+	if w := doCORSRequest(t, "*,https://app.example.com", true, "https://any.example.org"); w.Code != http.StatusForbidden {
+		t.Fatalf("* should not allow arbitrary origins with credentials, got %d", w.Code)
+	}
+	if w := doCORSRequest(t, "*,https://app.example.com", true, "https://app.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("listed origin should be echoed, got %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if w := doCORSRequest(t, "", true, "https://app.example.com"); w.Code != http.StatusForbidden {
+		t.Fatalf("credentials without an allowlist should reject cross-origin requests, got %d", w.Code)
+	}
+}
+
+func TestCORSExtraExposeHeaders(t *testing.T) {
+	r := gin.New()
+	r.Use(cors.New(corsConfig("", false, " X-Request-Cost, x-quota-status,X-Request-Cost,")))
+	r.GET("/api/status", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	exposed := strings.Split(w.Header().Get("Access-Control-Expose-Headers"), ",")
+	counts := map[string]int{}
+	for _, header := range exposed {
+		counts[http.CanonicalHeaderKey(strings.TrimSpace(header))]++
+	}
+	if counts["X-Request-Cost"] != 1 {
+		t.Fatalf("configured header should be exposed once, got %q", exposed)
+	}
+	if counts["X-Quota-Status"] != 1 || counts["Etag"] != 1 {
+		t.Fatalf("default headers should be kept without duplicates, got %q", exposed)
+	}
+}
@@ -335,16 +335,7 @@ func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, mode
 		common.SetContextKey(c, constant.ContextKeyChannelIsMultiKey, false)
 	}
 
-	// 渠道级别速率限制检查
-	channelSetting := channel.GetSetting()
-	if channelSetting.RateLimitEnabled {
-		allowed, errMsg := service.CheckChannelRateLimit(channel.Id, index, channelSetting.RateLimitRPM, channelSetting.RateLimitRPD)
-		if !allowed {
-			return types.NewError(errors.New(errMsg), types.ErrorCodeRateLimitExceeded)
-		}
-		// 增加计数（在请求开始时计数）
-		service.IncrementChannelRateLimit(channel.Id, index, channelSetting.RateLimitRPM, channelSetting.RateLimitRPD)
-	}
+	// 渠道级别速率限制由 ChannelRateLimit 中间件 (首次选择) 与重试时的 ConsumeChannelRateLimit 负责
 	// c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", key))
 	common.SetContextKey(c, constant.ContextKeyChannelKey, key)
 	common.SetContextKey(c, constant.ContextKeyChannelBaseUrl, channel.GetBaseURL())
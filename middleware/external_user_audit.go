@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 外部用户审计日志
+// 记录写入 Redis Stream (audit:external)，消息 ID 由写入时间 (毫秒) 生成，可直接按时间范围读取；
+// 通过 MAXLEN 近似裁剪保留最近的记录。写入为尽力而为，失败只记录日志，不影响请求。
+// 每条记录同时写入按用户划分的 Stream (audit:external:user:<userId>，userId 与记录中一致，已脱敏)，
+// 只保留每个用户最近的记录，用于管理端按用户分页查看，无需遍历全量日志。
+const (
+	auditStreamKey     = "audit:external"
+	auditStreamMaxLen  = 100000
+	auditExportPageLen = 200
+
+	auditUserStreamPrefix = "audit:external:user:"
+	auditUserStreamMaxLen = 1000
+)
+
+// AuditEntry 审计记录
+type AuditEntry struct {
+	Timestamp  int64  `json:"timestamp"` // 请求时间 (Unix 秒)
+	UserId     string `json:"userId"`
+	Email      string `json:"email,omitempty"`
+	ChannelId  string `json:"channelId,omitempty"`
+	Allowed    bool   `json:"allowed"`
+	Reason     string `json:"reason,omitempty"` // 拒绝原因
+	QuotaUsed  int    `json:"quotaUsed"`        // 本次请求后的已用次数
+	QuotaTotal int    `json:"quotaTotal"`
+}
+
+// AuditFilter 审计日志过滤条件 (时间范围为 Unix 秒，0 表示不限制)
+type AuditFilter struct {
+	Start  int64
+	End    int64
+	UserId string
+}
+
+// appendAuditEntry 写入一条审计记录
+func appendAuditEntry(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := externalRedisDo("XADD", auditStreamKey, "MAXLEN", "~", auditStreamMaxLen, "*", "data", string(data)); err != nil {
+		return err
+	}
+	if entry.UserId == "" {
+		return nil
+	}
+	_, err = externalRedisDo("XADD", auditUserStreamPrefix+entry.UserId, "MAXLEN", "~", auditUserStreamMaxLen, "*", "data", string(data))
+	return err
+}
+
+// pendingAuditWrites 进行中的异步审计写入
+var pendingAuditWrites sync.WaitGroup
+
+// recordAuditEntry 异步写入审计记录，不阻塞请求
+func recordAuditEntry(entry AuditEntry) {
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().Unix()
+	}
+	entry.UserId = common.HashPII(entry.UserId)
+	entry.Email = common.HashPII(entry.Email)
+	pendingAuditWrites.Add(1)
+	go func() {
+		defer pendingAuditWrites.Done()
+		if err := appendAuditEntry(entry); err != nil {
+			externalUserWarn(ctx, "写入审计日志失败", "user", common.HashPII(entry.UserId), "error", err)
+		}
+	}()
+}
+
+// nextStreamId 返回紧随 id 之后的 Stream ID (用于分页)
+func nextStreamId(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+	seq, _ := strconv.ParseUint(parts[1], 10, 64)
+	return parts[0] + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+// prevStreamId 返回紧邻 id 之前的 Stream ID (用于倒序分页)
+func prevStreamId(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return id
+	}
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	seq, _ := strconv.ParseUint(parts[1], 10, 64)
+	if seq > 0 {
+		return parts[0] + "-" + strconv.FormatUint(seq-1, 10)
+	}
+	if ms == 0 {
+		return "0-0"
+	}
+	return strconv.FormatUint(ms-1, 10) + "-" + strconv.FormatUint(^uint64(0), 10)
+}
+
+// readAuditPage 读取 [start, end] 范围内最多 count 条消息，返回解析出的记录、消息数与最后一条的 ID
+func readAuditPage(start, end string, count int) ([]AuditEntry, int, string, error) {
+	val, err := externalRedisDo("XRANGE", auditStreamKey, start, end, "COUNT", count)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	entries, n, lastId := parseAuditMessages(val)
+	return entries, n, lastId, nil
+}
+
+// GetUserAuditLog 按时间倒序分页读取用户最近的审计记录
+// cursor 为上一页返回的 nextCursor (首页传空)；nextCursor 为空表示没有更多记录。
+func GetUserAuditLog(userId string, cursor string, pageSize int) ([]AuditEntry, string, error) {
+	end := "+"
+	if cursor != "" {
+		end = prevStreamId(cursor)
+	}
+	val, err := externalRedisDo("XREVRANGE", auditUserStreamPrefix+common.HashPII(userId), end, "-", "COUNT", pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	entries, n, lastId := parseAuditMessages(val)
+	if n < pageSize {
+		lastId = ""
+	}
+	return entries, lastId, nil
+}
+
+// parseAuditMessages 解析 XRANGE / XREVRANGE 的返回值，返回记录、消息数与最后一条消息的 ID
+func parseAuditMessages(val interface{}) ([]AuditEntry, int, string) {
+	messages, _ := val.([]interface{})
+	entries := make([]AuditEntry, 0, len(messages))
+	lastId := ""
+	for _, m := range messages {
+		msg, ok := m.([]interface{})
+		if !ok || len(msg) < 2 {
+			continue
+		}
+		lastId = fmt.Sprintf("%v", msg[0])
+		fields, _ := msg[1].([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fmt.Sprintf("%v", fields[i]) != "data" {
+				continue
+			}
+			var entry AuditEntry
+			if json.Unmarshal([]byte(fmt.Sprintf("%v", fields[i+1])), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, len(messages), lastId
+}
+
+// ExportAuditLogNDJSON 按过滤条件将审计日志以 NDJSON 格式逐页写入 w，返回写出的记录数
+// 每页写完后 flush (如果 w 支持)，内存占用与日志总量无关。
+func ExportAuditLogNDJSON(w io.Writer, filter AuditFilter) (int, error) {
+	start, end := "-", "+"
+	if filter.Start > 0 {
+		start = strconv.FormatInt(filter.Start*1000, 10)
+	}
+	if filter.End > 0 {
+		end = strconv.FormatInt(filter.End*1000+999, 10)
+	}
+
+	encoder := json.NewEncoder(w)
+	written := 0
+	for {
+		entries, n, lastId, err := readAuditPage(start, end, auditExportPageLen)
+		if err != nil {
+			return written, err
+		}
+		for _, entry := range entries {
+			if filter.UserId != "" && entry.UserId != common.HashPII(filter.UserId) {
+				continue
+			}
+			if err := encoder.Encode(entry); err != nil {
+				return written, err
+			}
+			written++
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if lastId == "" || n < auditExportPageLen {
+			return written, nil
+		}
+		start = nextStreamId(lastId)
+	}
+}
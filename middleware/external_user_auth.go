@@ -3,8 +3,10 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
@@ -19,85 +22,295 @@ import (
 
 // ExternalUserConfig 外部用户验证配置
 type ExternalUserConfig struct {
-	RedisURL      string        // Redis 连接 URL (支持本地 redis:// 和 Upstash)
-	RedisToken    string        // Upstash Redis REST Token (本地 Redis 不需
-	JWTSecret     string        // JWT 密钥 (与前端一致)
-	MonthlyQuota  int           // 普通用户每月配额
-	Enabled       bool          // 是否启用外部用户验证
-	redisClient   *redis.Client // go-redis 客户端 (本地 Redis)
-	useLocalRedis bool          // 是否使用本地 Redis
+	RedisURL          string        // Redis 连接 URL (支持本地 redis:// 和 Upstash)
+	RedisToken        string        // Upstash Redis REST Token (本地 Redis 不需
+	JWTSecret         string        // JWT 密钥 (与前端一致)
+	MonthlyQuota      int           // 普通用户每月配额
+	MonthlyTokenQuota int           // 普通用户每月 token 配额，0 表示不限制
+	DailyQuota        int           // 普通用户每日配额 (与周期配额同时生效)，0 表示不限制
+	ResetDayOfMonth   int           // 全局配额周期锚定日 (1-31)，默认 1 即自然月
+	Enabled           bool          // 是否启用外部用户验证
+	TrackVIPUsage     bool          // 是否统计 VIP/管理员的实际用量 (不限制)
+	TrialQuota        int           // 首个周期的试用配额，0 表示不启用
+	RolloverMax       int           // 未用完的周期配额结转到下个周期的上限，0 表示不结转
+	redisClient       *redis.Client // go-redis 客户端 (本地 Redis)
+	useLocalRedis     bool          // 是否使用本地 Redis
+
+	// 验证失败统计
+	AuthFailWindow         time.Duration // 失败计数统计窗口
+	AuthFailBlockThreshold int           // 窗口内失败次数达到该值时临时封禁，0 表示不封禁
+	AuthFailBlockDuration  time.Duration // 封禁时长
+	MinTokenLength         int           // token 最小长度，低于该值直接判定为格式错误
+
+	// token 来源
+	TokenHeader     string // 读取 token 的 header 名称，默认 X-External-User-Token
+	TokenPrefix     string // 验证前从 header 值中去掉的前缀 (如 "Bearer ")，为空时不处理
+	TokenCookie     string // header 缺失时读取 token 的 cookie 名称，为空时不读取
+	AllowQueryToken bool   // header 与 cookie 都缺失时是否读取 query 参数 (默认关闭，query 会进入日志)
+	TokenQueryParam string // 读取 token 的 query 参数名，默认 access_token
+
+	// 签名校验
+	AllowUnsignedTokens bool                // 未配置任何密钥时是否跳过签名校验 (默认拒绝，仅用于开发环境)
+	JWTPublicKey        *rsa.PublicKey      // RS256 公钥
+	JWTAlgorithms       map[string]struct{} // 允许的签名算法，为空时按已配置的密钥推导
+	JWTPreviousSecrets  []string            // 密钥轮换后仍接受的旧 HS256 密钥 (仅用于验证)
+	JWTLeeway           time.Duration       // exp / nbf / iat 校验允许的时钟偏差
+	ExpectedIssuer      string              // 要求的 iss，为空时不校验
+	ExpectedAudience    string              // 要求的 aud，为空时不校验
+
+	// 用户查找
+	StrictUserLookup   bool // 严格模式: 拒绝 Redis 中不存在的用户 (token 有效也拒绝)
+	MaxChannelsPerUser int  // 每个用户可使用的渠道数上限，0 表示不限制
+
+	// 特权身份
+	AdminIDs        map[string]struct{} // 视为管理员的用户 ID (跳过配额限制)
+	AdminUsernames  map[string]struct{} // 视为管理员的用户名 (仅在 AdminByUsername 开启时生效)
+	AdminByUsername bool                // 兼容旧版: 按用户名识别管理员
+
+	// 读写配额时 Redis 出错的处理: true 放行请求并跳过配额计数，false (默认) 拒绝请求
+	FailOpen bool
+	// Redis 写入被拒绝 (OOM / 只读) 时的处理策略: open 或 closed，未配置时跟随 FailOpen
+	StorageFailurePolicy string
+
+	// 等级配额
+	TierQuotas map[string]int // 用户等级 -> 每周期配额 (-1 为无限)
+
+	// 配额预警
+	WarningPercent      int            // 全局预警阈值 (已用百分比)，0 表示不预警
+	TierWarningPercents map[string]int // 用户等级 -> 预警阈值，覆盖全局阈值
+
+	// 模型配额
+	ModelQuotas map[string]int // 模型 -> 每周期配额 (独立计量)
+
+	// 模型访问策略 (VIP/管理员不受限制)
+	DeniedModels      map[string]struct{}            // 禁止调用的模型
+	TierAllowedModels map[string]map[string]struct{} // 用户等级 -> 允许调用的模型
+
+	// 终身上限
+	LifetimeCaps map[string]int // 用户等级 -> 终身调用上限，0 表示不限制
+
+	// 请求消耗
+	TrustedCostNetworks []string // 允许通过 X-Request-Cost 指定消耗的来源 (CIDR / IP)
+	MaxRequestCost      int      // 单次请求允许的最大消耗
+
+	// 超时配置
+	LocalRedisTimeout time.Duration // 本地 Redis 读写超时
+	UpstashTimeout    time.Duration // Upstash REST 请求超时
+
+	// 临时性错误重试
+	RedisMaxAttempts    int           // 最大尝试次数 (含首次)，1 表示不重试
+	RedisRetryBaseDelay time.Duration // 首次重试前的等待时间，之后指数增长
+
+	// 活动期间暂停配额限制
+	PromoStart      time.Time // 活动开始时间，未设置表示无活动
+	PromoEnd        time.Time // 活动结束时间
+	PromoCountUsage bool      // 活动期间是否仍统计实际用量
+
+	// 超额延迟响应 (tarpit)
+	TarpitBaseDelay time.Duration // 首次超额的延迟，0 表示不启用
+	TarpitMaxDelay  time.Duration // 延迟上限
+	TarpitWindow    time.Duration // 违规计数统计窗口
+
+	// VIP 过期宽限期
+	VIPGracePeriod time.Duration // VIP 过期后仍保持 VIP 权限的时长，0 表示不启用
+
+	// 用户请求频率
+	UserRPMLimit         int // 每个用户每分钟请求数上限，0 表示不限制
+	MaxConcurrentPerUser int // 每个用户同时进行中的请求数上限，0 表示不限制
+
+	// 用户记录缓存 (仅请求验证路径)
+	UserCacheTTL  time.Duration // 缓存有效期，0 表示不缓存
+	UserCacheSize int           // 最多缓存的用户数
+
+	// 指标
+	MetricChannels map[string]struct{} // 配额消耗指标中单独计数的渠道，其余渠道计入 other
 }
 
 var externalUserConfig = ExternalUserConfig{
-	MonthlyQuota: 30,
-	Enabled:      false,
+	MonthlyQuota:          30,
+	ResetDayOfMonth:       1,
+	Enabled:               false,
+	AuthFailWindow:        15 * time.Minute,
+	AuthFailBlockDuration: 30 * time.Minute,
+	MinTokenLength:        defaultMinTokenLength,
+	TokenHeader:           defaultTokenHeader,
+	JWTLeeway:             defaultJWTLeeway,
+	AdminIDs:              map[string]struct{}{},
+	AdminUsernames:        map[string]struct{}{"admin": {}},
+	MaxRequestCost:        defaultMaxRequestCost,
+	LocalRedisTimeout:     defaultLocalRedisTimeout,
+	UpstashTimeout:        defaultUpstashTimeout,
+	RedisMaxAttempts:      defaultRedisMaxAttempts,
+	RedisRetryBaseDelay:   defaultRedisRetryBaseDelay,
+	TarpitMaxDelay:        defaultTarpitMaxDelay,
+	WarningPercent:        defaultQuotaWarningPercent,
+	TarpitWindow:          defaultTarpitWindow,
 }
 
 var ctx = context.Background()
 
 // InitExternalUserAuth 初始化外部用户验证配置
 func InitExternalUserAuth(redisURL, redisToken, jwtSecret string, monthlyQuota int) {
-	fmt.Printf("[ExternalUserAuth] 初始化开始: URL=%s, Token长度=%d, Quota=%d\n", redisURL, len(redisToken), monthlyQuota)
-	
+	externalUserDebugf(ctx, "初始化开始: URL=%s, Token长度=%d, Quota=%d", redisURL, len(redisToken), monthlyQuota)
+
 	externalUserConfig.RedisURL = redisURL
 	externalUserConfig.RedisToken = redisToken
 	externalUserConfig.JWTSecret = jwtSecret
+	externalUserConfig.TokenHeader = defaultTokenHeader
+	if header := strings.TrimSpace(constant.ExternalUserTokenHeader); header != "" {
+		externalUserConfig.TokenHeader = header
+	}
+	externalUserConfig.TokenPrefix = constant.ExternalUserTokenPrefix
+	externalUserConfig.TokenCookie = strings.TrimSpace(constant.ExternalUserTokenCookie)
+	externalUserConfig.AllowQueryToken = constant.ExternalUserAllowQueryToken
+	externalUserConfig.TokenQueryParam = strings.TrimSpace(constant.ExternalUserTokenQueryParam)
+	externalUserConfig.JWTPreviousSecrets = parseJWTSecretList(constant.ExternalUserJWTPreviousSecrets, jwtSecret)
 	if monthlyQuota > 0 {
 		externalUserConfig.MonthlyQuota = monthlyQuota
 	}
-
-	// 检测是否是本地 Redis (redis:// 开头)
-	if strings.HasPrefix(redisURL, "redis://") {
+	externalUserConfig.MonthlyTokenQuota = constant.ExternalUserMonthlyTokenQuota
+	externalUserConfig.DailyQuota = constant.ExternalUserDailyQuota
+	externalUserConfig.ResetDayOfMonth = normalizeResetDay(constant.ExternalUserQuotaResetDay)
+	externalUserConfig.TrackVIPUsage = constant.ExternalUserTrackVIPUsage
+	externalUserConfig.AllowUnsignedTokens = constant.ExternalUserAllowUnsignedTokens
+	externalUserConfig.JWTAlgorithms = parseJWTAlgorithms(constant.ExternalUserJWTAlgorithm)
+	if constant.ExternalUserJWTLeewaySeconds >= 0 {
+		externalUserConfig.JWTLeeway = time.Duration(constant.ExternalUserJWTLeewaySeconds) * time.Second
+	}
+	externalUserConfig.ExpectedIssuer = constant.ExternalUserJWTIssuer
+	externalUserConfig.ExpectedAudience = constant.ExternalUserJWTAudience
+	externalUserConfig.JWTPublicKey = nil
+	if constant.ExternalUserJWTPublicKeyPEM != "" {
+		publicKey, err := parseRSAPublicKeyPEM(constant.ExternalUserJWTPublicKeyPEM)
+		if err != nil {
+			externalUserError(ctx, "解析 JWT 公钥失败，RS256 token 将被拒绝", "error", err)
+		} else {
+			externalUserConfig.JWTPublicKey = publicKey
+		}
+	}
+	if len(hmacSecrets()) == 0 && externalUserConfig.JWTPublicKey == nil {
+		if externalUserConfig.AllowUnsignedTokens {
+			externalUserWarn(ctx, "JWT 密钥未配置且允许未签名 token，签名校验已关闭 (请勿用于生产环境)")
+		} else {
+			externalUserWarn(ctx, "JWT 密钥未配置，所有外部用户 token 将被拒绝")
+		}
+	}
+	externalUserConfig.StrictUserLookup = constant.ExternalUserStrictLookup
+	externalUserConfig.MaxChannelsPerUser = constant.ExternalUserMaxChannelsPerUser
+	externalUserConfig.TrialQuota = constant.ExternalUserTrialQuota
+	externalUserConfig.RolloverMax = constant.ExternalUserQuotaRolloverMax
+	externalUserConfig.PromoStart = parsePromoTime(constant.ExternalUserPromoStart)
+	externalUserConfig.PromoEnd = parsePromoTime(constant.ExternalUserPromoEnd)
+	externalUserConfig.PromoCountUsage = constant.ExternalUserPromoCountUsage
+	externalUserConfig.AdminIDs = parseIdentityList(constant.ExternalUserAdminIDs)
+	externalUserConfig.AdminUsernames = parseIdentityList(constant.ExternalUserAdminUsernames)
+	externalUserConfig.AdminByUsername = constant.ExternalUserAdminByUsername
+	if externalUserConfig.AdminByUsername {
+		externalUserWarn(ctx, "已开启按用户名识别管理员，任何注册了这些用户名的外部用户都将跳过配额限制", "usernames", sortedIdentities(externalUserConfig.AdminUsernames))
+	}
+	externalUserConfig.LocalRedisTimeout = validateRedisTimeout("EXTERNAL_USER_REDIS_TIMEOUT_MS", constant.ExternalUserRedisTimeoutMs, defaultLocalRedisTimeout)
+	externalUserConfig.UpstashTimeout = validateRedisTimeout("EXTERNAL_USER_UPSTASH_TIMEOUT_MS", constant.ExternalUserUpstashTimeoutMs, defaultUpstashTimeout)
+	setUpstashConcurrency(constant.ExternalUserUpstashMaxConcurrency)
+	if constant.ExternalUserRedisMaxAttempts > 0 {
+		externalUserConfig.RedisMaxAttempts = constant.ExternalUserRedisMaxAttempts
+	}
+	externalUserConfig.FailOpen = constant.ExternalUserFailOpen
+	externalUserConfig.StorageFailurePolicy = normalizeStorageFailurePolicy(constant.ExternalUserStorageFailurePolicy, constant.ExternalUserFailOpen)
+	externalUserConfig.TierQuotas = parseTierIntMap(constant.ExternalUserTierQuotas)
+	externalUserConfig.WarningPercent = constant.ExternalUserQuotaWarningPercent
+	externalUserConfig.TierWarningPercents = parseTierIntMap(constant.ExternalUserTierWarningPercents)
+	externalUserConfig.ModelQuotas = parseTierIntMap(constant.ExternalUserModelQuotas)
+	externalUserConfig.DeniedModels = parseIdentityList(constant.ExternalUserDeniedModels)
+	externalUserConfig.TierAllowedModels = parseTierModelMap(constant.ExternalUserTierAllowedModels)
+	externalUserConfig.LifetimeCaps = parseTierIntMap(constant.ExternalUserLifetimeCaps)
+	externalUserConfig.TrustedCostNetworks = parseNetworkList(constant.ExternalUserTrustedCostNetworks)
+	externalUserConfig.MetricChannels = parseIdentityList(constant.ExternalUserMetricChannels)
+	if constant.ExternalUserMaxRequestCost > 0 {
+		externalUserConfig.MaxRequestCost = constant.ExternalUserMaxRequestCost
+	}
+	if constant.ExternalUserMinTokenLength > 0 {
+		externalUserConfig.MinTokenLength = constant.ExternalUserMinTokenLength
+	}
+	if constant.ExternalUserAuthFailWindowSeconds > 0 {
+		externalUserConfig.AuthFailWindow = time.Duration(constant.ExternalUserAuthFailWindowSeconds) * time.Second
+	}
+	externalUserConfig.AuthFailBlockThreshold = constant.ExternalUserAuthFailBlockThreshold
+	if constant.ExternalUserAuthFailBlockSeconds > 0 {
+		externalUserConfig.AuthFailBlockDuration = time.Duration(constant.ExternalUserAuthFailBlockSeconds) * time.Second
+	}
+	externalUserConfig.TarpitBaseDelay = time.Duration(constant.ExternalUserTarpitBaseMs) * time.Millisecond
+	if constant.ExternalUserTarpitMaxMs > 0 {
+		externalUserConfig.TarpitMaxDelay = time.Duration(constant.ExternalUserTarpitMaxMs) * time.Millisecond
+	}
+	if constant.ExternalUserTarpitWindowSeconds > 0 {
+		externalUserConfig.TarpitWindow = time.Duration(constant.ExternalUserTarpitWindowSeconds) * time.Second
+	}
+	externalUserConfig.VIPGracePeriod = time.Duration(constant.ExternalUserVIPGraceSeconds) * time.Second
+	externalUserConfig.UserRPMLimit = constant.ExternalUserRPMLimit
+	externalUserConfig.MaxConcurrentPerUser = constant.ExternalUserMaxConcurrentPerUser
+	externalUserConfig.UserCacheTTL = time.Duration(constant.ExternalUserCacheTTLSeconds) * time.Second
+	externalUserConfig.UserCacheSize = constant.ExternalUserCacheSize
+	externalUserRecordCache.reset()
+
+	// 检测是否是本地 Redis (redis://、rediss:// 或 sentinel:// 开头)
+	if IsLocalRedisURL(redisURL) {
 		externalUserConfig.useLocalRedis = true
-		opt, err := redis.ParseURL(redisURL)
+		client, useTLS, err := newLocalRedisClient(redisURL)
 		if err != nil {
-			fmt.Printf("[ExternalUserAuth] ❌ 解析 Redis URL 失败: %v\n", err)
+			externalUserError(ctx, "解析 Redis URL 失败", "error", err)
 			externalUserConfig.Enabled = false
 			constant.ExternalUserAuthEnabled = false
 			return
 		}
-		externalUserConfig.redisClient = redis.NewClient(opt)
+		externalUserConfig.redisClient = client
 		// 测试连接
 		_, err = externalUserConfig.redisClient.Ping(ctx).Result()
 		if err != nil {
-			fmt.Printf("[ExternalUserAuth] ❌ Redis 连接失败: %v\n", err)
+			externalUserError(ctx, "Redis 连接失败", "error", err)
 			externalUserConfig.Enabled = false
 			constant.ExternalUserAuthEnabled = false
 			return
 		}
 		externalUserConfig.Enabled = true
 		constant.ExternalUserAuthEnabled = true
-		fmt.Printf("[ExternalUserAuth] ✓ 已启用外部用户验证 (本地 Redis), URL: %s, 每月配额: %d\n", redisURL, externalUserConfig.MonthlyQuota)
+		externalUserInfo(ctx, "已启用外部用户验证 (本地 Redis)", "tls", useTLS, "url", redisURL, "monthly_quota", externalUserConfig.MonthlyQuota)
 	} else if redisURL != "" && redisToken != "" {
 		// Upstash REST API
 		externalUserConfig.useLocalRedis = false
 		externalUserConfig.Enabled = true
 		constant.ExternalUserAuthEnabled = true
-		fmt.Printf("[ExternalUserAuth] ✓ 已启用外部用户验证 (Upstash), URL: %s, 每月配额: %d\n", redisURL, externalUserConfig.MonthlyQuota)
+		externalUserInfo(ctx, "已启用外部用户验证 (Upstash)", "url", redisURL, "monthly_quota", externalUserConfig.MonthlyQuota)
 	} else {
 		externalUserConfig.Enabled = false
 		constant.ExternalUserAuthEnabled = false
-		fmt.Printf("[ExternalUserAuth] ⚠️ 外部用户验证未启用 (Redis 未配置)\n")
+		externalUserWarn(ctx, "外部用户验证未启用 (Redis 未配置)")
 	}
 }
 
 // ExternalUserData 外部用户数据
 type ExternalUserData struct {
-	ID           string `json:"id"`
-	Email        string `json:"email"`
-	Username     string `json:"username"`
-	IsVIP        bool   `json:"isVip"`
-	VIPExpiresAt int64  `json:"vipExpiresAt"`
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	Username      string `json:"username"`
+	IsVIP         bool   `json:"isVip"`
+	VIPExpiresAt  int64  `json:"vipExpiresAt"`
+	ResetDay      int    `json:"resetDay,omitempty"`      // 用户自定义配额重置日 (账单锚定日)，覆盖全局配置
+	Tier          string `json:"tier,omitempty"`          // 用户等级 (用于分级限制)
+	TierExpiresAt int64  `json:"tierExpiresAt,omitempty"` // 等级到期时间 (Unix 秒)，0 表示不过期
+	QuotaLimit    int    `json:"quotaLimit,omitempty"`    // 用户自定义每周期配额，覆盖等级/渠道/全局配置 (-1 为无限)
 }
 
 // UserQuota 用户配额数据
 type UserQuota struct {
-	UsedCount   int    `json:"usedCount"`
-	MonthKey    string `json:"monthKey"`
-	LastResetAt int64  `json:"lastResetAt"`
+	UsedCount      int    `json:"usedCount"`
+	MonthKey       string `json:"monthKey"`
+	LastResetAt    int64  `json:"lastResetAt"`
+	FirstPeriodKey string `json:"firstPeriodKey,omitempty"` // 首次使用的周期 (用于试用配额)
+	TokenCount     int    `json:"tokenCount,omitempty"`     // 本周期已用 token 数
+	RolloverCredit int    `json:"rolloverCredit,omitempty"` // 从上个周期结转的额度 (开启配额结转时)
+	isNew          bool   // 记录不存在，本次为首次使用
 }
 
-
 // ChannelQuotaConfig 渠道配额配置 (从前端传递)
 type ChannelQuotaConfig struct {
 	ChannelId    string `json:"channelId"`
@@ -109,138 +322,383 @@ type ChannelQuotaConfig struct {
 // ExternalUserAuth 外部用户验证中间件
 func ExternalUserAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fmt.Printf("[ExternalUserAuth] ========== 开始处理请求 ==========\n")
-		fmt.Printf("[ExternalUserAuth] 请求路径: %s %s\n", c.Request.Method, c.Request.URL.Path)
-		fmt.Printf("[ExternalUserAuth] 配置状态: Enabled=%v, UseLocalRedis=%v, RedisURL=%s\n", externalUserConfig.Enabled, externalUserConfig.useLocalRedis, externalUserConfig.RedisURL)
+		externalUserDebugf(c, "开始处理请求: %s %s", c.Request.Method, c.Request.URL.Path)
 
 		if !externalUserConfig.Enabled {
-			fmt.Printf("[ExternalUserAuth] ❌ 中间件未启用, constant.ExternalUserRedisURL=%s\n", constant.ExternalUserRedisURL)
+			externalUserDebugf(c, "❌ 中间件未启用 (Redis 未配置)")
 			abortWithOpenAiMessage(c, http.StatusServiceUnavailable, "服务未正确配置，请联系管理员 (Redis 未配置)")
 			return
 		}
+		defer recordExternalUserRequestMetric(c)
 
-		externalToken := c.Request.Header.Get("X-External-User-Token")
+		externalToken := ExternalUserToken(c)
 		if externalToken == "" {
-			fmt.Printf("[ExternalUserAuth] ❌ 未收到 X-External-User-Token header\n")
+			externalUserDebugf(c, "❌ 未收到外部用户 token (header %s)", ExternalUserTokenHeader())
 			abortWithOpenAiMessage(c, http.StatusUnauthorized, "请先登录后再使用 API")
 			return
 		}
-		fmt.Printf("[ExternalUserAuth] ✓ 收到 Token: %s...\n", maskString(externalToken, 30))
+		clientIP := c.ClientIP()
+		if err := checkTokenShape(externalToken); err != nil {
+			externalUserDebugf(c, "❌ Token 格式错误: %v, IP=%s", err, clientIP)
+			recordMalformedToken(clientIP)
+			c.Header("X-Quota-Reason", "malformed_token")
+			abortWithOpenAiMessage(c, http.StatusUnauthorized, "外部用户验证失败: "+err.Error())
+			return
+		}
+		externalUserDebugf(c, "✓ 收到 Token: %s", maskString(externalToken, 30))
 
-		// 获取渠道配额配置 (从 header 传递)
-		channelId := c.Request.Header.Get("X-Channel-Id")
-		channelName := c.Request.Header.Get("X-Channel-Name")
-		quotaEnabledStr := c.Request.Header.Get("X-Channel-Quota-Enabled")
-		quotaLimitStr := c.Request.Header.Get("X-Channel-Quota-Limit")
-		
-		// 解析渠道配额配置
-		quotaEnabled := quotaEnabledStr != "false" // 默认启用
-		quotaLimit := externalUserConfig.MonthlyQuota // 默认使用全局配额
-		if quotaLimitStr != "" {
-			if parsed, err := strconv.Atoi(quotaLimitStr); err == nil {
-				quotaLimit = parsed
-			}
+		if isAuthBlocked(clientIP) {
+			externalUserDebugf(c, "❌ 验证失败次数过多，已临时封禁: IP=%s", clientIP)
+			abortWithOpenAiMessage(c, http.StatusForbidden, "验证失败次数过多，请稍后再试")
+			return
 		}
-		
-		fmt.Printf("[ExternalUserAuth] 渠道配置: ID=%s, Name=%s, QuotaEnabled=%v, QuotaLimit=%d\n", 
-			channelId, channelName, quotaEnabled, quotaLimit)
 
-		userData, err := verifyExternalJWT(externalToken)
+		// 获取渠道配额配置 (从 header 传递)
+		channel, quotaLimitSource := parseChannelQuotaConfig(c)
+		channelId, channelName := channel.ChannelId, channel.ChannelName
+		externalUserDebugf(c, "渠道配置: ID=%s, Name=%s, QuotaEnabled=%v, QuotaLimit=%d",
+			channelId, channelName, channel.QuotaEnabled, channel.QuotaLimit)
+
+		userData, err := verifyExternalJWT(c.Request.Context(), externalToken)
 		if err != nil {
-			fmt.Printf("[ExternalUserAuth] ❌ JWT 验证失败: %v\n", err)
+			externalUserDebugf(c, "❌ JWT 验证失败: %v", err)
+			recordAuthFailure(extractUnverifiedUserId(externalToken), clientIP)
 			abortWithOpenAiMessage(c, http.StatusUnauthorized, "外部用户验证失败: "+err.Error())
 			return
 		}
-		fmt.Printf("[ExternalUserAuth] ✓ 用户验证成功: ID=%s, Email=%s\n", userData.ID, userData.Email)
-
-		isVIP := userData.IsVIP && userData.VIPExpiresAt > time.Now().Unix()
-		isAdmin := userData.Username == "admin"
-
-		if isVIP || isAdmin {
-			fmt.Printf("[ExternalUserAuth] ✓ VIP/管理员用户，跳过配额检查\n")
-			c.Set("external_user_id", userData.ID)
-			c.Set("external_user_email", userData.Email)
-			c.Set("external_user_vip", true)
-			c.Header("X-Quota-Status", "vip")
-			c.Header("X-Quota-Used", "0")
-			c.Header("X-Quota-Total", "-1")
-			c.Header("X-Quota-Remaining", "-1")
-			c.Header("X-Channel-Id", channelId)
-			c.Next()
+		externalUserDebugf(c, "✓ 用户验证成功: ID=%s, Email=%s", common.HashPII(userData.ID), common.HashPII(userData.Email))
+		if ban, err := GetExternalUserBan(userData.ID); err != nil {
+			externalUserWarn(c, "检查封禁名单失败", "user", common.HashPII(userData.ID), "error", err)
+		} else if ban != nil {
+			externalUserDebugf(c, "❌ 用户 %s 已被封禁: %s", common.HashPII(userData.ID), ban.Reason)
+			c.Header("X-Quota-Reason", "banned")
+			recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Reason: "banned"})
+			message := "账户已被封禁"
+			if ban.Reason != "" {
+				message += ": " + ban.Reason
+			}
+			if ban.ExpiresAt > 0 {
+				message += fmt.Sprintf(" (解封时间 %s)", time.Unix(ban.ExpiresAt, 0).Format("2006-01-02 15:04:05"))
+			}
+			abortWithOpenAiMessage(c, http.StatusForbidden, message)
 			return
 		}
-
-		// 如果渠道禁用了配额，直接放行
-		if !quotaEnabled {
-			fmt.Printf("[ExternalUserAuth] ✓ 渠道 %s 禁用了配额限制，直接放行\n", channelName)
-			c.Set("external_user_id", userData.ID)
-			c.Set("external_user_email", userData.Email)
-			c.Set("external_user_vip", false)
-			c.Header("X-Quota-Status", "disabled")
-			c.Header("X-Quota-Used", "0")
-			c.Header("X-Quota-Total", "-1")
-			c.Header("X-Quota-Remaining", "-1")
-			c.Header("X-Channel-Id", channelId)
-			c.Next()
+		touchLastSeen(userData.ID)
+		if hasModelPolicy() {
+			if model := requestModelName(c); model != "" && !externalModelAllowed(userData, model) {
+				externalUserDebugf(c, "❌ 用户 %s 无权调用模型 %s", common.HashPII(userData.ID), model)
+				c.Header("X-Quota-Reason", "model_not_allowed")
+				abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("当前账户无权使用模型 %s，请升级 VIP", model))
+				return
+			}
+		}
+		if !enforceUserRPM(c, userData) {
+			externalUserDebugf(c, "❌ 用户 %s 请求过于频繁", common.HashPII(userData.ID))
+			return
+		}
+		releaseInflight, ok := enforceUserConcurrency(c, userData)
+		if !ok {
+			externalUserDebugf(c, "❌ 用户 %s 同时进行中的请求过多", common.HashPII(userData.ID))
 			return
 		}
+		defer releaseInflight()
+		rq := resolveRequestQuota(c, userData, channel, quotaLimitSource)
+		quotaLimit, quotaBucket, cost := rq.limit, rq.bucket, rq.cost
+
+		isVIP := HasVIPAccess(userData, time.Now())
+		if inVIPGrace(userData, time.Now()) && !isExternalAdmin(userData) {
+			externalUserDebugf(c, "用户 %s VIP 已过期，宽限期至 %s", common.HashPII(userData.ID), vipGraceEnd(userData).Format(time.RFC3339))
+			c.Header("X-Quota-Warning", "true")
+			c.Header("X-VIP-Grace-Until", strconv.FormatInt(vipGraceEnd(userData).Unix(), 10))
+		}
 
-		// 如果渠道配额无限制
-		if quotaLimit == -1 {
-			fmt.Printf("[ExternalUserAuth] ✓ 渠道 %s 配额无限制，直接放行\n", channelName)
+		// VIP/管理员、活动期间、渠道禁用配额或配额无限制时直接放行，不读取配额记录
+		if decision := resolveQuotaDecision(userData, rq, nil, time.Now()); decision.status != "" {
+			headers := decision.headers
+			switch decision.status {
+			case quotaFastPathVIP, quotaFastPathVIPGrace:
+				externalUserDebugf(c, "✓ VIP/管理员用户，跳过配额检查")
+				isVIP = true
+				if externalUserConfig.TrackVIPUsage {
+					headers["X-Quota-Used"] = strconv.Itoa(countVIPUsage(c.Request.Context(), userData, channelId, cost))
+				}
+			case quotaFastPathPromo:
+				externalUserDebugf(c, "✓ 活动期间，跳过配额检查")
+				if externalUserConfig.PromoCountUsage {
+					headers["X-Quota-Used"] = strconv.Itoa(countVIPUsage(c.Request.Context(), userData, channelId, cost))
+				}
+			case quotaFastPathDisabled:
+				externalUserDebugf(c, "✓ 渠道 %s 禁用了配额限制，直接放行", channelName)
+			case quotaFastPathUnlimited:
+				externalUserDebugf(c, "✓ 渠道 %s 配额无限制，直接放行", channelName)
+			}
 			c.Set("external_user_id", userData.ID)
 			c.Set("external_user_email", userData.Email)
-			c.Set("external_user_vip", false)
-			c.Header("X-Quota-Status", "unlimited")
-			c.Header("X-Quota-Used", "0")
-			c.Header("X-Quota-Total", "-1")
-			c.Header("X-Quota-Remaining", "-1")
-			c.Header("X-Channel-Id", channelId)
+			c.Set("external_user_vip", isVIP)
+			for key, value := range headers {
+				c.Header(key, value)
+			}
+			echoChannelHeaders(c, channel)
 			c.Next()
 			return
 		}
 
-		// 获取用户在该渠道的配额 (per-user-per-channel)
-		quota, err := getUserChannelQuota(userData.ID, channelId)
+		// 获取用户在该渠道 (或渠道下该模型) 的配额
+		quota, err := getUserChannelQuotaContext(c.Request.Context(), userData.ID, quotaBucket)
 		if err != nil {
-			fmt.Printf("[ExternalUserAuth] ❌ 获取配额失败: %v\n", err)
+			if externalUserConfig.FailOpen {
+				externalUserWarn(c, "获取配额失败，降级放行 (不计入配额)", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
+				markQuotaDegraded(c)
+				c.Set("external_user_id", userData.ID)
+				c.Set("external_user_email", userData.Email)
+				c.Set("external_user_vip", isVIP)
+				echoChannelHeaders(c, channel)
+				c.Next()
+				return
+			}
+			externalUserError(c, "获取配额失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
 			abortWithOpenAiMessage(c, http.StatusInternalServerError, "获取用户配额失败: "+err.Error())
 			return
 		}
 
-		currentMonthKey := time.Now().Format("2006-01")
-		if quota.MonthKey != currentMonthKey {
-			quota.UsedCount = 0
-			quota.MonthKey = currentMonthKey
-			quota.LastResetAt = time.Now().Unix()
+		decision := resolveQuotaDecision(userData, rq, quota, time.Now())
+		rq, quota = decision.rq, decision.quota
+		allowed, quotaStatus := decision.allowed, decision.status
+		currentPeriodKey, prevPeriodKey := rq.periodKey, rq.prevPeriodKey
+		if quota.isNew {
+			if ok, err := reserveUserChannel(userData.ID, channelId); err != nil {
+				externalUserWarn(c, "登记用户渠道失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
+			} else if !ok {
+				externalUserDebugf(c, "❌ 用户 %s 使用的渠道数超过上限 %d", common.HashPII(userData.ID), externalUserConfig.MaxChannelsPerUser)
+				c.Header("X-Quota-Reason", "too_many_channels")
+				abortWithOpenAiMessage(c, http.StatusForbidden,
+					fmt.Sprintf("可使用的渠道数已达上限 (%d)", externalUserConfig.MaxChannelsPerUser))
+				return
+			}
+		}
+		if rq.limitSource == quotaLimitSourceTrial {
+			externalUserDebugf(c, "✓ 首个周期试用配额: %d -> %d", quotaLimit, rq.baseLimit)
+		}
+		// 试用配额与上个周期结转的额度计入本周期限额 (原子扣除时脚本在基础限额上按同样规则加上结转额度)
+		quotaLimit = rq.limit
+
+		// 终身调用上限 (不随周期重置)
+		var lifetimeCount int64
+		if lifetimeLimit := lifetimeCap(userData); lifetimeLimit > 0 {
+			lifetimeCount, err = GetLifetimeCount(userData.ID)
+			if err != nil {
+				externalUserWarn(c, "获取终身调用次数失败", "user", common.HashPII(userData.ID), "error", err)
+			} else if lifetimeCount+int64(cost) > int64(lifetimeLimit) {
+				externalUserDebugf(c, "❌ 用户 %s 终身调用次数已用完: %d/%d", common.HashPII(userData.ID), lifetimeCount, lifetimeLimit)
+				c.Header("X-Quota-Reason", "lifetime_exhausted")
+				recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Reason: "lifetime_exhausted", QuotaUsed: quota.UsedCount, QuotaTotal: quotaLimit})
+				applyTarpit(c.Request.Context(), userData.ID)
+				abortWithOpenAiMessage(c, http.StatusTooManyRequests,
+					fmt.Sprintf("账户累计调用次数已达上限 (%d/%d)，请升级 VIP", lifetimeCount, lifetimeLimit))
+				return
+			}
 		}
 
-		if quota.UsedCount >= quotaLimit {
-			fmt.Printf("[ExternalUserAuth] ❌ 渠道 %s 配额已用完: %d/%d\n", channelName, quota.UsedCount, quotaLimit)
+		// token 配额 (按响应后累计的用量判断)
+		tokenLimit := rq.tokenLimit
+		if !allowed && decision.headers["X-Quota-Reason"] == "token_quota_exhausted" {
+			externalUserDebugf(c, "❌ 渠道 %s token 配额已用完: %d/%d", channelName, quota.TokenCount, tokenLimit)
+			setQuotaDenialHeaders(c, "token_quota_exhausted", rq.periodEnd, time.Now())
+			recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Reason: "token_quota_exhausted", QuotaUsed: quota.UsedCount, QuotaTotal: quotaLimit})
 			abortWithOpenAiMessage(c, http.StatusTooManyRequests,
-				fmt.Sprintf("渠道「%s」本月调用次数已用完 (%d/%d)，请升级 VIP 或切换其他渠道",
-					channelName, quota.UsedCount, quotaLimit))
+				fmt.Sprintf("渠道「%s」本月 token 用量已用完 (%d/%d)，请升级 VIP 或切换其他渠道",
+					channelName, quota.TokenCount, tokenLimit))
 			return
 		}
 
-		quota.UsedCount++
-		if err := saveUserChannelQuota(userData.ID, channelId, quota); err != nil {
-			fmt.Printf("[ExternalUserAuth] ⚠️ 保存配额失败: %v\n", err)
+		exceededAction := ""
+		if quotaStatus == "exceeded" {
+			exceededAction = applyQuotaExceededAction(c)
+			if exceededAction == quotaExceededActionBlock {
+				externalUserDebugf(c, "❌ 渠道 %s 配额已用完: %d/%d (本次消耗 %d)", channelName, quota.UsedCount, quotaLimit, cost)
+				setQuotaDenialHeaders(c, "quota_exhausted", rq.periodEnd, time.Now())
+				recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Reason: "quota_exhausted", QuotaUsed: quota.UsedCount, QuotaTotal: quotaLimit})
+				applyTarpit(c.Request.Context(), userData.ID)
+				abortWithOpenAiMessage(c, http.StatusTooManyRequests,
+					fmt.Sprintf("渠道「%s」本月调用次数已用完 (%d/%d)，请升级 VIP 或切换其他渠道",
+						channelName, quota.UsedCount, quotaLimit))
+				return
+			}
+			externalUserDebugf(c, "渠道 %s 配额已用完: %d/%d，按 %s 放行", channelName, quota.UsedCount, quotaLimit, exceededAction)
+		} else {
+			clearTarpit(userData.ID)
+		}
+
+		// 已按 warn / downgrade 放行的请求不再检查限额；其余请求在扣除时原子地再次检查，
+		// 并发请求在上面的检查中同时通过时，只有不超额的部分会被扣除并放行
+		chargeLimit := rq.baseLimit
+		if exceededAction != "" {
+			chargeLimit = -1
+		}
+		quota.UsedCount += cost
+		charged, accepted, saveErr := chargeUserChannelQuota(c.Request.Context(), userData.ID, quotaBucket, currentPeriodKey, cost, quota.FirstPeriodKey, chargeLimit, prevPeriodKey, rq.rolloverBase)
+		if saveErr == nil {
+			quota.UsedCount = charged.UsedCount
+			rq.limit += charged.RolloverCredit - quota.RolloverCredit
+			quotaLimit = rq.limit
+			quota.RolloverCredit = charged.RolloverCredit
+			if !accepted {
+				externalUserDebugf(c, "❌ 渠道 %s 配额已用完 (并发扣除): %d/%d (本次消耗 %d)", channelName, charged.UsedCount, quotaLimit, cost)
+				setQuotaDenialHeaders(c, "quota_exhausted", rq.periodEnd, time.Now())
+				recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Reason: "quota_exhausted", QuotaUsed: charged.UsedCount, QuotaTotal: quotaLimit})
+				applyTarpit(c.Request.Context(), userData.ID)
+				abortWithOpenAiMessage(c, http.StatusTooManyRequests,
+					fmt.Sprintf("渠道「%s」本月调用次数已用完 (%d/%d)，请升级 VIP 或切换其他渠道",
+						channelName, charged.UsedCount, quotaLimit))
+				return
+			}
+		}
+		if saveErr != nil {
+			if isRedisWriteRejected(saveErr) {
+				externalUserError(c, "Redis 拒绝写入 (内存不足或只读)，配额无法计数", "policy", externalUserConfig.StorageFailurePolicy, "error", saveErr)
+				if externalUserConfig.StorageFailurePolicy == storageFailurePolicyClosed {
+					c.Header("X-Quota-Reason", "storage_unavailable")
+					abortWithOpenAiMessage(c, http.StatusServiceUnavailable, "配额服务暂时不可用，请稍后再试")
+					return
+				}
+				markQuotaDegraded(c)
+			} else if externalUserConfig.FailOpen {
+				externalUserWarn(c, "保存配额失败，降级放行 (不计入配额)", "user", common.HashPII(userData.ID), "channel", channelId, "error", saveErr)
+				markQuotaDegraded(c)
+			} else {
+				externalUserError(c, "保存配额失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", saveErr)
+				c.Header("X-Quota-Reason", "storage_unavailable")
+				abortWithOpenAiMessage(c, http.StatusServiceUnavailable, "配额服务暂时不可用，请稍后再试")
+				return
+			}
 		}
 
+		// 每日配额 (周期配额扣除后检查，超出时退还本次扣除的周期配额)
+		dailyLimit := resolveDailyQuotaLimit(c)
+		dailyKey, dailyUsed := "", 0
+		if dailyLimit > 0 {
+			today := time.Now()
+			key := dailyQuotaKey(userData.ID, quotaBucket, today)
+			ok, used, err := reserveDailyQuota(key, cost, dailyLimit)
+			if err != nil {
+				externalUserWarn(c, "检查每日配额失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
+			} else if !ok {
+				if saveErr == nil {
+					if _, err := refundUserChannelQuota(userData.ID, quotaBucket, currentPeriodKey, cost); err != nil {
+						externalUserWarn(c, "退还周期配额失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
+					}
+				}
+				externalUserDebugf(c, "❌ 渠道 %s 今日配额已用完: %d/%d (本次消耗 %d)", channelName, used, dailyLimit, cost)
+				setQuotaDenialHeaders(c, "daily_quota_exhausted", nextDailyReset(today), time.Now())
+				recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Reason: "daily_quota_exhausted", QuotaUsed: used, QuotaTotal: dailyLimit})
+				applyTarpit(c.Request.Context(), userData.ID)
+				abortWithOpenAiMessage(c, http.StatusTooManyRequests,
+					fmt.Sprintf("渠道「%s」今日调用次数已用完 (%d/%d)，请明天再试或升级 VIP",
+						channelName, used, dailyLimit))
+				return
+			} else {
+				dailyKey, dailyUsed = key, used
+			}
+		}
+		// 终身调用次数原子地检查并累加，并发请求在上面的检查中同时通过时退还本次扣除的周期配额与每日配额
+		if lifetimeLimit := lifetimeCap(userData); lifetimeLimit > 0 {
+			ok, count, err := reserveLifetimeCount(userData.ID, cost, lifetimeLimit)
+			if err != nil {
+				externalUserWarn(c, "更新终身调用次数失败", "user", common.HashPII(userData.ID), "error", err)
+			} else if !ok {
+				if saveErr == nil {
+					if _, err := refundUserChannelQuota(userData.ID, quotaBucket, currentPeriodKey, cost); err != nil {
+						externalUserWarn(c, "退还周期配额失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
+					}
+				}
+				if dailyKey != "" {
+					refundDailyQuota(dailyKey, cost)
+				}
+				externalUserDebugf(c, "❌ 用户 %s 终身调用次数已用完 (并发累加): %d/%d", common.HashPII(userData.ID), count, lifetimeLimit)
+				c.Header("X-Quota-Reason", "lifetime_exhausted")
+				recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Reason: "lifetime_exhausted", QuotaUsed: quota.UsedCount, QuotaTotal: quotaLimit})
+				applyTarpit(c.Request.Context(), userData.ID)
+				abortWithOpenAiMessage(c, http.StatusTooManyRequests,
+					fmt.Sprintf("账户累计调用次数已达上限 (%d/%d)，请升级 VIP", count, lifetimeLimit))
+				return
+			}
+		}
+		if saveErr == nil {
+			common.ExternalUserQuotaUsed.WithLabelValues(quotaMetricChannel(channelId)).Add(float64(cost))
+		}
+
+		recordAuditEntry(AuditEntry{UserId: userData.ID, Email: userData.Email, ChannelId: channelId, Allowed: true, Reason: exceededAction, QuotaUsed: quota.UsedCount, QuotaTotal: quotaLimit})
+
 		c.Set("external_user_id", userData.ID)
 		c.Set("external_user_email", userData.Email)
-		c.Set("external_user_vip", false)
-		c.Header("X-Quota-Status", "active")
-		c.Header("X-Quota-Used", strconv.Itoa(quota.UsedCount))
-		c.Header("X-Quota-Total", strconv.Itoa(quotaLimit))
-		c.Header("X-Quota-Remaining", strconv.Itoa(quotaLimit-quota.UsedCount))
-		c.Header("X-Channel-Id", channelId)
+		c.Set("external_user_vip", isVIP)
+		remaining := quotaLimit - quota.UsedCount
+		if exceededAction != "" {
+			remaining = 0
+		}
+		setExternalQuotaContext(c, channelId, cost, quota.UsedCount, quotaLimit, remaining, saveErr)
+		for key, value := range limitedQuotaHeaders(userData, rq, quota, exceededAction) {
+			c.Header(key, value)
+		}
+		if c.GetBool("external_quota_degraded") && exceededAction == "" {
+			c.Header("X-Quota-Status", "degraded")
+		}
+		if dailyKey != "" {
+			c.Header("X-Quota-Daily-Used", strconv.Itoa(dailyUsed))
+			c.Header("X-Quota-Daily-Remaining", strconv.Itoa(dailyLimit-dailyUsed))
+		}
+		echoChannelHeaders(c, channel)
 
 		c.Next()
+
+		if saveErr == nil {
+			refundQuotaOnUpstreamFailure(c, userData, quotaBucket, currentPeriodKey, dailyKey, cost)
+		}
+		recordTokenUsage(c, userData.ID, quotaBucket, currentPeriodKey)
+	}
+}
+
+// countVIPUsage 统计 VIP 用户 (或活动期间的所有用户) 在渠道上的实际用量 (只计数不限制)，返回计数后的用量
+// 使用 chargeQuotaScript 原子累加 (限额 -1 表示不检查)，并发请求不会丢失计数。
+func countVIPUsage(reqCtx context.Context, userData *ExternalUserData, channelId string, cost int) int {
+	currentPeriodKey, _, _ := quotaPeriod(time.Now(), effectiveResetDay(userData))
+	quota, _, err := chargeUserChannelQuota(reqCtx, userData.ID, channelId, currentPeriodKey, cost, "", -1, "", -1)
+	if err != nil {
+		externalUserWarn(reqCtx, "保存 VIP 用量失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
+		return 0
+	}
+	return quota.UsedCount
+}
+
+// setExternalQuotaContext 将本次配额扣除信息写入 gin context，供消费日志记录
+// key 定义见 constant.ContextKeyExternalQuota*
+func setExternalQuotaContext(c *gin.Context, channelId string, charged, used, total, remaining int, saveErr error) {
+	common.SetContextKey(c, constant.ContextKeyExternalQuotaChannelId, channelId)
+	common.SetContextKey(c, constant.ContextKeyExternalQuotaCharged, charged)
+	common.SetContextKey(c, constant.ContextKeyExternalQuotaUsed, used)
+	common.SetContextKey(c, constant.ContextKeyExternalQuotaTotal, total)
+	common.SetContextKey(c, constant.ContextKeyExternalQuotaRemaining, remaining)
+	common.SetContextKey(c, constant.ContextKeyExternalQuotaSaved, saveErr == nil)
+	if saveErr != nil {
+		common.SetContextKey(c, constant.ContextKeyExternalQuotaError, saveErr.Error())
 	}
 }
 
+// quotaPercentUsed 已用配额百分比 (0-100，向下取整)，配额为 0 时视为已用完
+func quotaPercentUsed(used, limit int) int {
+	if limit <= 0 {
+		return 100
+	}
+	percent := used * 100 / limit
+	if percent < 0 {
+		return 0
+	}
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
 func maskString(s string, n int) string {
 	if len(s) <= n {
 		return s
@@ -248,11 +706,15 @@ func maskString(s string, n int) string {
 	return s[:n] + "..."
 }
 
-func verifyExternalJWT(tokenString string) (*ExternalUserData, error) {
+// verifyExternalJWT 校验 token 并读取用户数据，Redis 读取随 reqCtx 取消
+func verifyExternalJWT(reqCtx context.Context, tokenString string) (*ExternalUserData, error) {
 	parts := strings.Split(tokenString, ".")
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("无效的 token 格式")
 	}
+	if err := verifyJWTSignature(parts); err != nil {
+		return nil, err
+	}
 
 	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
@@ -267,10 +729,11 @@ func verifyExternalJWT(tokenString string) (*ExternalUserData, error) {
 		return nil, fmt.Errorf("无法解析 token payload")
 	}
 
-	if exp, ok := claims["exp"].(float64); ok {
-		if int64(exp) < time.Now().Unix() {
-			return nil, fmt.Errorf("token 已过期")
-		}
+	if err := validateJWTTimeClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := validateJWTIssuerAudience(claims); err != nil {
+		return nil, err
 	}
 
 	userId, _ := claims["userId"].(string)
@@ -280,8 +743,15 @@ func verifyExternalJWT(tokenString string) (*ExternalUserData, error) {
 		return nil, fmt.Errorf("token 中缺少用户信息")
 	}
 
-	userData, err := getUserFromRedis(userId)
+	userData, err := getCachedUser(reqCtx, userId)
 	if err != nil {
+		// 严格模式下拒绝 Redis 中不存在的用户；Redis 故障时仍使用回退数据，避免全部拒绝
+		if errors.Is(err, errExternalUserNotFound) && externalUserConfig.StrictUserLookup {
+			return nil, err
+		}
+		if !errors.Is(err, errExternalUserNotFound) {
+			externalUserWarn(reqCtx, "读取用户失败，使用 token 中的信息", "user", common.HashPII(userId), "error", err)
+		}
 		userData = &ExternalUserData{
 			ID:    userId,
 			Email: email,
@@ -294,9 +764,16 @@ func verifyExternalJWT(tokenString string) (*ExternalUserData, error) {
 	return userData, nil
 }
 
+// errExternalUserNotFound Redis 中不存在该用户 (区别于 Redis 访问错误)
+var errExternalUserNotFound = errors.New("用户不存在")
 
 // getUserFromRedis 从 Redis 获取用户数据
 func getUserFromRedis(userId string) (*ExternalUserData, error) {
+	return getUserFromRedisContext(ctx, userId)
+}
+
+// getUserFromRedisContext 从 Redis 获取用户数据，reqCtx 取消或超时时立即返回
+func getUserFromRedisContext(reqCtx context.Context, userId string) (*ExternalUserData, error) {
 	if !externalUserConfig.Enabled {
 		return nil, fmt.Errorf("Redis 未配置")
 	}
@@ -305,9 +782,9 @@ func getUserFromRedis(userId string) (*ExternalUserData, error) {
 
 	if externalUserConfig.useLocalRedis {
 		// 本地 Redis
-		val, err := externalUserConfig.redisClient.Get(ctx, key).Result()
+		val, err := externalUserConfig.redisClient.Get(reqCtx, key).Result()
 		if err == redis.Nil {
-			return nil, fmt.Errorf("用户不存在")
+			return nil, errExternalUserNotFound
 		}
 		if err != nil {
 			return nil, err
@@ -320,40 +797,62 @@ func getUserFromRedis(userId string) (*ExternalUserData, error) {
 	}
 
 	// Upstash REST API (保持原有逻辑)
-	return getUserFromUpstash(userId)
+	return getUserFromUpstash(reqCtx, userId)
 }
 
 // getUserQuota 获取用户配额 (旧版，保留兼容)
-func getUserQuota(userId string) (*UserQuota, error) {
+func getUserQuota(reqCtx context.Context, userId string) (*UserQuota, error) {
 	if !externalUserConfig.Enabled {
-		return &UserQuota{MonthKey: time.Now().Format("2006-01")}, nil
+		return &UserQuota{MonthKey: CurrentQuotaPeriodKey(0)}, nil
 	}
 
 	key := "quota:" + userId
 
 	if externalUserConfig.useLocalRedis {
-		val, err := externalUserConfig.redisClient.Get(ctx, key).Result()
+		val, err := externalUserConfig.redisClient.Get(reqCtx, key).Result()
 		if err == redis.Nil {
-			return &UserQuota{MonthKey: time.Now().Format("2006-01")}, nil
+			return &UserQuota{MonthKey: CurrentQuotaPeriodKey(0)}, nil
 		}
 		if err != nil {
 			return nil, err
 		}
 		var quota UserQuota
 		if err := json.Unmarshal([]byte(val), &quota); err != nil {
-			return &UserQuota{MonthKey: time.Now().Format("2006-01")}, nil
+			return &UserQuota{MonthKey: CurrentQuotaPeriodKey(0)}, nil
 		}
 		return &quota, nil
 	}
 
-	// Upstash REST API
-	return getQuotaFromUpstash(userId)
+	// Upstash REST API (临时性错误重试)
+	var quota *UserQuota
+	err := withExternalRedisRetry(reqCtx, func() error {
+		var err error
+		quota, err = getQuotaFromUpstash(reqCtx, userId)
+		return err
+	})
+	return quota, err
 }
 
 // getUserChannelQuota 获取用户在特定渠道的配额 (per-user-per-channel)
 func getUserChannelQuota(userId string, channelId string) (*UserQuota, error) {
+	return getUserChannelQuotaContext(ctx, userId, channelId)
+}
+
+// getUserChannelQuotaContext 获取用户在特定渠道的配额，临时性错误在 reqCtx 截止前重试
+func getUserChannelQuotaContext(reqCtx context.Context, userId string, channelId string) (*UserQuota, error) {
+	var quota *UserQuota
+	err := withExternalRedisRetry(reqCtx, func() error {
+		var err error
+		quota, err = loadUserChannelQuota(reqCtx, userId, channelId)
+		return err
+	})
+	return quota, err
+}
+
+// loadUserChannelQuota 读取一次用户渠道配额 (不重试)
+func loadUserChannelQuota(reqCtx context.Context, userId string, channelId string) (*UserQuota, error) {
 	if !externalUserConfig.Enabled {
-		return &UserQuota{MonthKey: time.Now().Format("2006-01")}, nil
+		return &UserQuota{MonthKey: CurrentQuotaPeriodKey(0)}, nil
 	}
 
 	// 如果没有指定渠道，使用旧的 key 格式
@@ -365,26 +864,26 @@ func getUserChannelQuota(userId string, channelId string) (*UserQuota, error) {
 	}
 
 	if externalUserConfig.useLocalRedis {
-		val, err := externalUserConfig.redisClient.Get(ctx, key).Result()
+		val, err := externalUserConfig.redisClient.Get(reqCtx, key).Result()
 		if err == redis.Nil {
-			return &UserQuota{MonthKey: time.Now().Format("2006-01")}, nil
+			return &UserQuota{MonthKey: CurrentQuotaPeriodKey(0), isNew: true}, nil
 		}
 		if err != nil {
 			return nil, err
 		}
 		var quota UserQuota
 		if err := json.Unmarshal([]byte(val), &quota); err != nil {
-			return &UserQuota{MonthKey: time.Now().Format("2006-01")}, nil
+			return &UserQuota{MonthKey: CurrentQuotaPeriodKey(0)}, nil
 		}
 		return &quota, nil
 	}
 
 	// Upstash REST API
-	return getChannelQuotaFromUpstash(userId, channelId)
+	return getChannelQuotaFromUpstash(reqCtx, userId, channelId)
 }
 
 // saveUserQuota 保存用户配额 (旧版，保留兼容)
-func saveUserQuota(userId string, quota *UserQuota) error {
+func saveUserQuota(reqCtx context.Context, userId string, quota *UserQuota) error {
 	if !externalUserConfig.Enabled {
 		return fmt.Errorf("Redis 未配置")
 	}
@@ -396,15 +895,30 @@ func saveUserQuota(userId string, quota *UserQuota) error {
 	}
 
 	if externalUserConfig.useLocalRedis {
-		return externalUserConfig.redisClient.Set(ctx, key, string(quotaJSON), 0).Err()
+		ttl := time.Duration(quotaKeyTTL(quota.MonthKey, time.Now())) * time.Second
+		return externalUserConfig.redisClient.Set(reqCtx, key, string(quotaJSON), ttl).Err()
 	}
 
-	// Upstash REST API
-	return saveQuotaToUpstash(userId, quota)
+	// Upstash REST API (SET 幂等，临时性错误重试)
+	return withExternalRedisRetry(reqCtx, func() error {
+		return saveQuotaToUpstash(reqCtx, userId, quota)
+	})
 }
 
 // saveUserChannelQuota 保存用户在特定渠道的配额 (per-user-per-channel)
 func saveUserChannelQuota(userId string, channelId string, quota *UserQuota) error {
+	return saveUserChannelQuotaContext(ctx, userId, channelId, quota)
+}
+
+// saveUserChannelQuotaContext 保存用户渠道配额 (SET 为幂等操作)，临时性错误在 reqCtx 截止前重试
+func saveUserChannelQuotaContext(reqCtx context.Context, userId string, channelId string, quota *UserQuota) error {
+	return withExternalRedisRetry(reqCtx, func() error {
+		return storeUserChannelQuota(reqCtx, userId, channelId, quota)
+	})
+}
+
+// storeUserChannelQuota 写入一次用户渠道配额 (不重试)
+func storeUserChannelQuota(reqCtx context.Context, userId string, channelId string, quota *UserQuota) error {
 	if !externalUserConfig.Enabled {
 		return fmt.Errorf("Redis 未配置")
 	}
@@ -423,11 +937,12 @@ func saveUserChannelQuota(userId string, channelId string, quota *UserQuota) err
 	}
 
 	if externalUserConfig.useLocalRedis {
-		return externalUserConfig.redisClient.Set(ctx, key, string(quotaJSON), 0).Err()
+		ttl := time.Duration(quotaKeyTTL(quota.MonthKey, time.Now())) * time.Second
+		return externalUserConfig.redisClient.Set(reqCtx, key, string(quotaJSON), ttl).Err()
 	}
 
 	// Upstash REST API
-	return saveChannelQuotaToUpstash(userId, channelId, quota)
+	return saveChannelQuotaToUpstash(reqCtx, userId, channelId, quota)
 }
 
 // GetExternalUserQuotaInfo 获取外部用户配额信息
@@ -441,27 +956,34 @@ func GetExternalUserQuotaInfo(userId string) (used int, total int, isVIP bool, e
 		return 0, 0, false, err
 	}
 
-	isVIP = userData.IsVIP && userData.VIPExpiresAt > time.Now().Unix()
-	if isVIP || userData.Username == "admin" {
+	now := time.Now()
+	isVIP = HasVIPAccess(userData, now) || isExternalAdmin(userData)
+	unlimited := IsUnlimitedUser(userData, now)
+	if unlimited && !externalUserConfig.TrackVIPUsage {
 		return 0, -1, true, nil
 	}
 
-	quota, err := getUserQuota(userId)
+	// 用量按渠道 (及渠道下的模型) 记录，这里汇总当前周期各渠道的用量
+	channels, err := GetUserChannelQuotas(userId, userData.ResetDay)
 	if err != nil {
 		return 0, 0, false, err
 	}
-
-	currentMonthKey := time.Now().Format("2006-01")
-	if quota.MonthKey != currentMonthKey {
-		quota.UsedCount = 0
+	for _, channel := range channels {
+		used += channel.UsedCount
 	}
 
-	return quota.UsedCount, externalUserConfig.MonthlyQuota, false, nil
+	if unlimited {
+		// VIP 仅统计实际用量，不限制总量
+		return used, -1, true, nil
+	}
+	// 按等级限额的 VIP 与普通用户一样返回等级 / 用户自定义配额
+	limit, _ := ResolveUserQuotaLimit(userData, externalUserConfig.MonthlyQuota, quotaLimitSourceGlobal)
+	return used, limit, isVIP, nil
 }
 
 // SetUserVIP 设置用户 VIP 状态
-func SetUserVIP(userId string, isVIP bool, expiresAt int64) error {
-	userData, err := getUserFromRedis(userId)
+func SetUserVIP(reqCtx context.Context, userId string, isVIP bool, expiresAt int64) error {
+	userData, err := getUserFromRedisContext(reqCtx, userId)
 	if err != nil {
 		return err
 	}
@@ -475,13 +997,16 @@ func SetUserVIP(userId string, isVIP bool, expiresAt int64) error {
 	}
 
 	key := "user:" + userId
+	defer InvalidateExternalUserCache(userId)
 
 	if externalUserConfig.useLocalRedis {
-		return externalUserConfig.redisClient.Set(ctx, key, string(userJSON), 0).Err()
+		return externalUserConfig.redisClient.Set(reqCtx, key, string(userJSON), 0).Err()
 	}
 
-	// Upstash REST API
-	return setUserToUpstash(userId, userData)
+	// Upstash REST API (SET 幂等，临时性错误重试)
+	return withExternalRedisRetry(reqCtx, func() error {
+		return setUserToUpstash(reqCtx, userId, userData)
+	})
 }
 
 // IsExternalUserEnabled 检查外部用户验证是否启用
@@ -499,19 +1024,18 @@ func IsUsingLocalRedis() bool {
 	return externalUserConfig.useLocalRedis
 }
 
-
 // ========== Upstash REST API 兼容函数 ==========
 
-func getUserFromUpstash(userId string) (*ExternalUserData, error) {
+func getUserFromUpstash(reqCtx context.Context, userId string) (*ExternalUserData, error) {
 	key := "user:" + userId
 	url := fmt.Sprintf("%s/get/%s", externalUserConfig.RedisURL, key)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+externalUserConfig.RedisToken)
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := upstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -522,6 +1046,9 @@ func getUserFromUpstash(userId string) (*ExternalUserData, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := upstashStatusError(resp.StatusCode, body); err != nil {
+		return nil, err
+	}
 
 	var result struct {
 		Result interface{} `json:"result"`
@@ -531,14 +1058,14 @@ func getUserFromUpstash(userId string) (*ExternalUserData, error) {
 	}
 
 	if result.Result == nil {
-		return nil, fmt.Errorf("用户不存在")
+		return nil, errExternalUserNotFound
 	}
 
 	var userData ExternalUserData
 	switch v := result.Result.(type) {
 	case string:
 		if v == "" {
-			return nil, fmt.Errorf("用户不存在")
+			return nil, errExternalUserNotFound
 		}
 		if err := json.Unmarshal([]byte(v), &userData); err != nil {
 			return nil, err
@@ -555,16 +1082,16 @@ func getUserFromUpstash(userId string) (*ExternalUserData, error) {
 	return &userData, nil
 }
 
-func getQuotaFromUpstash(userId string) (*UserQuota, error) {
+func getQuotaFromUpstash(reqCtx context.Context, userId string) (*UserQuota, error) {
 	key := "quota:" + userId
 	url := fmt.Sprintf("%s/get/%s", externalUserConfig.RedisURL, key)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+externalUserConfig.RedisToken)
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := upstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -575,6 +1102,9 @@ func getQuotaFromUpstash(userId string) (*UserQuota, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := upstashStatusError(resp.StatusCode, body); err != nil {
+		return nil, err
+	}
 
 	var result struct {
 		Result interface{} `json:"result"`
@@ -583,7 +1113,7 @@ func getQuotaFromUpstash(userId string) (*UserQuota, error) {
 		return nil, err
 	}
 
-	quota := &UserQuota{MonthKey: time.Now().Format("2006-01")}
+	quota := &UserQuota{MonthKey: CurrentQuotaPeriodKey(0)}
 	if result.Result != nil {
 		if v, ok := result.Result.(string); ok && v != "" {
 			json.Unmarshal([]byte(v), quota)
@@ -593,35 +1123,34 @@ func getQuotaFromUpstash(userId string) (*UserQuota, error) {
 	return quota, nil
 }
 
-func saveQuotaToUpstash(userId string, quota *UserQuota) error {
+func saveQuotaToUpstash(reqCtx context.Context, userId string, quota *UserQuota) error {
 	quotaJSON, _ := json.Marshal(quota)
 	key := "quota:" + userId
-	cmdBody, _ := json.Marshal([]string{"SET", key, string(quotaJSON)})
+	cmdBody, _ := json.Marshal(quotaSetCommand(key, string(quotaJSON), quota.MonthKey))
 
-	req, err := http.NewRequest("POST", externalUserConfig.RedisURL, bytes.NewReader(cmdBody))
+	req, err := http.NewRequestWithContext(reqCtx, "POST", externalUserConfig.RedisURL, bytes.NewReader(cmdBody))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Authorization", "Bearer "+externalUserConfig.RedisToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := upstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("Redis 返回错误: %s", string(body))
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return upstashStatusError(resp.StatusCode, body)
 }
 
 // getChannelQuotaFromUpstash 从 Upstash 获取用户渠道配额
-func getChannelQuotaFromUpstash(userId string, channelId string) (*UserQuota, error) {
+func getChannelQuotaFromUpstash(reqCtx context.Context, userId string, channelId string) (*UserQuota, error) {
 	var key string
 	if channelId == "" {
 		key = "quota:" + userId
@@ -630,13 +1159,13 @@ func getChannelQuotaFromUpstash(userId string, channelId string) (*UserQuota, er
 	}
 	
 	url := fmt.Sprintf("%s/get/%s", externalUserConfig.RedisURL, key)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+externalUserConfig.RedisToken)
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := upstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -647,6 +1176,9 @@ func getChannelQuotaFromUpstash(userId string, channelId string) (*UserQuota, er
 	if err != nil {
 		return nil, err
 	}
+	if err := upstashStatusError(resp.StatusCode, body); err != nil {
+		return nil, err
+	}
 
 	var result struct {
 		Result interface{} `json:"result"`
@@ -655,7 +1187,7 @@ func getChannelQuotaFromUpstash(userId string, channelId string) (*UserQuota, er
 		return nil, err
 	}
 
-	quota := &UserQuota{MonthKey: time.Now().Format("2006-01")}
+	quota := &UserQuota{MonthKey: CurrentQuotaPeriodKey(0), isNew: result.Result == nil}
 	if result.Result != nil {
 		if v, ok := result.Result.(string); ok && v != "" {
 			json.Unmarshal([]byte(v), quota)
@@ -666,7 +1198,7 @@ func getChannelQuotaFromUpstash(userId string, channelId string) (*UserQuota, er
 }
 
 // saveChannelQuotaToUpstash 保存用户渠道配额到 Upstash
-func saveChannelQuotaToUpstash(userId string, channelId string, quota *UserQuota) error {
+func saveChannelQuotaToUpstash(reqCtx context.Context, userId string, channelId string, quota *UserQuota) error {
 	quotaJSON, _ := json.Marshal(quota)
 	var key string
 	if channelId == "" {
@@ -674,48 +1206,64 @@ func saveChannelQuotaToUpstash(userId string, channelId string, quota *UserQuota
 	} else {
 		key = "quota:" + userId + ":channel:" + channelId
 	}
-	cmdBody, _ := json.Marshal([]string{"SET", key, string(quotaJSON)})
+	cmdBody, _ := json.Marshal(quotaSetCommand(key, string(quotaJSON), quota.MonthKey))
 
-	req, err := http.NewRequest("POST", externalUserConfig.RedisURL, bytes.NewReader(cmdBody))
+	req, err := http.NewRequestWithContext(reqCtx, "POST", externalUserConfig.RedisURL, bytes.NewReader(cmdBody))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Authorization", "Bearer "+externalUserConfig.RedisToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := upstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("Redis 返回错误: %s", string(body))
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := upstashStatusError(resp.StatusCode, body); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func setUserToUpstash(userId string, userData *ExternalUserData) error {
+// quotaSetCommand 构造写入配额记录的 SET 命令 (带周期结束时的过期时间)
+func quotaSetCommand(key string, value string, monthKey string) []string {
+	cmd := []string{"SET", key, value}
+	if ttl := quotaKeyTTL(monthKey, time.Now()); ttl > 0 {
+		cmd = append(cmd, "EX", strconv.FormatInt(ttl, 10))
+	}
+	return cmd
+}
+
+func setUserToUpstash(reqCtx context.Context, userId string, userData *ExternalUserData) error {
 	userJSON, _ := json.Marshal(userData)
 	key := "user:" + userId
 	cmdBody, _ := json.Marshal([]string{"SET", key, string(userJSON)})
 
-	req, err := http.NewRequest("POST", externalUserConfig.RedisURL, bytes.NewReader(cmdBody))
+	req, err := http.NewRequestWithContext(reqCtx, "POST", externalUserConfig.RedisURL, bytes.NewReader(cmdBody))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Authorization", "Bearer "+externalUserConfig.RedisToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := upstashHTTPClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	return nil
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return upstashStatusError(resp.StatusCode, body)
 }
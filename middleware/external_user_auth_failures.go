@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 验证失败统计 (用于发现撞库等滥用行为)
+// 计数 key 按 userId / IP 分别记录，统计窗口到期后自动过期；
+// 配置了阈值时，窗口内失败次数达到阈值会临时封禁对应的 IP。
+// userId 取自未验证签名的 token，任何人都能伪造，因此只计数、不封禁，避免他人借此锁定正常用户。
+// 格式错误的 token 单独按 IP 计数 (类型 "malformed")，不计入封禁，便于定位异常客户端。
+const (
+	authFailKeyPrefix  = "authfail:"
+	authBlockKeyPrefix = "authblock:"
+
+	defaultMinTokenLength = 20
+)
+
+// errMalformedToken token 形状不符合 JWT (header.payload.signature)
+var errMalformedToken = errors.New("malformed token")
+
+// AuthFailureRecord 验证失败统计记录
+type AuthFailureRecord struct {
+	Type     string `json:"type"`     // "user"、"ip" 或 "malformed"
+	Subject  string `json:"subject"`  // userId 或 IP
+	Count    int64  `json:"count"`    // 统计窗口内失败次数
+	TTL      int64  `json:"ttl"`      // 计数剩余有效秒数
+	Blocked  bool   `json:"blocked"`  // 是否已被封禁
+	BlockTTL int64  `json:"blockTtl"` // 封禁剩余秒数
+}
+
+// extractUnverifiedUserId 从未验证的 token 中提取 userId (仅用于失败统计，不可用于鉴权)
+func extractUnverifiedUserId(tokenString string) string {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	userId, _ := claims["userId"].(string)
+	return userId
+}
+
+// checkTokenShape 在解析 JWT 前做廉价的格式校验 (最小长度、恰好两个 '.')
+func checkTokenShape(tokenString string) error {
+	if len(tokenString) < externalUserConfig.MinTokenLength || strings.Count(tokenString, ".") != 2 {
+		return errMalformedToken
+	}
+	return nil
+}
+
+// recordMalformedToken 记录一次格式错误的 token (按 IP 统计)
+func recordMalformedToken(ip string) {
+	if ip == "" {
+		return
+	}
+	if _, err := externalRedisIncrWithTTL(authFailKeyPrefix+"malformed:"+ip, externalUserConfig.AuthFailWindow); err != nil {
+		externalUserWarn(ctx, "记录格式错误 token 次数失败", "error", err)
+	}
+}
+
+// recordAuthFailure 记录一次验证失败，IP 达到阈值时封禁
+func recordAuthFailure(userId string, ip string) {
+	subjects := map[string]string{"ip": ip}
+	if userId != "" {
+		subjects["user"] = userId
+	}
+	for kind, subject := range subjects {
+		if subject == "" {
+			continue
+		}
+		logSubject := subject
+		if kind == "user" {
+			logSubject = common.HashPII(subject)
+		}
+		count, err := externalRedisIncrWithTTL(authFailKeyPrefix+kind+":"+subject, externalUserConfig.AuthFailWindow)
+		if err != nil {
+			externalUserWarn(ctx, "记录验证失败次数失败", "type", kind, "error", err)
+			continue
+		}
+		threshold := externalUserConfig.AuthFailBlockThreshold
+		if kind == "ip" && threshold > 0 && count >= int64(threshold) {
+			blockKey := authBlockKeyPrefix + kind + ":" + subject
+			if _, err := externalRedisDo("SET", blockKey, "1", "EX", int64(externalUserConfig.AuthFailBlockDuration/time.Second)); err != nil {
+				externalUserWarn(ctx, "临时封禁失败", "type", kind, "subject", logSubject, "error", err)
+				continue
+			}
+			externalUserWarn(ctx, "验证失败次数过多，已临时封禁", "type", kind, "subject", logSubject, "count", count)
+		}
+	}
+}
+
+// isAuthBlocked 检查 IP 是否因验证失败过多被封禁
+func isAuthBlocked(ip string) bool {
+	if externalUserConfig.AuthFailBlockThreshold <= 0 || ip == "" {
+		return false
+	}
+	val, err := externalRedisDo("EXISTS", authBlockKeyPrefix+"ip:"+ip)
+	if err != nil {
+		return false
+	}
+	return externalRedisInt(val) > 0
+}
+
+// GetAuthFailureOffenders 获取统计窗口内验证失败的 userId / IP 列表
+func GetAuthFailureOffenders() ([]AuthFailureRecord, error) {
+	keys, err := externalRedisScan(authFailKeyPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]AuthFailureRecord, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, authFailKeyPrefix), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		record := AuthFailureRecord{Type: parts[0], Subject: parts[1]}
+		if val, err := externalRedisDo("GET", key); err == nil && val != nil {
+			record.Count = externalRedisInt(val)
+		}
+		if val, err := externalRedisDo("TTL", key); err == nil {
+			record.TTL = externalRedisInt(val)
+		}
+		if val, err := externalRedisDo("TTL", authBlockKeyPrefix+parts[0]+":"+parts[1]); err == nil {
+			if ttl := externalRedisInt(val); ttl > 0 {
+				record.Blocked = true
+				record.BlockTTL = ttl
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,3275 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const testJWTSecret = "test-secret"
+
+// gin 的运行模式是全局变量，只在这里设置一次，避免并发测试中重复设置产生数据竞争
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// makeTestToken 使用测试密钥签发 HS256 token
+func makeTestToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// seedTestUser 写入外部用户记录
+func seedTestUser(t *testing.T, mr *miniredis.Miniredis, user ExternalUserData) {
+	t.Helper()
+	data, _ := json.Marshal(user)
+	if err := mr.Set("user:"+user.ID, string(data)); err != nil {
+		t.Fatalf("seed user: %v", err)
+	}
+}
+
+// doExternalRequest 经过 ExternalUserAuth 发送一次请求
+func doExternalRequest(t *testing.T, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	return doExternalRequestWithBody(t, headers, "")
+}
+
+// doExternalRequestWithBody 经过 ExternalUserAuth 发送一次带请求体的请求
+func doExternalRequestWithBody(t *testing.T, headers map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveExternalRequest(newExternalTestRouter(), headers, body)
+}
+
+// newExternalTestRouter 创建经过 ExternalUserAuth 的测试路由 (并发测试在 goroutine 外创建一次)
+func newExternalTestRouter() *gin.Engine {
+	r := gin.New()
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return r
+}
+
+// serveExternalRequest 通过 r 发送一次请求 (可在多个 goroutine 中并发调用)
+func serveExternalRequest(r *gin.Engine, headers map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// useTestRedis 使用内存 Redis 替换外部用户存储，测试结束后恢复原配置
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	prev := externalUserConfig
+	externalUserConfig.Enabled = true
+	externalUserConfig.useLocalRedis = true
+	externalUserConfig.redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	externalUserConfig.JWTSecret = testJWTSecret
+	t.Cleanup(func() {
+		pendingAuditWrites.Wait()
+		externalUserConfig.redisClient.Close()
+		externalUserConfig = prev
+	})
+	return mr
+}
+
+func TestQuotaPeriodPerUserAnchor(t *testing.T) {
+	prevDay := externalUserConfig.ResetDayOfMonth
+	externalUserConfig.ResetDayOfMonth = 1
+	defer func() { externalUserConfig.ResetDayOfMonth = prevDay }()
+
+	defaultUser := &ExternalUserData{ID: "u1"}
+	anchoredUser := &ExternalUserData{ID: "u2", ResetDay: 15}
+
+	before := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	after := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(2025, 4, 2, 12, 0, 0, 0, time.UTC)
+
+	key := func(u *ExternalUserData, now time.Time) string {
+		k, _, _ := quotaPeriod(now, effectiveResetDay(u))
+		return k
+	}
+
+	// 全局锚定日 (1 号): 3 月内不重置，4 月 1 日重置
+	if key(defaultUser, before) != "2025-03" || key(defaultUser, after) != "2025-03" {
+		t.Fatalf("default user should stay in 2025-03, got %s / %s", key(defaultUser, before), key(defaultUser, after))
+	}
+	if key(defaultUser, nextMonth) != "2025-04" {
+		t.Fatalf("default user should reset on Apr 1, got %s", key(defaultUser, nextMonth))
+	}
+
+	// 用户锚定日 (15 号): 3 月 15 日重置，4 月 2 日仍在同一周期
+	if key(anchoredUser, before) != "2025-02-15" {
+		t.Fatalf("anchored user before 15th: got %s", key(anchoredUser, before))
+	}
+	if key(anchoredUser, after) != "2025-03-15" {
+		t.Fatalf("anchored user after 15th: got %s", key(anchoredUser, after))
+	}
+	if key(anchoredUser, nextMonth) != "2025-03-15" {
+		t.Fatalf("anchored user should not reset on Apr 1, got %s", key(anchoredUser, nextMonth))
+	}
+
+	_, _, end := quotaPeriod(after, effectiveResetDay(anchoredUser))
+	if !end.Equal(time.Date(2025, 4, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("anchored user next reset: got %v", end)
+	}
+}
+
+func TestQuotaPeriodShortMonthsAndYearBoundary(t *testing.T) {
+	cases := []struct {
+		now      time.Time
+		resetDay int
+		wantKey  string
+		wantEnd  time.Time
+	}{
+		// 31 号锚定: 2 月截断为月末 (含闰年)，3 月恢复 31 号
+		{time.Date(2025, 2, 27, 8, 0, 0, 0, time.UTC), 31, "2025-01-31", time.Date(2025, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2025, 2, 28, 8, 0, 0, 0, time.UTC), 31, "2025-02-28", time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 2, 29, 8, 0, 0, 0, time.UTC), 31, "2024-02-29", time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2025, 4, 30, 8, 0, 0, 0, time.UTC), 31, "2025-04-30", time.Date(2025, 5, 31, 0, 0, 0, 0, time.UTC)},
+		// 跨年
+		{time.Date(2025, 1, 10, 8, 0, 0, 0, time.UTC), 15, "2024-12-15", time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC), 1, "2024-12", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// 非法锚定日回退为 1 号
+		{time.Date(2025, 6, 5, 8, 0, 0, 0, time.UTC), 0, "2025-06", time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		key, _, end := quotaPeriod(tc.now, tc.resetDay)
+		if key != tc.wantKey || !end.Equal(tc.wantEnd) {
+			t.Errorf("quotaPeriod(%v, %d) = %s, %v; want %s, %v", tc.now, tc.resetDay, key, end, tc.wantKey, tc.wantEnd)
+		}
+	}
+
+	// 新记录使用全局锚定日的周期 key，不会被误判为需要重置
+	mr := useTestRedis(t)
+	externalUserConfig.ResetDayOfMonth = 15
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	quota, err := getUserChannelQuota("u1", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.MonthKey != CurrentQuotaPeriodKey(0) {
+		t.Fatalf("fresh record should use the anchored period key %s, got %s", CurrentQuotaPeriodKey(0), quota.MonthKey)
+	}
+}
+
+func TestAuthFailureThresholdBlocks(t *testing.T) {
+	useTestRedis(t)
+	externalUserConfig.AuthFailWindow = time.Minute
+	externalUserConfig.AuthFailBlockThreshold = 3
+	externalUserConfig.AuthFailBlockDuration = 10 * time.Minute
+
+	for i := 0; i < 2; i++ {
+		recordAuthFailure("victim", "10.0.0.1")
+	}
+	if isAuthBlocked("10.0.0.1") {
+		t.Fatal("should not block below threshold")
+	}
+
+	recordAuthFailure("victim", "10.0.0.1")
+	if !isAuthBlocked("10.0.0.1") {
+		t.Fatal("should block ip after reaching threshold")
+	}
+	if isAuthBlocked("10.0.0.2") {
+		t.Fatal("other ips should not be blocked")
+	}
+
+	records, err := GetAuthFailureOffenders()
+	if err != nil {
+		t.Fatalf("GetAuthFailureOffenders: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected user and ip records, got %+v", records)
+	}
+	for _, r := range records {
+		// 未验证的 userId 只计数不封禁
+		if r.Count != 3 || r.Blocked != (r.Type == "ip") {
+			t.Fatalf("unexpected record %+v", r)
+		}
+	}
+}
+
+func TestForgedTokensDoNotLockOutUser(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.AuthFailWindow = time.Minute
+	externalUserConfig.AuthFailBlockThreshold = 3
+	externalUserConfig.AuthFailBlockDuration = 10 * time.Minute
+	seedTestUser(t, mr, ExternalUserData{ID: "victim", Email: "victim@example.com"})
+
+	// 攻击者用受害者的 userId 伪造签名错误的 token
+	forged := makeTestToken(t, map[string]interface{}{"userId": "victim", "email": "victim@example.com"})
+	forged = forged[:strings.LastIndex(forged, ".")+1] + base64.RawURLEncoding.EncodeToString([]byte("forged-signature-forged-signature"))
+	for i := 0; i < 5; i++ {
+		doExternalRequest(t, map[string]string{"X-External-User-Token": forged, "X-Forwarded-For": "203.0.113.9"})
+	}
+	if w := doExternalRequest(t, map[string]string{"X-External-User-Token": forged, "X-Forwarded-For": "203.0.113.9"}); w.Code != http.StatusForbidden {
+		t.Fatalf("attacker ip should be blocked, got %d", w.Code)
+	}
+
+	valid := makeTestToken(t, map[string]interface{}{"userId": "victim", "email": "victim@example.com"})
+	if w := doExternalRequest(t, map[string]string{"X-External-User-Token": valid, "X-Forwarded-For": "198.51.100.7"}); w.Code != http.StatusOK {
+		t.Fatalf("validly signed token should not be blocked by forged failures, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthFailureCounterExpires(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.AuthFailWindow = time.Minute
+	externalUserConfig.AuthFailBlockThreshold = 3
+
+	recordAuthFailure("u1", "10.0.0.1")
+	recordAuthFailure("u1", "10.0.0.1")
+	if ttl := mr.TTL(authFailKeyPrefix + "user:u1"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("counter should be created with the window as ttl, got %v", ttl)
+	}
+	mr.FastForward(time.Minute + time.Second)
+	recordAuthFailure("u1", "10.0.0.1")
+
+	if isAuthBlocked("10.0.0.1") {
+		t.Fatal("counter should have reset after the window expired")
+	}
+	if got, _ := mr.Get(authFailKeyPrefix + "user:u1"); got != "1" {
+		t.Fatalf("expected fresh counter 1, got %q", got)
+	}
+}
+
+func TestVIPUsageCountedWhenEnabled(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "vip1", Email: "vip@example.com", IsVIP: true, VIPExpiresAt: time.Now().Add(time.Hour).Unix()})
+	token := makeTestToken(t, map[string]interface{}{"userId": "vip1", "email": "vip@example.com"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1"}
+
+	externalUserConfig.TrackVIPUsage = false
+	if w := doExternalRequest(t, headers); w.Header().Get("X-Quota-Used") != "0" {
+		t.Fatalf("untracked VIP should report 0, got %s", w.Header().Get("X-Quota-Used"))
+	}
+
+	externalUserConfig.TrackVIPUsage = true
+	doExternalRequest(t, headers)
+	w := doExternalRequest(t, headers)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if w.Header().Get("X-Quota-Used") != "2" || w.Header().Get("X-Quota-Total") != "-1" {
+		t.Fatalf("expected used=2 total=-1, got used=%s total=%s", w.Header().Get("X-Quota-Used"), w.Header().Get("X-Quota-Total"))
+	}
+
+	// 并发请求不丢失计数
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			countVIPUsage(context.Background(), &ExternalUserData{ID: "vip1"}, "c2", 1)
+		}()
+	}
+	wg.Wait()
+
+	used, total, isVIP, err := GetExternalUserQuotaInfo("vip1")
+	if err != nil || used != 12 || total != -1 || !isVIP {
+		t.Fatalf("expected aggregated used=12 total=-1 vip, got used=%d total=%d vip=%v err=%v", used, total, isVIP, err)
+	}
+}
+
+func TestTransferUserQuota(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "from"})
+	seedTestUser(t, mr, ExternalUserData{ID: "to"})
+	period := CurrentQuotaPeriodKey(0)
+	if err := saveUserChannelQuota("from", "c1", &UserQuota{UsedCount: 10, MonthKey: period}); err != nil {
+		t.Fatalf("seed quota: %v", err)
+	}
+
+	result, err := TransferUserQuota("from", "to", "c1", 5, 30, period)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if result.FromRemaining != 15 || result.ToRemaining != 35 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	fromQuota, _ := getUserChannelQuota("from", "c1")
+	toQuota, _ := getUserChannelQuota("to", "c1")
+	if fromQuota.UsedCount != 15 || toQuota.UsedCount != -5 {
+		t.Fatalf("unexpected stored counts from=%d to=%d", fromQuota.UsedCount, toQuota.UsedCount)
+	}
+}
+
+func TestTransferUserQuotaUsesUserLimit(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "from", QuotaLimit: 12})
+	seedTestUser(t, mr, ExternalUserData{ID: "to"})
+	period := CurrentQuotaPeriodKey(0)
+	saveUserChannelQuota("from", "c1", &UserQuota{UsedCount: 10, MonthKey: period})
+
+	// 渠道配额为 30，但转出方自定义配额为 12，只剩 2 次可转出
+	if _, err := TransferUserQuota("from", "to", "c1", 5, 30, period); !errors.Is(err, ErrQuotaTransferInsufficient) {
+		t.Fatalf("expected custom limit to apply, got %v", err)
+	}
+	result, err := TransferUserQuota("from", "to", "c1", 2, 30, period)
+	if err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if result.FromRemaining != 0 || result.ToRemaining != 32 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestTransferUserQuotaConcurrentWithCharge(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "from"})
+	seedTestUser(t, mr, ExternalUserData{ID: "to"})
+	period := CurrentQuotaPeriodKey(0)
+	saveUserChannelQuota("from", "c1", &UserQuota{UsedCount: 0, MonthKey: period})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := TransferUserQuota("from", "to", "c1", 1, 100, period); err != nil {
+				t.Errorf("transfer: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, _, err := chargeUserChannelQuota(context.Background(), "from", "c1", period, 1, "", -1, "", -1); err != nil {
+				t.Errorf("charge: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fromQuota, _ := getUserChannelQuota("from", "c1")
+	toQuota, _ := getUserChannelQuota("to", "c1")
+	if fromQuota.UsedCount != 20 || toQuota.UsedCount != -10 {
+		t.Fatalf("transfer and charge must not overwrite each other, got from=%d to=%d", fromQuota.UsedCount, toQuota.UsedCount)
+	}
+}
+
+func TestTransferUserQuotaRejections(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "from"})
+	seedTestUser(t, mr, ExternalUserData{ID: "to"})
+	period := CurrentQuotaPeriodKey(0)
+	saveUserChannelQuota("from", "c1", &UserQuota{UsedCount: 28, MonthKey: period})
+
+	if _, err := TransferUserQuota("from", "to", "c1", 5, 30, ""); !errors.Is(err, ErrQuotaTransferInsufficient) {
+		t.Fatalf("expected insufficient balance, got %v", err)
+	}
+	if _, err := TransferUserQuota("from", "to", "c1", -1, 30, ""); !errors.Is(err, ErrQuotaTransferInvalid) {
+		t.Fatalf("expected invalid amount, got %v", err)
+	}
+	if _, err := TransferUserQuota("from", "to", "c1", 1, 30, "1999-01"); !errors.Is(err, ErrQuotaTransferCrossPeriod) {
+		t.Fatalf("expected cross-period rejection, got %v", err)
+	}
+	fromQuota, _ := getUserChannelQuota("from", "c1")
+	if fromQuota.UsedCount != 28 {
+		t.Fatalf("rejected transfer must not modify quota, got %d", fromQuota.UsedCount)
+	}
+}
+
+func TestTrialQuotaFirstPeriodOnly(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.TrialQuota = 100
+	seedTestUser(t, mr, ExternalUserData{ID: "newbie"})
+	seedTestUser(t, mr, ExternalUserData{ID: "veteran"})
+	// 老用户已有历史配额记录
+	saveUserChannelQuota("veteran", "c1", &UserQuota{UsedCount: 3, MonthKey: "2000-01"})
+
+	request := func(userId string) *httptest.ResponseRecorder {
+		token := makeTestToken(t, map[string]interface{}{"userId": userId})
+		return doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"})
+	}
+
+	if w := request("newbie"); w.Header().Get("X-Quota-Total") != "100" {
+		t.Fatalf("first-period user should get trial quota, got %s", w.Header().Get("X-Quota-Total"))
+	}
+	if w := request("newbie"); w.Header().Get("X-Quota-Total") != "100" {
+		t.Fatalf("trial should last for the whole first period, got %s", w.Header().Get("X-Quota-Total"))
+	}
+	if w := request("veteran"); w.Header().Get("X-Quota-Total") != "30" {
+		t.Fatalf("returning user should get standard quota, got %s", w.Header().Get("X-Quota-Total"))
+	}
+
+	// 进入第二个周期后恢复标准配额
+	quota, _ := getUserChannelQuota("newbie", "c1")
+	quota.FirstPeriodKey = "2000-01"
+	saveUserChannelQuota("newbie", "c1", quota)
+	if w := request("newbie"); w.Header().Get("X-Quota-Total") != "30" {
+		t.Fatalf("second period should use standard quota, got %s", w.Header().Get("X-Quota-Total"))
+	}
+}
+
+func TestGetExemptIdentities(t *testing.T) {
+	prev := externalUserConfig
+	defer func() { externalUserConfig = prev }()
+	externalUserConfig.AdminUsernames = parseIdentityList(" root, admin ,,ops")
+	externalUserConfig.AdminByUsername = true
+
+	got := GetExemptIdentities()
+	want := []string{"admin", "ops", "root"}
+	if len(got.AdminUsernames) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got.AdminUsernames)
+	}
+	for i := range want {
+		if got.AdminUsernames[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got.AdminUsernames)
+		}
+	}
+	if !isExternalAdmin(&ExternalUserData{Username: "ops"}) || isExternalAdmin(&ExternalUserData{Username: "guest"}) {
+		t.Fatal("admin membership should follow the configured list")
+	}
+}
+
+func TestFutureQuotaPeriodIsNormalized(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 29, MonthKey: "2999-01"})
+
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"})
+	if w.Code != http.StatusOK || w.Header().Get("X-Quota-Used") != "1" {
+		t.Fatalf("future-dated record should be reset, status=%d used=%s", w.Code, w.Header().Get("X-Quota-Used"))
+	}
+	quota, _ := getUserChannelQuota("u1", "c1")
+	if quota.MonthKey != CurrentQuotaPeriodKey(0) {
+		t.Fatalf("record should be normalized to current period, got %s", quota.MonthKey)
+	}
+}
+
+func TestUpstashTimeoutApplied(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"result":"PONG"}`))
+	}))
+	defer slow.Close()
+
+	prev := externalUserConfig
+	defer func() { externalUserConfig = prev }()
+	externalUserConfig.Enabled = true
+	externalUserConfig.useLocalRedis = false
+	externalUserConfig.RedisURL = slow.URL
+	externalUserConfig.UpstashTimeout = validateRedisTimeout("EXTERNAL_USER_UPSTASH_TIMEOUT_MS", 50, defaultUpstashTimeout)
+
+	if _, err := externalRedisDo("PING"); err == nil {
+		t.Fatal("expected timeout error from slow Upstash endpoint")
+	}
+
+	externalUserConfig.LocalRedisTimeout = validateRedisTimeout("EXTERNAL_USER_REDIS_TIMEOUT_MS", 1500, defaultLocalRedisTimeout)
+	opt := &redis.Options{}
+	applyLocalRedisTimeout(opt)
+	if opt.ReadTimeout != 1500*time.Millisecond || opt.WriteTimeout != 1500*time.Millisecond || opt.DialTimeout != 1500*time.Millisecond {
+		t.Fatalf("local timeout not applied: %+v", opt)
+	}
+
+	for _, ms := range []int{-1, 0, 120000} {
+		if got := validateRedisTimeout("X", ms, defaultUpstashTimeout); got != defaultUpstashTimeout {
+			t.Fatalf("timeout %dms should fall back to default, got %v", ms, got)
+		}
+	}
+}
+
+func TestAggregateChannelUsage(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.ResetDayOfMonth = 1
+	current := CurrentQuotaPeriodKey(0)
+
+	seedQuota := func(key string, used int, monthKey string) {
+		data, _ := json.Marshal(UserQuota{UsedCount: used, MonthKey: monthKey})
+		if err := mr.Set(key, string(data)); err != nil {
+			t.Fatalf("seed quota: %v", err)
+		}
+	}
+	seedQuota("quota:u1:channel:5", 3, current)
+	seedQuota("quota:u2:channel:5", 4, current)
+	seedQuota("quota:u1:channel:7", 10, current)
+	seedQuota("quota:u3:channel:7", 8, "2000-01") // 过期周期不计入
+	seedQuota("quota:u1", 2, current)             // 旧版未分渠道 key
+
+	report, err := AggregateChannelUsage()
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if len(report.Channels) != 2 {
+		t.Fatalf("expected 2 channels, got %+v", report.Channels)
+	}
+	if ch := report.Channels[0]; ch.ChannelId != "7" || ch.UsedCount != 10 || ch.UserCount != 1 {
+		t.Fatalf("unexpected top channel: %+v", ch)
+	}
+	if ch := report.Channels[1]; ch.ChannelId != "5" || ch.UsedCount != 7 || ch.UserCount != 2 {
+		t.Fatalf("unexpected second channel: %+v", ch)
+	}
+	if report.Legacy.UsedCount != 2 || report.Legacy.UserCount != 1 {
+		t.Fatalf("unexpected legacy usage: %+v", report.Legacy)
+	}
+}
+
+func TestMalformedTokenShortCircuits(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MinTokenLength = 20
+
+	valid := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	cases := []string{
+		"   ",
+		"abc",
+		"a.b.c",
+		"only.one-dot-but-long-enough-value",
+		"too.many.dots.in-this-token-value",
+		valid[:len(valid)/2] + "x",
+	}
+	for _, token := range cases {
+		w := doExternalRequest(t, map[string]string{"X-External-User-Token": token})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q: expected 401, got %d", token, w.Code)
+		}
+		if reason := w.Header().Get("X-Quota-Reason"); reason != "malformed_token" {
+			t.Fatalf("token %q: expected malformed_token reason, got %q", token, reason)
+		}
+	}
+
+	if got, _ := mr.Get(authFailKeyPrefix + "malformed:192.0.2.1"); got != "6" {
+		t.Fatalf("expected 6 malformed records for client ip, got %q", got)
+	}
+	if mr.Exists(authFailKeyPrefix + "ip:192.0.2.1") {
+		t.Fatal("malformed tokens should not count as regular auth failures")
+	}
+}
+
+func TestTrustedRequestCost(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MaxRequestCost = 100
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	request := func(cost string) *httptest.ResponseRecorder {
+		return doExternalRequest(t, map[string]string{
+			"X-External-User-Token": token,
+			"X-Channel-Id":          "c1",
+			"X-Channel-Quota-Limit": "30",
+			"X-Request-Cost":        cost,
+		})
+	}
+
+	// httptest 请求来源为 192.0.2.1
+	externalUserConfig.TrustedCostNetworks = []string{"10.0.0.0/8"}
+	if w := request("5"); w.Header().Get("X-Quota-Used") != "1" {
+		t.Fatalf("untrusted cost header should be ignored, used=%s", w.Header().Get("X-Quota-Used"))
+	}
+
+	externalUserConfig.TrustedCostNetworks = []string{"192.0.2.0/24"}
+	if w := request("5"); w.Header().Get("X-Quota-Used") != "6" {
+		t.Fatalf("trusted cost header should be applied, used=%s", w.Header().Get("X-Quota-Used"))
+	}
+	for _, invalid := range []string{"0", "-3", "abc", "1000"} {
+		before, _ := getUserChannelQuota("u1", "c1")
+		request(invalid)
+		after, _ := getUserChannelQuota("u1", "c1")
+		if after.UsedCount-before.UsedCount != 1 {
+			t.Fatalf("invalid cost %q should fall back to 1, charged %d", invalid, after.UsedCount-before.UsedCount)
+		}
+	}
+
+	// 剩余配额不足以支付本次消耗时拒绝
+	if w := request("30"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("cost exceeding remaining quota should be rejected, got %d", w.Code)
+	}
+}
+
+func TestLifetimeCapAcrossPeriods(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.LifetimeCaps = map[string]int{"default": 3, "bronze": 5}
+	seedTestUser(t, mr, ExternalUserData{ID: "free"})
+	seedTestUser(t, mr, ExternalUserData{ID: "bronze", Tier: "bronze"})
+	seedTestUser(t, mr, ExternalUserData{ID: "vip", IsVIP: true, VIPExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	request := func(userId string) *httptest.ResponseRecorder {
+		token := makeTestToken(t, map[string]interface{}{"userId": userId})
+		return doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"})
+	}
+	// 模拟进入新周期：周期配额被重置，终身计数保留
+	expirePeriod := func(userId string) {
+		quota, _ := getUserChannelQuota(userId, "c1")
+		quota.MonthKey = "2000-01"
+		saveUserChannelQuota(userId, "c1", quota)
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("free"); w.Code != http.StatusOK {
+			t.Fatalf("request %d should pass, got %d", i, w.Code)
+		}
+	}
+	expirePeriod("free")
+	if w := request("free"); w.Code != http.StatusOK || w.Header().Get("X-Quota-Used") != "1" {
+		t.Fatalf("third call in new period should pass with fresh period usage, got %d used=%s", w.Code, w.Header().Get("X-Quota-Used"))
+	}
+	expirePeriod("free")
+	w := request("free")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Quota-Reason") != "lifetime_exhausted" {
+		t.Fatalf("lifetime cap should reject, got %d reason=%q", w.Code, w.Header().Get("X-Quota-Reason"))
+	}
+	if count, _ := GetLifetimeCount("free"); count != 3 {
+		t.Fatalf("expected lifetime count 3, got %d", count)
+	}
+
+	// 等级上限独立配置
+	for i := 0; i < 5; i++ {
+		if w := request("bronze"); w.Code != http.StatusOK {
+			t.Fatalf("bronze request %d should pass, got %d", i, w.Code)
+		}
+	}
+	if w := request("bronze"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("bronze should hit tier cap, got %d", w.Code)
+	}
+
+	for i := 0; i < 5; i++ {
+		if w := request("vip"); w.Code != http.StatusOK {
+			t.Fatalf("vip should bypass lifetime cap, got %d", w.Code)
+		}
+	}
+}
+
+func TestLifetimeCapConcurrentRequests(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.LifetimeCaps = map[string]int{"default": 3}
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	mr.Set(lifetimeKeyPrefix+"u1", "2")
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"}
+
+	// 边界上的并发请求只有一个能通过，被拒绝的请求不计入周期配额
+	r := newExternalTestRouter()
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if serveExternalRequest(r, headers, "").Code == http.StatusOK {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Fatalf("expected exactly one request at the lifetime boundary to pass, got %d", allowed)
+	}
+	if count, _ := GetLifetimeCount("u1"); count != 3 {
+		t.Fatalf("lifetime count should stop at the cap, got %d", count)
+	}
+	if quota, _ := getUserChannelQuota("u1", "c1"); quota.UsedCount != 1 {
+		t.Fatalf("rejected requests should be refunded from the period quota, used=%d", quota.UsedCount)
+	}
+}
+
+func TestQuotaPercentUsedHeader(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 4, MonthKey: CurrentQuotaPeriodKey(0)})
+
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "10"})
+	if got := w.Header().Get("X-Quota-Percent-Used"); got != "50" {
+		t.Fatalf("expected 50%% used, got %q", got)
+	}
+
+	for _, tc := range []struct{ used, limit, want int }{{0, 0, 100}, {-2, 10, 0}, {15, 10, 100}, {1, 3, 33}} {
+		if got := quotaPercentUsed(tc.used, tc.limit); got != tc.want {
+			t.Fatalf("quotaPercentUsed(%d, %d) = %d, want %d", tc.used, tc.limit, got, tc.want)
+		}
+	}
+}
+
+// useTestUpstash 使用 httptest 模拟 Upstash REST API，测试结束后恢复原配置
+func useTestUpstash(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	prev := externalUserConfig
+	externalUserConfig.Enabled = true
+	externalUserConfig.useLocalRedis = false
+	externalUserConfig.RedisURL = server.URL
+	externalUserConfig.RedisToken = "test-token"
+	externalUserConfig.JWTSecret = testJWTSecret
+	t.Cleanup(func() {
+		pendingAuditWrites.Wait()
+		server.Close()
+		externalUserConfig = prev
+	})
+}
+
+func TestStorageWriteRejectedPolicy(t *testing.T) {
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.URL.Path == "/get/user:u1" {
+				data, _ := json.Marshal(ExternalUserData{ID: "u1"})
+				json.NewEncoder(w).Encode(map[string]interface{}{"result": string(data)})
+				return
+			}
+			w.Write([]byte(`{"result":null}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"OOM command not allowed when used memory > 'maxmemory'."}`))
+	})
+
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"}
+
+	externalUserConfig.StorageFailurePolicy = storageFailurePolicyOpen
+	w := doExternalRequest(t, headers)
+	if w.Code != http.StatusOK || w.Header().Get("X-Quota-Degraded") != "true" {
+		t.Fatalf("fail-open should pass with degraded marker, got %d degraded=%q", w.Code, w.Header().Get("X-Quota-Degraded"))
+	}
+
+	externalUserConfig.StorageFailurePolicy = storageFailurePolicyClosed
+	w = doExternalRequest(t, headers)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Quota-Reason") != "storage_unavailable" {
+		t.Fatalf("fail-closed should reject, got %d reason=%q", w.Code, w.Header().Get("X-Quota-Reason"))
+	}
+
+	if isRedisWriteRejected(errors.New("dial tcp: i/o timeout")) {
+		t.Fatal("generic errors should not be treated as write rejection")
+	}
+	if !isRedisWriteRejected(errors.New("READONLY You can't write against a read only replica.")) {
+		t.Fatal("READONLY errors should be treated as write rejection")
+	}
+}
+
+func TestStorageFailurePolicyFollowsFailOpen(t *testing.T) {
+	cases := []struct {
+		policy   string
+		failOpen bool
+		want     string
+	}{
+		{"", false, storageFailurePolicyClosed},
+		{"", true, storageFailurePolicyOpen},
+		{"open", false, storageFailurePolicyOpen},
+		{" Closed ", true, storageFailurePolicyClosed},
+		{"bogus", false, storageFailurePolicyClosed},
+		{"bogus", true, storageFailurePolicyOpen},
+	}
+	for _, tc := range cases {
+		if got := normalizeStorageFailurePolicy(tc.policy, tc.failOpen); got != tc.want {
+			t.Errorf("policy=%q failOpen=%v: got %q, want %q", tc.policy, tc.failOpen, got, tc.want)
+		}
+	}
+
+	// 显式的写入拒绝策略只覆盖 OOM / 只读错误，其他存储错误仍按 FailOpen 处理
+	var oom atomic.Bool
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.URL.Path == "/get/user:u1" {
+				data, _ := json.Marshal(ExternalUserData{ID: "u1"})
+				json.NewEncoder(w).Encode(map[string]interface{}{"result": string(data)})
+				return
+			}
+			w.Write([]byte(`{"result":null}`))
+			return
+		}
+		if oom.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"OOM command not allowed when used memory > 'maxmemory'."}`))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"service unavailable"}`))
+	})
+	externalUserConfig.RedisMaxAttempts = 1
+	externalUserConfig.FailOpen = false
+	externalUserConfig.StorageFailurePolicy = normalizeStorageFailurePolicy("open", false)
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"}
+
+	oom.Store(true)
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK || w.Header().Get("X-Quota-Degraded") != "true" {
+		t.Fatalf("OOM with policy=open should pass degraded, got %d", w.Code)
+	}
+	oom.Store(false)
+	if w := doExternalRequest(t, headers); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("other write errors should follow FailOpen=false and reject, got %d", w.Code)
+	}
+}
+
+// captureOutput 捕获 fn 执行期间写入 stdout 与 gin 日志的内容
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	var logs bytes.Buffer
+	prevStdout, prevWriter, prevErrWriter := os.Stdout, gin.DefaultWriter, gin.DefaultErrorWriter
+	os.Stdout, gin.DefaultWriter, gin.DefaultErrorWriter = w, &logs, &logs
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+
+	fn()
+	pendingAuditWrites.Wait()
+
+	os.Stdout, gin.DefaultWriter, gin.DefaultErrorWriter = prevStdout, prevWriter, prevErrWriter
+	w.Close()
+	return <-done + logs.String()
+}
+
+func TestExternalUserAuthQuietByDefault(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1", Email: "u1@example.com"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"}
+
+	prevDebug := common.DebugEnabled
+	defer func() { common.DebugEnabled = prevDebug }()
+
+	common.DebugEnabled = false
+	var code int
+	out := captureOutput(t, func() { code = doExternalRequest(t, headers).Code })
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if out != "" {
+		t.Fatalf("expected no output at non-debug level, got:\n%s", out)
+	}
+
+	// 超额延迟、上游失败退还与非信任来源的 X-Request-Cost 同样只在 DEBUG 模式下输出
+	externalUserConfig.TarpitBaseDelay = time.Millisecond
+	externalUserConfig.TrustedCostNetworks = []string{"10.0.0.0/8"}
+	saveUserChannelQuota("u1", "c2", &UserQuota{UsedCount: 5, MonthKey: CurrentQuotaPeriodKey(0)})
+	r := gin.New()
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		c.String(http.StatusBadGateway, "upstream")
+	})
+	send := func(channelId string, limit string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		req.Header.Set("X-External-User-Token", token)
+		req.Header.Set("X-Channel-Id", channelId)
+		req.Header.Set("X-Channel-Quota-Limit", limit)
+		req.Header.Set("X-Request-Cost", "3")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	var refundCode, tarpitCode int
+	out = captureOutput(t, func() {
+		refundCode = send("c1", "30")
+		tarpitCode = send("c2", "5")
+	})
+	if refundCode != http.StatusBadGateway || tarpitCode != http.StatusTooManyRequests {
+		t.Fatalf("expected refunded 502 and tarpitted 429, got %d and %d", refundCode, tarpitCode)
+	}
+	// 拒绝请求时 abortWithOpenAiMessage 输出的错误日志不属于外部用户验证日志
+	if strings.Contains(out, externalUserLogPrefix) {
+		t.Fatalf("expected no external user output for tarpit/refund/untrusted cost at non-debug level, got:\n%s", out)
+	}
+
+	common.DebugEnabled = true
+	out = captureOutput(t, func() { doExternalRequest(t, headers) })
+	if !strings.Contains(out, externalUserLogPrefix) {
+		t.Fatalf("expected debug output, got:\n%s", out)
+	}
+	if strings.Contains(out, token) {
+		t.Fatalf("debug output must not contain the full token:\n%s", out)
+	}
+}
+
+func TestExternalUserTokenHeader(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	request := func(header, value string) int {
+		return doExternalRequest(t, map[string]string{header: value, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"}).Code
+	}
+
+	if code := request("X-External-User-Token", token); code != http.StatusOK {
+		t.Fatalf("default header should be accepted, got %d", code)
+	}
+
+	externalUserConfig.TokenHeader = "X-App-Token"
+	if code := request("X-App-Token", token); code != http.StatusOK {
+		t.Fatalf("custom header should be accepted, got %d", code)
+	}
+	if code := request("X-External-User-Token", token); code != http.StatusUnauthorized {
+		t.Fatalf("default header should be ignored once a custom header is configured, got %d", code)
+	}
+
+	externalUserConfig.TokenHeader = "Authorization"
+	externalUserConfig.TokenPrefix = "Bearer "
+	if code := request("Authorization", "Bearer "+token); code != http.StatusOK {
+		t.Fatalf("Authorization: Bearer token should be accepted, got %d", code)
+	}
+	if code := request("Authorization", "bearer "+token); code != http.StatusOK {
+		t.Fatalf("prefix should match case-insensitively, got %d", code)
+	}
+}
+
+func TestExternalUserTokenFallbackSources(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	seedTestUser(t, mr, ExternalUserData{ID: "u2"})
+	seedTestUser(t, mr, ExternalUserData{ID: "u3"})
+	headerToken := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	cookieToken := makeTestToken(t, map[string]interface{}{"userId": "u2"})
+	queryToken := makeTestToken(t, map[string]interface{}{"userId": "u3"})
+
+	r := gin.New()
+	r.GET("/v1/stream", ExternalUserAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("external_user_id"))
+	})
+	// 返回通过验证的用户 ID，未通过时返回空字符串
+	authedAs := func(header, cookie, query string) string {
+		target := "/v1/stream"
+		if query != "" {
+			target += "?access_token=" + query
+		}
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Channel-Id", "c1")
+		if header != "" {
+			req.Header.Set("X-External-User-Token", header)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "ext_token", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return ""
+		}
+		return w.Body.String()
+	}
+
+	// 未配置 cookie、未开启 query 时只接受 header
+	if got := authedAs("", cookieToken, queryToken); got != "" {
+		t.Fatalf("cookie and query should be ignored by default, authenticated as %q", got)
+	}
+
+	externalUserConfig.TokenCookie = "ext_token"
+	externalUserConfig.AllowQueryToken = true
+	externalUserConfig.TokenQueryParam = "access_token"
+	for _, tc := range []struct {
+		name                  string
+		header, cookie, query string
+		want                  string
+	}{
+		{"header", headerToken, "", "", "u1"},
+		{"cookie", "", cookieToken, "", "u2"},
+		{"query", "", "", queryToken, "u3"},
+		{"header over cookie and query", headerToken, cookieToken, queryToken, "u1"},
+		{"cookie over query", "", cookieToken, queryToken, "u2"},
+	} {
+		if got := authedAs(tc.header, tc.cookie, tc.query); got != tc.want {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+
+	externalUserConfig.AllowQueryToken = false
+	if got := authedAs("", "", queryToken); got != "" {
+		t.Fatalf("query token should be rejected when disabled, authenticated as %q", got)
+	}
+}
+
+func TestFailOpenOnRedisOutage(t *testing.T) {
+	var readOutage bool
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/get/user:u1" {
+			data, _ := json.Marshal(ExternalUserData{ID: "u1"})
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": string(data)})
+			return
+		}
+		if r.Method == http.MethodGet && !readOutage {
+			w.Write([]byte(`{"result":null}`))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"service unavailable"}`))
+	})
+	externalUserConfig.RedisMaxAttempts = 1
+
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"}
+
+	for _, tc := range []struct {
+		name       string
+		readOutage bool
+		closedCode int
+	}{
+		{"read", true, http.StatusInternalServerError},
+		{"write", false, http.StatusServiceUnavailable},
+	} {
+		readOutage = tc.readOutage
+
+		externalUserConfig.FailOpen = false
+		w := doExternalRequest(t, headers)
+		if w.Code != tc.closedCode {
+			t.Fatalf("%s outage: fail-closed should reject with %d, got %d", tc.name, tc.closedCode, w.Code)
+		}
+
+		externalUserConfig.FailOpen = true
+		w = doExternalRequest(t, headers)
+		if w.Code != http.StatusOK || w.Header().Get("X-Quota-Status") != "degraded" {
+			t.Fatalf("%s outage: fail-open should pass as degraded, got %d status=%q", tc.name, w.Code, w.Header().Get("X-Quota-Status"))
+		}
+	}
+}
+
+func TestUpstashRejectedResponses(t *testing.T) {
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/get/user:u1":
+			data, _ := json.Marshal(ExternalUserData{ID: "u1"})
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": string(data)})
+		case r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"Unauthorized"}`))
+		default:
+			// 写入返回 200 但带 error 字段 (如命令被拒绝)
+			w.Write([]byte(`{"error":"ERR max daily request limit exceeded"}`))
+		}
+	})
+
+	if _, err := getUserFromUpstash(context.Background(), "u2"); !errors.Is(err, ErrRedisRejected) || errors.Is(err, errExternalUserNotFound) {
+		t.Fatalf("401 must not be reported as user not found, got %v", err)
+	}
+	if _, err := getQuotaFromUpstash(context.Background(), "u2"); !errors.Is(err, ErrRedisRejected) {
+		t.Fatalf("401 must not be reported as an empty quota, got %v", err)
+	}
+	if err := saveQuotaToUpstash(context.Background(), "u1", &UserQuota{MonthKey: CurrentQuotaPeriodKey(0)}); !errors.Is(err, ErrRedisRejected) {
+		t.Fatalf("rejected quota write must fail, got %v", err)
+	}
+	if err := SetUserVIP(context.Background(), "u1", true, time.Now().Add(time.Hour).Unix()); !errors.Is(err, ErrRedisRejected) {
+		t.Fatalf("rejected VIP write must fail, got %v", err)
+	}
+	if err := SetUserTier(context.Background(), "u1", "gold", 0); !errors.Is(err, ErrRedisRejected) {
+		t.Fatalf("rejected tier write must fail, got %v", err)
+	}
+	if err := upstashStatusError(http.StatusServiceUnavailable, nil); !errors.Is(err, ErrRedisTransient) || errors.Is(err, ErrRedisRejected) {
+		t.Fatalf("5xx should stay retryable, got %v", err)
+	}
+}
+
+func TestUpstashConcurrencyBounded(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Write([]byte(`{"result":[]}`))
+	})
+	prevSem := upstashSemaphore
+	setUpstashConcurrency(2)
+	defer func() { upstashSemaphore = prevSem }()
+
+	keys := make([]string, 10*externalMGetBatchSize)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("quota:u%d", i)
+	}
+	if _, err := externalRedisMGet(keys); err != nil {
+		t.Fatalf("mget: %v", err)
+	}
+	if maxInFlight == 0 || maxInFlight > 2 {
+		t.Fatalf("expected at most 2 concurrent Upstash calls, observed %d", maxInFlight)
+	}
+}
+
+func TestQuotaLimitSourceHeader(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MonthlyQuota = 30
+	externalUserConfig.TierQuotas = map[string]int{"bronze": 500, "gold": -1}
+	externalUserConfig.TrialQuota = 0
+	seedTestUser(t, mr, ExternalUserData{ID: "plain"})
+	seedTestUser(t, mr, ExternalUserData{ID: "bronze", Tier: "bronze"})
+	seedTestUser(t, mr, ExternalUserData{ID: "gold", Tier: "gold"})
+	seedTestUser(t, mr, ExternalUserData{ID: "custom", Tier: "bronze", QuotaLimit: 42})
+	seedTestUser(t, mr, ExternalUserData{ID: "unknown-tier", Tier: "platinum"})
+
+	cases := []struct {
+		userId, channelLimit, wantSource, wantTotal string
+	}{
+		{"plain", "", quotaLimitSourceGlobal, "30"},
+		{"plain", "10", quotaLimitSourceChannel, "10"},
+		{"bronze", "10", quotaLimitSourceTier, "500"},
+		{"gold", "10", quotaLimitSourceTier, "-1"},
+		{"custom", "10", quotaLimitSourceCustom, "42"},
+		{"unknown-tier", "10", quotaLimitSourceChannel, "10"},
+	}
+	for _, tc := range cases {
+		headers := map[string]string{
+			"X-External-User-Token": makeTestToken(t, map[string]interface{}{"userId": tc.userId}),
+			"X-Channel-Id":          "c1",
+		}
+		if tc.channelLimit != "" {
+			headers["X-Channel-Quota-Limit"] = tc.channelLimit
+		}
+		w := doExternalRequest(t, headers)
+		if got := w.Header().Get("X-Quota-Limit-Source"); got != tc.wantSource {
+			t.Fatalf("%s/%s: expected source %s, got %q", tc.userId, tc.channelLimit, tc.wantSource, got)
+		}
+		if got := w.Header().Get("X-Quota-Total"); got != tc.wantTotal {
+			t.Fatalf("%s/%s: expected total %s, got %q", tc.userId, tc.channelLimit, tc.wantTotal, got)
+		}
+	}
+
+	// 首个周期试用配额更高时来源为 trial
+	externalUserConfig.TrialQuota = 100
+	seedTestUser(t, mr, ExternalUserData{ID: "newbie"})
+	w := doExternalRequest(t, map[string]string{
+		"X-External-User-Token": makeTestToken(t, map[string]interface{}{"userId": "newbie"}),
+		"X-Channel-Id":          "c1",
+	})
+	if got := w.Header().Get("X-Quota-Limit-Source"); got != quotaLimitSourceTrial {
+		t.Fatalf("expected trial source, got %q", got)
+	}
+}
+
+func TestModelScopedQuotaHeaders(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.ModelQuotas = map[string]int{"gpt-4o": 5}
+	prevMaxBody := constant.MaxRequestBodyMB
+	constant.MaxRequestBodyMB = 64
+	defer func() { constant.MaxRequestBodyMB = prevMaxBody }()
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	saveUserChannelQuota("u1", modelQuotaBucket("c1", "gpt-4o"), &UserQuota{UsedCount: 2, MonthKey: CurrentQuotaPeriodKey(0)})
+
+	headers := map[string]string{
+		"X-External-User-Token": makeTestToken(t, map[string]interface{}{"userId": "u1"}),
+		"X-Channel-Id":          "c1",
+		"X-Channel-Quota-Limit": "30",
+		"Content-Type":          "application/json",
+	}
+
+	w := doExternalRequestWithBody(t, headers, `{"model":"gpt-4o","messages":[]}`)
+	if w.Header().Get("X-Quota-Model") != "gpt-4o" {
+		t.Fatalf("expected X-Quota-Model gpt-4o, got %q", w.Header().Get("X-Quota-Model"))
+	}
+	if w.Header().Get("X-Quota-Used") != "3" || w.Header().Get("X-Quota-Total") != "5" || w.Header().Get("X-Quota-Remaining") != "2" {
+		t.Fatalf("headers should reflect the model bucket, got used=%s total=%s remaining=%s",
+			w.Header().Get("X-Quota-Used"), w.Header().Get("X-Quota-Total"), w.Header().Get("X-Quota-Remaining"))
+	}
+	if quota, _ := getUserChannelQuota("u1", "c1"); quota.UsedCount != 0 {
+		t.Fatalf("channel bucket should not be charged for a metered model, used=%d", quota.UsedCount)
+	}
+
+	// 未配置独立配额的模型沿用渠道配额
+	w = doExternalRequestWithBody(t, headers, `{"model":"gpt-4o-mini"}`)
+	if w.Header().Get("X-Quota-Model") != "" || w.Header().Get("X-Quota-Used") != "1" || w.Header().Get("X-Quota-Total") != "30" {
+		t.Fatalf("unmetered model should use channel quota, got model=%q used=%s total=%s",
+			w.Header().Get("X-Quota-Model"), w.Header().Get("X-Quota-Used"), w.Header().Get("X-Quota-Total"))
+	}
+}
+
+func TestExportAuditLogNDJSON(t *testing.T) {
+	mr := useTestRedis(t)
+	base := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	// 跨多页写入: 每小时一条，交替两个用户
+	total := 2*auditExportPageLen + 50
+	for i := 0; i < total; i++ {
+		ts := base.Add(time.Duration(i) * time.Hour)
+		mr.SetTime(ts)
+		userId := "u1"
+		if i%2 == 1 {
+			userId = "u2"
+		}
+		if err := appendAuditEntry(AuditEntry{Timestamp: ts.Unix(), UserId: userId, ChannelId: "c1", Allowed: true}); err != nil {
+			t.Fatalf("append audit entry: %v", err)
+		}
+	}
+
+	decode := func(out string) []AuditEntry {
+		var entries []AuditEntry
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+			var entry AuditEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid NDJSON line %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	var all strings.Builder
+	if n, err := ExportAuditLogNDJSON(&all, AuditFilter{}); err != nil || n != total {
+		t.Fatalf("expected %d entries, got %d (err=%v)", total, n, err)
+	}
+	if entries := decode(all.String()); len(entries) != total {
+		t.Fatalf("expected %d NDJSON lines, got %d", total, len(entries))
+	}
+
+	// 第 10~19 小时，仅 u1
+	var filtered strings.Builder
+	filter := AuditFilter{Start: base.Add(10 * time.Hour).Unix(), End: base.Add(19 * time.Hour).Unix(), UserId: "u1"}
+	if _, err := ExportAuditLogNDJSON(&filtered, filter); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	entries := decode(filtered.String())
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 filtered entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.UserId != "u1" || entry.Timestamp < filter.Start || entry.Timestamp > filter.End {
+			t.Fatalf("entry outside filter: %+v", entry)
+		}
+	}
+}
+
+func TestQuotaExceededActions(t *testing.T) {
+	mr := useTestRedis(t)
+	prevMaxBody := constant.MaxRequestBodyMB
+	constant.MaxRequestBodyMB = 64
+	defer func() { constant.MaxRequestBodyMB = prevMaxBody }()
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 10, MonthKey: CurrentQuotaPeriodKey(0)})
+
+	var forwardedModel string
+	r := gin.New()
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		common.UnmarshalBodyReusable(c, &req)
+		forwardedModel = req.Model
+		c.String(http.StatusOK, "ok")
+	})
+	request := func(action, downgradeModel string) *httptest.ResponseRecorder {
+		forwardedModel = ""
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","stream":true}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-External-User-Token", makeTestToken(t, map[string]interface{}{"userId": "u1"}))
+		req.Header.Set("X-Channel-Id", "c1")
+		req.Header.Set("X-Channel-Quota-Limit", "10")
+		req.Header.Set("X-Channel-Quota-Exceeded-Action", action)
+		req.Header.Set("X-Channel-Downgrade-Model", downgradeModel)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("", ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("default action should block, got %d", w.Code)
+	}
+	if w := request(quotaExceededActionBlock, ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("block should reject, got %d", w.Code)
+	}
+
+	w := request(quotaExceededActionWarn, "")
+	if w.Code != http.StatusOK || w.Header().Get("X-Quota-Status") != "exceeded" || w.Header().Get("X-Quota-Exceeded-Action") != quotaExceededActionWarn {
+		t.Fatalf("warn should pass with exceeded marker, got %d status=%q", w.Code, w.Header().Get("X-Quota-Status"))
+	}
+	if forwardedModel != "gpt-4o" {
+		t.Fatalf("warn should not change the model, got %q", forwardedModel)
+	}
+
+	w = request(quotaExceededActionDowngrade, "gpt-4o-mini")
+	if w.Code != http.StatusOK || w.Header().Get("X-Quota-Downgraded-Model") != "gpt-4o-mini" {
+		t.Fatalf("downgrade should pass with downgraded model, got %d model=%q", w.Code, w.Header().Get("X-Quota-Downgraded-Model"))
+	}
+	if forwardedModel != "gpt-4o-mini" {
+		t.Fatalf("downstream should see the downgraded model, got %q", forwardedModel)
+	}
+
+	if w := request(quotaExceededActionDowngrade, ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("downgrade without a target model should fall back to block, got %d", w.Code)
+	}
+}
+
+func TestLastSeenThrottled(t *testing.T) {
+	mr := useTestRedis(t)
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	prevNow := lastSeenNow
+	lastSeenNow = func() time.Time { return now }
+	defer func() { lastSeenNow = prevNow }()
+	lastSeenWritten.Delete("u1")
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+
+	doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Quota-Enabled": "false"})
+	if got := GetLastSeen("u1"); got != now.Unix() {
+		t.Fatalf("expected lastSeen %d, got %d", now.Unix(), got)
+	}
+
+	first := now
+	now = now.Add(30 * time.Second)
+	doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Quota-Enabled": "false"})
+	if got := GetLastSeen("u1"); got != first.Unix() {
+		t.Fatalf("lastSeen should be throttled within a minute, got %d", got)
+	}
+
+	now = now.Add(31 * time.Second)
+	doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Quota-Enabled": "false"})
+	if got := GetLastSeen("u1"); got != now.Unix() {
+		t.Fatalf("lastSeen should update after the throttle window, got %d", got)
+	}
+}
+
+func TestStrictUserLookup(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "known"})
+	ghost := makeTestToken(t, map[string]interface{}{"userId": "ghost", "email": "ghost@example.com"})
+	known := makeTestToken(t, map[string]interface{}{"userId": "known"})
+	headers := func(token string) map[string]string {
+		return map[string]string{"X-External-User-Token": token, "X-Channel-Quota-Enabled": "false"}
+	}
+
+	// 宽松模式: 不存在的用户使用 token 中的信息
+	externalUserConfig.StrictUserLookup = false
+	if w := doExternalRequest(t, headers(ghost)); w.Code != http.StatusOK {
+		t.Fatalf("lenient mode should accept unknown users, got %d", w.Code)
+	}
+
+	// 严格模式: 拒绝不存在的用户，已存在的用户正常
+	externalUserConfig.StrictUserLookup = true
+	if w := doExternalRequest(t, headers(ghost)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("strict mode should reject unknown users, got %d", w.Code)
+	}
+	if w := doExternalRequest(t, headers(known)); w.Code != http.StatusOK {
+		t.Fatalf("strict mode should accept known users, got %d", w.Code)
+	}
+
+	// Redis 故障不等同于用户不存在，严格模式下仍回退
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	defer mr.SetError("")
+	if _, err := verifyExternalJWT(context.Background(), ghost); err != nil {
+		t.Fatalf("redis errors should fall back even in strict mode, got %v", err)
+	}
+}
+
+func TestMaxChannelsPerUser(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MaxChannelsPerUser = 2
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	request := func(channelId string) *httptest.ResponseRecorder {
+		return doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": channelId, "X-Channel-Quota-Limit": "30"})
+	}
+
+	for _, ch := range []string{"c1", "c2", "c1"} {
+		if w := request(ch); w.Code != http.StatusOK {
+			t.Fatalf("channel %s should be allowed, got %d", ch, w.Code)
+		}
+	}
+	w := request("c3")
+	if w.Code != http.StatusForbidden || w.Header().Get("X-Quota-Reason") != "too_many_channels" {
+		t.Fatalf("third distinct channel should be rejected, got %d reason=%q", w.Code, w.Header().Get("X-Quota-Reason"))
+	}
+	if mr.Exists("quota:u1:channel:c3") {
+		t.Fatal("rejected channel should not create a quota key")
+	}
+	if members, _ := mr.Members(userChannelsKeyPrefix + "u1"); len(members) != 2 {
+		t.Fatalf("expected 2 tracked channels, got %v", members)
+	}
+	if w := request("c2"); w.Code != http.StatusOK {
+		t.Fatalf("existing channel should still be allowed, got %d", w.Code)
+	}
+}
+
+func TestTarpitDelayGrows(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.TarpitBaseDelay = 20 * time.Millisecond
+	externalUserConfig.TarpitMaxDelay = 80 * time.Millisecond
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 5, MonthKey: CurrentQuotaPeriodKey(0)})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "5"}
+
+	var prev time.Duration
+	for i, want := range []time.Duration{20, 40, 80, 80} {
+		start := time.Now()
+		w := doExternalRequest(t, headers)
+		elapsed := time.Since(start)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("violation %d should be rejected, got %d", i+1, w.Code)
+		}
+		if elapsed < want*time.Millisecond {
+			t.Fatalf("violation %d should wait at least %dms, waited %v", i+1, want, elapsed)
+		}
+		if i < 2 && elapsed <= prev {
+			t.Fatalf("delay should grow: violation %d waited %v after %v", i+1, elapsed, prev)
+		}
+		prev = elapsed
+	}
+	if got := tarpitDelay(100); got != 80*time.Millisecond {
+		t.Fatalf("delay should be capped at 80ms, got %v", got)
+	}
+
+	// 恢复正常请求后清除违规记录
+	headers["X-Channel-Quota-Limit"] = "10"
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+		t.Fatalf("request within quota should pass, got %d", w.Code)
+	}
+	if mr.Exists(tarpitKeyPrefix + "u1") {
+		t.Fatal("tarpit counter should be cleared after a compliant request")
+	}
+
+	// 客户端断开时立即结束等待
+	externalUserConfig.TarpitBaseDelay = time.Minute
+	externalUserConfig.TarpitMaxDelay = time.Minute
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	applyTarpit(reqCtx, "u1")
+	if time.Since(start) > time.Second {
+		t.Fatal("canceled request should not wait for the tarpit delay")
+	}
+}
+
+func TestQuotaContextKeysForLogging(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.TrustedCostNetworks = []string{"192.0.2.0/24"}
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 4, MonthKey: CurrentQuotaPeriodKey(0)})
+
+	var captured map[string]any
+	r := gin.New()
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		captured = c.Keys
+		c.String(http.StatusOK, "ok")
+	})
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Header.Set("X-External-User-Token", makeTestToken(t, map[string]interface{}{"userId": "u1"}))
+	req.Header.Set("X-Channel-Id", "c1")
+	req.Header.Set("X-Channel-Quota-Limit", "10")
+	req.Header.Set("X-Request-Cost", "3")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	want := map[constant.ContextKey]any{
+		constant.ContextKeyExternalUserId:         "u1",
+		constant.ContextKeyExternalQuotaChannelId: "c1",
+		constant.ContextKeyExternalQuotaCharged:   3,
+		constant.ContextKeyExternalQuotaUsed:      7,
+		constant.ContextKeyExternalQuotaTotal:     10,
+		constant.ContextKeyExternalQuotaRemaining: 3,
+		constant.ContextKeyExternalQuotaSaved:     true,
+	}
+	for key, value := range want {
+		if got := captured[string(key)]; got != value {
+			t.Errorf("context %s = %v, want %v", key, got, value)
+		}
+	}
+}
+
+func TestConcurrentPeriodResetCountsEveryRequest(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	// 上个周期的记录: 本周期的首批请求会同时触发重置
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 25, MonthKey: "2000-01"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+
+	r := gin.New()
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			req.Header.Set("X-External-User-Token", token)
+			req.Header.Set("X-Channel-Id", "c1")
+			req.Header.Set("X-Channel-Quota-Limit", "100")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("expected 200, got %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	quota, err := getUserChannelQuota("u1", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.UsedCount != n || quota.MonthKey != CurrentQuotaPeriodKey(0) {
+		t.Fatalf("expected exactly %d uses in %s, got %d in %s", n, CurrentQuotaPeriodKey(0), quota.UsedCount, quota.MonthKey)
+	}
+}
+
+func TestConcurrentRequestsNeverExceedQuota(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+
+	r := gin.New()
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	const n, limit = 50, 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			req.Header.Set("X-External-User-Token", token)
+			req.Header.Set("X-Channel-Id", "c1")
+			req.Header.Set("X-Channel-Quota-Limit", fmt.Sprint(limit))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			switch w.Code {
+			case http.StatusOK:
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			case http.StatusTooManyRequests:
+			default:
+				t.Errorf("unexpected status %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	quota, err := getUserChannelQuota("u1", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.UsedCount > limit || accepted != limit || quota.UsedCount != accepted {
+		t.Fatalf("expected exactly %d accepted uses, got accepted=%d used=%d", limit, accepted, quota.UsedCount)
+	}
+}
+
+func TestQuotaWarningThresholdPerTier(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.WarningPercent = 80
+	externalUserConfig.TierWarningPercents = map[string]int{"free": 50}
+	seedTestUser(t, mr, ExternalUserData{ID: "free-user", Tier: "free"})
+	seedTestUser(t, mr, ExternalUserData{ID: "pro-user", Tier: "pro"})
+
+	cases := []struct {
+		userId    string
+		used      int
+		wantAlert bool
+	}{
+		{"free-user", 4, false}, // 本次请求后 4/10
+		{"free-user", 5, true},
+		{"pro-user", 7, false}, // 使用全局阈值 80%
+		{"pro-user", 8, true},
+	}
+	for _, tc := range cases {
+		saveUserChannelQuota(tc.userId, "c1", &UserQuota{UsedCount: tc.used - 1, MonthKey: CurrentQuotaPeriodKey(0)})
+		token := makeTestToken(t, map[string]interface{}{"userId": tc.userId})
+		w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "10"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tc.userId, w.Code)
+		}
+		if got := w.Header().Get("X-Quota-Warning") == "true"; got != tc.wantAlert {
+			t.Errorf("%s at %s%%: warning=%v, want %v", tc.userId, w.Header().Get("X-Quota-Percent-Used"), got, tc.wantAlert)
+		}
+	}
+}
+
+func TestFilterExternalUserModelsByTier(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.DeniedModels = map[string]struct{}{"o1": {}}
+	externalUserConfig.TierAllowedModels = parseTierModelMap("default:gpt-4o-mini|gpt-3.5-turbo|o1")
+	seedTestUser(t, mr, ExternalUserData{ID: "free"})
+	seedTestUser(t, mr, ExternalUserData{ID: "vip", IsVIP: true, VIPExpiresAt: time.Now().Add(time.Hour).Unix()})
+	all := []string{"gpt-4o", "gpt-4o-mini", "gpt-3.5-turbo", "o1"}
+
+	models, err := FilterExternalUserModels(makeTestToken(t, map[string]interface{}{"userId": "free"}), all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(models, ",") != "gpt-3.5-turbo,gpt-4o-mini" {
+		t.Fatalf("free user should only see allow-listed, non-denied models, got %v", models)
+	}
+
+	models, err = FilterExternalUserModels(makeTestToken(t, map[string]interface{}{"userId": "vip"}), all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != len(all) {
+		t.Fatalf("VIP should see all models, got %v", models)
+	}
+
+	// 中间件使用同一策略拒绝不允许的模型
+	prevMaxBody := constant.MaxRequestBodyMB
+	constant.MaxRequestBodyMB = 64
+	defer func() { constant.MaxRequestBodyMB = prevMaxBody }()
+	w := doExternalRequestWithBody(t, map[string]string{
+		"X-External-User-Token": makeTestToken(t, map[string]interface{}{"userId": "free"}),
+		"X-Channel-Id":          "c1",
+		"Content-Type":          "application/json",
+	}, `{"model":"gpt-4o"}`)
+	if w.Code != http.StatusForbidden || w.Header().Get("X-Quota-Reason") != "model_not_allowed" {
+		t.Fatalf("free user calling gpt-4o should be rejected, got %d reason=%q", w.Code, w.Header().Get("X-Quota-Reason"))
+	}
+}
+
+func TestPromoWindowSuspendsQuota(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 10, MonthKey: CurrentQuotaPeriodKey(0)})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "10"}
+
+	// 活动期间: 配额已用完也放行，并统计用量
+	externalUserConfig.PromoStart = time.Now().Add(-time.Hour)
+	externalUserConfig.PromoEnd = time.Now().Add(time.Hour)
+	externalUserConfig.PromoCountUsage = true
+	w := doExternalRequest(t, headers)
+	if w.Code != http.StatusOK || w.Header().Get("X-Quota-Status") != "promo" {
+		t.Fatalf("inside promo window should bypass quota, got %d status=%q", w.Code, w.Header().Get("X-Quota-Status"))
+	}
+	if w.Header().Get("X-Quota-Used") != "11" {
+		t.Fatalf("promo usage should still be counted, got %q", w.Header().Get("X-Quota-Used"))
+	}
+
+	// 活动结束后恢复限制
+	externalUserConfig.PromoStart = time.Now().Add(-2 * time.Hour)
+	externalUserConfig.PromoEnd = time.Now().Add(-time.Hour)
+	w = doExternalRequest(t, headers)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("outside promo window quota should be enforced, got %d", w.Code)
+	}
+}
+
+func TestUserAuditLog(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1", Email: "u1@example.com"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "1"}
+
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+		t.Fatalf("first request should be allowed, got %d", w.Code)
+	}
+	pendingAuditWrites.Wait()
+	if w := doExternalRequest(t, headers); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request should be denied, got %d", w.Code)
+	}
+	pendingAuditWrites.Wait()
+
+	entries, next, err := GetUserAuditLog("u1", "", 10)
+	if err != nil || next != "" || len(entries) != 2 {
+		t.Fatalf("expected 2 entries and no next page, got %+v next=%q err=%v", entries, next, err)
+	}
+	denied, allowed := entries[0], entries[1]
+	if denied.Allowed || denied.Reason != "quota_exhausted" || denied.ChannelId != "c1" || denied.QuotaUsed != 1 || denied.QuotaTotal != 1 {
+		t.Fatalf("unexpected denied entry: %+v", denied)
+	}
+	if !allowed.Allowed || allowed.UserId != "u1" || allowed.Email != "u1@example.com" || allowed.ChannelId != "c1" || allowed.QuotaUsed != 1 || allowed.Timestamp == 0 {
+		t.Fatalf("unexpected allowed entry: %+v", allowed)
+	}
+
+	// 倒序分页
+	for i := 0; i < 3; i++ {
+		if err := appendAuditEntry(AuditEntry{Timestamp: int64(i), UserId: "u1", ChannelId: fmt.Sprintf("p%d", i)}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	var seen []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		entries, next, err := GetUserAuditLog("u1", cursor, 2)
+		if err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		for _, entry := range entries {
+			seen = append(seen, entry.ChannelId)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if want := []string{"p2", "p1", "p0", "c1", "c1"}; strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected newest-first pages %v, got %v", want, seen)
+	}
+	if entries, _, _ := GetUserAuditLog("u2", "", 10); len(entries) != 0 {
+		t.Fatalf("other users should have no entries, got %+v", entries)
+	}
+}
+
+func TestPIIHashedInAuditEntries(t *testing.T) {
+	mr := useTestRedis(t)
+	prevEnabled, prevSalt := common.PIIHashEnabled, common.PIIHashSalt
+	common.PIIHashEnabled, common.PIIHashSalt = true, "salt-a"
+	defer func() { common.PIIHashEnabled, common.PIIHashSalt = prevEnabled, prevSalt }()
+
+	hashed := common.HashPII("u1")
+	if hashed == "u1" || !strings.HasPrefix(hashed, "pii_") || common.HashPII("u1") != hashed {
+		t.Fatalf("userId should be hashed consistently, got %q", hashed)
+	}
+	common.PIIHashSalt = "salt-b"
+	if common.HashPII("u1") == hashed {
+		t.Fatal("hash should depend on the salt")
+	}
+	common.PIIHashSalt = "salt-a"
+
+	seedTestUser(t, mr, ExternalUserData{ID: "u1", Email: "alice@example.com"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	if w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1"}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	pendingAuditWrites.Wait()
+
+	var out strings.Builder
+	if n, err := ExportAuditLogNDJSON(&out, AuditFilter{UserId: "u1"}); err != nil || n != 1 {
+		t.Fatalf("filtering by raw userId should still match the hashed entry, got %d (err=%v)", n, err)
+	}
+	if strings.Contains(out.String(), `"u1"`) || strings.Contains(out.String(), "alice@example.com") {
+		t.Fatalf("audit entry should not contain raw PII: %s", out.String())
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(out.String()), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.UserId != hashed || entry.Email != common.HashPII("alice@example.com") {
+		t.Fatalf("unexpected audit identifiers: %+v", entry)
+	}
+
+	common.PIIHashEnabled = false
+	if common.HashPII("u1") != "u1" {
+		t.Fatal("raw values should be kept when hashing is disabled")
+	}
+}
+
+func TestVerifyExternalJWTSignature(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	valid := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	parts := strings.Split(valid, ".")
+
+	if userData, err := verifyExternalJWT(context.Background(), valid); err != nil || userData.ID != "u1" {
+		t.Fatalf("valid token should verify, got %+v err=%v", userData, err)
+	}
+
+	forged, _ := json.Marshal(map[string]interface{}{"userId": "admin"})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+	if _, err := verifyExternalJWT(context.Background(), tampered); !errors.Is(err, errJWTSignature) {
+		t.Fatalf("tampered payload should fail signature check, got %v", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("wrong-secret"))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	wrongSig := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if _, err := verifyExternalJWT(context.Background(), wrongSig); !errors.Is(err, errJWTSignature) {
+		t.Fatalf("token signed with another secret should be rejected, got %v", err)
+	}
+
+	noneHeader, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	algNone := base64.RawURLEncoding.EncodeToString(noneHeader) + "." + parts[1] + "."
+	if _, err := verifyExternalJWT(context.Background(), algNone); err == nil {
+		t.Fatal("alg none should be rejected")
+	}
+
+	// 未配置密钥时默认拒绝，显式允许后跳过校验
+	externalUserConfig.JWTSecret = ""
+	if _, err := verifyExternalJWT(context.Background(), valid); err == nil {
+		t.Fatal("empty JWT secret should fail closed")
+	}
+	externalUserConfig.AllowUnsignedTokens = true
+	if _, err := verifyExternalJWT(context.Background(), valid); err != nil {
+		t.Fatalf("unsigned tokens should be accepted when explicitly allowed, got %v", err)
+	}
+}
+
+func TestVerifyExternalJWTTimeClaims(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	externalUserConfig.JWTLeeway = time.Minute
+	now := time.Now().Unix()
+
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		want   error
+	}{
+		{"within nbf leeway", map[string]interface{}{"nbf": now + 30}, nil},
+		{"before nbf", map[string]interface{}{"nbf": now + 300}, errJWTNotYetValid},
+		{"expired within leeway", map[string]interface{}{"exp": now - 30}, nil},
+		{"expired beyond leeway", map[string]interface{}{"exp": now - 300}, errJWTExpired},
+		{"iat within leeway", map[string]interface{}{"iat": now + 30}, nil},
+		{"iat in the future", map[string]interface{}{"iat": now + 3600}, errJWTIssuedInFuture},
+	} {
+		tc.claims["userId"] = "u1"
+		_, err := verifyExternalJWT(context.Background(), makeTestToken(t, tc.claims))
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestExternalUserCache(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1", Tier: "bronze"})
+	externalUserConfig.UserCacheTTL = 100 * time.Millisecond
+	externalUserConfig.UserCacheSize = 10
+	externalUserRecordCache.reset()
+	t.Cleanup(externalUserRecordCache.reset)
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	tier := func() string {
+		t.Helper()
+		user, err := verifyExternalJWT(context.Background(), token)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		return user.Tier
+	}
+
+	if got := tier(); got != "bronze" {
+		t.Fatalf("expected bronze, got %q", got)
+	}
+	// 缓存命中: Redis 中的修改在 TTL 内不可见
+	seedTestUser(t, mr, ExternalUserData{ID: "u1", Tier: "gold"})
+	if got := tier(); got != "bronze" {
+		t.Fatalf("expected cached bronze, got %q", got)
+	}
+
+	// 过期后重新读取
+	time.Sleep(150 * time.Millisecond)
+	if got := tier(); got != "gold" {
+		t.Fatalf("expected gold after TTL, got %q", got)
+	}
+
+	// SetUserVIP 后立即失效
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	if err := SetUserVIP(context.Background(), "u1", true, expiresAt); err != nil {
+		t.Fatalf("SetUserVIP: %v", err)
+	}
+	user, err := verifyExternalJWT(context.Background(), token)
+	if err != nil || !user.IsVIP || user.VIPExpiresAt != expiresAt {
+		t.Fatalf("expected fresh VIP record after SetUserVIP, got %+v err=%v", user, err)
+	}
+}
+
+func TestVerifyExternalJWTSecretRotation(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	externalUserConfig.JWTSecret = "new-secret"
+	externalUserConfig.JWTPreviousSecrets = parseJWTSecretList("old-secret, new-secret,", "new-secret")
+	if len(externalUserConfig.JWTPreviousSecrets) != 1 {
+		t.Fatalf("primary and empty entries should be dropped, got %v", externalUserConfig.JWTPreviousSecrets)
+	}
+
+	signed := func(secret string) string {
+		parts := strings.Split(makeTestToken(t, map[string]interface{}{"userId": "u1"}), ".")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	for _, secret := range []string{"new-secret", "old-secret"} {
+		if _, err := verifyExternalJWT(context.Background(), signed(secret)); err != nil {
+			t.Fatalf("token signed with %s should verify, got %v", secret, err)
+		}
+	}
+	if _, err := verifyExternalJWT(context.Background(), signed("removed-secret")); !errors.Is(err, errJWTSignature) {
+		t.Fatalf("token signed with a removed secret should be rejected, got %v", err)
+	}
+}
+
+func TestVerifyExternalJWTIssuerAudience(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	verify := func(claims map[string]interface{}) error {
+		claims["userId"] = "u1"
+		_, err := verifyExternalJWT(context.Background(), makeTestToken(t, claims))
+		return err
+	}
+
+	// 未配置期望值时不校验
+	if err := verify(map[string]interface{}{"iss": "other-app", "aud": "other-app"}); err != nil {
+		t.Fatalf("iss/aud should be ignored when not configured, got %v", err)
+	}
+
+	externalUserConfig.ExpectedIssuer = "auth.example.com"
+	externalUserConfig.ExpectedAudience = "new-api"
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		want   error
+	}{
+		{"matching", map[string]interface{}{"iss": "auth.example.com", "aud": "new-api"}, nil},
+		{"array audience", map[string]interface{}{"iss": "auth.example.com", "aud": []string{"other-app", "new-api"}}, nil},
+		{"wrong issuer", map[string]interface{}{"iss": "evil.example.com", "aud": "new-api"}, errJWTIssuer},
+		{"missing issuer", map[string]interface{}{"aud": "new-api"}, errJWTIssuer},
+		{"wrong audience", map[string]interface{}{"iss": "auth.example.com", "aud": "other-app"}, errJWTAudience},
+		{"array without audience", map[string]interface{}{"iss": "auth.example.com", "aud": []string{"other-app"}}, errJWTAudience},
+	} {
+		if err := verify(tc.claims); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestVerifyExternalJWTRS256(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicKey, err := parseRSAPublicKeyPEM(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 仅配置 RSA 公钥
+	externalUserConfig.JWTSecret = ""
+	externalUserConfig.JWTPublicKey = publicKey
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, _ := json.Marshal(map[string]interface{}{"userId": "u1"})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	valid := signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+	if userData, err := verifyExternalJWT(context.Background(), valid); err != nil || userData.ID != "u1" {
+		t.Fatalf("valid RS256 token should verify, got %+v err=%v", userData, err)
+	}
+
+	// 攻击者用公钥作为 HMAC 密钥签发 HS256 token
+	hsHeader, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	hsInput := base64.RawURLEncoding.EncodeToString(hsHeader) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, der)
+	mac.Write([]byte(hsInput))
+	if _, err := verifyExternalJWT(context.Background(), hsInput+"."+base64.RawURLEncoding.EncodeToString(mac.Sum(nil))); err == nil {
+		t.Fatal("HS256 token should be rejected when only RSA is configured")
+	}
+
+	noneHeader, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	if _, err := verifyExternalJWT(context.Background(), base64.RawURLEncoding.EncodeToString(noneHeader)+"."+base64.RawURLEncoding.EncodeToString(payload)+"."); err == nil {
+		t.Fatal("alg none should be rejected")
+	}
+
+	// 显式的算法列表优先于按密钥推导
+	externalUserConfig.JWTSecret = testJWTSecret
+	externalUserConfig.JWTAlgorithms = parseJWTAlgorithms("RS256")
+	if _, err := verifyExternalJWT(context.Background(), makeTestToken(t, map[string]interface{}{"userId": "u1"})); err == nil {
+		t.Fatal("HS256 should be rejected when the allowed algorithms exclude it")
+	}
+}
+
+func TestQuotaKeyExpiresAtPeriodEnd(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.TrialQuota = 0
+
+	// 月末前 30 秒写入的记录在下个月 1 日零点过期
+	nearMonthEnd := time.Date(2025, 1, 31, 23, 59, 30, 0, time.Local)
+	if ttl := quotaKeyTTL("2025-01", nearMonthEnd); ttl != 30 {
+		t.Fatalf("expected 30s ttl near month end, got %d", ttl)
+	}
+	// 锚定日 31 在 2 月被截断为 28 日，按 3 月 31 日过期而不是提前到 3 月 28 日
+	if ttl := quotaKeyTTL("2025-02-28", time.Date(2025, 3, 30, 0, 0, 0, 0, time.Local)); ttl != 24*3600 {
+		t.Fatalf("truncated anchor day should expire at the latest possible end, got %d", ttl)
+	}
+
+	periodKey, _, periodEnd := quotaPeriod(time.Now(), 1)
+	if err := saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 3, MonthKey: periodKey}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("quota:u1:channel:c1"); ttl <= 0 || ttl > time.Until(periodEnd)+time.Second {
+		t.Fatalf("quota key should expire at period end %v, ttl=%v", periodEnd, ttl)
+	}
+	if _, _, err := chargeUserChannelQuota(context.Background(), "u1", "c2", periodKey, 1, periodKey, -1, "", -1); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("quota:u1:channel:c2"); ttl <= 0 || ttl > time.Until(periodEnd)+time.Second {
+		t.Fatalf("charged quota key should expire at period end %v, ttl=%v", periodEnd, ttl)
+	}
+
+	// 过期后视为新周期的首次使用
+	mr.FastForward(time.Until(periodEnd) + time.Second)
+	quota, err := getUserChannelQuota("u1", "c1")
+	if err != nil || quota.UsedCount != 0 || !quota.isNew {
+		t.Fatalf("expired key should read as a fresh period, got %+v err=%v", quota, err)
+	}
+
+	// 启用试用配额时保留记录 (FirstPeriodKey 不能丢失)
+	externalUserConfig.TrialQuota = 10
+	if ttl := quotaKeyTTL(periodKey, time.Now()); ttl != 0 {
+		t.Fatalf("quota keys should not expire while trial quota is enabled, got %d", ttl)
+	}
+}
+
+func TestQuotaRefundedOnUpstreamFailure(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	periodKey := CurrentQuotaPeriodKey(0)
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 3, MonthKey: periodKey})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+
+	r := gin.New()
+	upstreamStatus := http.StatusOK
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		c.String(upstreamStatus, "upstream")
+	})
+	send := func(reqCtx context.Context) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(reqCtx)
+		req.Header.Set("X-External-User-Token", token)
+		req.Header.Set("X-Channel-Id", "c1")
+		req.Header.Set("X-Channel-Quota-Limit", "10")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		quota, err := getUserChannelQuota("u1", "c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return quota.UsedCount
+	}
+
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		upstreamStatus = status
+		if used := send(context.Background()); used != 3 {
+			t.Fatalf("status %d should refund the quota, used=%d", status, used)
+		}
+	}
+
+	// 客户端断开连接
+	upstreamStatus = http.StatusOK
+	cancelled, cancel := context.WithCancel(context.Background())
+	r.POST("/v1/cancel", ExternalUserAuth(), func(c *gin.Context) { cancel() })
+	req := httptest.NewRequest(http.MethodPost, "/v1/cancel", nil).WithContext(cancelled)
+	req.Header.Set("X-External-User-Token", token)
+	req.Header.Set("X-Channel-Id", "c1")
+	req.Header.Set("X-Channel-Quota-Limit", "10")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if quota, _ := getUserChannelQuota("u1", "c1"); quota.UsedCount != 3 {
+		t.Fatalf("cancelled request should refund the quota, used=%d", quota.UsedCount)
+	}
+
+	// 收到完整响应后才断开的请求照常计数
+	streamed, cancelStreamed := context.WithCancel(context.Background())
+	r.POST("/v1/streamed", ExternalUserAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, "data: done")
+		cancelStreamed()
+	})
+	req = httptest.NewRequest(http.MethodPost, "/v1/streamed", nil).WithContext(streamed)
+	req.Header.Set("X-External-User-Token", token)
+	req.Header.Set("X-Channel-Id", "c1")
+	req.Header.Set("X-Channel-Quota-Limit", "10")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if quota, _ := getUserChannelQuota("u1", "c1"); quota.UsedCount != 4 {
+		t.Fatalf("cancel after the response was written should be charged, used=%d", quota.UsedCount)
+	}
+
+	// 上游成功或客户端错误时正常计数
+	if used := send(context.Background()); used != 5 {
+		t.Fatalf("successful request should be charged, used=%d", used)
+	}
+	upstreamStatus = http.StatusBadRequest
+	if used := send(context.Background()); used != 6 {
+		t.Fatalf("client errors should still be charged, used=%d", used)
+	}
+}
+
+func TestTokenQuotaAccruesAcrossRequests(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+
+	r := gin.New()
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		// 模拟消费日志写入本次 token 用量
+		common.SetContextKey(c, constant.ContextKeyExternalQuotaTokens, 120)
+		c.String(http.StatusOK, "ok")
+	})
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		req.Header.Set("X-External-User-Token", token)
+		req.Header.Set("X-Channel-Id", "c1")
+		req.Header.Set("X-Channel-Quota-Limit", "100")
+		req.Header.Set("X-Channel-Quota-Token-Limit", "300")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, wantUsed := range []string{"0", "120", "240"} {
+		w := send()
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d should pass, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("X-Quota-Token-Used"); got != wantUsed || w.Header().Get("X-Quota-Token-Total") != "300" {
+			t.Fatalf("request %d: expected token used %s/300, got %s/%s", i, wantUsed, got, w.Header().Get("X-Quota-Token-Total"))
+		}
+	}
+	quota, _ := getUserChannelQuota("u1", "c1")
+	if quota.TokenCount != 360 || quota.UsedCount != 3 {
+		t.Fatalf("expected 360 tokens over 3 requests, got %+v", quota)
+	}
+
+	w := send()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Quota-Reason") != "token_quota_exhausted" {
+		t.Fatalf("token budget should be enforced, got %d reason=%q", w.Code, w.Header().Get("X-Quota-Reason"))
+	}
+	if quota, _ := getUserChannelQuota("u1", "c1"); quota.UsedCount != 3 {
+		t.Fatalf("rejected request should not be charged, used=%d", quota.UsedCount)
+	}
+}
+
+func TestDailyQuotaExhaustedWhileMonthlyHasRoom(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{
+		"X-External-User-Token":       token,
+		"X-Channel-Id":                "c1",
+		"X-Channel-Quota-Limit":       "100",
+		"X-Channel-Quota-Daily-Limit": "2",
+	}
+
+	for i, wantRemaining := range []string{"1", "0"} {
+		w := doExternalRequest(t, headers)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d should pass, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("X-Quota-Daily-Remaining"); got != wantRemaining || w.Header().Get("X-Quota-Daily-Used") != fmt.Sprint(i+1) {
+			t.Fatalf("request %d: unexpected daily headers used=%s remaining=%s", i, w.Header().Get("X-Quota-Daily-Used"), got)
+		}
+	}
+
+	w := doExternalRequest(t, headers)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Quota-Reason") != "daily_quota_exhausted" {
+		t.Fatalf("daily limit should be enforced, got %d reason=%q", w.Code, w.Header().Get("X-Quota-Reason"))
+	}
+	if !strings.Contains(w.Body.String(), "今日") {
+		t.Fatalf("message should say the daily limit was hit, got %s", w.Body.String())
+	}
+	quota, _ := getUserChannelQuota("u1", "c1")
+	if quota.UsedCount != 2 {
+		t.Fatalf("monthly quota should be refunded when the daily limit rejects, used=%d", quota.UsedCount)
+	}
+	dayKey := dailyQuotaKey("u1", "c1", time.Now())
+	if ttl := mr.TTL(dayKey); ttl <= 0 || ttl > dailyQuotaKeyTTL {
+		t.Fatalf("daily counter should expire, ttl=%v", ttl)
+	}
+
+	// 次日重新计数
+	mr.Del(dayKey)
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+		t.Fatalf("new day should reset the daily quota, got %d", w.Code)
+	}
+}
+
+func TestVIPTierQuotas(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MonthlyQuota = 3
+	externalUserConfig.TierQuotas = map[string]int{"bronze": 2, "silver": 5, "gold": -1}
+	vipUntil := time.Now().Add(time.Hour).Unix()
+
+	cases := []struct {
+		user       ExternalUserData
+		wantStatus string
+		wantTotal  string
+	}{
+		{ExternalUserData{ID: "bronze", IsVIP: true, VIPExpiresAt: vipUntil, Tier: "bronze"}, "active", "2"},
+		{ExternalUserData{ID: "silver", IsVIP: true, VIPExpiresAt: vipUntil, Tier: "silver"}, "active", "5"},
+		{ExternalUserData{ID: "gold", IsVIP: true, VIPExpiresAt: vipUntil, Tier: "gold"}, "vip", "-1"},
+		// 未知等级: VIP 保持不限制，普通用户使用全局配额
+		{ExternalUserData{ID: "vip-unknown", IsVIP: true, VIPExpiresAt: vipUntil, Tier: "platinum"}, "vip", "-1"},
+		{ExternalUserData{ID: "vip-none", IsVIP: true, VIPExpiresAt: vipUntil}, "vip", "-1"},
+		{ExternalUserData{ID: "free-unknown", Tier: "platinum"}, "active", "3"},
+	}
+	for _, tc := range cases {
+		seedTestUser(t, mr, tc.user)
+		token := makeTestToken(t, map[string]interface{}{"userId": tc.user.ID})
+		w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tc.user.ID, w.Code)
+		}
+		if got := w.Header().Get("X-Quota-Status"); got != tc.wantStatus {
+			t.Errorf("%s: expected status %s, got %s", tc.user.ID, tc.wantStatus, got)
+		}
+		if got := w.Header().Get("X-Quota-Total"); got != tc.wantTotal {
+			t.Errorf("%s: expected total %s, got %s", tc.user.ID, tc.wantTotal, got)
+		}
+	}
+
+	// Bronze VIP 用完等级配额后被限制
+	token := makeTestToken(t, map[string]interface{}{"userId": "bronze"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1"}
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+		t.Fatalf("bronze second call should pass, got %d", w.Code)
+	}
+	if w := doExternalRequest(t, headers); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("bronze VIP should be limited to its tier quota, got %d", w.Code)
+	}
+}
+
+func TestVIPGracePeriod(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MonthlyQuota = 5
+	externalUserConfig.VIPGracePeriod = 48 * time.Hour
+	now := time.Now()
+
+	cases := []struct {
+		name       string
+		expiresAt  time.Time
+		wantStatus string
+		wantTotal  string
+		wantGrace  bool
+	}{
+		{"in-grace", now.Add(-time.Hour), "vip_grace", "-1", true},
+		{"just-past-grace", now.Add(-48*time.Hour - time.Minute), "active", "5", false},
+		{"far-expired", now.Add(-30 * 24 * time.Hour), "active", "5", false},
+	}
+	for _, tc := range cases {
+		seedTestUser(t, mr, ExternalUserData{ID: tc.name, IsVIP: true, VIPExpiresAt: tc.expiresAt.Unix()})
+		token := makeTestToken(t, map[string]interface{}{"userId": tc.name})
+		w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tc.name, w.Code)
+		}
+		if got := w.Header().Get("X-Quota-Status"); got != tc.wantStatus || w.Header().Get("X-Quota-Total") != tc.wantTotal {
+			t.Errorf("%s: expected %s total=%s, got %s total=%s", tc.name, tc.wantStatus, tc.wantTotal, got, w.Header().Get("X-Quota-Total"))
+		}
+		graceUntil := w.Header().Get("X-VIP-Grace-Until")
+		if (graceUntil != "") != tc.wantGrace {
+			t.Errorf("%s: unexpected grace header %q", tc.name, graceUntil)
+		}
+		if tc.wantGrace && (graceUntil != fmt.Sprint(tc.expiresAt.Add(48*time.Hour).Unix()) || w.Header().Get("X-Quota-Warning") != "true") {
+			t.Errorf("%s: grace users should get a warning with the grace end, got until=%s warning=%s", tc.name, graceUntil, w.Header().Get("X-Quota-Warning"))
+		}
+	}
+
+	// 未配置宽限期时过期即降级
+	externalUserConfig.VIPGracePeriod = 0
+	token := makeTestToken(t, map[string]interface{}{"userId": "in-grace"})
+	if w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1"}); w.Header().Get("X-Quota-Status") != "active" {
+		t.Fatalf("without a grace period expired VIP should use the normal quota, got %s", w.Header().Get("X-Quota-Status"))
+	}
+}
+
+func TestAdminDetectionByID(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MonthlyQuota = 5
+	externalUserConfig.AdminIDs = parseIdentityList("ops-1")
+	externalUserConfig.AdminUsernames = parseIdentityList("admin")
+	externalUserConfig.AdminByUsername = false
+
+	seedTestUser(t, mr, ExternalUserData{ID: "ops-1", Username: "alice"})
+	seedTestUser(t, mr, ExternalUserData{ID: "u2", Username: "bob"})
+	// 攻击者在外部系统注册了用户名 admin
+	seedTestUser(t, mr, ExternalUserData{ID: "attacker", Username: "admin"})
+
+	status := func(userId string) string {
+		token := makeTestToken(t, map[string]interface{}{"userId": userId})
+		w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1"})
+		return w.Header().Get("X-Quota-Status")
+	}
+	if got := status("ops-1"); got != "vip" {
+		t.Fatalf("admin ID should skip quota, got %s", got)
+	}
+	if got := status("u2"); got != "active" {
+		t.Fatalf("non-admin should be metered, got %s", got)
+	}
+	if got := status("attacker"); got != "active" {
+		t.Fatalf("username admin must not grant admin access, got %s", got)
+	}
+
+	// 旧版兼容: 显式开启后按用户名识别
+	externalUserConfig.AdminByUsername = true
+	if got := status("attacker"); got != "vip" {
+		t.Fatalf("legacy username matching should apply when enabled, got %s", got)
+	}
+}
+
+func TestUserRPMLimit(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.UserRPMLimit = 3
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	now := time.Date(2025, 3, 1, 10, 0, 15, 0, time.UTC)
+	prevNow := userRPMNow
+	userRPMNow = func() time.Time { return now }
+	defer func() { userRPMNow = prevNow }()
+
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "100"}
+	for i := 0; i < 3; i++ {
+		if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+			t.Fatalf("request %d should pass, got %d", i, w.Code)
+		}
+	}
+	w := doExternalRequest(t, headers)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Quota-Reason") != "rpm_exceeded" {
+		t.Fatalf("burst past the limit should be rejected, got %d reason=%q", w.Code, w.Header().Get("X-Quota-Reason"))
+	}
+	if got := w.Header().Get("Retry-After"); got != "45" {
+		t.Fatalf("expected Retry-After 45, got %q", got)
+	}
+
+	// 请求头不能放宽或关闭全局上限
+	for _, override := range []string{"5", "0", "-1"} {
+		headers["X-User-RPM-Limit"] = override
+		if w := doExternalRequest(t, headers); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("header %q should not raise the limit, got %d", override, w.Code)
+		}
+	}
+
+	// 下一分钟恢复，请求头可以收紧上限
+	now = now.Add(time.Minute)
+	headers["X-User-RPM-Limit"] = "1"
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+		t.Fatalf("next minute should pass, got %d", w.Code)
+	}
+	if w := doExternalRequest(t, headers); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("header should tighten the limit, got %d", w.Code)
+	}
+}
+
+func TestConcurrentInflightCap(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.MaxConcurrentPerUser = 2
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+
+	r := gin.New()
+	entered := make(chan struct{}, 10)
+	finish := make(chan struct{})
+	r.POST("/v1/chat/completions", ExternalUserAuth(), func(c *gin.Context) {
+		// 模拟长时间的流式请求: 等待结束信号或客户端断开
+		entered <- struct{}{}
+		select {
+		case <-finish:
+		case <-c.Request.Context().Done():
+		}
+		c.String(http.StatusOK, "ok")
+	})
+	send := func(reqCtx context.Context) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(reqCtx)
+		req.Header.Set("X-External-User-Token", token)
+		req.Header.Set("X-Channel-Id", "c1")
+		req.Header.Set("X-Channel-Quota-Limit", "100")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// 占满两个名额: 一个正常结束，一个由客户端断开
+	cancelled, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for _, reqCtx := range []context.Context{context.Background(), cancelled} {
+		wg.Add(1)
+		go func(reqCtx context.Context) {
+			defer wg.Done()
+			codes <- send(reqCtx)
+		}(reqCtx)
+	}
+	<-entered
+	<-entered
+
+	const extra = 3
+	for i := 0; i < extra; i++ {
+		if code := send(context.Background()); code != http.StatusTooManyRequests {
+			t.Fatalf("request beyond the in-flight cap should be rejected, got %d", code)
+		}
+	}
+
+	cancel()
+	close(finish)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("in-flight requests should complete, got %d", code)
+		}
+	}
+	if val, _ := mr.Get(inflightKeyPrefix + "u1"); val != "0" {
+		t.Fatalf("in-flight counter should return to 0 after all requests finish, got %q", val)
+	}
+	if code := send(context.Background()); code != http.StatusOK {
+		t.Fatalf("slots should be free again, got %d", code)
+	}
+}
+
+func TestBannedUserRejected(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "100"}
+
+	if _, err := BanExternalUser("u1", "abuse", 0); err != nil {
+		t.Fatal(err)
+	}
+	w := doExternalRequest(t, headers)
+	if w.Code != http.StatusForbidden || w.Header().Get("X-Quota-Reason") != "banned" || !strings.Contains(w.Body.String(), "abuse") {
+		t.Fatalf("banned user should be rejected with the reason, got %d %s", w.Code, w.Body.String())
+	}
+	if quota, _ := getUserChannelQuota("u1", "c1"); quota.UsedCount != 0 {
+		t.Fatalf("rejected request should not be charged, used=%d", quota.UsedCount)
+	}
+
+	if removed, err := UnbanExternalUser("u1"); err != nil || !removed {
+		t.Fatalf("unban should remove the record, removed=%v err=%v", removed, err)
+	}
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+		t.Fatalf("unbanned user should pass, got %d", w.Code)
+	}
+
+	// 限期封禁到期后自动解除
+	if _, err := BanExternalUser("u1", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if w := doExternalRequest(t, headers); w.Code != http.StatusForbidden {
+		t.Fatalf("temporary ban should apply, got %d", w.Code)
+	}
+	mr.FastForward(time.Hour + time.Second)
+	if w := doExternalRequest(t, headers); w.Code != http.StatusOK {
+		t.Fatalf("ban should expire, got %d", w.Code)
+	}
+}
+
+func TestResetStaleQuotas(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.ResetDayOfMonth = 1
+	current := CurrentQuotaPeriodKey(0)
+	seedTestUser(t, mr, ExternalUserData{ID: "u2", ResetDay: 15})
+	anchored := CurrentQuotaPeriodKey(15)
+
+	seedQuota := func(key string, quota UserQuota) {
+		data, _ := json.Marshal(quota)
+		if err := mr.Set(key, string(data)); err != nil {
+			t.Fatalf("seed quota: %v", err)
+		}
+	}
+	seedQuota("quota:u1", UserQuota{UsedCount: 5, MonthKey: "2000-01", FirstPeriodKey: "2000-01"})
+	seedQuota("quota:u1:channel:7", UserQuota{UsedCount: 3, MonthKey: current})
+	seedQuota("quota:u2:channel:7", UserQuota{UsedCount: 9, MonthKey: current}) // 锚定日 15，按月周期 key 已过期
+	seedQuota("quota:u2:channel:8", UserQuota{UsedCount: 4, MonthKey: anchored})
+	dailyKey := "quota:u1:channel:7" + dailyQuotaKeySeparator + time.Now().Format("2006-01-02")
+	mr.Set(dailyKey, "3")
+
+	reset, err := ResetStaleQuotas()
+	if err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if reset != 2 {
+		t.Fatalf("expected 2 stale records reset, got %d", reset)
+	}
+
+	readQuota := func(key string) UserQuota {
+		raw, err := mr.Get(key)
+		if err != nil {
+			t.Fatalf("read %s: %v", key, err)
+		}
+		var quota UserQuota
+		_ = json.Unmarshal([]byte(raw), &quota)
+		return quota
+	}
+	if q := readQuota("quota:u1"); q.UsedCount != 0 || q.MonthKey != current || q.FirstPeriodKey != "2000-01" {
+		t.Fatalf("stale legacy quota not reset correctly: %+v", q)
+	}
+	if q := readQuota("quota:u2:channel:7"); q.UsedCount != 0 || q.MonthKey != anchored {
+		t.Fatalf("stale channel quota not aligned to user anchor: %+v", q)
+	}
+	if q := readQuota("quota:u1:channel:7"); q.UsedCount != 3 || q.MonthKey != current {
+		t.Fatalf("current quota must be untouched: %+v", q)
+	}
+	if q := readQuota("quota:u2:channel:8"); q.UsedCount != 4 {
+		t.Fatalf("current anchored quota must be untouched: %+v", q)
+	}
+	if v, _ := mr.Get(dailyKey); v != "3" {
+		t.Fatalf("daily counter must be untouched, got %q", v)
+	}
+
+	if reset, err := ResetStaleQuotas(); err != nil || reset != 0 {
+		t.Fatalf("second run should reset nothing, got %d %v", reset, err)
+	}
+
+	mr.Set(quotaResetLockKey, "other")
+	if _, err := ResetStaleQuotas(); !errors.Is(err, ErrQuotaResetBusy) {
+		t.Fatalf("expected busy error while another run holds the lock, got %v", err)
+	}
+}
+
+func TestRedisCallsCancelledWithRequest(t *testing.T) {
+	release := make(chan struct{})
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		w.Write([]byte(`{"result":null}`))
+	})
+	defer close(release)
+	externalUserConfig.UpstashTimeout = 10 * time.Second
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := getUserFromRedisContext(reqCtx, "u1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled from Upstash lookup, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("cancelled Upstash lookup took %v", elapsed)
+	}
+
+	// 本地 Redis: 服务端不响应时，请求截止时间到达即返回
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	externalUserConfig.useLocalRedis = true
+	externalUserConfig.redisClient = redis.NewClient(&redis.Options{Addr: ln.Addr().String(), ReadTimeout: 10 * time.Second, MaxRetries: -1})
+	defer externalUserConfig.redisClient.Close()
+
+	reqCtx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := getUserFromRedisContext(reqCtx, "u1"); err == nil || errors.Is(err, errExternalUserNotFound) {
+		t.Fatalf("expected timeout error from local Redis lookup, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("local Redis lookup ignored the request deadline, took %v", elapsed)
+	}
+}
+
+func TestUpstashConnectionsReused(t *testing.T) {
+	var newConns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+		w.Write([]byte(`{"result":"PONG"}`))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&newConns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	prev := externalUserConfig
+	defer func() { externalUserConfig = prev }()
+	externalUserConfig.Enabled = true
+	externalUserConfig.useLocalRedis = false
+	externalUserConfig.RedisURL = server.URL
+	externalUserConfig.UpstashTimeout = defaultUpstashTimeout
+	prevSem := upstashSemaphore
+	setUpstashConcurrency(8)
+	defer func() { upstashSemaphore = prevSem }()
+
+	// 多轮突发请求: 每轮结束后 8 个连接同时空闲，下一轮应全部复用
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := externalRedisDo("PING"); err != nil {
+					t.Errorf("ping: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if n := atomic.LoadInt64(&newConns); n == 0 || n > 8 {
+		t.Fatalf("expected at most 8 connections for 40 requests, opened %d", n)
+	}
+}
+
+func TestRedisRetryOnTransientFailures(t *testing.T) {
+	var calls int64
+	var failWith int64 // 0: 网络错误 (断开连接)，其他: 返回该状态码
+	var failures int64
+	var failWritesOnly int64 // 1: 只有写入 (POST) 失败
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if (atomic.LoadInt64(&failWritesOnly) == 0 || r.Method == http.MethodPost) && atomic.AddInt64(&failures, -1) >= 0 {
+			if code := atomic.LoadInt64(&failWith); code != 0 {
+				w.WriteHeader(int(code))
+				w.Write([]byte(`{"error":"failure"}`))
+				return
+			}
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"result":"{\"usedCount\":3,\"monthKey\":\"2000-01\"}"}`))
+			return
+		}
+		w.Write([]byte(`{"result":"OK"}`))
+	})
+	externalUserConfig.RedisMaxAttempts = 3
+	externalUserConfig.RedisRetryBaseDelay = time.Millisecond
+	reset := func(code int64, n int64) {
+		atomic.StoreInt64(&calls, 0)
+		atomic.StoreInt64(&failWith, code)
+		atomic.StoreInt64(&failures, n)
+	}
+
+	// 一次 5xx 后成功
+	reset(http.StatusServiceUnavailable, 1)
+	quota, err := getUserChannelQuota("u1", "5")
+	if err != nil || quota.UsedCount != 3 || atomic.LoadInt64(&calls) != 2 {
+		t.Fatalf("expected success on second attempt, got %+v %v after %d calls", quota, err, calls)
+	}
+
+	// 一次网络错误后成功
+	reset(0, 1)
+	if err := saveUserChannelQuota("u1", "5", &UserQuota{UsedCount: 1, MonthKey: CurrentQuotaPeriodKey(0)}); err != nil || atomic.LoadInt64(&calls) != 2 {
+		t.Fatalf("expected save to succeed on second attempt, got %v after %d calls", err, calls)
+	}
+
+	// 4xx 不重试
+	reset(http.StatusBadRequest, 1)
+	if err := saveUserChannelQuota("u1", "5", &UserQuota{UsedCount: 1}); err == nil || atomic.LoadInt64(&calls) != 1 {
+		t.Fatalf("4xx must not be retried, got %v after %d calls", err, calls)
+	}
+
+	// 旧版配额读写与用户记录写入同样重试
+	reset(http.StatusServiceUnavailable, 1)
+	if quota, err := getUserQuota(context.Background(), "u1"); err != nil || quota.UsedCount != 3 || atomic.LoadInt64(&calls) != 2 {
+		t.Fatalf("expected legacy quota read to succeed on second attempt, got %+v %v after %d calls", quota, err, calls)
+	}
+	reset(http.StatusBadGateway, 1)
+	if err := saveUserQuota(context.Background(), "u1", &UserQuota{UsedCount: 1, MonthKey: CurrentQuotaPeriodKey(0)}); err != nil || atomic.LoadInt64(&calls) != 2 {
+		t.Fatalf("expected legacy quota save to succeed on second attempt, got %v after %d calls", err, calls)
+	}
+	atomic.StoreInt64(&failWritesOnly, 1)
+	reset(http.StatusServiceUnavailable, 1)
+	if err := SetUserVIP(context.Background(), "u1", true, time.Now().Add(time.Hour).Unix()); err != nil || atomic.LoadInt64(&calls) != 3 {
+		t.Fatalf("expected VIP write to succeed on second attempt, got %v after %d calls", err, calls)
+	}
+	reset(http.StatusTooManyRequests, 1)
+	if err := SetUserTier(context.Background(), "u1", "gold", 0); !errors.Is(err, ErrRedisRejected) || atomic.LoadInt64(&calls) != 2 {
+		t.Fatalf("4xx user writes must not be retried, got %v after %d calls", err, calls)
+	}
+	atomic.StoreInt64(&failWritesOnly, 0)
+
+	// 持续失败时最多尝试 RedisMaxAttempts 次
+	reset(http.StatusBadGateway, 10)
+	if _, err := getUserChannelQuota("u1", "5"); !errors.Is(err, ErrRedisTransient) || atomic.LoadInt64(&calls) != 3 {
+		t.Fatalf("expected 3 attempts before giving up, got %v after %d calls", err, calls)
+	}
+
+	// 请求 context 剩余时间不足以等待下一次重试时立即放弃
+	externalUserConfig.RedisRetryBaseDelay = time.Second
+	reset(http.StatusBadGateway, 10)
+	reqCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := getUserChannelQuotaContext(reqCtx, "u1", "5"); err == nil || atomic.LoadInt64(&calls) != 1 || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("retry should respect the request deadline, got %v after %d calls in %v", err, calls, time.Since(start))
+	}
+}
+
+func TestRedissURLUsesTLS(t *testing.T) {
+	if !IsLocalRedisURL("rediss://redis.example.com:6380") || !IsLocalRedisURL("redis://localhost:6379") || IsLocalRedisURL("https://example.upstash.io") {
+		t.Fatal("redis:// and rediss:// should be classified as local Redis, https:// as Upstash")
+	}
+	opt, err := newLocalRedisOptions("rediss://:secret@redis.example.com:6380/2")
+	if err != nil {
+		t.Fatalf("parse rediss url: %v", err)
+	}
+	if opt.TLSConfig == nil || opt.TLSConfig.ServerName != "redis.example.com" || opt.Addr != "redis.example.com:6380" || opt.DB != 2 {
+		t.Fatalf("rediss url should configure a TLS client: %+v", opt)
+	}
+	if opt, _ := newLocalRedisOptions("redis://localhost:6379"); opt.TLSConfig != nil {
+		t.Fatal("redis:// must not enable TLS")
+	}
+
+	// TLS Redis: 证书不受信任时 Ping 失败，不启用；信任证书后可正常连接
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.StartTLS()
+	defer ts.Close()
+	mr := miniredis.NewMiniRedis()
+	if err := mr.StartTLS(ts.TLS); err != nil {
+		t.Fatalf("start tls redis: %v", err)
+	}
+	defer mr.Close()
+
+	prev := externalUserConfig
+	prevEnabled := constant.ExternalUserAuthEnabled
+	t.Cleanup(func() {
+		if externalUserConfig.redisClient != nil {
+			externalUserConfig.redisClient.Close()
+		}
+		externalUserConfig = prev
+		constant.ExternalUserAuthEnabled = prevEnabled
+	})
+	InitExternalUserAuth("rediss://"+mr.Addr(), "", testJWTSecret, 30)
+	if !externalUserConfig.useLocalRedis || externalUserConfig.Enabled {
+		t.Fatalf("untrusted TLS Redis should be treated as local but not enabled (local=%v enabled=%v)", externalUserConfig.useLocalRedis, externalUserConfig.Enabled)
+	}
+
+	opt, _ = newLocalRedisOptions("rediss://" + mr.Addr())
+	opt.TLSConfig.RootCAs = x509.NewCertPool()
+	opt.TLSConfig.RootCAs.AddCert(ts.Certificate())
+	opt.TLSConfig.ServerName = "example.com"
+	client := redis.NewClient(opt)
+	defer client.Close()
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("ping over TLS: %v", err)
+	}
+}
+
+func TestSentinelURLUsesFailoverClient(t *testing.T) {
+	opt, err := parseSentinelURL("sentinel://mymaster@10.0.0.1,10.0.0.2:26380/3?password=pw&sentinel_password=spw")
+	if err != nil {
+		t.Fatalf("parse sentinel url: %v", err)
+	}
+	if opt.MasterName != "mymaster" || opt.DB != 3 || opt.Password != "pw" || opt.SentinelPassword != "spw" ||
+		strings.Join(opt.SentinelAddrs, ",") != "10.0.0.1:26379,10.0.0.2:26380" {
+		t.Fatalf("unexpected failover options: %+v", opt)
+	}
+	for _, bad := range []string{"sentinel://host1,host2", "sentinel://mymaster@", "sentinel://mymaster@host/x"} {
+		if _, err := parseSentinelURL(bad); err == nil {
+			t.Fatalf("%s should be rejected", bad)
+		}
+	}
+
+	// 模拟 Sentinel: 返回内存 Redis 作为主节点
+	master := miniredis.RunT(t)
+	sentinel := miniredis.RunT(t)
+	masterHost, masterPort, _ := net.SplitHostPort(master.Addr())
+	var lookups int64
+	err = sentinel.Server().Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		if len(args) == 2 && strings.EqualFold(args[0], "get-master-addr-by-name") && args[1] == "mymaster" {
+			atomic.AddInt64(&lookups, 1)
+			c.WriteLen(2)
+			c.WriteBulk(masterHost)
+			c.WriteBulk(masterPort)
+			return
+		}
+		c.WriteLen(0)
+	})
+	if err != nil {
+		t.Fatalf("register sentinel command: %v", err)
+	}
+
+	prev := externalUserConfig
+	prevEnabled := constant.ExternalUserAuthEnabled
+	t.Cleanup(func() {
+		pendingAuditWrites.Wait()
+		if externalUserConfig.redisClient != nil {
+			externalUserConfig.redisClient.Close()
+		}
+		externalUserConfig = prev
+		constant.ExternalUserAuthEnabled = prevEnabled
+	})
+	InitExternalUserAuth("sentinel://mymaster@"+sentinel.Addr(), "", testJWTSecret, 30)
+	if !externalUserConfig.Enabled || !externalUserConfig.useLocalRedis || atomic.LoadInt64(&lookups) == 0 {
+		t.Fatalf("sentinel config should enable local Redis via master lookup (enabled=%v lookups=%d)", externalUserConfig.Enabled, lookups)
+	}
+
+	// 其余读写逻辑不变，数据写入 Sentinel 返回的主节点
+	seedTestUser(t, master, ExternalUserData{ID: "u1", Email: "u1@example.com"})
+	user, err := getUserFromRedis("u1")
+	if err != nil || user.Email != "u1@example.com" {
+		t.Fatalf("read user through failover client: %+v %v", user, err)
+	}
+	if err := saveUserChannelQuota("u1", "5", &UserQuota{UsedCount: 2, MonthKey: CurrentQuotaPeriodKey(0)}); err != nil {
+		t.Fatalf("save quota through failover client: %v", err)
+	}
+	if !master.Exists("quota:u1:channel:5") {
+		t.Fatal("quota should be written to the master returned by Sentinel")
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	mr := useTestRedis(t)
+	externalUserConfig.RolloverMax = 20
+
+	// 跨两个周期: 2026-01 用 25/30，结转 5；2026-02 用 1/35，结转 30+5-1=34，封顶 20
+	charge := func(periodKey, prevKey string, cost int) (*UserQuota, bool) {
+		quota, accepted, err := chargeUserChannelQuota(context.Background(), "u1", "c1", periodKey, cost, "2026-01", 30, prevKey, 30)
+		if err != nil {
+			t.Fatalf("charge %s: %v", periodKey, err)
+		}
+		return quota, accepted
+	}
+	if _, accepted := charge("2026-01", "2025-12", 25); !accepted {
+		t.Fatal("first period charge should be accepted")
+	}
+	prev, _ := getUserChannelQuota("u1", "c1")
+	if got := rolloverCreditFor(prev, "2026-01", 30); got != 5 {
+		t.Fatalf("expected rollover 5 computed in Go, got %d", got)
+	}
+	quota, accepted := charge("2026-02", "2026-01", 1)
+	if !accepted || quota.RolloverCredit != 5 || quota.UsedCount != 1 {
+		t.Fatalf("expected rollover 5 with 1 used, got %+v accepted=%v", quota, accepted)
+	}
+	if _, accepted := charge("2026-02", "2026-01", 35); accepted {
+		t.Fatal("charge beyond base limit plus rollover should be rejected")
+	}
+	if _, accepted := charge("2026-02", "2026-01", 34); !accepted {
+		t.Fatal("charge within base limit plus rollover should be accepted")
+	}
+	saveUserChannelQuota("u1", "c1", &UserQuota{UsedCount: 1, MonthKey: "2026-02", RolloverCredit: 5})
+	if quota, _ := charge("2026-03", "2026-02", 1); quota.RolloverCredit != 20 {
+		t.Fatalf("expected rollover capped at 20, got %d", quota.RolloverCredit)
+	}
+	// 中间有周期未使用时不结转
+	if quota, _ := charge("2026-05", "2026-04", 1); quota.RolloverCredit != 0 {
+		t.Fatalf("expected no rollover after a skipped period, got %d", quota.RolloverCredit)
+	}
+
+	// 请求路径: 上个周期用了 10/30，本周期限额 30+20
+	seedTestUser(t, mr, ExternalUserData{ID: "u2"})
+	_, periodStart, _ := quotaPeriod(time.Now(), externalUserConfig.ResetDayOfMonth)
+	saveUserChannelQuota("u2", "c1", &UserQuota{UsedCount: 10, MonthKey: previousPeriodKey(periodStart, externalUserConfig.ResetDayOfMonth)})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u2"})
+	w := doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": "c1", "X-Channel-Quota-Limit": "30"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	for header, want := range map[string]string{"X-Quota-Rollover": "20", "X-Quota-Total": "50", "X-Quota-Remaining": "49"} {
+		if got := w.Header().Get(header); got != want {
+			t.Fatalf("expected %s=%s, got %q", header, want, got)
+		}
+	}
+}
+
+func TestPreviewExternalUserQuotaMatchesRealCall(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	seedTestUser(t, mr, ExternalUserData{ID: "vip", IsVIP: true})
+
+	preview := func(headers map[string]string) *ExternalUserQuotaPreview {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/external-user/quota/preview", nil)
+		for k, v := range headers {
+			c.Request.Header.Set(k, v)
+		}
+		p, err := PreviewExternalUserQuota(c, headers["X-External-User-Token"])
+		if err != nil {
+			t.Fatalf("preview: %v", err)
+		}
+		return p
+	}
+
+	for _, tc := range []struct {
+		name    string
+		userId  string
+		headers map[string]string
+		calls   int
+	}{
+		{"limited", "u1", map[string]string{"X-Channel-Id": "c1", "X-Channel-Quota-Limit": "3"}, 4},
+		{"disabled", "u1", map[string]string{"X-Channel-Id": "c2", "X-Channel-Quota-Enabled": "false"}, 1},
+		{"unlimited", "u1", map[string]string{"X-Channel-Id": "c3", "X-Channel-Quota-Limit": "-1"}, 1},
+		{"vip", "vip", map[string]string{"X-Channel-Id": "c1", "X-Channel-Quota-Limit": "3"}, 1},
+	} {
+		tc.headers["X-External-User-Token"] = makeTestToken(t, map[string]interface{}{"userId": tc.userId})
+		for i := 0; i < tc.calls; i++ {
+			// 预览不扣除配额，重复预览结果不变
+			p := preview(tc.headers)
+			if again := preview(tc.headers); *again != *p {
+				t.Fatalf("%s call %d: preview must not consume quota: %+v vs %+v", tc.name, i, p, again)
+			}
+			w := doExternalRequest(t, tc.headers)
+			if p.Allowed != (w.Code == http.StatusOK) {
+				t.Fatalf("%s call %d: preview allowed=%v, real call got %d", tc.name, i, p.Allowed, w.Code)
+			}
+			if !p.Allowed {
+				if p.Reason != "quota_exhausted" {
+					t.Fatalf("%s call %d: expected quota_exhausted, got %q", tc.name, i, p.Reason)
+				}
+				continue
+			}
+			for header, got := range map[string]string{
+				"X-Quota-Status":    p.Status,
+				"X-Quota-Used":      strconv.Itoa(p.Used),
+				"X-Quota-Total":     strconv.Itoa(p.Total),
+				"X-Quota-Remaining": strconv.Itoa(p.Remaining),
+			} {
+				if want := w.Header().Get(header); got != want {
+					t.Fatalf("%s call %d: preview %s=%s, real call %s", tc.name, i, header, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestResolveQuotaDecision(t *testing.T) {
+	prev := externalUserConfig
+	defer func() { externalUserConfig = prev }()
+	now := time.Date(2026, 3, 15, 12, 0, 0, 0, time.Local)
+	externalUserConfig.AdminIDs = parseIdentityList("root")
+	externalUserConfig.VIPGracePeriod = 24 * time.Hour
+	externalUserConfig.ResetDayOfMonth = 1
+	externalUserConfig.TrialQuota = 0
+	externalUserConfig.RolloverMax = 0
+	periodKey, _, _ := quotaPeriod(now, 1)
+
+	limited := func(limit int, mutate ...func(*requestQuota)) *requestQuota {
+		rq := &requestQuota{
+			channel:     ChannelQuotaConfig{ChannelId: "c1", QuotaEnabled: true, QuotaLimit: limit},
+			limit:       limit,
+			limitSource: quotaLimitSourceChannel,
+			bucket:      "c1",
+			cost:        1,
+			action:      quotaExceededActionBlock,
+		}
+		for _, m := range mutate {
+			m(rq)
+		}
+		return rq
+	}
+	normal := &ExternalUserData{ID: "u1"}
+
+	for _, tc := range []struct {
+		name        string
+		user        *ExternalUserData
+		rq          *requestQuota
+		quota       *UserQuota
+		promo       bool
+		wantAllowed bool
+		wantStatus  string
+		wantHeaders map[string]string
+	}{
+		{"admin", &ExternalUserData{ID: "root"}, limited(5), nil, false, true, "vip", map[string]string{"X-Quota-Total": "-1", "X-Quota-Remaining": "-1"}},
+		{"vip", &ExternalUserData{ID: "v1", IsVIP: true, VIPExpiresAt: now.Add(time.Hour).Unix()}, limited(5), nil, false, true, "vip", map[string]string{"X-Quota-Status": "vip"}},
+		{"vip grace", &ExternalUserData{ID: "v2", IsVIP: true, VIPExpiresAt: now.Add(-time.Hour).Unix()}, limited(5), nil, false, true, "vip_grace", nil},
+		{"promo", normal, limited(5), nil, true, true, "promo", map[string]string{"X-Quota-Reset": strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}},
+		{"disabled", normal, limited(5, func(rq *requestQuota) { rq.channel.QuotaEnabled = false }), nil, false, true, "disabled", map[string]string{"X-Quota-Used": "0"}},
+		{"unlimited", normal, limited(-1), nil, false, true, "unlimited", map[string]string{"X-Quota-Limit-Source": quotaLimitSourceChannel}},
+		{"needs quota record", normal, limited(5), nil, false, false, "", nil},
+		{"active", normal, limited(5), &UserQuota{UsedCount: 2, MonthKey: periodKey}, false, true, "active",
+			map[string]string{"X-Quota-Used": "3", "X-Quota-Total": "5", "X-Quota-Remaining": "2", "X-Quota-Percent-Used": "60"}},
+		{"stale period resets", normal, limited(5), &UserQuota{UsedCount: 5, MonthKey: "2000-01"}, false, true, "active", map[string]string{"X-Quota-Used": "1"}},
+		{"exhausted", normal, limited(5), &UserQuota{UsedCount: 5, MonthKey: periodKey}, false, false, "exceeded",
+			map[string]string{"X-Quota-Used": "5", "X-Quota-Reason": "quota_exhausted"}},
+		{"exhausted with warn", normal, limited(5, func(rq *requestQuota) { rq.action = quotaExceededActionWarn }), &UserQuota{UsedCount: 5, MonthKey: periodKey}, false, true, "exceeded",
+			map[string]string{"X-Quota-Used": "6", "X-Quota-Remaining": "0", "X-Quota-Exceeded-Action": quotaExceededActionWarn}},
+		{"cost exceeds remaining", normal, limited(5, func(rq *requestQuota) { rq.cost = 3 }), &UserQuota{UsedCount: 3, MonthKey: periodKey}, false, false, "exceeded", nil},
+		{"token quota exhausted", normal, limited(5, func(rq *requestQuota) { rq.tokenLimit = 100 }), &UserQuota{UsedCount: 1, TokenCount: 100, MonthKey: periodKey}, false, false, "exceeded",
+			map[string]string{"X-Quota-Reason": "token_quota_exhausted", "X-Quota-Token-Total": "100"}},
+	} {
+		externalUserConfig.PromoStart, externalUserConfig.PromoEnd = time.Time{}, time.Time{}
+		if tc.promo {
+			externalUserConfig.PromoStart, externalUserConfig.PromoEnd = now.Add(-time.Hour), now.Add(time.Hour)
+		}
+		decision := resolveQuotaDecision(tc.user, tc.rq, tc.quota, now)
+		if decision.allowed != tc.wantAllowed || decision.status != tc.wantStatus {
+			t.Fatalf("%s: expected allowed=%v status=%q, got allowed=%v status=%q", tc.name, tc.wantAllowed, tc.wantStatus, decision.allowed, decision.status)
+		}
+		for key, want := range tc.wantHeaders {
+			if got := decision.headers[key]; got != want {
+				t.Fatalf("%s: expected %s=%s, got %q", tc.name, key, want, got)
+			}
+		}
+	}
+
+	// 对齐周期与结转只作用于返回的副本: 传入的 rq / quota 不变，重复判定结果一致
+	externalUserConfig.RolloverMax = 10
+	_, periodStart, _ := quotaPeriod(now, 1)
+	rq := limited(5)
+	quota := &UserQuota{UsedCount: 2, MonthKey: previousPeriodKey(periodStart, 1)}
+	first := resolveQuotaDecision(normal, rq, quota, now)
+	second := resolveQuotaDecision(normal, rq, quota, now)
+	if rq.limit != 5 || rq.periodKey != "" || quota.MonthKey == periodKey || quota.UsedCount != 2 {
+		t.Fatalf("inputs should not be modified, got rq=%+v quota=%+v", rq, quota)
+	}
+	if first.rq.limit != 8 || first.quota.MonthKey != periodKey || first.quota.RolloverCredit != 3 || first.rq.periodKey != periodKey {
+		t.Fatalf("decision should carry the normalized values, got rq=%+v quota=%+v", first.rq, first.quota)
+	}
+	if second.rq.limit != first.rq.limit || second.headers["X-Quota-Total"] != "8" || second.headers["X-Quota-Used"] != first.headers["X-Quota-Used"] {
+		t.Fatalf("repeated decisions should match, got %v and %v", first.headers, second.headers)
+	}
+}
+
+// scrapeMetric 抓取指标接口，返回指定序列 (如 `external_user_requests_total{result="allowed"}`) 的当前值
+func scrapeMetric(t *testing.T, series string) float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	common.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("parse %s: %v", line, err)
+			}
+			return parsed
+		}
+	}
+	return 0
+}
+
+func TestExternalUserMetrics(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	externalUserConfig.MetricChannels = map[string]struct{}{"metrics-c1": {}}
+
+	allowed := `external_user_requests_total{result="allowed"}`
+	deniedQuota := `external_user_requests_total{result="denied_quota"}`
+	deniedAuth := `external_user_requests_total{result="denied_auth"}`
+	used := `external_user_quota_used{channel="metrics-c1"}`
+	before := map[string]float64{}
+	for _, series := range []string{allowed, deniedQuota, deniedAuth, used} {
+		before[series] = scrapeMetric(t, series)
+	}
+
+	headers := map[string]string{"X-External-User-Token": token, "X-Channel-Id": "metrics-c1", "X-Channel-Quota-Limit": "2"}
+	for i := 0; i < 3; i++ {
+		doExternalRequest(t, headers)
+	}
+	doExternalRequest(t, map[string]string{"X-External-User-Token": token + "x", "X-Channel-Id": "metrics-c1"})
+
+	want := map[string]float64{allowed: 2, deniedQuota: 1, deniedAuth: 1, used: 2}
+	for series, delta := range want {
+		if got := scrapeMetric(t, series) - before[series]; got != delta {
+			t.Errorf("%s moved by %v, want %v", series, got, delta)
+		}
+	}
+}
+
+func TestQuotaUsedMetricBucketsUnconfiguredChannels(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	externalUserConfig.MetricChannels = map[string]struct{}{"metrics-known": {}}
+
+	known := `external_user_quota_used{channel="metrics-known"}`
+	other := `external_user_quota_used{channel="other"}`
+	before := map[string]float64{known: scrapeMetric(t, known), other: scrapeMetric(t, other)}
+
+	for _, channelId := range []string{"metrics-known", "metrics-random-1", "metrics-random-2"} {
+		doExternalRequest(t, map[string]string{"X-External-User-Token": token, "X-Channel-Id": channelId})
+	}
+
+	want := map[string]float64{known: 1, other: 2}
+	for series, delta := range want {
+		if got := scrapeMetric(t, series) - before[series]; got != delta {
+			t.Errorf("%s moved by %v, want %v", series, got, delta)
+		}
+	}
+	// 客户端传递的任意渠道 ID 不产生新的指标序列
+	if got := scrapeMetric(t, `external_user_quota_used{channel="metrics-random-1"}`); got != 0 {
+		t.Errorf("unconfigured channel must not get its own series, got %v", got)
+	}
+}
+
+func TestProbeExternalRedis(t *testing.T) {
+	resetRedisHealthCache()
+	t.Cleanup(resetRedisHealthCache)
+
+	mr := useTestRedis(t)
+	if health := ProbeExternalRedis(); !health.Reachable || health.Error != "" {
+		t.Fatalf("miniredis should be reachable, got %+v", health)
+	}
+
+	// 缓存期内不再探测，Redis 关闭后仍返回上次结果
+	mr.Close()
+	if health := ProbeExternalRedis(); !health.Reachable {
+		t.Fatalf("cached result should be reused, got %+v", health)
+	}
+	resetRedisHealthCache()
+	if health := ProbeExternalRedis(); health.Reachable || health.Error == "" {
+		t.Fatalf("closed redis should be unreachable, got %+v", health)
+	}
+}
+
+func TestProbeExternalRedisSlowBackend(t *testing.T) {
+	resetRedisHealthCache()
+	t.Cleanup(resetRedisHealthCache)
+	prevTimeout := redisProbeTimeout
+	redisProbeTimeout = 200 * time.Millisecond
+	defer func() { redisProbeTimeout = prevTimeout }()
+
+	var delay atomic.Int64
+	useTestUpstash(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+		w.Write([]byte(`{"result":null}`))
+	})
+
+	delay.Store(int64(50 * time.Millisecond))
+	if health := ProbeExternalRedis(); !health.Reachable || health.LatencyMs < 50 {
+		t.Fatalf("slow backend should be reachable with measured latency, got %+v", health)
+	}
+
+	resetRedisHealthCache()
+	delay.Store(int64(400 * time.Millisecond))
+	health := ProbeExternalRedis()
+	if health.Reachable || !strings.Contains(health.Error, "超时") {
+		t.Fatalf("backend slower than the probe timeout should be unreachable, got %+v", health)
+	}
+	if health.LatencyMs >= 400 {
+		t.Fatalf("probe should stop at the timeout, took %dms", health.LatencyMs)
+	}
+}
+
+func TestQuotaDenialReasonAndRetryAfter(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	token := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	periodKey := CurrentQuotaPeriodKey(0)
+	saveUserChannelQuota("u1", "monthly", &UserQuota{UsedCount: 5, MonthKey: periodKey})
+	saveUserChannelQuota("u1", "tokens", &UserQuota{UsedCount: 1, TokenCount: 1000, MonthKey: periodKey})
+
+	now := time.Now()
+	_, _, periodEnd := quotaPeriod(now, effectiveResetDay(&ExternalUserData{ID: "u1"}))
+	for _, tc := range []struct {
+		name       string
+		headers    map[string]string
+		requests   int
+		wantReason string
+		wantReset  time.Time
+	}{
+		{"monthly", map[string]string{"X-Channel-Id": "monthly", "X-Channel-Quota-Limit": "5"}, 1, "quota_exhausted", periodEnd},
+		{"token", map[string]string{"X-Channel-Id": "tokens", "X-Channel-Quota-Limit": "100", "X-Channel-Quota-Token-Limit": "1000"}, 1, "token_quota_exhausted", periodEnd},
+		{"daily", map[string]string{"X-Channel-Id": "daily", "X-Channel-Quota-Limit": "100", "X-Channel-Quota-Daily-Limit": "1"}, 2, "daily_quota_exhausted", nextDailyReset(now)},
+	} {
+		tc.headers["X-External-User-Token"] = token
+		var w *httptest.ResponseRecorder
+		for i := 0; i < tc.requests; i++ {
+			w = doExternalRequest(t, tc.headers)
+		}
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Quota-Reason") != tc.wantReason {
+			t.Fatalf("%s: expected 429 %s, got %d reason=%q", tc.name, tc.wantReason, w.Code, w.Header().Get("X-Quota-Reason"))
+		}
+		// 允许测试执行期间的 1 秒误差
+		retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		if want := retryAfterSeconds(tc.wantReset, now); err != nil || retryAfter > want || retryAfter < want-1 {
+			t.Fatalf("%s: Retry-After = %q, want about %d", tc.name, w.Header().Get("Retry-After"), want)
+		}
+	}
+
+	day := time.Date(2025, 3, 31, 18, 30, 0, 0, time.UTC)
+	if got := nextDailyReset(day); !got.Equal(time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("daily reset should roll into the next month, got %v", got)
+	}
+	if got := retryAfterSeconds(day.Add(1500*time.Millisecond), day); got != 2 {
+		t.Fatalf("partial seconds should round up, got %d", got)
+	}
+}
+
+func TestQuotaHeadersConsistentAcrossBranches(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	seedTestUser(t, mr, ExternalUserData{ID: "vip1", IsVIP: true, VIPExpiresAt: time.Now().Add(time.Hour).Unix()})
+	userToken := makeTestToken(t, map[string]interface{}{"userId": "u1"})
+	vipToken := makeTestToken(t, map[string]interface{}{"userId": "vip1"})
+
+	schema := []string{"X-Quota-Status", "X-Quota-Used", "X-Quota-Total", "X-Quota-Remaining", "X-Quota-Limit-Source", "X-Quota-Percent-Used", "X-Quota-Reset"}
+	for _, tc := range []struct {
+		name       string
+		headers    map[string]string
+		status     string
+		remaining  string
+		unlimited  bool
+		wantSource string
+	}{
+		{"limited", map[string]string{"X-External-User-Token": userToken, "X-Channel-Quota-Limit": "10"}, "active", "9", false, quotaLimitSourceChannel},
+		{"vip", map[string]string{"X-External-User-Token": vipToken, "X-Channel-Quota-Limit": "10"}, quotaFastPathVIP, "-1", true, quotaLimitSourceChannel},
+		{"disabled", map[string]string{"X-External-User-Token": userToken, "X-Channel-Quota-Enabled": "false"}, quotaFastPathDisabled, "-1", true, quotaLimitSourceGlobal},
+		{"unlimited", map[string]string{"X-External-User-Token": userToken, "X-Channel-Quota-Limit": "-1"}, quotaFastPathUnlimited, "-1", true, quotaLimitSourceChannel},
+	} {
+		tc.headers["X-Channel-Id"] = "ch-" + tc.name
+		tc.headers["X-Channel-Name"] = "Channel " + tc.name
+		w := doExternalRequest(t, tc.headers)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", tc.name, w.Code)
+		}
+		for _, header := range schema {
+			if w.Header().Get(header) == "" {
+				t.Errorf("%s: missing %s", tc.name, header)
+			}
+		}
+		if got := w.Header().Get("X-Quota-Status"); got != tc.status {
+			t.Errorf("%s: X-Quota-Status = %q, want %q", tc.name, got, tc.status)
+		}
+		if got := w.Header().Get("X-Quota-Remaining"); got != tc.remaining {
+			t.Errorf("%s: X-Quota-Remaining = %q, want %q", tc.name, got, tc.remaining)
+		}
+		if tc.unlimited && w.Header().Get("X-Quota-Total") != "-1" {
+			t.Errorf("%s: unlimited branches should report total -1, got %q", tc.name, w.Header().Get("X-Quota-Total"))
+		}
+		if got := w.Header().Get("X-Quota-Limit-Source"); got != tc.wantSource {
+			t.Errorf("%s: X-Quota-Limit-Source = %q, want %q", tc.name, got, tc.wantSource)
+		}
+		if w.Header().Get("X-Channel-Id") != "ch-"+tc.name || w.Header().Get("X-Channel-Name") != "Channel "+tc.name {
+			t.Errorf("%s: channel headers not echoed: id=%q name=%q", tc.name, w.Header().Get("X-Channel-Id"), w.Header().Get("X-Channel-Name"))
+		}
+	}
+}
+
+func TestUserTierExpiry(t *testing.T) {
+	mr := useTestRedis(t)
+	seedTestUser(t, mr, ExternalUserData{ID: "u1"})
+	externalUserConfig.TierQuotas = map[string]int{"gold": 500}
+
+	if err := SetUserTier(context.Background(), "u1", " gold ", time.Now().Add(time.Hour).Unix()); err != nil {
+		t.Fatalf("SetUserTier: %v", err)
+	}
+	user, _ := getUserFromRedis("u1")
+	if limit, source := ResolveUserQuotaLimit(user, 30, quotaLimitSourceGlobal); limit != 500 || source != quotaLimitSourceTier {
+		t.Fatalf("active tier should set the limit, got %d (%s)", limit, source)
+	}
+
+	// 到期后按 default 计算，GetUserTier 不再返回等级
+	past := time.Now().Add(-time.Minute).Unix()
+	if err := SetUserTier(context.Background(), "u1", "gold", past); err != nil {
+		t.Fatalf("SetUserTier: %v", err)
+	}
+	user, _ = getUserFromRedis("u1")
+	if limit, _ := ResolveUserQuotaLimit(user, 30, quotaLimitSourceGlobal); limit != 30 || userTier(user) != defaultLimitTierID {
+		t.Fatalf("expired tier should fall back to default, got limit %d tier %q", limit, userTier(user))
+	}
+	if tier, expiresAt, err := GetUserTier("u1"); err != nil || tier != "" || expiresAt != past {
+		t.Fatalf("expired tier should read back empty, got %q %d %v", tier, expiresAt, err)
+	}
+
+	if err := SetUserTier(context.Background(), "missing", "gold", 0); !IsExternalUserNotFound(err) {
+		t.Fatalf("expected not found for missing user, got %v", err)
+	}
+}
+
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 外部用户封禁名单
+// 封禁记录保存在 blocked:<uid> (JSON)，设置了期限时由 Redis 到期自动解封；
+// 验证 token 后立即检查，被封禁的用户即使 token 有效、配额充足也会被拒绝。
+const blockedKeyPrefix = "blocked:"
+
+// ExternalUserBan 封禁记录
+type ExternalUserBan struct {
+	UserId    string `json:"userId"`
+	Reason    string `json:"reason,omitempty"`
+	BannedAt  int64  `json:"bannedAt"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // 0 表示永久封禁
+}
+
+// BanExternalUser 封禁用户，duration 为 0 时永久封禁
+func BanExternalUser(userId string, reason string, duration time.Duration) (*ExternalUserBan, error) {
+	userId = strings.TrimSpace(userId)
+	if userId == "" {
+		return nil, fmt.Errorf("用户 ID 不能为空")
+	}
+	if duration < 0 {
+		return nil, fmt.Errorf("封禁时长不能为负数")
+	}
+	now := time.Now()
+	ban := &ExternalUserBan{UserId: userId, Reason: reason, BannedAt: now.Unix()}
+	args := []interface{}{"SET", blockedKeyPrefix + userId}
+	if duration > 0 {
+		ban.ExpiresAt = now.Add(duration).Unix()
+	}
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, string(data))
+	if duration > 0 {
+		args = append(args, "EX", int64(duration/time.Second))
+	}
+	if _, err := externalRedisDo(args...); err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// UnbanExternalUser 解除封禁，返回用户之前是否处于封禁状态
+func UnbanExternalUser(userId string) (bool, error) {
+	val, err := externalRedisDo("DEL", blockedKeyPrefix+userId)
+	if err != nil {
+		return false, err
+	}
+	return externalRedisInt(val) > 0, nil
+}
+
+// GetExternalUserBan 获取用户的封禁记录，未被封禁时返回 nil
+func GetExternalUserBan(userId string) (*ExternalUserBan, error) {
+	val, err := externalRedisDo("GET", blockedKeyPrefix+userId)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	raw, _ := val.(string)
+	ban := &ExternalUserBan{UserId: userId}
+	if err := json.Unmarshal([]byte(raw), ban); err != nil {
+		// 记录损坏时仍视为封禁
+		externalUserWarn(ctx, "解析封禁记录失败", "user", common.HashPII(userId), "error", err)
+	}
+	return ban, nil
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// 外部用户记录的进程内缓存 (LRU + TTL)
+// 仅用于请求验证路径 (verifyExternalJWT)，减少每个请求读取 user:<id> 的开销；管理接口始终读取 Redis。
+// 缓存的是原始用户记录，VIP 是否有效仍在每次请求时按当前时间计算，VIP 到期不会因缓存而延后。
+// 本进程内修改用户记录时主动失效；其他实例或外部系统直接写入 Redis 的修改最迟在 TTL 后生效。
+// 默认不启用 (EXTERNAL_USER_CACHE_TTL_SECONDS 为 0)：开启后多实例部署中封禁、降级、删除用户或修改自定义配额，
+// 在其他实例上最多延迟一个 TTL 才生效，只在能接受这一延迟、且 Redis 读取成为瓶颈时开启。
+// TTL 或容量为 0 时不启用缓存。
+type externalUserCacheEntry struct {
+	userId    string
+	user      ExternalUserData
+	expiresAt time.Time
+}
+
+type externalUserCache struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+var externalUserRecordCache = &externalUserCache{ll: list.New(), items: map[string]*list.Element{}}
+
+// get 返回未过期的缓存记录副本
+func (c *externalUserCache) get(userId string, now time.Time) (*ExternalUserData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[userId]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*externalUserCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.ll.Remove(elem)
+		delete(c.items, userId)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	user := entry.user
+	return &user, true
+}
+
+// put 写入缓存，超出容量时淘汰最久未使用的记录
+func (c *externalUserCache) put(userId string, user *ExternalUserData, now time.Time, ttl time.Duration, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[userId]; ok {
+		entry := elem.Value.(*externalUserCacheEntry)
+		entry.user, entry.expiresAt = *user, now.Add(ttl)
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[userId] = c.ll.PushFront(&externalUserCacheEntry{userId: userId, user: *user, expiresAt: now.Add(ttl)})
+	for c.ll.Len() > size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*externalUserCacheEntry).userId)
+	}
+}
+
+// invalidate 移除指定用户的缓存
+func (c *externalUserCache) invalidate(userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[userId]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, userId)
+	}
+}
+
+// reset 清空缓存
+func (c *externalUserCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+}
+
+// getCachedUser 读取用户记录，启用缓存时优先使用缓存 (用户不存在或读取失败时不缓存)
+func getCachedUser(reqCtx context.Context, userId string) (*ExternalUserData, error) {
+	ttl, size := externalUserConfig.UserCacheTTL, externalUserConfig.UserCacheSize
+	if ttl <= 0 || size <= 0 {
+		return getUserFromRedisContext(reqCtx, userId)
+	}
+	if user, ok := externalUserRecordCache.get(userId, time.Now()); ok {
+		return user, nil
+	}
+	user, err := getUserFromRedisContext(reqCtx, userId)
+	if err != nil {
+		return nil, err
+	}
+	externalUserRecordCache.put(userId, user, time.Now(), ttl, size)
+	return user, nil
+}
+
+// InvalidateExternalUserCache 用户记录被修改或删除后使本进程内的缓存失效
+func InvalidateExternalUserCache(userId string) {
+	externalUserRecordCache.invalidate(userId)
+}
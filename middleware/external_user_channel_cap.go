@@ -0,0 +1,35 @@
+package middleware
+
+import "github.com/QuantumNous/new-api/common"
+
+// 每个用户可使用的渠道数上限
+// 用户使用过的渠道记录在集合 channels:<uid> 中，首次使用新渠道时加入集合，
+// 超过 MaxChannelsPerUser 时拒绝，防止伪造大量 channelId 生成无限多的配额 key。
+const userChannelsKeyPrefix = "channels:"
+
+// reserveUserChannel 登记用户使用的渠道，超出上限时返回 false
+func reserveUserChannel(userId string, channelId string) (bool, error) {
+	maxChannels := externalUserConfig.MaxChannelsPerUser
+	if maxChannels <= 0 || channelId == "" {
+		return true, nil
+	}
+	key := userChannelsKeyPrefix + userId
+	added, err := externalRedisDo("SADD", key, channelId)
+	if err != nil {
+		return false, err
+	}
+	if externalRedisInt(added) == 0 {
+		return true, nil
+	}
+	count, err := externalRedisDo("SCARD", key)
+	if err != nil {
+		return false, err
+	}
+	if externalRedisInt(count) > int64(maxChannels) {
+		if _, err := externalRedisDo("SREM", key, channelId); err != nil {
+			externalUserWarn(ctx, "回滚渠道登记失败", "user", common.HashPII(userId), "channel", channelId, "error", err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
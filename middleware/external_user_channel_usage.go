@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// externalMGetBatchSize 每批 MGET 的 key 数量
+const externalMGetBatchSize = 100
+
+// ChannelUsageSummary 单个渠道当前周期的调用汇总
+type ChannelUsageSummary struct {
+	ChannelId   string `json:"channelId"`
+	ChannelName string `json:"channelName"`
+	UsedCount   int64  `json:"usedCount"` // 所有用户当前周期调用次数合计
+	UserCount   int    `json:"userCount"` // 当前周期有调用的用户数
+}
+
+// ChannelUsageReport 按渠道聚合的使用情况
+// Legacy 为未区分渠道的旧版配额 key (quota:<uid>) 的汇总，单独统计避免与渠道数据重复计算。
+type ChannelUsageReport struct {
+	Channels []ChannelUsageSummary `json:"channels"`
+	Legacy   ChannelUsageSummary   `json:"legacy"`
+}
+
+// externalRedisMGet 分批读取多个 key，返回 key -> value (不存在的 key 不包含在结果中)
+// 各批次并发执行，Upstash 下受出站并发限制约束。
+func externalRedisMGet(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	for start := 0; start < len(keys); start += externalMGetBatchSize {
+		end := start + externalMGetBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			args := []interface{}{"MGET"}
+			for _, k := range batch {
+				args = append(args, k)
+			}
+			val, err := externalRedisDo(args...)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			items, _ := val.([]interface{})
+			for i, item := range items {
+				if s, ok := item.(string); ok && i < len(batch) {
+					values[batch[i]] = s
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return values, nil
+}
+
+// AggregateChannelUsage 汇总所有外部用户当前周期在各渠道的调用次数，按调用次数降序排列
+// 每个用户按自己的锚定日判断当前周期，过期周期的记录不计入。
+func AggregateChannelUsage() (*ChannelUsageReport, error) {
+	keys, err := externalRedisScan("quota:*")
+	if err != nil {
+		return nil, err
+	}
+
+	type quotaKeyInfo struct {
+		userId    string
+		channelId string
+	}
+	parsed := make(map[string]quotaKeyInfo, len(keys))
+	userKeys := []string{}
+	seenUsers := map[string]bool{}
+	for _, key := range keys {
+		// 每日计数器不是配额记录
+		if strings.Contains(key, dailyQuotaKeySeparator) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, "quota:")
+		info := quotaKeyInfo{userId: rest}
+		if idx := strings.Index(rest, ":channel:"); idx >= 0 {
+			info = quotaKeyInfo{userId: rest[:idx], channelId: rest[idx+len(":channel:"):]}
+			// 模型配额桶计入所属渠道
+			if m := strings.Index(info.channelId, modelQuotaSeparator); m >= 0 {
+				info.channelId = info.channelId[:m]
+			}
+		}
+		if info.userId == "" {
+			continue
+		}
+		parsed[key] = info
+		if !seenUsers[info.userId] {
+			seenUsers[info.userId] = true
+			userKeys = append(userKeys, "user:"+info.userId)
+		}
+	}
+
+	quotaKeys := make([]string, 0, len(parsed))
+	for key := range parsed {
+		quotaKeys = append(quotaKeys, key)
+	}
+	quotaValues, err := externalRedisMGet(quotaKeys)
+	if err != nil {
+		return nil, err
+	}
+	userValues, err := externalRedisMGet(userKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// 每个用户的当前周期 key
+	now := time.Now()
+	periodKeys := make(map[string]string, len(userKeys))
+	periodKeyFor := func(userId string) string {
+		if key, ok := periodKeys[userId]; ok {
+			return key
+		}
+		var userData *ExternalUserData
+		if raw, ok := userValues["user:"+userId]; ok {
+			var u ExternalUserData
+			if json.Unmarshal([]byte(raw), &u) == nil {
+				userData = &u
+			}
+		}
+		key, _, _ := quotaPeriod(now, effectiveResetDay(userData))
+		periodKeys[userId] = key
+		return key
+	}
+
+	report := &ChannelUsageReport{Channels: []ChannelUsageSummary{}}
+	byChannel := map[string]*ChannelUsageSummary{}
+	channelUsers := map[string]map[string]bool{}
+	for key, raw := range quotaValues {
+		var quota UserQuota
+		if err := json.Unmarshal([]byte(raw), &quota); err != nil {
+			continue
+		}
+		info := parsed[key]
+		if quota.UsedCount <= 0 || quota.MonthKey != periodKeyFor(info.userId) {
+			continue
+		}
+		summary := &report.Legacy
+		if info.channelId != "" {
+			summary = byChannel[info.channelId]
+			if summary == nil {
+				summary = &ChannelUsageSummary{ChannelId: info.channelId}
+				byChannel[info.channelId] = summary
+			}
+		}
+		summary.UsedCount += int64(quota.UsedCount)
+		if channelUsers[info.channelId] == nil {
+			channelUsers[info.channelId] = map[string]bool{}
+		}
+		if !channelUsers[info.channelId][info.userId] {
+			channelUsers[info.channelId][info.userId] = true
+			summary.UserCount++
+		}
+	}
+
+	for _, summary := range byChannel {
+		report.Channels = append(report.Channels, *summary)
+	}
+	sort.Slice(report.Channels, func(i, j int) bool {
+		if report.Channels[i].UsedCount != report.Channels[j].UsedCount {
+			return report.Channels[i].UsedCount > report.Channels[j].UsedCount
+		}
+		return report.Channels[i].ChannelId < report.Channels[j].ChannelId
+	})
+	return report, nil
+}
+
+// UserChannelQuota 单个用户在某个渠道 (或渠道内模型配额桶) 的配额使用情况
+type UserChannelQuota struct {
+	ChannelId string `json:"channelId"`
+	Model     string `json:"model,omitempty"`    // 非空表示该渠道下的模型配额桶
+	UsedCount int    `json:"usedCount"`          // 当前周期已用次数，记录属于过期周期时为 0
+	MonthKey  string `json:"monthKey"`           // 记录所在周期
+	Rollover  int    `json:"rollover,omitempty"` // 从上个周期结转的额度 (已计入 remaining)
+
+	// 以下由 ApplyUserChannelQuotaLimits 填写，-1 表示无限制
+	QuotaLimit int `json:"quotaLimit"`
+	Remaining  int `json:"remaining"`
+}
+
+// GetUserChannelQuotas 获取用户在各渠道的配额使用情况，按渠道、模型排序
+// resetDay 为用户锚定日 (0 表示使用全局配置)，用于判断记录是否属于当前周期。
+func GetUserChannelQuotas(userId string, resetDay int) ([]UserChannelQuota, error) {
+	prefix := "quota:" + userId + ":channel:"
+	keys, err := externalRedisScan(redisGlobEscaper.Replace(prefix) + "*")
+	if err != nil {
+		return nil, err
+	}
+	quotaKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		// 每日计数器不是配额记录
+		if !strings.Contains(key, dailyQuotaKeySeparator) {
+			quotaKeys = append(quotaKeys, key)
+		}
+	}
+	values, err := externalRedisMGet(quotaKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	currentPeriod := CurrentQuotaPeriodKey(resetDay)
+	result := make([]UserChannelQuota, 0, len(values))
+	for key, raw := range values {
+		var quota UserQuota
+		if err := json.Unmarshal([]byte(raw), &quota); err != nil {
+			continue
+		}
+		item := UserChannelQuota{ChannelId: strings.TrimPrefix(key, prefix), MonthKey: quota.MonthKey}
+		if m := strings.Index(item.ChannelId, modelQuotaSeparator); m >= 0 {
+			item.ChannelId, item.Model = item.ChannelId[:m], item.ChannelId[m+len(modelQuotaSeparator):]
+		}
+		if quota.MonthKey == currentPeriod {
+			item.UsedCount, item.Rollover = quota.UsedCount, quota.RolloverCredit
+		}
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ChannelId != result[j].ChannelId {
+			return result[i].ChannelId < result[j].ChannelId
+		}
+		return result[i].Model < result[j].Model
+	})
+	return result, nil
+}
+
+// ApplyUserChannelQuotaLimits 按与请求鉴权相同的规则计算各计数桶的上限与剩余次数:
+// 无限用户不限额，模型配额桶使用模型配额，其余使用用户自定义 / 等级配额，否则使用 channelLimit
+func ApplyUserChannelQuotaLimits(userData *ExternalUserData, channels []UserChannelQuota, channelLimit int, now time.Time) {
+	unlimited := IsUnlimitedUser(userData, now)
+	userLimit, _ := ResolveUserQuotaLimit(userData, channelLimit, "")
+	for i := range channels {
+		item := &channels[i]
+		limit := userLimit
+		if modelLimit, ok := externalUserConfig.ModelQuotas[item.Model]; ok && item.Model != "" {
+			limit = modelLimit
+		}
+		if unlimited || limit < 0 {
+			item.QuotaLimit, item.Remaining = -1, -1
+			continue
+		}
+		item.QuotaLimit = limit
+		item.Remaining = limit + item.Rollover - item.UsedCount
+		if item.Remaining < 0 {
+			item.Remaining = 0
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 每日配额
+// 与周期配额并行生效，防止用户在短时间内耗尽整个周期的额度。
+// 计数器 key 为 quota:<uid>:channel:<id>:day:<YYYY-MM-DD> (整数)，首次写入时设置过期时间，次日自动清除。
+// 渠道通过 X-Channel-Quota-Daily-Limit 指定上限，未指定时使用全局配置，0 表示不限制。
+const (
+	dailyQuotaKeySeparator = ":day:"
+	dailyQuotaKeyTTL       = 48 * time.Hour // 保留到次日之后，避免时区差异导致提前清除
+)
+
+// reserveDailyQuotaScript 扣除后不超过上限时才扣除
+// KEYS[1]: 每日计数 key; ARGV: 本次消耗、上限、过期秒数
+// 返回 {是否扣除 (1/0), 扣除后 (或当前) 用量}
+const reserveDailyQuotaScript = `
+local used = tonumber(redis.call("GET", KEYS[1]) or "0")
+if used + tonumber(ARGV[1]) > tonumber(ARGV[2]) then
+	return {0, used}
+end
+used = redis.call("INCRBY", KEYS[1], ARGV[1])
+if redis.call("TTL", KEYS[1]) < 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[3])
+end
+return {1, used}
+`
+
+// dailyQuotaKey 用户在渠道 (或渠道下模型) 某一天的计数 key
+func dailyQuotaKey(userId string, channelId string, day time.Time) string {
+	return channelQuotaKey(userId, channelId) + dailyQuotaKeySeparator + day.Format("2006-01-02")
+}
+
+// resolveDailyQuotaLimit 渠道指定的每日上限优先，未指定时使用全局配置
+func resolveDailyQuotaLimit(c *gin.Context) int {
+	if header := c.Request.Header.Get("X-Channel-Quota-Daily-Limit"); header != "" {
+		if parsed, err := strconv.Atoi(header); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return externalUserConfig.DailyQuota
+}
+
+// reserveDailyQuota 原子地检查并扣除每日配额，返回是否扣除与扣除后 (或当前) 用量
+func reserveDailyQuota(key string, cost int, limit int) (bool, int, error) {
+	val, err := externalRedisDo("EVAL", reserveDailyQuotaScript, 1, key, cost, limit, int64(dailyQuotaKeyTTL/time.Second))
+	if err != nil {
+		return false, 0, err
+	}
+	result, ok := val.([]interface{})
+	if !ok || len(result) != 2 {
+		return false, 0, fmt.Errorf("每日配额脚本返回值异常: %v", val)
+	}
+	return externalRedisInt(result[0]) == 1, int(externalRedisInt(result[1])), nil
+}
+
+// refundDailyQuota 退还每日配额 (尽力而为)
+func refundDailyQuota(key string, cost int) {
+	if _, err := externalRedisDo("DECRBY", key, cost); err != nil {
+		externalUserWarn(ctx, "退还每日配额失败", "error", err)
+	}
+}
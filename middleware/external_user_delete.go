@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 外部用户删除
+// 删除用户记录 user:<uid>、旧版配额 quota:<uid>、所有渠道配额 quota:<uid>:channel:* 以及渠道登记集合 channels:<uid>。
+// 封禁记录与终身调用次数保留，避免删除后重新创建同一用户绕过封禁或终身上限。
+
+// redisGlobEscaper 转义 SCAN pattern 中的通配符，避免 userId 含 * 等字符时误匹配其他用户的 key
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// DeleteExternalUserData 删除用户及其配额数据，返回实际删除的 key 数量 (用户不存在时为 0)
+func DeleteExternalUserData(userId string) (int64, error) {
+	userId = strings.TrimSpace(userId)
+	if userId == "" {
+		return 0, fmt.Errorf("用户 ID 不能为空")
+	}
+
+	channelKeys, err := externalRedisScan("quota:" + redisGlobEscaper.Replace(userId) + ":channel:*")
+	if err != nil {
+		return 0, err
+	}
+	args := []interface{}{"DEL", "user:" + userId, "quota:" + userId, userChannelsKeyPrefix + userId}
+	for _, key := range channelKeys {
+		args = append(args, key)
+	}
+
+	val, err := externalRedisDo(args...)
+	if err != nil {
+		return 0, err
+	}
+	InvalidateExternalUserCache(userId)
+	removed := externalRedisInt(val)
+	externalUserInfo(ctx, "已删除用户数据", "user", common.HashPII(userId), "keys", removed)
+	return removed, nil
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 配额用完后的处理方式 (渠道配置，通过 X-Channel-Quota-Exceeded-Action 传递)
+//   - block     (默认): 拒绝请求
+//   - warn      : 放行并标记超额
+//   - downgrade : 将请求模型替换为 X-Channel-Downgrade-Model 指定的低价模型后放行，
+//     无法替换 (未配置模型或请求体不是 JSON) 时按 block 处理
+const (
+	quotaExceededActionBlock     = "block"
+	quotaExceededActionWarn      = "warn"
+	quotaExceededActionDowngrade = "downgrade"
+)
+
+// configuredQuotaExceededAction 渠道配置的超额处理方式，不修改请求
+// downgrade 未配置降级模型时按 block 处理；请求体能否替换模型只有实际处理时才能确定
+func configuredQuotaExceededAction(c *gin.Context) string {
+	action := strings.ToLower(strings.TrimSpace(c.Request.Header.Get("X-Channel-Quota-Exceeded-Action")))
+	switch action {
+	case quotaExceededActionWarn:
+		return quotaExceededActionWarn
+	case quotaExceededActionDowngrade:
+		if strings.TrimSpace(c.Request.Header.Get("X-Channel-Downgrade-Model")) == "" {
+			return quotaExceededActionBlock
+		}
+		return quotaExceededActionDowngrade
+	}
+	return quotaExceededActionBlock
+}
+
+// applyQuotaExceededAction 按渠道配置处理超额请求，返回实际采取的处理方式
+func applyQuotaExceededAction(c *gin.Context) string {
+	action := configuredQuotaExceededAction(c)
+	if action != quotaExceededActionDowngrade {
+		if action == quotaExceededActionBlock && strings.EqualFold(strings.TrimSpace(c.Request.Header.Get("X-Channel-Quota-Exceeded-Action")), quotaExceededActionDowngrade) {
+			externalUserWarn(c, "渠道未配置降级模型，按 block 处理", "channel", c.Request.Header.Get("X-Channel-Id"))
+		}
+		return action
+	}
+	model := strings.TrimSpace(c.Request.Header.Get("X-Channel-Downgrade-Model"))
+	if err := rewriteRequestModel(c, model); err != nil {
+		externalUserWarn(c, "降级模型失败，按 block 处理", "channel", c.Request.Header.Get("X-Channel-Id"), "error", err)
+		return quotaExceededActionBlock
+	}
+	c.Header("X-Quota-Downgraded-Model", model)
+	return quotaExceededActionDowngrade
+}
+
+// rewriteRequestModel 替换 JSON 请求体中的 model 字段，保留其他字段不变
+func rewriteRequestModel(c *gin.Context, model string) error {
+	if !strings.HasPrefix(c.Request.Header.Get("Content-Type"), "application/json") {
+		return fmt.Errorf("请求体不是 JSON")
+	}
+	body, err := common.GetRequestBody(c)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	modelJSON, _ := json.Marshal(model)
+	fields["model"] = modelJSON
+	newBody, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	c.Set(common.KeyRequestBody, newBody)
+	c.Request.Body = io.NopCloser(bytes.NewReader(newBody))
+	c.Request.ContentLength = int64(len(newBody))
+	c.Request.Header.Set("Content-Length", strconv.Itoa(len(newBody)))
+	return nil
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Redis 连通性探测
+// 状态接口只检查配置项无法发现 Redis 不可达，这里实际发送一条命令并记录往返耗时:
+// 本地 Redis 发送 PING，Upstash 发送一次 GET (REST API 不需要额外权限)。
+// 结果缓存 redisProbeCacheTTL，管理后台轮询状态时不会每次都访问 Redis。
+const (
+	redisProbeCacheTTL = 5 * time.Second
+	redisProbeKey      = "health:probe"
+)
+
+// redisProbeTimeout 单次探测的超时，超时视为不可达 (测试中可调整)
+var redisProbeTimeout = 2 * time.Second
+
+// ExternalRedisHealth Redis 探测结果
+type ExternalRedisHealth struct {
+	Reachable bool      `json:"reachable"`
+	LatencyMs int64     `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+var redisHealthCache struct {
+	mu     sync.Mutex
+	result *ExternalRedisHealth
+}
+
+// ProbeExternalRedis 返回 Redis 连通性与延迟，缓存期内直接返回上次结果
+// 外部用户验证未启用时不探测，返回不可达。
+func ProbeExternalRedis() ExternalRedisHealth {
+	if !externalUserConfig.Enabled {
+		return ExternalRedisHealth{Error: "Redis 未配置", CheckedAt: time.Now()}
+	}
+	redisHealthCache.mu.Lock()
+	defer redisHealthCache.mu.Unlock()
+	if cached := redisHealthCache.result; cached != nil && time.Since(cached.CheckedAt) < redisProbeCacheTTL {
+		return *cached
+	}
+	result := probeExternalRedis()
+	redisHealthCache.result = &result
+	return result
+}
+
+// probeExternalRedis 发送一次探测命令 (不重试)
+func probeExternalRedis() ExternalRedisHealth {
+	probeCtx, cancel := context.WithTimeout(ctx, redisProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	if externalUserConfig.useLocalRedis {
+		_, err = externalRedisDoContext(probeCtx, "PING")
+	} else {
+		_, err = externalRedisDoContext(probeCtx, "GET", redisProbeKey)
+	}
+	result := ExternalRedisHealth{LatencyMs: time.Since(start).Milliseconds(), CheckedAt: time.Now()}
+	if err != nil {
+		if probeCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("探测超时 (%v)", redisProbeTimeout)
+		}
+		result.Error = err.Error()
+		return result
+	}
+	result.Reachable = true
+	return result
+}
+
+// resetRedisHealthCache 清除缓存的探测结果
+func resetRedisHealthCache() {
+	redisHealthCache.mu.Lock()
+	defer redisHealthCache.mu.Unlock()
+	redisHealthCache.result = nil
+}
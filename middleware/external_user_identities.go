@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"sort"
+	"strings"
+)
+
+// 特权身份 (跳过配额检查的用户)
+// 管理员按用户 ID 识别 (ID 由签发方分配，外部用户无法自行指定)；
+// 用户名可被外部用户自行注册，仅在显式开启 AdminByUsername 时作为旧版兼容生效。
+
+// ExemptIdentities 当前生效的特权身份配置 (不含任何密钥)
+type ExemptIdentities struct {
+	AdminIDs        []string `json:"adminIds"`        // 视为管理员的用户 ID
+	AdminUsernames  []string `json:"adminUsernames"`  // 视为管理员的用户名
+	AdminByUsername bool     `json:"adminByUsername"` // 用户名匹配是否生效
+}
+
+// parseIdentityList 解析逗号分隔的身份列表
+func parseIdentityList(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = struct{}{}
+		}
+	}
+	return set
+}
+
+// isExternalAdmin 判断用户是否为管理员 (跳过配额限制)
+func isExternalAdmin(userData *ExternalUserData) bool {
+	if userData == nil {
+		return false
+	}
+	if _, ok := externalUserConfig.AdminIDs[userData.ID]; ok && userData.ID != "" {
+		return true
+	}
+	if !externalUserConfig.AdminByUsername {
+		return false
+	}
+	_, ok := externalUserConfig.AdminUsernames[userData.Username]
+	return ok
+}
+
+func sortedIdentities(set map[string]struct{}) []string {
+	list := make([]string, 0, len(set))
+	for item := range set {
+		list = append(list, item)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// GetExemptIdentities 获取当前生效的特权身份列表 (供审计使用)
+func GetExemptIdentities() ExemptIdentities {
+	return ExemptIdentities{
+		AdminIDs:        sortedIdentities(externalUserConfig.AdminIDs),
+		AdminUsernames:  sortedIdentities(externalUserConfig.AdminUsernames),
+		AdminByUsername: externalUserConfig.AdminByUsername,
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 每个用户同时进行中的请求数上限
+// 请求进入时 inflight:<uid> 计数加一，请求结束 (包括客户端中途断开) 时减一；
+// 计数超过 MaxConcurrentPerUser 时立即撤销本次计数并拒绝。
+// 每次进入都会刷新过期时间，实例异常退出未能减一时计数会在过期后自动清除。管理员不受限制。
+const (
+	inflightKeyPrefix = "inflight:"
+	inflightKeyTTL    = 10 * time.Minute
+)
+
+// acquireInflightSlot 占用一个并发名额，返回释放函数；超过上限时返回 false
+func acquireInflightSlot(userId string, limit int) (func(), bool, error) {
+	noop := func() {}
+	if limit <= 0 {
+		return noop, true, nil
+	}
+	key := inflightKeyPrefix + userId
+	val, err := externalRedisDo("INCR", key)
+	if err != nil {
+		return noop, true, err
+	}
+	if _, err := externalRedisDo("EXPIRE", key, int64(inflightKeyTTL/time.Second)); err != nil {
+		externalUserWarn(ctx, "设置并发计数过期时间失败", "user", common.HashPII(userId), "error", err)
+	}
+	release := func() {
+		if _, err := externalRedisDo("DECR", key); err != nil {
+			externalUserWarn(ctx, "释放并发名额失败", "user", common.HashPII(userId), "error", err)
+		}
+	}
+	if externalRedisInt(val) > int64(limit) {
+		release()
+		return noop, false, nil
+	}
+	return release, true, nil
+}
+
+// enforceUserConcurrency 检查并占用并发名额，返回请求结束时需调用的释放函数；超过上限时返回 429 并终止请求
+func enforceUserConcurrency(c *gin.Context, userData *ExternalUserData) (func(), bool) {
+	limit := externalUserConfig.MaxConcurrentPerUser
+	if isExternalAdmin(userData) {
+		limit = 0
+	}
+	release, ok, err := acquireInflightSlot(userData.ID, limit)
+	if err != nil {
+		externalUserWarn(c, "检查并发请求数失败", "user", common.HashPII(userData.ID), "error", err)
+		return release, true
+	}
+	if !ok {
+		c.Header("X-Quota-Reason", "too_many_concurrent")
+		abortWithOpenAiMessage(c, http.StatusTooManyRequests,
+			fmt.Sprintf("同时进行中的请求过多 (最多 %d 个)，请等待之前的请求完成", limit))
+		return release, false
+	}
+	return release, true
+}
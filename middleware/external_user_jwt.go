@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JWT 签名校验
+// 支持 HS256 (JWTSecret) 与 RS256 (JWTPublicKey)，按 token header 中的 alg 选择校验方式，
+// 但只接受允许列表内的算法 (防止 alg 混淆 / 降级攻击，如 "none" 或用公钥当 HMAC 密钥)。
+// 允许列表未配置时按已配置的密钥推导: 有 JWTSecret 允许 HS256，有 JWTPublicKey 允许 RS256。
+// 两者都未配置时默认拒绝所有 token；仅在显式开启 AllowUnsignedTokens 时跳过校验 (仅用于开发环境)。
+// 轮换 HS256 密钥时，旧密钥配置在 JWTPreviousSecrets 中继续用于验证，签发只应使用 JWTSecret。
+const (
+	jwtAlgHS256 = "HS256"
+	jwtAlgRS256 = "RS256"
+)
+
+var errJWTSignature = errors.New("签名验证失败")
+
+// 时间声明校验
+// exp / nbf / iat 均允许 JWTLeeway 的时钟偏差: exp 过后 leeway 内仍有效，nbf 前 leeway 内已生效，
+// iat 晚于当前时间超过 leeway 视为签发时间无效。声明缺失或不是数字时不校验 (兼容未设置的签发方)。
+const defaultJWTLeeway = 60 * time.Second
+
+var (
+	errJWTExpired        = errors.New("token 已过期")
+	errJWTNotYetValid    = errors.New("token 尚未生效")
+	errJWTIssuedInFuture = errors.New("token 签发时间在未来")
+)
+
+// validateJWTTimeClaims 校验 exp、nbf、iat
+func validateJWTTimeClaims(claims map[string]interface{}, now time.Time) error {
+	leeway := int64(externalUserConfig.JWTLeeway / time.Second)
+	unix := now.Unix()
+	if exp, ok := claims["exp"].(float64); ok && unix > int64(exp)+leeway {
+		return errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && unix < int64(nbf)-leeway {
+		return errJWTNotYetValid
+	}
+	if iat, ok := claims["iat"].(float64); ok && int64(iat)-leeway > unix {
+		return errJWTIssuedInFuture
+	}
+	return nil
+}
+
+var (
+	errJWTIssuer   = errors.New("token 签发方不匹配")
+	errJWTAudience = errors.New("token 受众不匹配")
+)
+
+// validateJWTIssuerAudience 校验 iss 与 aud (未配置期望值时不校验)
+// aud 按 JWT 规范可以是字符串或字符串数组，数组中包含期望值即通过。
+func validateJWTIssuerAudience(claims map[string]interface{}) error {
+	if expected := externalUserConfig.ExpectedIssuer; expected != "" {
+		if iss, _ := claims["iss"].(string); iss != expected {
+			return errJWTIssuer
+		}
+	}
+	expected := externalUserConfig.ExpectedAudience
+	if expected == "" {
+		return nil
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == expected {
+			return nil
+		}
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok && s == expected {
+				return nil
+			}
+		}
+	}
+	return errJWTAudience
+}
+
+// parseRSAPublicKeyPEM 解析 PEM 格式的 RSA 公钥 (PKIX 或 PKCS#1)，兼容环境变量中以 \n 转义的换行
+func parseRSAPublicKeyPEM(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(strings.ReplaceAll(s, `\n`, "\n")))
+	if block == nil {
+		return nil, fmt.Errorf("无效的 PEM 公钥")
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("公钥不是 RSA 类型")
+		}
+		return rsaKey, nil
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+// parseJWTAlgorithms 解析允许的签名算法列表 (逗号分隔)，忽略不支持的算法
+func parseJWTAlgorithms(s string) map[string]struct{} {
+	algs := make(map[string]struct{})
+	for alg := range parseIdentityList(strings.ToUpper(s)) {
+		if alg != jwtAlgHS256 && alg != jwtAlgRS256 {
+			externalUserWarn(ctx, "忽略不支持的 JWT 算法", "alg", alg)
+			continue
+		}
+		algs[alg] = struct{}{}
+	}
+	return algs
+}
+
+// parseJWTSecretList 解析逗号分隔的旧密钥列表 (保持顺序，去除空值与重复)
+func parseJWTSecretList(s string, primary string) []string {
+	var secrets []string
+	seen := map[string]struct{}{primary: {}}
+	for _, secret := range strings.Split(s, ",") {
+		secret = strings.TrimSpace(secret)
+		if _, dup := seen[secret]; secret == "" || dup {
+			continue
+		}
+		seen[secret] = struct{}{}
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+// hmacSecrets 验证 HS256 时依次尝试的密钥: 当前密钥在前，旧密钥在后
+func hmacSecrets() []string {
+	secrets := make([]string, 0, 1+len(externalUserConfig.JWTPreviousSecrets))
+	if externalUserConfig.JWTSecret != "" {
+		secrets = append(secrets, externalUserConfig.JWTSecret)
+	}
+	return append(secrets, externalUserConfig.JWTPreviousSecrets...)
+}
+
+// allowedJWTAlgorithms 当前允许的签名算法
+func allowedJWTAlgorithms() map[string]struct{} {
+	if len(externalUserConfig.JWTAlgorithms) > 0 {
+		return externalUserConfig.JWTAlgorithms
+	}
+	algs := make(map[string]struct{})
+	if len(hmacSecrets()) > 0 {
+		algs[jwtAlgHS256] = struct{}{}
+	}
+	if externalUserConfig.JWTPublicKey != nil {
+		algs[jwtAlgRS256] = struct{}{}
+	}
+	return algs
+}
+
+// verifyJWTSignature 校验 token 的算法与签名，parts 为按 '.' 切分后的三段
+func verifyJWTSignature(parts []string) error {
+	allowed := allowedJWTAlgorithms()
+	if len(allowed) == 0 {
+		if externalUserConfig.AllowUnsignedTokens {
+			return nil
+		}
+		return fmt.Errorf("JWT 密钥未配置，拒绝验证 token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("无法解码 token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("无法解析 token header")
+	}
+	if _, ok := allowed[header.Alg]; !ok {
+		return fmt.Errorf("不支持的签名算法: %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errJWTSignature
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case jwtAlgHS256:
+		secrets := hmacSecrets()
+		if len(secrets) == 0 {
+			return fmt.Errorf("JWT 密钥未配置，无法验证 %s", header.Alg)
+		}
+		for _, secret := range secrets {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(signingInput)
+			if hmac.Equal(signature, mac.Sum(nil)) {
+				return nil
+			}
+		}
+		return errJWTSignature
+	case jwtAlgRS256:
+		if externalUserConfig.JWTPublicKey == nil {
+			return fmt.Errorf("JWT 公钥未配置，无法验证 %s", header.Alg)
+		}
+		digest := sha256.Sum256(signingInput)
+		if err := rsa.VerifyPKCS1v15(externalUserConfig.JWTPublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errJWTSignature
+		}
+	}
+	return nil
+}
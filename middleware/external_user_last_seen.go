@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 最近活跃时间
+// 写入 lastSeen:<uid> (Unix 秒)，同一实例内每个用户最多每分钟写一次，避免每个请求都写 Redis。
+const (
+	lastSeenKeyPrefix = "lastSeen:"
+	lastSeenThrottle  = time.Minute
+)
+
+var (
+	lastSeenNow     = time.Now
+	lastSeenWritten sync.Map // userId -> 本实例上次写入时间 (time.Time)
+)
+
+// touchLastSeen 记录用户最近活跃时间 (节流，尽力而为)
+func touchLastSeen(userId string) {
+	if userId == "" {
+		return
+	}
+	now := lastSeenNow()
+	if last, ok := lastSeenWritten.Load(userId); ok && now.Sub(last.(time.Time)) < lastSeenThrottle {
+		return
+	}
+	lastSeenWritten.Store(userId, now)
+	if _, err := externalRedisDo("SET", lastSeenKeyPrefix+userId, now.Unix()); err != nil {
+		externalUserWarn(ctx, "记录最近活跃时间失败", "user", common.HashPII(userId), "error", err)
+	}
+}
+
+// GetLastSeen 获取用户最近活跃时间 (Unix 秒)，从未活跃时返回 0
+func GetLastSeen(userId string) int64 {
+	val, err := externalRedisDo("GET", lastSeenKeyPrefix+userId)
+	if err != nil || val == nil {
+		return 0
+	}
+	if s, ok := val.(string); ok {
+		ts, _ := strconv.ParseInt(s, 10, 64)
+		return ts
+	}
+	return externalRedisInt(val)
+}
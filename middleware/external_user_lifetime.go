@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 终身调用上限
+// 与按周期重置的配额不同，终身计数 (LifetimeCount) 记录在独立的 lifetime:<uid> 计数器中，永不重置；
+// 上限按用户等级配置，未设置等级的用户使用 "default"，上限为 0 或未配置表示不限制。VIP 不受限制。
+// 请求处理时先读取计数快速拒绝，周期配额扣除后再通过 reserveLifetimeScript 原子地检查并累加，
+// 并发请求在边界同时通过读取检查时，只有不超过上限的部分会被计入。
+const (
+	lifetimeKeyPrefix  = "lifetime:"
+	defaultLimitTierID = "default"
+)
+
+// parseTierIntMap 解析 "default:1000,bronze:5000" 格式的等级配置
+func parseTierIntMap(s string) map[string]int {
+	m := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			externalUserWarn(ctx, "忽略无效的等级配置", "item", item)
+			continue
+		}
+		m[strings.TrimSpace(parts[0])] = value
+	}
+	return m
+}
+
+// userTier 用户等级，未设置或已到期时为 "default"
+func userTier(userData *ExternalUserData) string {
+	if tier := activeTier(userData); tier != "" {
+		return tier
+	}
+	return defaultLimitTierID
+}
+
+// lifetimeCap 用户等级对应的终身调用上限，0 表示不限制
+func lifetimeCap(userData *ExternalUserData) int {
+	return externalUserConfig.LifetimeCaps[userTier(userData)]
+}
+
+// GetLifetimeCount 获取用户终身调用次数
+func GetLifetimeCount(userId string) (int64, error) {
+	val, err := externalRedisDo("GET", lifetimeKeyPrefix+userId)
+	if err != nil {
+		return 0, err
+	}
+	return externalRedisInt(val), nil
+}
+
+// reserveLifetimeScript 累加后不超过上限时才累加
+// KEYS[1]: 终身计数 key; ARGV: 本次消耗、上限
+// 返回 {是否累加 (1/0), 累加后 (或当前) 次数}
+const reserveLifetimeScript = `
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+if count + tonumber(ARGV[1]) > tonumber(ARGV[2]) then
+	return {0, count}
+end
+return {1, redis.call("INCRBY", KEYS[1], ARGV[1])}
+`
+
+// reserveLifetimeCount 原子地检查并累加终身调用次数，返回是否累加与累加后 (或当前) 次数
+func reserveLifetimeCount(userId string, cost int, limit int) (bool, int64, error) {
+	val, err := externalRedisDo("EVAL", reserveLifetimeScript, 1, lifetimeKeyPrefix+userId, cost, limit)
+	if err != nil {
+		return false, 0, err
+	}
+	result, ok := val.([]interface{})
+	if !ok || len(result) != 2 {
+		return false, 0, fmt.Errorf("终身调用次数脚本返回值异常: %v", val)
+	}
+	return externalRedisInt(result[0]) == 1, externalRedisInt(result[1]), nil
+}
+
+// addLifetimeCount 累加用户终身调用次数 (退还时传入负数)
+func addLifetimeCount(userId string, cost int) {
+	if _, err := externalRedisDo("INCRBY", lifetimeKeyPrefix+userId, cost); err != nil {
+		externalUserWarn(ctx, "更新终身调用次数失败", "user", common.HashPII(userId), "error", err)
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import "time"
+
+// 配额上限来源 (X-Quota-Limit-Source)，优先级从高到低:
+// custom (用户自定义) > tier (用户等级) > channel (渠道配置) > global (全局默认)；
+// 首个周期试用配额更高时最终来源为 trial。
+const (
+	quotaLimitSourceGlobal  = "global"
+	quotaLimitSourceChannel = "channel"
+	quotaLimitSourceTier    = "tier"
+	quotaLimitSourceCustom  = "custom"
+	quotaLimitSourceTrial   = "trial"
+)
+
+// ResolveUserQuotaLimit 在渠道/全局配额的基础上应用用户级别的配额上限
+// 管理接口展示用户配额时使用同一规则 (source 只用于 X-Quota-Limit-Source，不关心时可传空字符串)
+func ResolveUserQuotaLimit(userData *ExternalUserData, limit int, source string) (int, string) {
+	if userData == nil {
+		return limit, source
+	}
+	if userData.QuotaLimit != 0 {
+		return userData.QuotaLimit, quotaLimitSourceCustom
+	}
+	if tier := activeTier(userData); tier != "" {
+		if tierLimit, ok := externalUserConfig.TierQuotas[tier]; ok {
+			return tierLimit, quotaLimitSourceTier
+		}
+	}
+	return limit, source
+}
+
+// isActiveVIP VIP 是否在有效期内
+func isActiveVIP(userData *ExternalUserData, now time.Time) bool {
+	return userData != nil && userData.IsVIP && userData.VIPExpiresAt > now.Unix()
+}
+
+// vipGraceEnd VIP 宽限期结束时间
+func vipGraceEnd(userData *ExternalUserData) time.Time {
+	return time.Unix(userData.VIPExpiresAt, 0).Add(externalUserConfig.VIPGracePeriod)
+}
+
+// inVIPGrace VIP 已过期但仍在宽限期内 (保持 VIP 权限，响应中提示即将降级)
+func inVIPGrace(userData *ExternalUserData, now time.Time) bool {
+	if externalUserConfig.VIPGracePeriod <= 0 || userData == nil || !userData.IsVIP || userData.VIPExpiresAt <= 0 {
+		return false
+	}
+	return !isActiveVIP(userData, now) && now.Before(vipGraceEnd(userData))
+}
+
+// HasVIPAccess VIP 有效或处于宽限期内
+func HasVIPAccess(userData *ExternalUserData, now time.Time) bool {
+	return isActiveVIP(userData, now) || inVIPGrace(userData, now)
+}
+
+// IsUnlimitedUser 管理员与未按等级限额的 VIP (含宽限期内) 不受配额限制
+// VIP 所在等级在 TierQuotas 中配置了有限配额时 (如 bronze:500) 按等级配额计量;
+// 等级配额为 -1、未设置等级或等级未配置时保持不限制。
+func IsUnlimitedUser(userData *ExternalUserData, now time.Time) bool {
+	if isExternalAdmin(userData) {
+		return true
+	}
+	if !HasVIPAccess(userData, now) {
+		return false
+	}
+	tier := activeTier(userData)
+	tierLimit, ok := externalUserConfig.TierQuotas[tier]
+	return tier == "" || !ok || tierLimit == -1
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+)
+
+// 外部用户验证日志
+// 请求处理过程的逐步日志只在 DEBUG 模式下输出；Redis 故障等需要运维关注的问题输出为 WARN / ERR，
+// 附带 key=value 字段便于检索。日志中不得出现完整 token，用户标识须经 common.HashPII 处理。
+const externalUserLogPrefix = "[ExternalUserAuth] "
+
+// externalUserDebugf 输出调试日志 (仅 DEBUG 模式)
+func externalUserDebugf(ctx context.Context, format string, args ...any) {
+	if !common.DebugEnabled {
+		return
+	}
+	logger.LogDebug(ctx, externalUserLogPrefix+fmt.Sprintf(format, args...))
+}
+
+// externalUserInfo 输出启动配置等一次性信息
+func externalUserInfo(ctx context.Context, msg string, fields ...any) {
+	logger.LogInfo(ctx, externalUserLogPrefix+msg+formatLogFields(fields))
+}
+
+// externalUserWarn 输出可降级处理的异常 (如 Redis 读写失败后放行)
+func externalUserWarn(ctx context.Context, msg string, fields ...any) {
+	logger.LogWarn(ctx, externalUserLogPrefix+msg+formatLogFields(fields))
+}
+
+// externalUserError 输出导致请求失败或功能不可用的错误
+func externalUserError(ctx context.Context, msg string, fields ...any) {
+	logger.LogError(ctx, externalUserLogPrefix+msg+formatLogFields(fields))
+}
+
+// formatLogFields 将 key, value 交替排列的字段格式化为 " key=value ..."，含空白的值加引号
+func formatLogFields(fields []any) string {
+	var sb strings.Builder
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if i+1 >= len(fields) {
+			sb.WriteString(" " + key + "=<missing>")
+			break
+		}
+		value := fmt.Sprint(fields[i+1])
+		if strings.ContainsAny(value, " \t\n\"") {
+			value = strconv.Quote(value)
+		}
+		sb.WriteString(" " + key + "=" + value)
+	}
+	return sb.String()
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 外部用户请求结果指标
+const (
+	externalUserResultAllowed     = "allowed"
+	externalUserResultDeniedQuota = "denied_quota"
+	externalUserResultDeniedAuth  = "denied_auth"
+)
+
+// recordExternalUserRequestMetric 在 ExternalUserAuth 返回时按处理结果计数
+// 放行的请求都会设置 external_user_id；拒绝的请求按状态码区分: 429 (及渠道数超限) 为配额 / 频率限制，401 / 403 为身份或权限问题。
+// 配置错误与存储故障 (5xx) 不计入。
+func recordExternalUserRequestMetric(c *gin.Context) {
+	result := ""
+	switch {
+	case c.GetString("external_user_id") != "":
+		result = externalUserResultAllowed
+	case c.Writer.Status() == http.StatusTooManyRequests, c.Writer.Header().Get("X-Quota-Reason") == "too_many_channels":
+		result = externalUserResultDeniedQuota
+	case c.Writer.Status() == http.StatusUnauthorized || c.Writer.Status() == http.StatusForbidden:
+		result = externalUserResultDeniedAuth
+	default:
+		return
+	}
+	common.ExternalUserRequestsTotal.WithLabelValues(result).Inc()
+}
+
+// metricChannelOther 未在 MetricChannels 中配置的渠道在配额消耗指标中的标签
+const metricChannelOther = "other"
+
+// quotaMetricChannel 配额消耗指标的渠道标签
+// X-Channel-Id 由客户端传递，直接作为标签会让指标序列随任意取值无限增长，只有配置过的渠道单独计数。
+func quotaMetricChannel(channelId string) string {
+	if _, ok := externalUserConfig.MetricChannels[channelId]; ok {
+		return channelId
+	}
+	return metricChannelOther
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// 模型访问策略
+// 非 VIP 用户不能调用 DeniedModels 中的模型；用户等级配置了允许列表 (TierAllowedModels) 时只能调用列表内的模型。
+// VIP 与管理员不受限制。配置格式: EXTERNAL_USER_TIER_ALLOWED_MODELS="default:gpt-4o-mini|gpt-3.5-turbo,pro:gpt-4o"
+
+// parseTierModelMap 解析 "tier:model1|model2,tier2:model3" 格式的等级模型列表
+func parseTierModelMap(s string) map[string]map[string]struct{} {
+	m := make(map[string]map[string]struct{})
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			continue
+		}
+		m[strings.TrimSpace(parts[0])] = parseIdentityList(strings.ReplaceAll(parts[1], "|", ","))
+	}
+	return m
+}
+
+// hasModelPolicy 是否配置了模型访问策略
+func hasModelPolicy() bool {
+	return len(externalUserConfig.DeniedModels) > 0 || len(externalUserConfig.TierAllowedModels) > 0
+}
+
+// externalModelAllowed 判断用户是否可以调用指定模型
+func externalModelAllowed(userData *ExternalUserData, model string) bool {
+	if HasVIPAccess(userData, time.Now()) || isExternalAdmin(userData) {
+		return true
+	}
+	if _, denied := externalUserConfig.DeniedModels[model]; denied {
+		return false
+	}
+	if allowed, ok := externalUserConfig.TierAllowedModels[userTier(userData)]; ok {
+		_, inList := allowed[model]
+		return inList
+	}
+	return true
+}
+
+// FilterExternalUserModels 从 token 解析用户，返回 models 中该用户可调用的模型 (已排序)
+func FilterExternalUserModels(tokenString string, models []string) ([]string, error) {
+	if err := checkTokenShape(tokenString); err != nil {
+		return nil, err
+	}
+	userData, err := verifyExternalJWT(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make([]string, 0, len(models))
+	for _, model := range models {
+		if externalModelAllowed(userData, model) {
+			allowed = append(allowed, model)
+		}
+	}
+	sort.Strings(allowed)
+	return allowed, nil
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 按模型计量的配额
+// 配置了 ModelQuotas 的模型使用独立的配额桶 (quota:<uid>:channel:<cid>:model:<model>)，
+// 扣减与 X-Quota-* 响应头均以该模型为准，并通过 X-Quota-Model 标明；其他模型沿用渠道配额。
+const (
+	quotaLimitSourceModel = "model"
+	modelQuotaSeparator   = ":model:"
+)
+
+// requestModelName 从 JSON 请求体中读取模型名称 (请求体可重复读取)
+func requestModelName(c *gin.Context) string {
+	if !strings.HasPrefix(c.Request.Header.Get("Content-Type"), "application/json") {
+		return ""
+	}
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := common.UnmarshalBodyReusable(c, &req); err != nil {
+		return ""
+	}
+	return req.Model
+}
+
+// resolveModelQuota 请求的模型配置了独立配额时返回模型名与配额
+func resolveModelQuota(c *gin.Context) (string, int, bool) {
+	if len(externalUserConfig.ModelQuotas) == 0 {
+		return "", 0, false
+	}
+	model := requestModelName(c)
+	if model == "" {
+		return "", 0, false
+	}
+	limit, ok := externalUserConfig.ModelQuotas[model]
+	return model, limit, ok
+}
+
+// modelQuotaBucket 模型配额桶在渠道配额 key 中的标识
+func modelQuotaBucket(channelId string, model string) string {
+	return channelId + modelQuotaSeparator + model
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 配额周期计算
+// 周期以「锚定日」为起点: 锚定日为 1 时与自然月一致，period key 保持 "2006-01" 格式以兼容旧数据;
+// 其他锚定日使用周期起始日期 "2006-01-02" 作为 period key。
+// 锚定日超过当月天数时 (如 31 号遇到 2 月) 取当月最后一天。
+
+// normalizeResetDay 规范化锚定日，非法值回退为 1
+func normalizeResetDay(day int) int {
+	if day < 1 || day > 31 {
+		return 1
+	}
+	return day
+}
+
+// anchorDate 返回指定年月的锚定日 (按当月天数截断)
+func anchorDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// quotaPeriod 计算 now 所在配额周期的 key、起始时间和下次重置时间
+func quotaPeriod(now time.Time, resetDay int) (key string, start time.Time, end time.Time) {
+	resetDay = normalizeResetDay(resetDay)
+	loc := now.Location()
+
+	start = anchorDate(now.Year(), now.Month(), resetDay, loc)
+	if now.Before(start) {
+		start = anchorDate(now.Year(), now.Month()-1, resetDay, loc)
+	}
+	end = anchorDate(start.Year(), start.Month()+1, resetDay, loc)
+
+	if resetDay == 1 {
+		key = start.Format("2006-01")
+	} else {
+		key = start.Format("2006-01-02")
+	}
+	return key, start, end
+}
+
+// effectiveResetDay 用户自定义锚定日优先，未设置时使用全局配置
+func effectiveResetDay(userData *ExternalUserData) int {
+	if userData != nil && userData.ResetDay > 0 {
+		return userData.ResetDay
+	}
+	return externalUserConfig.ResetDayOfMonth
+}
+
+// CurrentQuotaPeriodKey 获取指定锚定日 (0 表示使用全局配置) 的当前周期 key (供管理接口使用)
+func CurrentQuotaPeriodKey(resetDay int) string {
+	if resetDay <= 0 {
+		resetDay = externalUserConfig.ResetDayOfMonth
+	}
+	key, _, _ := quotaPeriod(time.Now(), resetDay)
+	return key
+}
+
+// parsePeriodKey 解析 period key 为周期起始时间
+func parsePeriodKey(key string, loc *time.Location) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", "2006-01"} {
+		if t, err := time.ParseInLocation(layout, key, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// normalizeQuotaPeriod 将配额记录对齐到当前周期，返回是否发生了重置
+// 周期 key 晚于当前周期 (时钟错误或手动修改) 时同样重置并记录日志，不信任未来的周期。
+func normalizeQuotaPeriod(userId string, quota *UserQuota, periodKey string, periodStart time.Time) bool {
+	if quota.MonthKey == periodKey {
+		return false
+	}
+	if recordStart, ok := parsePeriodKey(quota.MonthKey, periodStart.Location()); ok && recordStart.After(periodStart) {
+		externalUserWarn(ctx, "配额周期晚于当前周期，已重置", "user", common.HashPII(userId), "period", quota.MonthKey, "current", periodKey)
+	}
+	quota.UsedCount = 0
+	quota.TokenCount = 0
+	quota.RolloverCredit = 0
+	quota.MonthKey = periodKey
+	quota.LastResetAt = time.Now().Unix()
+	return true
+}
+
+// quotaKeyTTL 计算配额记录剩余的有效秒数 (到记录所在周期结束)，0 表示不设置过期时间
+// 周期结束后 Redis 自动清除记录，不活跃用户的配额 key 不会无限堆积；读取时记录不存在即视为新周期。
+// 记录过期后 FirstPeriodKey 一并丢失，启用试用配额时不设置过期，避免用户再次获得试用配额。
+// 开启配额结转时记录多保留一个周期，下个周期首次请求时仍能读取上周期的用量。
+// 锚定日被截断到月末时 (如 31 号在 2 月) 无法从 key 还原原始锚定日，按 31 计算: 宁可晚过期，不能提前丢失本周期计数。
+func quotaKeyTTL(monthKey string, now time.Time) int64 {
+	if externalUserConfig.TrialQuota > 0 {
+		return 0
+	}
+	start, ok := parsePeriodKey(monthKey, now.Location())
+	if !ok {
+		return 0
+	}
+	resetDay := start.Day()
+	if start.Day() == anchorDate(start.Year(), start.Month(), 31, start.Location()).Day() {
+		resetDay = 31
+	}
+	end := anchorDate(start.Year(), start.Month()+1, resetDay, start.Location())
+	if externalUserConfig.RolloverMax > 0 {
+		end = anchorDate(start.Year(), start.Month()+2, resetDay, start.Location())
+	}
+	ttl := int64(end.Sub(now) / time.Second)
+	if ttl <= 0 {
+		return 0
+	}
+	return ttl
+}
+
+// previousPeriodKey 返回 periodStart 所在周期的上一个周期 key
+func previousPeriodKey(periodStart time.Time, resetDay int) string {
+	key, _, _ := quotaPeriod(periodStart.Add(-time.Second), resetDay)
+	return key
+}
+
+// rolloverCreditFor 计算 quota (上个周期的记录) 结转到下个周期的额度
+// 结转 = 上周期限额 (基础限额 + 上周期的结转额度) 中未用完的部分，不超过 RolloverMax；
+// 未开启结转、限额无限制或记录不属于上个周期 (中间有周期未使用) 时为 0。
+// 上周期的基础限额按当前限额计算，与 chargeQuotaScript 中的规则保持一致。
+func rolloverCreditFor(quota *UserQuota, prevPeriodKey string, limit int) int {
+	if externalUserConfig.RolloverMax <= 0 || limit < 0 || prevPeriodKey == "" || quota.MonthKey != prevPeriodKey {
+		return 0
+	}
+	credit := limit + quota.RolloverCredit - quota.UsedCount
+	if credit > externalUserConfig.RolloverMax {
+		credit = externalUserConfig.RolloverMax
+	}
+	if credit < 0 {
+		return 0
+	}
+	return credit
+}
+
+// rolloverQuotaPeriod 与 normalizeQuotaPeriod 相同，开启配额结转时重置前先记下上周期的结转额度
+func rolloverQuotaPeriod(userId string, quota *UserQuota, periodKey string, prevPeriodKey string, periodStart time.Time, limit int) bool {
+	credit := rolloverCreditFor(quota, prevPeriodKey, limit)
+	if !normalizeQuotaPeriod(userId, quota, periodKey, periodStart) {
+		return false
+	}
+	quota.RolloverCredit = credit
+	return true
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import "time"
+
+// 活动期间暂停配额限制
+// 当前时间处于 [PromoStart, PromoEnd) 内时，所有用户跳过配额检查 (X-Quota-Status: promo)，
+// 开启 PromoCountUsage 时仍按渠道统计实际用量，活动结束后恢复正常限制。
+
+// inPromoWindow 判断 now 是否处于活动时间窗口内
+func inPromoWindow(now time.Time) bool {
+	start, end := externalUserConfig.PromoStart, externalUserConfig.PromoEnd
+	if start.IsZero() || end.IsZero() {
+		return false
+	}
+	return !now.Before(start) && now.Before(end)
+}
+
+// parsePromoTime 将 Unix 秒转换为时间，0 表示未设置
+func parsePromoTime(unix int64) time.Time {
+	if unix <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// chargeQuotaScript 原子地完成「周期重置 + 限额检查 + 扣除」
+// 记录的 monthKey 与当前周期不一致时先清零再累加，避免周期切换时并发请求的重置覆盖彼此的扣除;
+// 限额检查与扣除在同一脚本内完成，并发请求不会在读取与写回之间同时通过检查而超额。
+// 开启配额结转时，记录属于上个周期则在重置前按 rolloverCreditFor 的规则计算结转额度，限额检查使用「基础限额 + 结转额度」。
+// KEYS[1]: 配额 key; ARGV: 当前周期 key、本次消耗、重置时间戳、首次使用周期、基础限额 (-1 为不检查)、过期秒数 (0 为不过期)、
+// 上个周期 key、结转计算使用的限额 (-1 为无限制)、结转上限 (0 为不结转)
+// 返回 {是否扣除 (1/0), 配额记录 JSON}
+const chargeQuotaScript = `
+local quota = {}
+local raw = redis.call("GET", KEYS[1])
+if raw then
+	local ok, decoded = pcall(cjson.decode, raw)
+	if ok and type(decoded) == "table" then
+		quota = decoded
+	end
+end
+if quota.monthKey ~= ARGV[1] then
+	local credit = 0
+	local rolloverLimit = tonumber(ARGV[8])
+	local rolloverMax = tonumber(ARGV[9])
+	if rolloverMax > 0 and rolloverLimit >= 0 and ARGV[7] ~= "" and quota.monthKey == ARGV[7] then
+		credit = rolloverLimit + (tonumber(quota.rolloverCredit) or 0) - (tonumber(quota.usedCount) or 0)
+		credit = math.max(0, math.min(credit, rolloverMax))
+	end
+	quota.usedCount = 0
+	quota.tokenCount = 0
+	quota.monthKey = ARGV[1]
+	quota.lastResetAt = tonumber(ARGV[3])
+	if credit > 0 then
+		quota.rolloverCredit = credit
+	else
+		quota.rolloverCredit = nil
+	end
+end
+if (quota.firstPeriodKey == nil or quota.firstPeriodKey == "") and ARGV[4] ~= "" then
+	quota.firstPeriodKey = ARGV[4]
+end
+local used = tonumber(quota.usedCount) or 0
+local limit = tonumber(ARGV[5])
+if limit >= 0 then
+	limit = limit + (tonumber(quota.rolloverCredit) or 0)
+end
+if limit >= 0 and used + tonumber(ARGV[2]) > limit then
+	return {0, cjson.encode(quota)}
+end
+quota.usedCount = used + tonumber(ARGV[2])
+local encoded = cjson.encode(quota)
+if tonumber(ARGV[6]) > 0 then
+	redis.call("SET", KEYS[1], encoded, "EX", tonumber(ARGV[6]))
+else
+	redis.call("SET", KEYS[1], encoded)
+end
+return {1, encoded}
+`
+
+// chargeUserChannelQuota 在 periodKey 周期内原子扣除 cost
+// limit >= 0 时扣除后超过 limit (加上结转额度) 则不扣除并返回 false；返回的配额记录为脚本执行后的最新值
+// prevPeriodKey / rolloverLimit 用于周期切换时计算结转额度，未开启配额结转时不生效
+func chargeUserChannelQuota(reqCtx context.Context, userId string, channelId string, periodKey string, cost int, firstPeriodKey string, limit int, prevPeriodKey string, rolloverLimit int) (*UserQuota, bool, error) {
+	now := time.Now()
+	val, err := externalRedisDoContext(reqCtx, "EVAL", chargeQuotaScript, 1, channelQuotaKey(userId, channelId),
+		periodKey, cost, now.Unix(), firstPeriodKey, limit, quotaKeyTTL(periodKey, now),
+		prevPeriodKey, rolloverLimit, externalUserConfig.RolloverMax)
+	if err != nil {
+		return nil, false, err
+	}
+	result, ok := val.([]interface{})
+	if !ok || len(result) != 2 {
+		return nil, false, fmt.Errorf("配额脚本返回值异常: %v", val)
+	}
+	raw, ok := result[1].(string)
+	if !ok {
+		return nil, false, fmt.Errorf("配额脚本返回值异常: %v", val)
+	}
+	var quota UserQuota
+	if err := json.Unmarshal([]byte(raw), &quota); err != nil {
+		return nil, false, fmt.Errorf("解析配额记录失败: %v", err)
+	}
+	return &quota, externalRedisInt(result[0]) == 1, nil
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 配额拒绝的响应 header
+// X-Quota-Reason 为机器可读的拒绝原因，可重置的限额同时返回 Retry-After (距离下次重置的秒数)，
+// 客户端据此退避而不是立即重试:
+//   - quota_exhausted / token_quota_exhausted: 周期配额，重置于当前周期结束
+//   - daily_quota_exhausted: 每日配额，重置于次日零点
+//   - rpm_exceeded: 每分钟请求数，重置于下一分钟 (见 enforceUserRPM)
+//
+// 终身上限等不会重置的限制只返回 X-Quota-Reason。
+
+// retryAfterSeconds 距离 resetAt 的秒数 (向上取整，至少 1 秒)
+func retryAfterSeconds(resetAt time.Time, now time.Time) int {
+	wait := resetAt.Sub(now)
+	seconds := int(wait / time.Second)
+	if wait%time.Second > 0 {
+		seconds++
+	}
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// setQuotaDenialHeaders 写入拒绝原因，resetAt 非零时同时写入 Retry-After
+func setQuotaDenialHeaders(c *gin.Context, reason string, resetAt time.Time, now time.Time) {
+	c.Header("X-Quota-Reason", reason)
+	if !resetAt.IsZero() {
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(resetAt, now)))
+	}
+}
+
+// nextDailyReset 每日配额的下次重置时间 (次日零点，与 dailyQuotaKey 使用同一时区)
+func nextDailyReset(now time.Time) time.Time {
+	year, month, day := now.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExternalUserQuotaPreview 预览立即发起请求时的配额结果 (不扣除任何配额)
+// 字段与实际请求的响应 header 对应: used / total / remaining 为本次请求计入后的值，
+// 前端可据此提示「这将是本月第 used 次 (共 total 次)」。
+type ExternalUserQuotaPreview struct {
+	UserId      string `json:"userId"`
+	ChannelId   string `json:"channelId,omitempty"`
+	IsVIP       bool   `json:"isVip"`
+	Allowed     bool   `json:"allowed"`
+	Status      string `json:"status"`           // 同 X-Quota-Status: vip / vip_grace / promo / disabled / unlimited / active / exceeded
+	Reason      string `json:"reason,omitempty"` // 不放行或超额放行的原因，同 X-Quota-Reason
+	Action      string `json:"action,omitempty"` // 超额时的处理方式，同 X-Quota-Exceeded-Action
+	Cost        int    `json:"cost"`
+	Used        int    `json:"used"`
+	Total       int    `json:"total"`     // -1 表示无限制
+	Remaining   int    `json:"remaining"` // -1 表示无限制
+	Rollover    int    `json:"rollover,omitempty"`
+	LimitSource string `json:"limitSource,omitempty"`
+	ResetAt     int64  `json:"resetAt,omitempty"`
+}
+
+// PreviewExternalUserQuota 按 ExternalUserAuth 的规则解析 token 与渠道 header，返回本次请求的配额结果
+// 只读取 Redis，不扣除周期 / 每日 / 终身配额；请求频率与并发限制是瞬时状态，不在预览范围内。
+func PreviewExternalUserQuota(c *gin.Context, tokenString string) (*ExternalUserQuotaPreview, error) {
+	if err := checkTokenShape(tokenString); err != nil {
+		return nil, err
+	}
+	userData, err := verifyExternalJWT(c.Request.Context(), tokenString)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	channel, limitSource := parseChannelQuotaConfig(c)
+	preview := &ExternalUserQuotaPreview{
+		UserId:    userData.ID,
+		ChannelId: channel.ChannelId,
+		IsVIP:     HasVIPAccess(userData, now),
+	}
+	deny := func(reason string) (*ExternalUserQuotaPreview, error) {
+		preview.Allowed, preview.Reason = false, reason
+		return preview, nil
+	}
+
+	if ban, err := GetExternalUserBan(userData.ID); err != nil {
+		return nil, err
+	} else if ban != nil {
+		return deny("banned")
+	}
+	if hasModelPolicy() {
+		if model := requestModelName(c); model != "" && !externalModelAllowed(userData, model) {
+			return deny("model_not_allowed")
+		}
+	}
+
+	rq := resolveRequestQuota(c, userData, channel, limitSource)
+	preview.Cost = rq.cost
+	decision := resolveQuotaDecision(userData, rq, nil, now)
+	if decision.status == "" {
+		quota, err := getUserChannelQuotaContext(c.Request.Context(), userData.ID, rq.bucket)
+		if err != nil {
+			return nil, err
+		}
+		decision = resolveQuotaDecision(userData, rq, quota, now)
+		preview.Rollover = decision.quota.RolloverCredit
+	}
+	preview.applyHeaders(decision.headers)
+	if preview.Total == -1 {
+		preview.Allowed = true
+		return preview, nil
+	}
+
+	// 与 ExternalUserAuth 的检查顺序一致: 终身上限优先于 token / 周期配额，每日配额在其后
+	if lifetimeLimit := lifetimeCap(userData); lifetimeLimit > 0 {
+		count, err := GetLifetimeCount(userData.ID)
+		if err != nil {
+			return nil, err
+		}
+		if count+int64(rq.cost) > int64(lifetimeLimit) {
+			return deny("lifetime_exhausted")
+		}
+	}
+	if !decision.allowed {
+		return deny(decision.headers["X-Quota-Reason"])
+	}
+	if dailyLimit := resolveDailyQuotaLimit(c); dailyLimit > 0 {
+		val, err := externalRedisDoContext(c.Request.Context(), "GET", dailyQuotaKey(userData.ID, rq.bucket, now))
+		if err != nil {
+			return nil, fmt.Errorf("读取每日配额失败: %v", err)
+		}
+		if int(externalRedisInt(val))+rq.cost > dailyLimit {
+			return deny("daily_quota_exhausted")
+		}
+	}
+	preview.Allowed = true
+	return preview, nil
+}
+
+// applyHeaders 按实际请求的响应 header 填充预览结果
+func (p *ExternalUserQuotaPreview) applyHeaders(headers map[string]string) {
+	p.Status = headers["X-Quota-Status"]
+	p.Reason = headers["X-Quota-Reason"]
+	p.Action = headers["X-Quota-Exceeded-Action"]
+	p.LimitSource = headers["X-Quota-Limit-Source"]
+	p.Used, _ = strconv.Atoi(headers["X-Quota-Used"])
+	p.Total, _ = strconv.Atoi(headers["X-Quota-Total"])
+	p.Remaining, _ = strconv.Atoi(headers["X-Quota-Remaining"])
+	p.ResetAt, _ = strconv.ParseInt(headers["X-Quota-Reset"], 10, 64)
+}
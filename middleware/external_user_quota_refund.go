@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 上游失败时退还配额
+// 配额在请求转发前扣除，上游返回 502/503/504 或客户端在收到任何响应前断开连接时本次调用并未得到服务，
+// 请求结束后按原周期退还扣除的次数。已开始写出响应 (如流式输出) 后断开的请求照常计数。
+// 退还为尽力而为: 失败只记录日志，不影响响应。
+
+// refundQuotaScript 仍处于扣除时的周期才退还，且用量不低于 0
+// KEYS[1]: 配额 key; ARGV: 扣除时的周期 key、退还次数、过期秒数 (0 为不过期)
+// 返回退还后的用量，周期已切换或记录不存在时返回 -1
+const refundQuotaScript = `
+local raw = redis.call("GET", KEYS[1])
+if not raw then
+	return -1
+end
+local ok, quota = pcall(cjson.decode, raw)
+if not ok or type(quota) ~= "table" or quota.monthKey ~= ARGV[1] then
+	return -1
+end
+local used = (tonumber(quota.usedCount) or 0) - tonumber(ARGV[2])
+if used < 0 then
+	used = 0
+end
+quota.usedCount = used
+local encoded = cjson.encode(quota)
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], encoded, "EX", tonumber(ARGV[3]))
+else
+	redis.call("SET", KEYS[1], encoded)
+end
+return used
+`
+
+// isUpstreamFailure 判断请求是否因上游失败 (或客户端在收到响应前断开) 未得到服务
+func isUpstreamFailure(c *gin.Context) bool {
+	switch c.Writer.Status() {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return !c.Writer.Written() && errors.Is(c.Request.Context().Err(), context.Canceled)
+}
+
+// refundUserChannelQuota 退还 periodKey 周期内扣除的 cost 次，返回退还后的用量 (-1 表示未退还)
+func refundUserChannelQuota(userId string, channelId string, periodKey string, cost int) (int64, error) {
+	val, err := externalRedisDo("EVAL", refundQuotaScript, 1, channelQuotaKey(userId, channelId),
+		periodKey, cost, quotaKeyTTL(periodKey, time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return externalRedisInt(val), nil
+}
+
+// refundQuotaOnUpstreamFailure 请求结束后检查响应，上游失败时退还本次扣除的配额、每日配额与终身调用次数
+func refundQuotaOnUpstreamFailure(c *gin.Context, userData *ExternalUserData, channelId string, periodKey string, dailyKey string, cost int) {
+	if cost <= 0 || !isUpstreamFailure(c) {
+		return
+	}
+	if dailyKey != "" {
+		refundDailyQuota(dailyKey, cost)
+	}
+	used, err := refundUserChannelQuota(userData.ID, channelId, periodKey, cost)
+	if err != nil {
+		externalUserWarn(c, "退还配额失败", "user", common.HashPII(userData.ID), "channel", channelId, "error", err)
+		return
+	}
+	if used < 0 {
+		externalUserDebugf(c, "用户 %s 配额周期已切换，跳过退还", common.HashPII(userData.ID))
+		return
+	}
+	if lifetimeCap(userData) > 0 {
+		addLifetimeCount(userData.ID, -cost)
+	}
+	externalUserDebugf(c, "✓ 上游失败 (status=%d)，已退还用户 %s 配额 %d 次，当前用量 %d",
+		c.Writer.Status(), common.HashPII(userData.ID), cost, used)
+}
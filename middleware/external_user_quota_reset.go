@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 周期配额定时重置
+// 配额默认在用户下次请求时惰性重置，不活跃用户的记录会一直停留在旧周期，月初统计不一致。
+// 定时任务遍历 quota:* 配额记录 (不含每日计数器)，将周期 key 不是当前周期的记录清零并对齐到当前周期，
+// 保留 FirstPeriodKey 等字段，与惰性重置的结果一致；重复执行时当前周期的记录不受影响。
+// 写回使用比较后设置 (值未变化才覆盖)，避免覆盖任务执行期间请求写入的新计数；每个批次一次 EVAL，Upstash 下同样按批提交。
+const (
+	quotaResetLockKey = "lock:quota-reset"
+	quotaResetLockTTL = 5 * time.Minute
+)
+
+// ErrQuotaResetBusy 其他实例正在执行重置任务
+var ErrQuotaResetBusy = errors.New("配额重置任务正在执行，请稍后重试")
+
+// resetStaleQuotaScript 对每组 (KEYS[i], ARGV[3i-2..3i]) 执行: 当前值等于旧值时写入新值并设置过期时间 (0 表示不过期)
+const resetStaleQuotaScript = `local n = 0
+for i, key in ipairs(KEYS) do
+	local base = (i - 1) * 3
+	if redis.call("GET", key) == ARGV[base + 1] then
+		local ttl = tonumber(ARGV[base + 3])
+		if ttl > 0 then
+			redis.call("SET", key, ARGV[base + 2], "EX", ttl)
+		else
+			redis.call("SET", key, ARGV[base + 2])
+		end
+		n = n + 1
+	end
+end
+return n`
+
+// quotaKeyUserId 从配额 key (quota:<uid> 或 quota:<uid>:channel:<id>) 中解析 userId
+func quotaKeyUserId(key string) string {
+	rest := strings.TrimPrefix(key, "quota:")
+	if idx := strings.Index(rest, ":channel:"); idx >= 0 {
+		return rest[:idx]
+	}
+	return rest
+}
+
+// ResetStaleQuotas 将所有不属于当前周期的配额记录清零，返回重置的记录数
+func ResetStaleQuotas() (int, error) {
+	if !externalUserConfig.Enabled {
+		return 0, fmt.Errorf("Redis 未配置")
+	}
+	token, acquired, err := acquireExternalLock(quotaResetLockKey, quotaResetLockTTL)
+	if err != nil {
+		return 0, err
+	}
+	if !acquired {
+		return 0, ErrQuotaResetBusy
+	}
+	defer releaseExternalLock(quotaResetLockKey, token)
+
+	keys, err := externalRedisScan("quota:*")
+	if err != nil {
+		return 0, err
+	}
+	quotaKeys := make([]string, 0, len(keys))
+	userKeys := []string{}
+	seenUsers := map[string]bool{}
+	for _, key := range keys {
+		// 每日计数器不是配额记录
+		if strings.Contains(key, dailyQuotaKeySeparator) {
+			continue
+		}
+		userId := quotaKeyUserId(key)
+		if userId == "" {
+			continue
+		}
+		quotaKeys = append(quotaKeys, key)
+		if !seenUsers[userId] {
+			seenUsers[userId] = true
+			userKeys = append(userKeys, "user:"+userId)
+		}
+	}
+	quotaValues, err := externalRedisMGet(quotaKeys)
+	if err != nil {
+		return 0, err
+	}
+	userValues, err := externalRedisMGet(userKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var staleKeys []string
+	var staleArgs []interface{}
+	for _, key := range quotaKeys {
+		raw, ok := quotaValues[key]
+		if !ok {
+			continue
+		}
+		var quota UserQuota
+		if err := json.Unmarshal([]byte(raw), &quota); err != nil {
+			continue
+		}
+		userId := quotaKeyUserId(key)
+		var userData *ExternalUserData
+		if rawUser, ok := userValues["user:"+userId]; ok {
+			var u ExternalUserData
+			if json.Unmarshal([]byte(rawUser), &u) == nil {
+				userData = &u
+			}
+		}
+		resetDay := effectiveResetDay(userData)
+		periodKey, periodStart, _ := quotaPeriod(now, resetDay)
+		// 开启配额结转时上个周期的记录留给请求路径重置: 结转额度依赖渠道限额，定时任务无法得知
+		if externalUserConfig.RolloverMax > 0 && quota.MonthKey == previousPeriodKey(periodStart, resetDay) {
+			continue
+		}
+		if !normalizeQuotaPeriod(userId, &quota, periodKey, periodStart) {
+			continue
+		}
+		data, err := json.Marshal(quota)
+		if err != nil {
+			continue
+		}
+		staleKeys = append(staleKeys, key)
+		staleArgs = append(staleArgs, raw, string(data), quotaKeyTTL(periodKey, now))
+	}
+
+	reset := 0
+	for start := 0; start < len(staleKeys); start += externalMGetBatchSize {
+		end := start + externalMGetBatchSize
+		if end > len(staleKeys) {
+			end = len(staleKeys)
+		}
+		args := []interface{}{"EVAL", resetStaleQuotaScript, end - start}
+		for _, key := range staleKeys[start:end] {
+			args = append(args, key)
+		}
+		args = append(args, staleArgs[start*3:end*3]...)
+		val, err := externalRedisDo(args...)
+		if err != nil {
+			return reset, err
+		}
+		reset += int(externalRedisInt(val))
+	}
+	externalUserInfo(ctx, "周期配额重置完成", "checked", len(quotaKeys), "reset", reset)
+	return reset, nil
+}
+
+var quotaResetJobOnce sync.Once
+
+// StartQuotaResetJob 启动周期配额定时重置任务，interval <= 0 时不启动
+// 各用户锚定日不同，周期切换时间不一致，因此按固定间隔检查而不是只在月初执行。
+func StartQuotaResetJob(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	quotaResetJobOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if !externalUserConfig.Enabled {
+					continue
+				}
+				if _, err := ResetStaleQuotas(); err != nil {
+					externalUserWarn(ctx, "周期配额重置失败", "error", err)
+				}
+			}
+		}()
+	})
+}
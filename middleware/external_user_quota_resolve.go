@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 配额解析
+// ExternalUserAuth 与 PreviewExternalUserQuota 共用以下函数计算渠道配置、限额、计数桶与配额状态，
+// 预览结果与实际请求按同一套规则得出，两条路径不会各自演变。
+// 请求相关的输入 (header、请求体) 由 resolveRequestQuota 一次性读出，resolveQuotaDecision 只依据已读取的数据判定，不读写 Redis。
+
+// 跳过周期配额计数的状态 (与 X-Quota-Status 一致)
+// 这些状态下 X-Quota-Total / X-Quota-Remaining 为 -1 (不限制)，X-Quota-Used 为 0 (开启 VIP / 活动用量统计时为实际用量)；
+// 其余 header 与需要计数时相同，客户端在受限与不受限的渠道之间切换时读取到的字段一致。
+const (
+	quotaFastPathVIP       = "vip"
+	quotaFastPathVIPGrace  = "vip_grace"
+	quotaFastPathPromo     = "promo"
+	quotaFastPathDisabled  = "disabled"
+	quotaFastPathUnlimited = "unlimited"
+)
+
+// requestQuota 单次请求的配额解析结果
+type requestQuota struct {
+	channel       ChannelQuotaConfig
+	limit         int    // 每周期限额 (-1 为无限)，applyPeriod 后计入试用配额与结转额度
+	limitSource   string // 限额来源 (X-Quota-Limit-Source)
+	baseLimit     int    // 未计入结转额度的限额，原子扣除时使用
+	rolloverBase  int    // 计算结转额度使用的限额 (不含试用配额)
+	bucket        string // 计数的渠道 (或渠道下的模型)
+	model         string // 独立计量的模型
+	hasModelQuota bool
+	cost          int
+	tokenLimit    int    // 每周期 token 配额，0 表示不限制
+	action        string // 超额时渠道配置的处理方式 (block / warn / downgrade)
+	periodKey     string
+	prevPeriodKey string
+	periodEnd     time.Time
+}
+
+// parseChannelQuotaConfig 从请求 header 读取渠道配额配置，返回配置与限额来源
+// 未传递配额开关时默认启用，未传递 (或无法解析) 限额时使用全局配额
+func parseChannelQuotaConfig(c *gin.Context) (ChannelQuotaConfig, string) {
+	channel := ChannelQuotaConfig{
+		ChannelId:    c.Request.Header.Get("X-Channel-Id"),
+		ChannelName:  c.Request.Header.Get("X-Channel-Name"),
+		QuotaEnabled: c.Request.Header.Get("X-Channel-Quota-Enabled") != "false",
+		QuotaLimit:   externalUserConfig.MonthlyQuota,
+	}
+	source := quotaLimitSourceGlobal
+	if header := c.Request.Header.Get("X-Channel-Quota-Limit"); header != "" {
+		if parsed, err := strconv.Atoi(header); err == nil {
+			channel.QuotaLimit = parsed
+			source = quotaLimitSourceChannel
+		}
+	}
+	return channel, source
+}
+
+// ChannelQuotaLimit 请求中渠道配置的配额上限 (未配置时为全局配额)，供管理接口按与鉴权相同的规则计算用户限额
+func ChannelQuotaLimit(c *gin.Context) int {
+	channel, _ := parseChannelQuotaConfig(c)
+	return channel.QuotaLimit
+}
+
+// resolveRequestQuota 从请求中读取用户本次请求的限额、计数桶、消耗与超额处理方式
+func resolveRequestQuota(c *gin.Context, userData *ExternalUserData, channel ChannelQuotaConfig, limitSource string) *requestQuota {
+	rq := &requestQuota{
+		channel:    channel,
+		bucket:     channel.ChannelId,
+		cost:       requestCost(c),
+		tokenLimit: resolveTokenQuotaLimit(c),
+		action:     configuredQuotaExceededAction(c),
+	}
+	rq.limit, rq.limitSource = ResolveUserQuotaLimit(userData, channel.QuotaLimit, limitSource)
+	if model, modelLimit, ok := resolveModelQuota(c); ok {
+		rq.bucket = modelQuotaBucket(channel.ChannelId, model)
+		rq.limit, rq.limitSource = modelLimit, quotaLimitSourceModel
+		rq.model, rq.hasModelQuota = model, true
+	}
+	return rq
+}
+
+// quotaFastPath 判定是否跳过周期配额计数，返回对应的状态，为空表示需要计数
+func quotaFastPath(userData *ExternalUserData, rq *requestQuota, now time.Time) string {
+	switch {
+	case IsUnlimitedUser(userData, now):
+		if inVIPGrace(userData, now) && !isExternalAdmin(userData) {
+			return quotaFastPathVIPGrace
+		}
+		return quotaFastPathVIP
+	case inPromoWindow(now):
+		return quotaFastPathPromo
+	case !rq.channel.QuotaEnabled:
+		return quotaFastPathDisabled
+	case rq.limit == -1:
+		return quotaFastPathUnlimited
+	}
+	return ""
+}
+
+// applyPeriod 将配额记录对齐到当前周期 (开启结转时记下上周期的结转额度)，并将试用配额与结转额度计入限额
+func (rq *requestQuota) applyPeriod(userData *ExternalUserData, quota *UserQuota, now time.Time) {
+	resetDay := effectiveResetDay(userData)
+	periodKey, periodStart, periodEnd := quotaPeriod(now, resetDay)
+	rq.periodKey, rq.periodEnd = periodKey, periodEnd
+	rq.prevPeriodKey = previousPeriodKey(periodStart, resetDay)
+	if quota.isNew {
+		quota.FirstPeriodKey = periodKey
+	}
+	rolloverQuotaPeriod(userData.ID, quota, periodKey, rq.prevPeriodKey, periodStart, rq.limit)
+	rq.rolloverBase = rq.limit
+
+	// 首个周期使用试用配额 (仅在试用配额更高时生效)
+	if externalUserConfig.TrialQuota > rq.limit && quota.FirstPeriodKey == periodKey {
+		rq.limit = externalUserConfig.TrialQuota
+		rq.limitSource = quotaLimitSourceTrial
+	}
+	rq.baseLimit = rq.limit
+	rq.limit += quota.RolloverCredit
+}
+
+// quotaDecision resolveQuotaDecision 的判定结果
+type quotaDecision struct {
+	allowed bool
+	status  string // 配额状态，为空表示需要读取配额记录后再次判定
+	headers map[string]string
+	rq      *requestQuota // 对齐到当前周期后的请求配额 (试用配额与结转额度已计入限额)
+	quota   *UserQuota    // 对齐到当前周期后的配额记录，未传入配额记录时为 nil
+}
+
+// resolveQuotaDecision 根据已读取的用户、请求配额配置与配额记录判定本次请求，返回是否放行、配额状态与响应 header
+//   - 无需计数 (vip / vip_grace / promo / disabled / unlimited) 时直接放行，quota 可为 nil
+//   - 需要计数而 quota 为 nil 时返回空状态，调用方读取配额记录后再次判定
+//   - 需要计数时先将记录对齐到当前周期 (见 applyPeriod)，token 配额或周期配额用完时状态为 exceeded;
+//     周期配额用完且渠道配置为 warn / downgrade 时仍放行，header 中的用量为计入本次请求后的值
+//
+// 对齐周期在 rq / quota 的副本上进行，传入的值不会被修改；调用方后续计数使用结果中对齐后的 rq / quota。
+// 终身上限与每日配额依赖独立的计数器，由调用方读取后检查。
+func resolveQuotaDecision(userData *ExternalUserData, rq *requestQuota, quota *UserQuota, now time.Time) quotaDecision {
+	normalizedRQ := *rq
+	rq = &normalizedRQ
+	if fastPath := quotaFastPath(userData, rq, now); fastPath != "" {
+		_, _, periodEnd := quotaPeriod(now, effectiveResetDay(userData))
+		headers := map[string]string{
+			"X-Quota-Status":       fastPath,
+			"X-Quota-Used":         "0",
+			"X-Quota-Total":        "-1",
+			"X-Quota-Remaining":    "-1",
+			"X-Quota-Limit-Source": rq.limitSource,
+			"X-Quota-Percent-Used": "0",
+			"X-Quota-Reset":        strconv.FormatInt(periodEnd.Unix(), 10),
+		}
+		if fastPath == quotaFastPathPromo {
+			headers["X-Quota-Reset"] = strconv.FormatInt(externalUserConfig.PromoEnd.Unix(), 10)
+		}
+		return quotaDecision{allowed: true, status: fastPath, headers: headers, rq: rq}
+	}
+	if quota == nil {
+		return quotaDecision{rq: rq}
+	}
+
+	normalizedQuota := *quota
+	quota = &normalizedQuota
+	rq.applyPeriod(userData, quota, now)
+	decision := quotaDecision{status: "exceeded", rq: rq, quota: quota}
+	if rq.tokenLimit > 0 && quota.TokenCount >= rq.tokenLimit {
+		decision.headers = limitedQuotaHeaders(userData, rq, quota, "")
+		decision.headers["X-Quota-Status"], decision.headers["X-Quota-Reason"] = "exceeded", "token_quota_exhausted"
+		return decision
+	}
+	charged := *quota
+	charged.UsedCount += rq.cost
+	if quota.UsedCount+rq.cost > rq.limit {
+		if rq.action == quotaExceededActionBlock {
+			decision.headers = limitedQuotaHeaders(userData, rq, quota, "")
+			decision.headers["X-Quota-Status"], decision.headers["X-Quota-Reason"] = "exceeded", "quota_exhausted"
+			return decision
+		}
+		decision.allowed, decision.headers = true, limitedQuotaHeaders(userData, rq, &charged, rq.action)
+		return decision
+	}
+	decision.allowed, decision.status, decision.headers = true, "active", limitedQuotaHeaders(userData, rq, &charged, "")
+	return decision
+}
+
+// echoChannelHeaders 回显请求的渠道 ID 与名称 (所有放行的请求都会返回)
+func echoChannelHeaders(c *gin.Context, channel ChannelQuotaConfig) {
+	c.Header("X-Channel-Id", channel.ChannelId)
+	c.Header("X-Channel-Name", channel.ChannelName)
+}
+
+// limitedQuotaHeaders 需要计数时的配额响应 header，action 非空表示已按该方式超额放行
+func limitedQuotaHeaders(userData *ExternalUserData, rq *requestQuota, quota *UserQuota, action string) map[string]string {
+	percentUsed := quotaPercentUsed(quota.UsedCount, rq.limit)
+	headers := map[string]string{
+		"X-Quota-Status":       "active",
+		"X-Quota-Used":         strconv.Itoa(quota.UsedCount),
+		"X-Quota-Total":        strconv.Itoa(rq.limit),
+		"X-Quota-Remaining":    strconv.Itoa(rq.limit - quota.UsedCount),
+		"X-Quota-Limit-Source": rq.limitSource,
+		"X-Quota-Percent-Used": strconv.Itoa(percentUsed),
+		"X-Quota-Reset":        strconv.FormatInt(rq.periodEnd.Unix(), 10),
+	}
+	if externalUserConfig.RolloverMax > 0 {
+		headers["X-Quota-Rollover"] = strconv.Itoa(quota.RolloverCredit)
+	}
+	if rq.tokenLimit > 0 {
+		headers["X-Quota-Token-Used"] = strconv.Itoa(quota.TokenCount)
+		headers["X-Quota-Token-Total"] = strconv.Itoa(rq.tokenLimit)
+	}
+	if rq.hasModelQuota {
+		headers["X-Quota-Model"] = rq.model
+	}
+	if shouldWarnQuota(userData, percentUsed) {
+		headers["X-Quota-Warning"] = "true"
+	}
+	if action != "" {
+		headers["X-Quota-Status"] = "exceeded"
+		headers["X-Quota-Remaining"] = "0"
+		headers["X-Quota-Reason"] = "quota_exhausted"
+		headers["X-Quota-Exceeded-Action"] = action
+	}
+	return headers
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrQuotaTransferInvalid      = errors.New("无效的配额转移参数")
+	ErrQuotaTransferCrossPeriod  = errors.New("不支持跨周期转移配额")
+	ErrQuotaTransferInsufficient = errors.New("转出用户剩余配额不足")
+	ErrQuotaTransferBusy         = errors.New("配额正在被其他操作修改，请稍后重试")
+)
+
+const quotaLockTTL = 10 * time.Second
+
+// QuotaTransferResult 配额转移结果
+type QuotaTransferResult struct {
+	PeriodKey     string `json:"periodKey"`
+	FromUsedCount int    `json:"fromUsedCount"`
+	ToUsedCount   int    `json:"toUsedCount"`
+	FromRemaining int    `json:"fromRemaining"`
+	ToRemaining   int    `json:"toRemaining"`
+}
+
+// channelQuotaKey 生成用户渠道配额 key (未指定渠道时使用旧版 key)
+func channelQuotaKey(userId string, channelId string) string {
+	if channelId == "" {
+		return "quota:" + userId
+	}
+	return "quota:" + userId + ":channel:" + channelId
+}
+
+// transferQuotaScript 原子地完成双方的「周期重置 + 余额检查 + 转移」
+// 与 chargeQuotaScript 一样在脚本内读写配额记录，转移与并发请求的扣除不会在读取与写回之间互相覆盖。
+// KEYS[1]: 转出方配额 key, KEYS[2]: 转入方配额 key; ARGV: 当前周期 key、转移次数、重置时间戳、转出方基础限额、过期秒数 (0 为不过期)
+// 返回 {是否转移 (1/0), 转出方配额记录 JSON, 转入方配额记录 JSON}
+const transferQuotaScript = `
+local function load(key)
+	local quota = {}
+	local raw = redis.call("GET", key)
+	if raw then
+		local ok, decoded = pcall(cjson.decode, raw)
+		if ok and type(decoded) == "table" then
+			quota = decoded
+		end
+	end
+	if quota.monthKey ~= ARGV[1] then
+		quota.usedCount = 0
+		quota.tokenCount = 0
+		quota.rolloverCredit = nil
+		quota.monthKey = ARGV[1]
+		quota.lastResetAt = tonumber(ARGV[3])
+	end
+	return quota
+end
+local function store(key, quota)
+	local encoded = cjson.encode(quota)
+	if tonumber(ARGV[5]) > 0 then
+		redis.call("SET", key, encoded, "EX", tonumber(ARGV[5]))
+	else
+		redis.call("SET", key, encoded)
+	end
+	return encoded
+end
+local amount = tonumber(ARGV[2])
+local from = load(KEYS[1])
+local to = load(KEYS[2])
+local fromUsed = tonumber(from.usedCount) or 0
+local limit = tonumber(ARGV[4]) + (tonumber(from.rolloverCredit) or 0)
+if limit - fromUsed < amount then
+	return {0, cjson.encode(from), cjson.encode(to)}
+end
+from.usedCount = fromUsed + amount
+to.usedCount = (tonumber(to.usedCount) or 0) - amount
+return {1, store(KEYS[1], from), store(KEYS[2], to)}
+`
+
+// decodeTransferQuota 解析转移脚本返回的配额记录
+func decodeTransferQuota(val interface{}) (*UserQuota, *UserQuota, bool, error) {
+	result, ok := val.([]interface{})
+	if !ok || len(result) != 3 {
+		return nil, nil, false, fmt.Errorf("配额转移脚本返回值异常: %v", val)
+	}
+	quotas := make([]*UserQuota, 2)
+	for i := range quotas {
+		raw, ok := result[i+1].(string)
+		if !ok {
+			return nil, nil, false, fmt.Errorf("配额转移脚本返回值异常: %v", val)
+		}
+		quotas[i] = &UserQuota{}
+		if err := json.Unmarshal([]byte(raw), quotas[i]); err != nil {
+			return nil, nil, false, fmt.Errorf("解析配额记录失败: %v", err)
+		}
+	}
+	return quotas[0], quotas[1], externalRedisInt(result[0]) == 1, nil
+}
+
+// TransferUserQuota 将 fromId 当前周期的剩余配额转移 amount 次给 toId
+// 转出方 UsedCount 增加、转入方 UsedCount 减少 (可为负数，表示额外可用次数)。
+// periodKey 非空时必须与双方的当前周期一致；channelLimit 为渠道 (或全局) 配额，
+// 双方的实际限额按 ResolveUserQuotaLimit 在其上应用自定义配额与等级配额，与请求鉴权时一致。
+func TransferUserQuota(fromId, toId, channelId string, amount int, channelLimit int, periodKey string) (*QuotaTransferResult, error) {
+	if fromId == "" || toId == "" || fromId == toId || amount <= 0 {
+		return nil, ErrQuotaTransferInvalid
+	}
+
+	fromUser, err := getUserFromRedis(fromId)
+	if err != nil {
+		return nil, fmt.Errorf("转出用户 %s: %w", fromId, err)
+	}
+	toUser, err := getUserFromRedis(toId)
+	if err != nil {
+		return nil, fmt.Errorf("转入用户 %s: %w", toId, err)
+	}
+	fromLimit, _ := ResolveUserQuotaLimit(fromUser, channelLimit, quotaLimitSourceChannel)
+	toLimit, _ := ResolveUserQuotaLimit(toUser, channelLimit, quotaLimitSourceChannel)
+	// 不限额的用户没有可转出的剩余配额
+	if fromLimit < 0 {
+		return nil, ErrQuotaTransferInvalid
+	}
+
+	now := time.Now()
+	fromPeriod, _, _ := quotaPeriod(now, effectiveResetDay(fromUser))
+	toPeriod, _, _ := quotaPeriod(now, effectiveResetDay(toUser))
+	if fromPeriod != toPeriod || (periodKey != "" && periodKey != fromPeriod) {
+		return nil, ErrQuotaTransferCrossPeriod
+	}
+
+	val, err := externalRedisDo("EVAL", transferQuotaScript, 2, channelQuotaKey(fromId, channelId), channelQuotaKey(toId, channelId),
+		fromPeriod, amount, now.Unix(), fromLimit, quotaKeyTTL(fromPeriod, now))
+	if err != nil {
+		return nil, err
+	}
+	fromQuota, toQuota, transferred, err := decodeTransferQuota(val)
+	if err != nil {
+		return nil, err
+	}
+	if !transferred {
+		return nil, ErrQuotaTransferInsufficient
+	}
+
+	result := &QuotaTransferResult{
+		PeriodKey:     fromPeriod,
+		FromUsedCount: fromQuota.UsedCount,
+		ToUsedCount:   toQuota.UsedCount,
+		FromRemaining: fromLimit + fromQuota.RolloverCredit - fromQuota.UsedCount,
+		ToRemaining:   -1,
+	}
+	if toLimit >= 0 {
+		result.ToRemaining = toLimit + toQuota.RolloverCredit - toQuota.UsedCount
+	}
+	return result, nil
+}
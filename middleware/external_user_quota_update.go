@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AllChannels 批量更新配额时表示用户的所有渠道
+const AllChannels = "all"
+
+// SetUserChannelQuotas 将用户渠道配额的当前周期已用次数设置为 usedCount
+// channelId 为 AllChannels 时更新该用户所有渠道 (含模型配额桶) 的记录，否则只更新指定渠道；返回已更新的渠道列表。
+// 每日计数器不受影响。usedCount 为 0 时视为重置，本周期 token 用量一并清零。
+func SetUserChannelQuotas(userId string, channelId string, usedCount int) ([]string, error) {
+	if userId == "" || channelId == "" {
+		return nil, ErrQuotaTransferInvalid
+	}
+	userData, err := getUserFromRedis(userId)
+	if err != nil && !errors.Is(err, errExternalUserNotFound) {
+		return nil, err
+	}
+
+	channels := []string{channelId}
+	if channelId == AllChannels {
+		prefix := "quota:" + userId + ":channel:"
+		keys, err := externalRedisScan(redisGlobEscaper.Replace(prefix) + "*")
+		if err != nil {
+			return nil, err
+		}
+		channels = channels[:0]
+		for _, key := range keys {
+			if !strings.Contains(key, dailyQuotaKeySeparator) {
+				channels = append(channels, strings.TrimPrefix(key, prefix))
+			}
+		}
+		sort.Strings(channels)
+	}
+
+	periodKey, periodStart, _ := quotaPeriod(time.Now(), effectiveResetDay(userData))
+	updated := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		if err := setUserChannelQuota(userId, ch, usedCount, periodKey, periodStart); err != nil {
+			return updated, err
+		}
+		updated = append(updated, ch)
+	}
+	return updated, nil
+}
+
+// setUserChannelQuota 加锁后更新单个渠道的配额记录 (保留试用周期等字段)
+func setUserChannelQuota(userId string, channelId string, usedCount int, periodKey string, periodStart time.Time) error {
+	lockKey := "lock:" + channelQuotaKey(userId, channelId)
+	token, ok, err := acquireExternalLock(lockKey, quotaLockTTL)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrQuotaTransferBusy
+	}
+	defer releaseExternalLock(lockKey, token)
+
+	quota, err := getUserChannelQuota(userId, channelId)
+	if err != nil {
+		return err
+	}
+	normalizeQuotaPeriod(userId, quota, periodKey, periodStart)
+	quota.UsedCount = usedCount
+	quota.LastResetAt = time.Now().Unix()
+	if usedCount == 0 {
+		quota.TokenCount = 0
+	}
+	return saveUserChannelQuota(userId, channelId, quota)
+}
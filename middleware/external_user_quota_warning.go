@@ -0,0 +1,20 @@
+package middleware
+
+// 配额预警
+// 已用百分比达到阈值时返回 X-Quota-Warning: true，便于前端提前提示用户。
+// 阈值可按用户等级覆盖 (如免费用户更早提醒)，未配置等级时使用全局阈值，阈值为 0 表示不预警。
+const defaultQuotaWarningPercent = 80
+
+// quotaWarningPercent 用户等级对应的预警阈值 (百分比)
+func quotaWarningPercent(userData *ExternalUserData) int {
+	if percent, ok := externalUserConfig.TierWarningPercents[userTier(userData)]; ok {
+		return percent
+	}
+	return externalUserConfig.WarningPercent
+}
+
+// shouldWarnQuota 已用百分比是否达到用户的预警阈值
+func shouldWarnQuota(userData *ExternalUserData, percentUsed int) bool {
+	threshold := quotaWarningPercent(userData)
+	return threshold > 0 && percentUsed >= threshold
+}
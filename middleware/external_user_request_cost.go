@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 单次请求的配额消耗
+// 上游网关可通过 X-Request-Cost 指定本次请求扣除的配额次数，仅信任来自 TrustedCostNetworks 的请求；
+// 其他来源或取值非法时按默认 1 次扣除。
+const (
+	defaultRequestCost    = 1
+	defaultMaxRequestCost = 100
+)
+
+// parseNetworkList 解析逗号分隔的 CIDR / IP 列表
+func parseNetworkList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// requestCost 获取本次请求应扣除的配额次数
+func requestCost(c *gin.Context) int {
+	raw := c.Request.Header.Get("X-Request-Cost")
+	if raw == "" || len(externalUserConfig.TrustedCostNetworks) == 0 {
+		return defaultRequestCost
+	}
+	ip := net.ParseIP(c.ClientIP())
+	if ip == nil || !common.IsIpInCIDRList(ip, externalUserConfig.TrustedCostNetworks) {
+		externalUserDebugf(c, "忽略非信任来源的 X-Request-Cost: IP=%s", common.HashPII(c.ClientIP()))
+		return defaultRequestCost
+	}
+	cost, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || cost <= 0 || cost > externalUserConfig.MaxRequestCost {
+		externalUserDebugf(c, "X-Request-Cost=%q 无效 (范围 1-%d)，按 %d 次扣除", raw, externalUserConfig.MaxRequestCost, defaultRequestCost)
+		return defaultRequestCost
+	}
+	return cost
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 临时性错误重试
+// 仅重试网络错误与 Upstash 5xx 响应，4xx、key 不存在、Redis 返回的命令错误均直接返回。
+// 重试间隔按指数退避并加入随机抖动，剩余时间不足以等待下一次重试时 (请求 context 截止) 立即放弃。
+// 只用于幂等的读写 (GET / SET)，INCR、EVAL 等命令重试可能导致重复计数，不经过此处。
+const (
+	defaultRedisMaxAttempts    = 3
+	defaultRedisRetryBaseDelay = 50 * time.Millisecond
+	maxRedisRetryDelay         = time.Second
+)
+
+// ErrRedisTransient 可重试的临时性错误 (如 Upstash 返回 5xx)
+var ErrRedisTransient = errors.New("Redis 暂时不可用")
+
+// ErrRedisRejected Upstash 拒绝了请求 (4xx 或响应中带 error 字段，如 token 无效、限流、命令错误)，不重试
+var ErrRedisRejected = errors.New("Redis 返回错误")
+
+// upstashStatusError 检查 Upstash 响应状态码与 error 字段，在解析 result 之前调用
+// 5xx 返回可重试的 ErrRedisTransient；其余非 2xx 或 error 字段非空返回 ErrRedisRejected，
+// 避免 401 / 429 等响应因 result 为空被当作 key 不存在、写入被拒绝时仍报告成功。
+func upstashStatusError(statusCode int, body []byte) error {
+	if statusCode >= 500 {
+		return fmt.Errorf("%w: HTTP %d %s", ErrRedisTransient, statusCode, string(body))
+	}
+	var result struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.Error != "" {
+		return fmt.Errorf("%w: %s", ErrRedisRejected, result.Error)
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return fmt.Errorf("%w: HTTP %d %s", ErrRedisRejected, statusCode, string(body))
+	}
+	return nil
+}
+
+// isTransientRedisError 判断错误是否值得重试
+func isTransientRedisError(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return false
+	}
+	if errors.Is(err, ErrRedisTransient) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// redisRetryDelay 第 attempt 次失败后的等待时间 (指数退避，抖动范围 [d/2, d))
+func redisRetryDelay(attempt int) time.Duration {
+	delay := externalUserConfig.RedisRetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > maxRedisRetryDelay {
+		delay = maxRedisRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// withExternalRedisRetry 执行 op，遇到临时性错误时按退避策略重试，最多 RedisMaxAttempts 次
+func withExternalRedisRetry(reqCtx context.Context, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= externalUserConfig.RedisMaxAttempts || !isTransientRedisError(err) || reqCtx.Err() != nil {
+			return err
+		}
+		delay := redisRetryDelay(attempt)
+		if deadline, ok := reqCtx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		externalUserWarn(reqCtx, "Redis 请求失败，稍后重试", "delay", delay, "attempt", attempt+1, "maxAttempts", externalUserConfig.RedisMaxAttempts, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-reqCtx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// WithExternalRedisRetry 供管理接口使用的重试封装 (与配额读写共用重试策略)
+func WithExternalRedisRetry(reqCtx context.Context, op func() error) error {
+	return withExternalRedisRetry(reqCtx, op)
+}
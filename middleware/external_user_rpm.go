@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/gin-gonic/gin"
+)
+
+// 外部用户每分钟请求数限制
+// 与渠道速率限制 (service/channel_rate_limit.go) 一样按自然分钟分桶，计数器存放在 Redis 中，
+// 多实例部署时共享: key 为 rpm:<uid>:<分钟>，首次写入时设置过期时间。
+// 全局配置为 0 表示不限制。请求可通过 X-User-RPM-Limit 收紧上限 (只能小于等于全局配置，
+// 该请求头由客户端提供，不能用来放宽或关闭限制)。管理员不受限制。
+const (
+	userRPMKeyPrefix = "rpm:"
+	userRPMKeyTTL    = 2 * time.Minute
+)
+
+var userRPMNow = time.Now
+
+// resolveUserRPMLimit 请求指定的上限比全局配置更严格时使用请求值，否则使用全局配置
+func resolveUserRPMLimit(c *gin.Context) int {
+	configured := externalUserConfig.UserRPMLimit
+	if header := c.Request.Header.Get("X-User-RPM-Limit"); header != "" {
+		if parsed, err := strconv.Atoi(header); err == nil && parsed > 0 && (configured <= 0 || parsed <= configured) {
+			return parsed
+		}
+	}
+	return configured
+}
+
+// checkUserRPM 计入本次请求并检查是否超过每分钟上限，超过时返回距下一分钟的秒数
+func checkUserRPM(userId string, limit int) (bool, int, error) {
+	if limit <= 0 {
+		return true, 0, nil
+	}
+	now := userRPMNow()
+	key := userRPMKeyPrefix + userId + ":" + now.Format("200601021504")
+	count, err := externalRedisIncrWithTTL(key, userRPMKeyTTL)
+	if err != nil {
+		return true, 0, err
+	}
+	if count <= int64(limit) {
+		return true, 0, nil
+	}
+	retryAfter := int(now.Truncate(time.Minute).Add(time.Minute).Sub(now) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	return false, retryAfter, nil
+}
+
+// enforceUserRPM 超过每分钟上限时返回 429 并终止请求
+func enforceUserRPM(c *gin.Context, userData *ExternalUserData) bool {
+	if isExternalAdmin(userData) {
+		return true
+	}
+	limit := resolveUserRPMLimit(c)
+	ok, retryAfter, err := checkUserRPM(userData.ID, limit)
+	if err != nil {
+		externalUserWarn(c, "检查每分钟请求数失败", "user", common.HashPII(userData.ID), "error", err)
+		return true
+	}
+	if ok {
+		return true
+	}
+	c.Header("X-Quota-Reason", "rpm_exceeded")
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	abortWithOpenAiMessage(c, http.StatusTooManyRequests, fmt.Sprintf("请求过于频繁 (每分钟最多 %d 次)，请 %d 秒后再试", limit, retryAfter))
+	return false
+}
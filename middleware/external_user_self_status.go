@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"time"
+)
+
+// ExternalUserSelfStatus 外部用户查询自身配额的结果
+type ExternalUserSelfStatus struct {
+	UserId      string `json:"userId"`
+	ChannelId   string `json:"channelId,omitempty"`
+	IsVIP       bool   `json:"isVip"`
+	Used        int    `json:"used"`
+	Total       int    `json:"total"`     // -1 表示无限制
+	Remaining   int    `json:"remaining"` // -1 表示无限制
+	PercentUsed int    `json:"percentUsed"`
+	Rollover    int    `json:"rollover,omitempty"` // 从上个周期结转的额度 (已计入 total)
+	ResetAt     int64  `json:"resetAt"`            // 下次重置时间 (Unix 秒)
+
+	// channelId 为 all 时附带各渠道的用量 (渠道上限由前端传递，按全局 / 用户等级 / 用户自定义配额计算剩余次数)
+	Channels []UserChannelQuota `json:"channels,omitempty"`
+}
+
+// GetExternalUserSelfStatus 凭 token 查询用户自身在 channelId 上的配额 (channelId 为空时查询旧版全局配额)
+// 渠道配额上限由前端随请求传递，服务端只能按全局 / 用户等级 / 用户自定义配额计算
+// channelId 为 AllChannels 时按全局配额计算，并附带各渠道的用量明细
+func GetExternalUserSelfStatus(tokenString string, channelId string) (*ExternalUserSelfStatus, error) {
+	if err := checkTokenShape(tokenString); err != nil {
+		return nil, err
+	}
+	userData, err := verifyExternalJWT(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := channelId
+	if channelId == AllChannels {
+		bucket = ""
+	}
+	quota, err := getUserChannelQuota(userData.ID, bucket)
+	if err != nil {
+		return nil, err
+	}
+	resetDay := effectiveResetDay(userData)
+	currentPeriodKey, periodStart, periodEnd := quotaPeriod(time.Now(), resetDay)
+	limit, _ := ResolveUserQuotaLimit(userData, externalUserConfig.MonthlyQuota, quotaLimitSourceGlobal)
+	rolloverQuotaPeriod(userData.ID, quota, currentPeriodKey, previousPeriodKey(periodStart, resetDay), periodStart, limit)
+
+	status := &ExternalUserSelfStatus{
+		UserId:    userData.ID,
+		ChannelId: channelId,
+		IsVIP:     HasVIPAccess(userData, time.Now()) || isExternalAdmin(userData),
+		Used:      quota.UsedCount,
+		ResetAt:   periodEnd.Unix(),
+	}
+	if channelId == AllChannels {
+		if status.Channels, err = GetUserChannelQuotas(userData.ID, userData.ResetDay); err != nil {
+			return nil, err
+		}
+		ApplyUserChannelQuotaLimits(userData, status.Channels, externalUserConfig.MonthlyQuota, time.Now())
+	}
+	if IsUnlimitedUser(userData, time.Now()) || limit == -1 {
+		status.Total, status.Remaining = -1, -1
+		return status, nil
+	}
+	status.Rollover = quota.RolloverCredit
+	limit += quota.RolloverCredit
+	status.Total = limit
+	status.Remaining = limit - quota.UsedCount
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	status.PercentUsed = quotaPercentUsed(quota.UsedCount, limit)
+	return status, nil
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// externalUserUsageBuckets 用量分布直方图各区间的下限 (当前周期 usedCount)
+var externalUserUsageBuckets = []int{0, 1, 10, 30, 100}
+
+// UsageBucket 用量分布区间 [Min, Max]，Max 为 -1 表示无上限
+type UsageBucket struct {
+	Label string `json:"label"`
+	Min   int    `json:"min"`
+	Max   int    `json:"max"`
+	Users int    `json:"users"`
+}
+
+// ExternalUserStats 外部用户汇总统计
+type ExternalUserStats struct {
+	TotalUsers  int           `json:"totalUsers"`
+	ActiveVIPs  int           `json:"activeVips"`
+	ExpiredVIPs int           `json:"expiredVips"`
+	QuotaUsed   int64         `json:"quotaUsed"` // 当前周期已用配额合计 (旧版未分渠道 key)
+	Histogram   []UsageBucket `json:"histogram"`
+	GeneratedAt int64         `json:"generatedAt"`
+}
+
+// newUsageHistogram 按 externalUserUsageBuckets 生成空直方图
+func newUsageHistogram() []UsageBucket {
+	buckets := make([]UsageBucket, len(externalUserUsageBuckets))
+	for i, min := range externalUserUsageBuckets {
+		buckets[i] = UsageBucket{Min: min, Max: -1}
+		if i+1 < len(externalUserUsageBuckets) {
+			buckets[i].Max = externalUserUsageBuckets[i+1] - 1
+		}
+		switch {
+		case buckets[i].Max < 0:
+			buckets[i].Label = fmt.Sprintf("%d+", min)
+		case buckets[i].Max == min:
+			buckets[i].Label = fmt.Sprintf("%d", min)
+		default:
+			buckets[i].Label = fmt.Sprintf("%d-%d", min, buckets[i].Max)
+		}
+	}
+	return buckets
+}
+
+// ComputeExternalUserStats 汇总所有外部用户的 VIP 状态与当前周期用量
+// 仅遍历一次 user:*，用户记录与配额记录通过 MGET 批量读取，不逐个用户查询。
+func ComputeExternalUserStats() (*ExternalUserStats, error) {
+	keys, err := externalRedisScan("user:*")
+	if err != nil {
+		return nil, err
+	}
+	quotaKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		quotaKeys = append(quotaKeys, "quota:"+strings.TrimPrefix(key, "user:"))
+	}
+	userValues, err := externalRedisMGet(keys)
+	if err != nil {
+		return nil, err
+	}
+	quotaValues, err := externalRedisMGet(quotaKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	stats := &ExternalUserStats{Histogram: newUsageHistogram(), GeneratedAt: now.Unix()}
+	for i, key := range keys {
+		raw, ok := userValues[key]
+		if !ok {
+			continue
+		}
+		var user ExternalUserData
+		if err := json.Unmarshal([]byte(raw), &user); err != nil {
+			continue
+		}
+		stats.TotalUsers++
+		if user.IsVIP {
+			if user.VIPExpiresAt > now.Unix() {
+				stats.ActiveVIPs++
+			} else {
+				stats.ExpiredVIPs++
+			}
+		}
+
+		used := 0
+		if rawQuota, ok := quotaValues[quotaKeys[i]]; ok {
+			var quota UserQuota
+			periodKey, _, _ := quotaPeriod(now, effectiveResetDay(&user))
+			if json.Unmarshal([]byte(rawQuota), &quota) == nil && quota.MonthKey == periodKey {
+				used = quota.UsedCount
+			}
+		}
+		stats.QuotaUsed += int64(used)
+		// 转入配额可能使 usedCount 为负数，计入第一个区间
+		for j := len(stats.Histogram) - 1; j >= 0; j-- {
+			if used >= stats.Histogram[j].Min || j == 0 {
+				stats.Histogram[j].Users++
+				break
+			}
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Redis 存储故障时的处理策略
+// 默认值只有一个: EXTERNAL_USER_FAIL_OPEN (默认 false)，即存储出错时拒绝请求，避免在无法计数的情况下无限放行。
+// FailOpen 为 true 时放行请求，并通过 X-Quota-Degraded 标记本次未计入配额。
+//
+// 写入被拒绝 (OOM / 只读) 的策略 EXTERNAL_USER_STORAGE_FAILURE_POLICY 未设置时跟随 FailOpen (open / closed)；
+// 这类错误说明 Redis 本身不可写，需要运维介入，可单独设置为 open 或 closed 覆盖 FailOpen，只影响这类错误。
+const (
+	storageFailurePolicyOpen   = "open"
+	storageFailurePolicyClosed = "closed"
+)
+
+// normalizeStorageFailurePolicy 规范化写入被拒绝时的策略，未设置或非法值时按 failOpen 取 open / closed
+func normalizeStorageFailurePolicy(policy string, failOpen bool) string {
+	derived := storageFailurePolicyClosed
+	if failOpen {
+		derived = storageFailurePolicyOpen
+	}
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "":
+		return derived
+	case storageFailurePolicyOpen:
+		return storageFailurePolicyOpen
+	case storageFailurePolicyClosed:
+		return storageFailurePolicyClosed
+	}
+	externalUserWarn(ctx, "未知的 Redis 写入失败策略，跟随 EXTERNAL_USER_FAIL_OPEN", "policy", policy, "default", derived)
+	return derived
+}
+
+// isRedisWriteRejected 判断是否为 Redis 内存不足或只读导致的写入失败
+func isRedisWriteRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "OOM ") || strings.Contains(msg, "READONLY ")
+}
+
+// markQuotaDegraded 标记本次请求未计入配额 (降级放行)
+func markQuotaDegraded(c *gin.Context) {
+	c.Set("external_quota_degraded", true)
+	c.Header("X-Quota-Degraded", "true")
+	c.Header("X-Quota-Status", "degraded")
+}
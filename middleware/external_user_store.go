@@ -0,0 +1,264 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultLocalRedisTimeout = 5 * time.Second
+	defaultUpstashTimeout    = 5 * time.Second
+	maxRedisTimeout          = 60 * time.Second
+)
+
+// validateRedisTimeout 校验超时配置 (毫秒)，未设置或超出范围时使用默认值
+func validateRedisTimeout(name string, ms int, defaultValue time.Duration) time.Duration {
+	if ms == 0 {
+		return defaultValue
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if ms < 0 || timeout > maxRedisTimeout {
+		externalUserWarn(ctx, "Redis 超时配置无效，使用默认值", "name", name, "value", ms, "maxMs", maxRedisTimeout.Milliseconds(), "default", defaultValue)
+		return defaultValue
+	}
+	return timeout
+}
+
+const (
+	sentinelURLScheme   = "sentinel://"
+	defaultSentinelPort = "26379"
+)
+
+// IsLocalRedisURL 是否为 Redis 连接串 (redis://、启用 TLS 的 rediss:// 或 Sentinel 的 sentinel://)，否则视为 Upstash REST URL
+func IsLocalRedisURL(redisURL string) bool {
+	return strings.HasPrefix(redisURL, "redis://") || strings.HasPrefix(redisURL, "rediss://") || strings.HasPrefix(redisURL, sentinelURLScheme)
+}
+
+// newLocalRedisClient 根据连接串创建本地 Redis 客户端，sentinel:// 创建自动故障转移的客户端
+// 两种客户端类型相同 (*redis.Client)，后续读写逻辑无需区分。
+func newLocalRedisClient(redisURL string) (*redis.Client, bool, error) {
+	if strings.HasPrefix(redisURL, sentinelURLScheme) {
+		opt, err := parseSentinelURL(redisURL)
+		if err != nil {
+			return nil, false, err
+		}
+		return redis.NewFailoverClient(opt), false, nil
+	}
+	opt, err := newLocalRedisOptions(redisURL)
+	if err != nil {
+		return nil, false, err
+	}
+	return redis.NewClient(opt), opt.TLSConfig != nil, nil
+}
+
+// parseSentinelURL 解析 Sentinel 连接串
+// 格式: sentinel://<master-name>@host1[:port],host2[:port][/db][?password=...&sentinel_password=...]
+// 端口默认为 26379；password 为主节点密码，sentinel_password 为 Sentinel 自身的密码。
+func parseSentinelURL(redisURL string) (*redis.FailoverOptions, error) {
+	rest := strings.TrimPrefix(redisURL, sentinelURLScheme)
+	query := ""
+	if idx := strings.Index(rest, "?"); idx >= 0 {
+		rest, query = rest[:idx], rest[idx+1:]
+	}
+	at := strings.LastIndex(rest, "@")
+	if at <= 0 {
+		return nil, fmt.Errorf("Sentinel 连接串缺少主节点名称: sentinel://<master-name>@host1,host2")
+	}
+	masterName, hosts := rest[:at], rest[at+1:]
+
+	opt := &redis.FailoverOptions{MasterName: masterName}
+	if idx := strings.Index(hosts, "/"); idx >= 0 {
+		db, err := strconv.Atoi(hosts[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("无效的 Sentinel 数据库编号: %s", hosts[idx+1:])
+		}
+		hosts, opt.DB = hosts[:idx], db
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, defaultSentinelPort)
+		}
+		opt.SentinelAddrs = append(opt.SentinelAddrs, host)
+	}
+	if len(opt.SentinelAddrs) == 0 {
+		return nil, fmt.Errorf("Sentinel 连接串缺少 Sentinel 地址")
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	opt.Password = values.Get("password")
+	opt.SentinelPassword = values.Get("sentinel_password")
+
+	opt.DialTimeout = externalUserConfig.LocalRedisTimeout
+	opt.ReadTimeout = externalUserConfig.LocalRedisTimeout
+	opt.WriteTimeout = externalUserConfig.LocalRedisTimeout
+	opt.MaxRetries = -1
+	return opt, nil
+}
+
+// newLocalRedisOptions 解析本地 Redis 连接串并应用超时与重试配置
+// rediss:// 由 redis.ParseURL 配置 TLS (校验服务端证书，ServerName 取自 URL 中的主机名)。
+func newLocalRedisOptions(redisURL string) (*redis.Options, error) {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	applyLocalRedisTimeout(opt)
+	// 关闭 go-redis 内置重试: 幂等读写由 withExternalRedisRetry 重试，避免网络错误时重放 INCR / EVAL 等非幂等命令
+	opt.MaxRetries = -1
+	return opt, nil
+}
+
+// applyLocalRedisTimeout 将本地 Redis 超时应用到连接参数
+func applyLocalRedisTimeout(opt *redis.Options) {
+	opt.DialTimeout = externalUserConfig.LocalRedisTimeout
+	opt.ReadTimeout = externalUserConfig.LocalRedisTimeout
+	opt.WriteTimeout = externalUserConfig.LocalRedisTimeout
+}
+
+// externalRedisDo 执行任意 Redis 命令
+// 本地 Redis 使用 go-redis，Upstash 使用 REST API；key 不存在时返回 (nil, nil)
+func externalRedisDo(args ...interface{}) (interface{}, error) {
+	return externalRedisDoContext(ctx, args...)
+}
+
+// externalRedisDoContext 执行任意 Redis 命令，reqCtx 取消或超时时中止
+func externalRedisDoContext(reqCtx context.Context, args ...interface{}) (interface{}, error) {
+	if !externalUserConfig.Enabled {
+		return nil, fmt.Errorf("Redis 未配置")
+	}
+
+	if externalUserConfig.useLocalRedis {
+		val, err := externalUserConfig.redisClient.Do(reqCtx, args...).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return val, err
+	}
+
+	cmdBody, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(reqCtx, "POST", externalUserConfig.RedisURL, bytes.NewReader(cmdBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+externalUserConfig.RedisToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := upstashHTTPClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("解析 Redis 响应失败: %s", string(body))
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("Redis 返回错误: %s", result.Error)
+	}
+	return result.Result, nil
+}
+
+// externalRedisInt 将命令结果转换为整数 (兼容 go-redis 的 int64 与 Upstash 的 JSON number/string)
+func externalRedisInt(val interface{}) int64 {
+	switch v := val.(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case string:
+		var n int64
+		fmt.Sscanf(v, "%d", &n)
+		return n
+	}
+	return 0
+}
+
+// incrWithTTLScript 计数器自增，首次创建时在同一脚本内设置过期时间 (不会留下永不过期的计数)
+const incrWithTTLScript = `local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then redis.call("EXPIRE", KEYS[1], ARGV[1]) end
+return n`
+
+// externalRedisIncrWithTTL 计数器自增，首次创建时设置过期时间
+func externalRedisIncrWithTTL(key string, ttl time.Duration) (int64, error) {
+	val, err := externalRedisDo("EVAL", incrWithTTLScript, 1, key, int64(ttl/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return externalRedisInt(val), nil
+}
+
+// externalRedisScan 使用 SCAN 遍历匹配 pattern 的所有 key
+func externalRedisScan(pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		val, err := externalRedisDo("SCAN", cursor, "MATCH", pattern, "COUNT", 100)
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := val.([]interface{})
+		if !ok || len(parts) < 2 {
+			return keys, nil
+		}
+		cursor = fmt.Sprintf("%v", parts[0])
+		if batch, ok := parts[1].([]interface{}); ok {
+			for _, k := range batch {
+				keys = append(keys, fmt.Sprintf("%v", k))
+			}
+		}
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// releaseLockScript 仅在锁仍属于自己时释放
+const releaseLockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+
+// acquireExternalLock 获取分布式锁 (SET NX EX)，返回锁的持有标识
+func acquireExternalLock(key string, ttl time.Duration) (string, bool, error) {
+	token := fmt.Sprintf("%d", time.Now().UnixNano())
+	val, err := externalRedisDo("SET", key, token, "NX", "EX", int64(ttl/time.Second))
+	if err != nil {
+		return "", false, err
+	}
+	return token, val != nil, nil
+}
+
+// releaseExternalLock 释放分布式锁
+func releaseExternalLock(key string, token string) {
+	if _, err := externalRedisDo("EVAL", releaseLockScript, 1, key, token); err != nil {
+		externalUserWarn(ctx, "释放锁失败", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 超额请求延迟响应 (tarpit)
+// 窗口内持续超额的用户每次被拒绝前都会等待一段时间，延迟按违规次数翻倍并受上限约束；
+// 违规计数记录在 tarpit:<uid>，窗口到期或用户恢复正常请求后清除。
+const (
+	tarpitKeyPrefix = "tarpit:"
+
+	defaultTarpitMaxDelay = 10 * time.Second
+	defaultTarpitWindow   = 10 * time.Minute
+)
+
+// tarpitDelay 计算第 violations 次违规的延迟: base * 2^(violations-1)，不超过上限
+func tarpitDelay(violations int64) time.Duration {
+	base := externalUserConfig.TarpitBaseDelay
+	if base <= 0 || violations <= 0 {
+		return 0
+	}
+	delay := base
+	for i := int64(1); i < violations && delay < externalUserConfig.TarpitMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > externalUserConfig.TarpitMaxDelay {
+		delay = externalUserConfig.TarpitMaxDelay
+	}
+	return delay
+}
+
+// applyTarpit 记录一次超额违规并等待相应延迟，客户端断开时立即返回
+func applyTarpit(reqCtx context.Context, userId string) {
+	if externalUserConfig.TarpitBaseDelay <= 0 {
+		return
+	}
+	violations, err := externalRedisIncrWithTTL(tarpitKeyPrefix+userId, externalUserConfig.TarpitWindow)
+	if err != nil {
+		externalUserWarn(reqCtx, "记录超额次数失败", "user", common.HashPII(userId), "error", err)
+		return
+	}
+	delay := tarpitDelay(violations)
+	externalUserDebugf(reqCtx, "⏳ 用户 %s 窗口内第 %d 次超额，延迟 %v 后响应", common.HashPII(userId), violations, delay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-reqCtx.Done():
+	}
+}
+
+// clearTarpit 用户恢复正常请求后清除违规计数
+func clearTarpit(userId string) {
+	if externalUserConfig.TarpitBaseDelay <= 0 {
+		return
+	}
+	if _, err := externalRedisDo("DEL", tarpitKeyPrefix+userId); err != nil {
+		externalUserWarn(ctx, "清除超额次数失败", "user", common.HashPII(userId), "error", err)
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// 用户等级分配
+// 等级写入用户记录的 tier 字段 (与外部系统写入的等级相同)，可设置到期时间 tierExpiresAt，
+// 到期后按未设置等级 (default) 计算配额、预警阈值、模型列表与终身上限。
+
+// activeTier 用户当前生效的等级，未设置或已到期时为空
+func activeTier(userData *ExternalUserData) string {
+	if userData == nil || userData.Tier == "" {
+		return ""
+	}
+	if userData.TierExpiresAt > 0 && userData.TierExpiresAt <= time.Now().Unix() {
+		return ""
+	}
+	return userData.Tier
+}
+
+// ErrInvalidTierName 等级名称包含配置格式使用的分隔符
+var ErrInvalidTierName = errors.New("等级名称不能包含 : 或 ,")
+
+// IsExternalUserNotFound 判断错误是否为用户记录不存在
+func IsExternalUserNotFound(err error) bool {
+	return errors.Is(err, errExternalUserNotFound)
+}
+
+// SetUserTier 设置用户等级，expiresAt 为到期时间 (Unix 秒，0 表示不过期)；tier 为空时清除等级
+func SetUserTier(reqCtx context.Context, userId string, tier string, expiresAt int64) error {
+	tier = strings.TrimSpace(tier)
+	if strings.ContainsAny(tier, ":,") {
+		return ErrInvalidTierName
+	}
+	userData, err := getUserFromRedisContext(reqCtx, userId)
+	if err != nil {
+		return err
+	}
+
+	userData.Tier = tier
+	userData.TierExpiresAt = expiresAt
+	if tier == "" {
+		userData.TierExpiresAt = 0
+	}
+
+	userJSON, err := json.Marshal(userData)
+	if err != nil {
+		return err
+	}
+
+	key := "user:" + userId
+	defer InvalidateExternalUserCache(userId)
+
+	if externalUserConfig.useLocalRedis {
+		return externalUserConfig.redisClient.Set(reqCtx, key, string(userJSON), 0).Err()
+	}
+
+	// Upstash REST API (SET 幂等，临时性错误重试)
+	return withExternalRedisRetry(reqCtx, func() error {
+		return setUserToUpstash(reqCtx, userId, userData)
+	})
+}
+
+// GetUserTier 读取用户当前生效的等级与到期时间 (等级已到期时返回空等级)
+func GetUserTier(userId string) (string, int64, error) {
+	userData, err := getUserFromRedis(userId)
+	if err != nil {
+		return "", 0, err
+	}
+	return activeTier(userData), userData.TierExpiresAt, nil
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/gin-gonic/gin"
+)
+
+// Token 配额
+// 请求次数之外按 token 用量限制每周期消耗: 渠道通过 X-Channel-Quota-Token-Limit 指定上限，
+// 未指定时使用全局配置，0 表示不限制。token 用量在响应完成后才能得知，
+// 由消费日志写入 context (constant.ContextKeyExternalQuotaTokens)，请求结束后累加到配额记录的 TokenCount。
+// 已用 token 达到上限后拒绝后续请求 (单次请求可能超出剩余额度，不做预扣)。
+
+// accrueTokensScript 仍处于请求所在周期时累加 token 用量
+// KEYS[1]: 配额 key; ARGV: 周期 key、token 数、过期秒数 (0 为不过期)
+// 返回累加后的 token 用量，周期已切换或记录不存在时返回 -1
+const accrueTokensScript = `
+local raw = redis.call("GET", KEYS[1])
+if not raw then
+	return -1
+end
+local ok, quota = pcall(cjson.decode, raw)
+if not ok or type(quota) ~= "table" or quota.monthKey ~= ARGV[1] then
+	return -1
+end
+quota.tokenCount = (tonumber(quota.tokenCount) or 0) + tonumber(ARGV[2])
+local encoded = cjson.encode(quota)
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], encoded, "EX", tonumber(ARGV[3]))
+else
+	redis.call("SET", KEYS[1], encoded)
+end
+return quota.tokenCount
+`
+
+// resolveTokenQuotaLimit 渠道指定的 token 上限优先，未指定时使用全局配置
+func resolveTokenQuotaLimit(c *gin.Context) int {
+	if header := c.Request.Header.Get("X-Channel-Quota-Token-Limit"); header != "" {
+		if parsed, err := strconv.Atoi(header); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return externalUserConfig.MonthlyTokenQuota
+}
+
+// accrueUserChannelTokens 累加 periodKey 周期内的 token 用量，返回累加后的用量 (-1 表示未累加)
+func accrueUserChannelTokens(userId string, channelId string, periodKey string, tokens int) (int64, error) {
+	val, err := externalRedisDo("EVAL", accrueTokensScript, 1, channelQuotaKey(userId, channelId),
+		periodKey, tokens, quotaKeyTTL(periodKey, time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return externalRedisInt(val), nil
+}
+
+// recordTokenUsage 请求结束后将本次消耗的 token 累加到配额记录
+func recordTokenUsage(c *gin.Context, userId string, channelId string, periodKey string) {
+	tokens := common.GetContextKeyInt(c, constant.ContextKeyExternalQuotaTokens)
+	if tokens <= 0 {
+		return
+	}
+	total, err := accrueUserChannelTokens(userId, channelId, periodKey, tokens)
+	if err != nil {
+		externalUserWarn(c, "累计 token 用量失败", "user", common.HashPII(userId), "channel", channelId, "error", err)
+		return
+	}
+	if total < 0 {
+		externalUserDebugf(c, "用户 %s 配额周期已切换，跳过 token 累计", common.HashPII(userId))
+	}
+}
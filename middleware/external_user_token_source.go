@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 外部用户 token 的来源
+// 默认从 X-External-User-Token 读取；网关会剥离自定义 X- header 时可改为 Authorization 等标准 header，
+// 并配置 TokenPrefix (如 "Bearer ") 在验证前去掉前缀 (前缀不区分大小写，缺少前缀时按原值处理)。
+// 无法设置自定义 header 的浏览器客户端 (如 EventSource) 可改用 cookie 或 query 参数，优先级: header > cookie > query。
+// query 参数会随 URL 出现在访问日志、代理日志与浏览器历史中，需显式开启 AllowQueryToken 才会读取。
+const (
+	defaultTokenHeader     = "X-External-User-Token"
+	defaultTokenQueryParam = "access_token"
+)
+
+// ExternalUserTokenHeader 当前读取 token 的 header 名称
+func ExternalUserTokenHeader() string {
+	if externalUserConfig.TokenHeader == "" {
+		return defaultTokenHeader
+	}
+	return externalUserConfig.TokenHeader
+}
+
+// ExternalUserToken 从请求中读取外部用户 token (header 已去除配置的前缀)，不存在时返回空字符串
+func ExternalUserToken(c *gin.Context) string {
+	if token := c.GetHeader(ExternalUserTokenHeader()); token != "" {
+		if prefix := externalUserConfig.TokenPrefix; prefix != "" && len(token) >= len(prefix) && strings.EqualFold(token[:len(prefix)], prefix) {
+			token = strings.TrimSpace(token[len(prefix):])
+		}
+		return token
+	}
+	if name := externalUserConfig.TokenCookie; name != "" {
+		if token, err := c.Cookie(name); err == nil && token != "" {
+			return token
+		}
+	}
+	if externalUserConfig.AllowQueryToken {
+		param := externalUserConfig.TokenQueryParam
+		if param == "" {
+			param = defaultTokenQueryParam
+		}
+		return c.Query(param)
+	}
+	return ""
+}
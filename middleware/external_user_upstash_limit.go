@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstash 出站并发限制
+// 所有 Upstash REST 请求共用一个信号量，批量操作 (用户列表、MGET 等) 并发发起请求时，
+// 同时进行中的请求数不超过 UpstashMaxConcurrency，避免触发 Upstash 自身的限流。
+// 信号量在响应 Body 关闭时释放。
+const defaultUpstashMaxConcurrency = 8
+
+var upstashSemaphore = make(chan struct{}, defaultUpstashMaxConcurrency)
+
+// setUpstashConcurrency 设置 Upstash 最大并发数 (仅在初始化时调用)
+func setUpstashConcurrency(n int) {
+	if n <= 0 {
+		n = defaultUpstashMaxConcurrency
+	}
+	upstashSemaphore = make(chan struct{}, n)
+}
+
+// upstashLimitedTransport 在发起请求前获取信号量，并为未设置截止时间的请求附加 UpstashTimeout
+// 超时通过请求 context 实现 (覆盖排队、连接与读取 Body)，所有请求共用同一个客户端与连接池。
+type upstashLimitedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *upstashLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if _, ok := req.Context().Deadline(); !ok && externalUserConfig.UpstashTimeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), externalUserConfig.UpstashTimeout)
+		req = req.WithContext(ctx)
+	}
+
+	sem := upstashSemaphore
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		cancel()
+		return nil, req.Context().Err()
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		<-sem
+		cancel()
+		return nil, err
+	}
+	resp.Body = &semaphoreReleaseBody{ReadCloser: resp.Body, sem: sem, cancel: cancel}
+	return resp, nil
+}
+
+// semaphoreReleaseBody 关闭响应 Body 时释放信号量并结束请求 context
+type semaphoreReleaseBody struct {
+	io.ReadCloser
+	sem    chan struct{}
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (b *semaphoreReleaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		<-b.sem
+		b.cancel()
+	})
+	return err
+}
+
+// upstashBaseTransport Upstash 专用连接池
+// 默认 Transport 每个 host 只保留 2 个空闲连接，并发请求时会频繁新建连接 (每次都要 TLS 握手)，
+// 空闲连接数放宽到并发上限以上，保证排队中的请求能复用已建立的连接。
+var upstashBaseTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   64,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+var upstashTransport = &upstashLimitedTransport{base: upstashBaseTransport}
+
+// upstashClient 所有 Upstash REST 请求共用的客户端 (超时由 upstashLimitedTransport 按请求设置)
+var upstashClient = &http.Client{Transport: upstashTransport}
+
+// upstashHTTPClient 返回带超时和并发限制的共享 Upstash 客户端
+func upstashHTTPClient() *http.Client {
+	return upstashClient
+}
+
+// UpstashHTTPClient 供管理接口使用的 Upstash 客户端 (共享超时与并发限制)
+func UpstashHTTPClient() *http.Client {
+	return upstashHTTPClient()
+}
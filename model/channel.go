@@ -924,6 +924,12 @@ func GetChannelsByIds(ids []int) ([]*Channel, error) {
 	return channels, err
 }
 
+func GetChannelsByName(name string) ([]*Channel, error) {
+	var channels []*Channel
+	err := DB.Where("name = ?", name).Find(&channels).Error
+	return channels, err
+}
+
 func BatchSetChannelTag(ids []int, tag *string) error {
 	// 开启事务
 	tx := DB.Begin()
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/types"
 
@@ -170,11 +171,14 @@ type RecordConsumeLogParams struct {
 }
 
 func RecordConsumeLog(c *gin.Context, userId int, params RecordConsumeLogParams) {
+	// 外部用户 token 配额在请求结束后累计，与是否记录日志无关
+	common.SetContextKey(c, constant.ContextKeyExternalQuotaTokens, params.PromptTokens+params.CompletionTokens)
 	if !common.LogConsumeEnabled {
 		return
 	}
 	logger.LogInfo(c, fmt.Sprintf("record consume log: userId=%d, params=%s", userId, common.GetJsonString(params)))
 	username := c.GetString("username")
+	appendExternalQuotaOther(c, &params)
 	otherStr := common.MapToJsonStr(params.Other)
 	// 判断是否需要记录 IP
 	needRecordIp := false
@@ -252,8 +256,8 @@ func RecordConsumeLog(c *gin.Context, userId int, params RecordConsumeLogParams)
 			return ""
 		}(),
 		Other:              otherStr,
-		ExternalUserId:     externalUserId,
-		ExternalUserEmail:  externalUserEmail,
+		ExternalUserId:     common.HashPII(externalUserId),
+		ExternalUserEmail:  common.HashPII(externalUserEmail),
 		ExternalQuotaUsed:  externalQuotaUsed,
 		ExternalQuotaTotal: externalQuotaTotal,
 		ExternalQuotaVIP:   externalQuotaVIP,
@@ -271,6 +275,20 @@ func RecordConsumeLog(c *gin.Context, userId int, params RecordConsumeLogParams)
 	}
 }
 
+// appendExternalQuotaOther 将 ExternalUserAuth 写入 context 的本次扣除信息合并到 Other
+func appendExternalQuotaOther(c *gin.Context, params *RecordConsumeLogParams) {
+	charged, ok := common.GetContextKeyType[int](c, constant.ContextKeyExternalQuotaCharged)
+	if !ok {
+		return
+	}
+	if params.Other == nil {
+		params.Other = map[string]interface{}{}
+	}
+	params.Other["external_quota_charged"] = charged
+	params.Other["external_quota_channel_id"] = common.GetContextKeyString(c, constant.ContextKeyExternalQuotaChannelId)
+	params.Other["external_quota_remaining"] = common.GetContextKeyInt(c, constant.ContextKeyExternalQuotaRemaining)
+}
+
 func GetAllLogs(logType int, startTimestamp int64, endTimestamp int64, modelName string, username string, tokenName string, startIdx int, num int, channel int, group string) (logs []*Log, total int64, err error) {
 	var tx *gorm.DB
 	if logType == LogTypeUnknown {
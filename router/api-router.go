@@ -120,16 +120,37 @@ func SetApiRouter(router *gin.Engine) {
 		}
 		// 外部用户验证状态 (管理员可查看)
 		apiRouter.GET("/external-user-auth/status", middleware.AdminAuth(), controller.GetExternalUserAuthStatus)
+		// 外部用户自助查询 (凭 X-External-User-Token)
+		apiRouter.GET("/external-user/models", controller.GetExternalUserAllowedModels)
+		apiRouter.GET("/external-user/quota", controller.GetExternalUserSelfStatus)
+		apiRouter.GET("/external-user/quota/preview", controller.PreviewExternalUserQuota)
+		apiRouter.POST("/external-user/quota/preview", controller.PreviewExternalUserQuota)
 		
 		// 外部用户管理 (管理员)
 		externalUserRoute := apiRouter.Group("/external-users")
 		externalUserRoute.Use(middleware.AdminAuth())
 		{
 			externalUserRoute.GET("/", controller.GetExternalUsers)
+			externalUserRoute.POST("/", controller.CreateExternalUser)
+			externalUserRoute.GET("/auth-failures", controller.GetExternalUserAuthFailures)
+			externalUserRoute.GET("/exempt-identities", controller.GetExternalUserExemptIdentities)
+			externalUserRoute.GET("/channel-usage", controller.GetExternalUserChannelUsage)
+			externalUserRoute.GET("/stats", controller.GetExternalUserStats)
+			externalUserRoute.GET("/audit-log/export", controller.ExportExternalUserAuditLog)
 			externalUserRoute.GET("/:userId", controller.GetExternalUserDetail)
+			externalUserRoute.DELETE("/:userId", controller.DeleteExternalUser)
+			externalUserRoute.GET("/:userId/audit-log", controller.GetExternalUserAuditLog)
 			externalUserRoute.PUT("/:userId/quota", controller.UpdateExternalUserQuota)
 			externalUserRoute.PUT("/:userId/vip", controller.UpdateExternalUserVIP)
+			externalUserRoute.GET("/:userId/tier", controller.GetExternalUserTier)
+			externalUserRoute.PUT("/:userId/tier", controller.UpdateExternalUserTier)
+			externalUserRoute.POST("/:userId/ban", controller.BanExternalUser)
+			externalUserRoute.DELETE("/:userId/ban", controller.UnbanExternalUser)
 			externalUserRoute.POST("/batch-quota", controller.BatchUpdateQuota)
+			externalUserRoute.POST("/batch-vip", controller.BatchUpdateVIP)
+			externalUserRoute.POST("/import", controller.ImportExternalUsers)
+			externalUserRoute.POST("/transfer-quota", controller.TransferExternalUserQuota)
+			externalUserRoute.POST("/reset-stale-quotas", controller.ResetStaleExternalUserQuotas)
 		}
 
 		optionRoute := apiRouter.Group("/option")
@@ -181,7 +202,9 @@ func SetApiRouter(router *gin.Engine) {
 			// 渠道速率限制
 			channelRoute.GET("/rate_limit", controller.GetAllChannelRateLimitInfo)
 			channelRoute.GET("/rate_limit/channels", controller.GetAllChannelsForBatchRateLimit)
+			channelRoute.GET("/rate_limit/by_name", controller.GetChannelRateLimitInfoByName)
 			channelRoute.GET("/rate_limit/:id", controller.GetChannelRateLimitInfo)
+			channelRoute.POST("/rate_limit/reset_all", controller.ResetAllChannelRateLimits)
 			channelRoute.POST("/rate_limit/:id/reset", controller.ResetChannelRateLimit)
 			channelRoute.POST("/rate_limit/batch", controller.BatchSetChannelRateLimit)
 		}
@@ -0,0 +1,44 @@
+package service
+
+// 渠道 key 的并发限制
+// 每个渠道 key 同时进行中的请求数保存在本实例内存中 (与 channelRateLimitStore 共用 channelRateLimitMutex)，
+// 不参与快照与过期清理，进程重启后从 0 开始。
+var channelConcurrencyStore = make(map[string]int)
+
+// AcquireChannelSlot 占用渠道 key 的一个并发名额，maxConcurrency <= 0 表示不限制；已达到上限时返回 false
+func AcquireChannelSlot(channelID int, keyIndex int, maxConcurrency int) bool {
+	key := getChannelRateLimitKey(channelID, keyIndex)
+
+	channelRateLimitMutex.Lock()
+	defer channelRateLimitMutex.Unlock()
+
+	if maxConcurrency > 0 && channelConcurrencyStore[key] >= maxConcurrency {
+		return false
+	}
+	channelConcurrencyStore[key]++
+	return true
+}
+
+// ReleaseChannelSlot 释放渠道 key 的一个并发名额
+func ReleaseChannelSlot(channelID int, keyIndex int) {
+	key := getChannelRateLimitKey(channelID, keyIndex)
+
+	channelRateLimitMutex.Lock()
+	defer channelRateLimitMutex.Unlock()
+
+	if channelConcurrencyStore[key] <= 1 {
+		delete(channelConcurrencyStore, key)
+		return
+	}
+	channelConcurrencyStore[key]--
+}
+
+// GetChannelConcurrency 获取渠道 key 当前进行中的请求数
+func GetChannelConcurrency(channelID int, keyIndex int) int {
+	key := getChannelRateLimitKey(channelID, keyIndex)
+
+	channelRateLimitMutex.RLock()
+	defer channelRateLimitMutex.RUnlock()
+
+	return channelConcurrencyStore[key]
+}
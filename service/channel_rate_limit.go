@@ -2,13 +2,19 @@ package service
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
 )
 
 // ChannelRateLimitInfo 渠道速率限制信息
+// 计数与剩余量均按请求权重累计 (见 RateLimitOptionWithCost)，权重为 1 时即请求数。
 type ChannelRateLimitInfo struct {
 	ChannelID     int   `json:"channel_id"`
 	KeyIndex      int   `json:"key_index"`      // 多 key 模式下的 key 索引
@@ -18,11 +24,260 @@ type ChannelRateLimitInfo struct {
 	RPDLimit      int   `json:"rpd_limit"`      // 每天限制
 	RPMRemaining  int   `json:"rpm_remaining"`  // 每分钟剩余
 	RPDRemaining  int   `json:"rpd_remaining"`  // 每天剩余
+	Model         string `json:"model,omitempty"` // 按模型单独计数时的模型名称
 	LastMinuteKey string `json:"last_minute_key"` // 上次分钟 key
 	LastDayKey    string `json:"last_day_key"`    // 上次日期 key
+	WindowSeconds int    `json:"window_seconds"`  // RPM 统计窗口 (秒)
+	RPMResetAt    int64  `json:"rpm_reset_at"`    // RPM 窗口重置时间 (Unix 秒)
+	RPDResetAt    int64  `json:"rpd_reset_at"`    // 日计数重置时间 (Unix 秒)
+
+	// 每小时限制 (按自然小时 "2006-01-02-15" 计数)
+	RPHCount     int    `json:"rph_count"`     // 当前小时请求数
+	RPHLimit     int    `json:"rph_limit"`     // 每小时限制
+	RPHRemaining int    `json:"rph_remaining"` // 每小时剩余
+	LastHourKey  string `json:"last_hour_key"` // 上次小时 key
+	RPHResetAt   int64  `json:"rph_reset_at"`  // 小时计数重置时间 (Unix 秒)
+
+	// 漏桶模式 (允许短时突发，按固定速率漏出)
+	LeakyBucket bool      `json:"leaky_bucket"` // 是否使用漏桶限流代替固定窗口 RPM
+	BucketLevel float64   `json:"bucket_level"` // 当前桶内水位
+	BucketSize  int       `json:"bucket_size"`  // 桶容量 (允许的突发请求数)
+	LeakRate    int       `json:"leak_rate"`    // 每分钟漏出的请求数
+	lastLeakAt  time.Time // 上次漏水时间
+
+	// 令牌桶模式 (按 RPM 匀速补充令牌，桶满时允许 BurstSize 次突发)
+	TokenBucket  bool      `json:"token_bucket"`  // 是否使用令牌桶限流代替固定窗口 RPM
+	Tokens       float64   `json:"tokens"`        // 当前可用令牌数
+	BurstSize    int       `json:"burst_size"`    // 桶容量 (允许的突发请求数)
+	RefillRate   float64   `json:"refill_rate"`   // 每秒补充的令牌数
+	lastRefillAt time.Time // 上次补充令牌时间
 }
 
-// 内存存储（简单实现，生产环境建议用 Redis）
+// ChannelRateLimitOption 速率限制可选参数
+type ChannelRateLimitOption func(*channelRateLimitOptions)
+
+type channelRateLimitOptions struct {
+	windowSeconds int
+	leakyBucket   bool
+	bucketSize    int
+	leakRate      int
+	tokenBucket   bool
+	burstSize     int
+	rphLimit      int
+	model         string
+	cost          int
+}
+
+// RateLimitOptionWithWindow 设置 RPM 统计窗口 (秒)，<= 0 时使用默认 60 秒
+func RateLimitOptionWithWindow(seconds int) ChannelRateLimitOption {
+	return func(o *channelRateLimitOptions) {
+		o.windowSeconds = seconds
+	}
+}
+
+// RateLimitOptionWithModel 按模型单独计数 (key 为 channel_rate_limit:<渠道>:<key>:<模型>)，为空时使用渠道整体计数
+func RateLimitOptionWithModel(model string) ChannelRateLimitOption {
+	return func(o *channelRateLimitOptions) {
+		o.model = model
+	}
+}
+
+// RateLimitOptionWithCost 设置本次请求计入的权重 (如长上下文或图片请求计为多次)，<= 0 时为 1
+// 计数按权重累计，检查时比较 计数 + 权重 是否超过限制；权重超过限制本身时按限制计算，窗口内没有其他请求时仍可放行。
+func RateLimitOptionWithCost(cost int) ChannelRateLimitOption {
+	return func(o *channelRateLimitOptions) {
+		o.cost = cost
+	}
+}
+
+// RateLimitOptionWithRPH 设置每小时请求数限制，<= 0 表示不限制
+func RateLimitOptionWithRPH(limit int) ChannelRateLimitOption {
+	return func(o *channelRateLimitOptions) {
+		o.rphLimit = limit
+	}
+}
+
+// RateLimitOptionWithLeakyBucket 使用漏桶限流代替固定窗口 RPM
+// bucketSize 为允许的突发请求数，leakRate 为每分钟漏出的请求数，<= 0 时均默认取 RPM 限制
+func RateLimitOptionWithLeakyBucket(bucketSize int, leakRate int) ChannelRateLimitOption {
+	return func(o *channelRateLimitOptions) {
+		o.leakyBucket = true
+		o.bucketSize = bucketSize
+		o.leakRate = leakRate
+	}
+}
+
+// RateLimitOptionWithTokenBucket 使用令牌桶限流代替固定窗口 RPM
+// 令牌按 RPM/60 每秒匀速补充，burstSize 为桶容量，<= 0 时默认取 RPM 限制
+func RateLimitOptionWithTokenBucket(burstSize int) ChannelRateLimitOption {
+	return func(o *channelRateLimitOptions) {
+		o.tokenBucket = true
+		o.burstSize = burstSize
+	}
+}
+
+// EffectiveChannelRateLimitSetting 返回渠道实际生效的速率限制设置，以及是否继承自全局默认限制
+// 渠道启用了自己的速率限制时始终使用渠道设置；未启用且开启了全局默认限制时，
+// 使用全局默认 RPM / RPD (其他限流参数保持默认)。
+func EffectiveChannelRateLimitSetting(setting dto.ChannelSettings) (dto.ChannelSettings, bool) {
+	if setting.RateLimitEnabled || !constant.ChannelRateLimitDefaultEnabled {
+		return setting, false
+	}
+	if constant.ChannelRateLimitDefaultRPM <= 0 && constant.ChannelRateLimitDefaultRPD <= 0 {
+		return setting, false
+	}
+	return dto.ChannelSettings{
+		RateLimitEnabled: true,
+		RateLimitRPM:     constant.ChannelRateLimitDefaultRPM,
+		RateLimitRPD:     constant.ChannelRateLimitDefaultRPD,
+	}, true
+}
+
+// ChannelRateLimitForModel 返回请求指定模型时生效的 RPM / RPD 与速率限制参数
+// 渠道为该模型配置了覆盖限制时，模型单独计数且只检查模型的 RPM / RPD (统计窗口沿用渠道设置)；
+// 否则使用渠道整体的限制与计数。模型设置了请求权重时，每次请求按权重计数。
+func ChannelRateLimitForModel(setting dto.ChannelSettings, model string) (int, int, []ChannelRateLimitOption) {
+	var costOpts []ChannelRateLimitOption
+	if weight := setting.RateLimitModelWeights[model]; weight > 1 && model != "" {
+		costOpts = append(costOpts, RateLimitOptionWithCost(weight))
+	}
+	if limit, ok := setting.RateLimitModels[model]; ok && model != "" {
+		return limit.RPM, limit.RPD, append([]ChannelRateLimitOption{
+			RateLimitOptionWithWindow(setting.RateLimitWindowSeconds),
+			RateLimitOptionWithModel(model),
+		}, costOpts...)
+	}
+	return setting.RateLimitRPM, setting.RateLimitRPD, append(ChannelRateLimitOptionsFromSetting(setting), costOpts...)
+}
+
+// ChannelRateLimitOptionsFromSetting 根据渠道设置生成速率限制参数
+func ChannelRateLimitOptionsFromSetting(setting dto.ChannelSettings) []ChannelRateLimitOption {
+	opts := []ChannelRateLimitOption{
+		RateLimitOptionWithWindow(setting.RateLimitWindowSeconds),
+		RateLimitOptionWithRPH(setting.RateLimitRPH),
+	}
+	if setting.RateLimitLeakyBucket {
+		opts = append(opts, RateLimitOptionWithLeakyBucket(setting.RateLimitBucketSize, setting.RateLimitLeakRate))
+	}
+	if setting.RateLimitTokenBucket {
+		opts = append(opts, RateLimitOptionWithTokenBucket(setting.RateLimitBurstSize))
+	}
+	return opts
+}
+
+func buildChannelRateLimitOptions(opts []ChannelRateLimitOption) channelRateLimitOptions {
+	o := channelRateLimitOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.windowSeconds <= 0 {
+		o.windowSeconds = 60
+	}
+	if o.cost <= 0 {
+		o.cost = 1
+	}
+	return o
+}
+
+// rateLimitCostWithin 权重超过容量时按容量计算，避免权重过大的请求永远无法放行
+func rateLimitCostWithin(cost int, capacity int) int {
+	if capacity > 0 && cost > capacity {
+		return capacity
+	}
+	return cost
+}
+
+// rateLimitNow 当前时间 (测试中可替换)
+var rateLimitNow = time.Now
+
+// rateLimitWindowKey 计算当前所在 RPM 窗口的 key
+// 60 秒窗口保持原有的分钟格式，其他窗口使用窗口起始时间
+func rateLimitWindowKey(now time.Time, windowSeconds int) string {
+	if windowSeconds == 60 {
+		return now.Format("2006-01-02-15-04")
+	}
+	start := time.Unix(now.Unix()/int64(windowSeconds)*int64(windowSeconds), 0).In(now.Location())
+	return start.Format("2006-01-02-15-04-05")
+}
+
+// rateLimitResetTimes 根据记录的窗口 key 计算 RPM 窗口与日计数的重置时间
+// key 无法解析时使用 now 所在窗口的下一个边界
+func rateLimitResetTimes(info *ChannelRateLimitInfo, now time.Time) (int64, int64) {
+	loc := now.Location()
+	layout := "2006-01-02-15-04-05"
+	if info.WindowSeconds == 60 {
+		layout = "2006-01-02-15-04"
+	}
+	windowStart, err := time.ParseInLocation(layout, info.LastMinuteKey, loc)
+	if err != nil {
+		windowStart = time.Unix(now.Unix()/int64(info.WindowSeconds)*int64(info.WindowSeconds), 0).In(loc)
+	}
+	dayStart, err := time.ParseInLocation("2006-01-02", info.LastDayKey, loc)
+	if err != nil {
+		dayStart = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	}
+	return windowStart.Add(time.Duration(info.WindowSeconds) * time.Second).Unix(), dayStart.AddDate(0, 0, 1).Unix()
+}
+
+// leakChannelRateLimitBucket 按经过的时间漏出桶内水位，并同步漏桶参数
+func leakChannelRateLimitBucket(info *ChannelRateLimitInfo, now time.Time, rpmLimit int, o channelRateLimitOptions) {
+	info.LeakyBucket = o.leakyBucket
+	if !o.leakyBucket {
+		info.BucketLevel = 0
+		info.lastLeakAt = time.Time{}
+		return
+	}
+	info.BucketSize = o.bucketSize
+	if info.BucketSize <= 0 {
+		info.BucketSize = rpmLimit
+	}
+	info.LeakRate = o.leakRate
+	if info.LeakRate <= 0 {
+		info.LeakRate = rpmLimit
+	}
+	if !info.lastLeakAt.IsZero() && now.After(info.lastLeakAt) {
+		info.BucketLevel -= now.Sub(info.lastLeakAt).Minutes() * float64(info.LeakRate)
+		if info.BucketLevel < 0 {
+			info.BucketLevel = 0
+		}
+	}
+	info.lastLeakAt = now
+}
+
+// refillChannelRateLimitTokens 按经过的时间补充令牌，并同步令牌桶参数
+// 新建的桶是满的，空闲足够久后恢复到桶容量
+func refillChannelRateLimitTokens(info *ChannelRateLimitInfo, now time.Time, rpmLimit int, o channelRateLimitOptions) {
+	info.TokenBucket = o.tokenBucket
+	if !o.tokenBucket {
+		info.Tokens = 0
+		info.lastRefillAt = time.Time{}
+		return
+	}
+	info.BurstSize = o.burstSize
+	if info.BurstSize <= 0 {
+		info.BurstSize = rpmLimit
+	}
+	info.RefillRate = float64(rpmLimit) / 60
+	if info.lastRefillAt.IsZero() {
+		info.Tokens = float64(info.BurstSize)
+	} else if now.After(info.lastRefillAt) {
+		info.Tokens += now.Sub(info.lastRefillAt).Seconds() * info.RefillRate
+	}
+	if info.Tokens > float64(info.BurstSize) {
+		info.Tokens = float64(info.BurstSize)
+	}
+	info.lastRefillAt = now
+}
+
+// describeRateLimitWindow 窗口描述 (用于错误信息)
+func describeRateLimitWindow(windowSeconds int) string {
+	if windowSeconds == 60 {
+		return "每分钟"
+	}
+	return fmt.Sprintf("每 %d 秒", windowSeconds)
+}
+
+// 内存存储（未配置 Redis 时使用，Redis 存储见 channel_rate_limit_redis.go）
 var (
 	channelRateLimitStore = make(map[string]*ChannelRateLimitInfo)
 	channelRateLimitMutex sync.RWMutex
@@ -30,48 +285,90 @@ var (
 
 // getChannelRateLimitKey 生成渠道速率限制的 key
 func getChannelRateLimitKey(channelID int, keyIndex int) string {
-	return fmt.Sprintf("channel_rate_limit:%d:%d", channelID, keyIndex)
+	return fmt.Sprintf("%s%d:%d", channelRateLimitKeyPrefix, channelID, keyIndex)
 }
 
-// GetChannelRateLimitInfo 获取渠道速率限制信息
-func GetChannelRateLimitInfo(channelID int, keyIndex int, rpmLimit int, rpdLimit int) *ChannelRateLimitInfo {
-	key := getChannelRateLimitKey(channelID, keyIndex)
-	currentMinute := time.Now().Format("2006-01-02-15-04")
-	currentDay := time.Now().Format("2006-01-02")
+// channelRateLimitKeyPrefix 速率限制 key 的前缀 (内存与 Redis 共用)
+const channelRateLimitKeyPrefix = "channel_rate_limit:"
 
-	channelRateLimitMutex.Lock()
-	defer channelRateLimitMutex.Unlock()
+// channelRateLimitKey 生成渠道 (按模型计数时为渠道下的模型) 速率限制的 key
+func channelRateLimitKey(channelID int, keyIndex int, o channelRateLimitOptions) string {
+	if o.model == "" {
+		return getChannelRateLimitKey(channelID, keyIndex)
+	}
+	return getChannelRateLimitKey(channelID, keyIndex) + ":" + o.model
+}
 
+// lockedChannelRateLimitInfo 获取 (不存在时创建) key 的记录，并在窗口切换时重置对应计数
+// 调用方需持有 channelRateLimitMutex
+func lockedChannelRateLimitInfo(key string, channelID int, keyIndex int, rpmLimit int, rpdLimit int, w rateLimitWindow, o channelRateLimitOptions) *ChannelRateLimitInfo {
 	info, exists := channelRateLimitStore[key]
 	if !exists {
 		info = &ChannelRateLimitInfo{
 			ChannelID:     channelID,
 			KeyIndex:      keyIndex,
+			Model:         o.model,
 			RPMCount:      0,
 			RPDCount:      0,
 			RPMLimit:      rpmLimit,
 			RPDLimit:      rpdLimit,
-			LastMinuteKey: currentMinute,
-			LastDayKey:    currentDay,
+			LastMinuteKey: w.minute,
+			LastDayKey:    w.day,
+			WindowSeconds: o.windowSeconds,
+			LastHourKey:   w.hour,
 		}
 		channelRateLimitStore[key] = info
 	}
 
 	// 检查是否需要重置分钟计数
-	if info.LastMinuteKey != currentMinute {
+	if info.LastMinuteKey != w.minute {
 		info.RPMCount = 0
-		info.LastMinuteKey = currentMinute
+		info.LastMinuteKey = w.minute
+	}
+
+	// 检查是否需要重置小时计数
+	if info.LastHourKey != w.hour {
+		info.RPHCount = 0
+		info.LastHourKey = w.hour
 	}
 
 	// 检查是否需要重置日计数
-	if info.LastDayKey != currentDay {
+	if info.LastDayKey != w.day {
 		info.RPDCount = 0
-		info.LastDayKey = currentDay
+		info.LastDayKey = w.day
+	}
+	return info
+}
+
+// rateLimitWindow 当前时间所在的 RPM 窗口、小时与日期 key
+type rateLimitWindow struct {
+	now    time.Time
+	minute string
+	hour   string
+	day    string
+}
+
+func currentRateLimitWindow(o channelRateLimitOptions) rateLimitWindow {
+	now := rateLimitNow()
+	return rateLimitWindow{
+		now:    now,
+		minute: rateLimitWindowKey(now, o.windowSeconds),
+		hour:   now.Format("2006-01-02-15"),
+		day:    now.Format("2006-01-02"),
 	}
+}
 
+// refreshChannelRateLimitInfo 更新限制值、漏桶/令牌桶状态、重置时间与剩余次数 (调用方需持有 channelRateLimitMutex)
+func refreshChannelRateLimitInfo(info *ChannelRateLimitInfo, now time.Time, rpmLimit int, rpdLimit int, o channelRateLimitOptions) {
 	// 更新限制值
 	info.RPMLimit = rpmLimit
 	info.RPDLimit = rpdLimit
+	info.RPHLimit = o.rphLimit
+	info.WindowSeconds = o.windowSeconds
+	leakChannelRateLimitBucket(info, now, rpmLimit, o)
+	refillChannelRateLimitTokens(info, now, rpmLimit, o)
+	info.RPMResetAt, info.RPDResetAt = rateLimitResetTimes(info, now)
+	info.RPHResetAt = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location()).Add(time.Hour).Unix()
 
 	// 计算剩余
 	if rpmLimit > 0 {
@@ -83,6 +380,15 @@ func GetChannelRateLimitInfo(channelID int, keyIndex int, rpmLimit int, rpdLimit
 		info.RPMRemaining = -1 // -1 表示无限制
 	}
 
+	if o.rphLimit > 0 {
+		info.RPHRemaining = o.rphLimit - info.RPHCount
+		if info.RPHRemaining < 0 {
+			info.RPHRemaining = 0
+		}
+	} else {
+		info.RPHRemaining = -1 // -1 表示无限制
+	}
+
 	if rpdLimit > 0 {
 		info.RPDRemaining = rpdLimit - info.RPDCount
 		if info.RPDRemaining < 0 {
@@ -91,76 +397,225 @@ func GetChannelRateLimitInfo(channelID int, keyIndex int, rpmLimit int, rpdLimit
 	} else {
 		info.RPDRemaining = -1 // -1 表示无限制
 	}
+}
+
+// consumeChannelRateLimitBucket 按请求权重向漏桶注水 / 从令牌桶取出令牌 (调用方需持有 channelRateLimitMutex)
+func consumeChannelRateLimitBucket(info *ChannelRateLimitInfo, cost int) {
+	if info.LeakyBucket {
+		info.BucketLevel += float64(cost)
+	}
+	if info.TokenBucket {
+		info.Tokens -= float64(cost)
+		if info.Tokens < 0 {
+			info.Tokens = 0
+		}
+	}
+}
+
+// GetChannelRateLimitInfo 获取渠道速率限制信息
+func GetChannelRateLimitInfo(channelID int, keyIndex int, rpmLimit int, rpdLimit int, opts ...ChannelRateLimitOption) *ChannelRateLimitInfo {
+	o := buildChannelRateLimitOptions(opts)
+	key := channelRateLimitKey(channelID, keyIndex, o)
+	w := currentRateLimitWindow(o)
+	redisRPM, redisRPH, redisRPD, useRedis := loadRedisRateLimitCounts(key, w.minute, w.hour, w.day)
 
+	channelRateLimitMutex.Lock()
+	defer channelRateLimitMutex.Unlock()
+
+	info := lockedChannelRateLimitInfo(key, channelID, keyIndex, rpmLimit, rpdLimit, w, o)
+
+	// 多实例共享的 Redis 计数
+	if useRedis {
+		info.RPMCount, info.RPHCount, info.RPDCount = redisRPM, redisRPH, redisRPD
+	}
+
+	refreshChannelRateLimitInfo(info, w.now, rpmLimit, rpdLimit, o)
 	return info
 }
 
-// CheckChannelRateLimit 检查渠道是否超过速率限制
-// 返回: (是否允许, 错误信息)
-func CheckChannelRateLimit(channelID int, keyIndex int, rpmLimit int, rpdLimit int) (bool, string) {
-	if rpmLimit <= 0 && rpdLimit <= 0 {
-		return true, "" // 没有限制
+// rateLimitSubject 错误信息中的限流对象描述
+func rateLimitSubject(channelID int, keyIndex int, model string) string {
+	if model == "" {
+		return fmt.Sprintf("渠道 %d (key %d)", channelID, keyIndex)
 	}
+	return fmt.Sprintf("渠道 %d (key %d) 模型 %s", channelID, keyIndex, model)
+}
 
-	info := GetChannelRateLimitInfo(channelID, keyIndex, rpmLimit, rpdLimit)
+// checkChannelRateLimitInfo 根据已刷新的记录判断是否允许再发送一次权重为 cost 的请求
+// 拒绝时同时返回建议的重试等待秒数: 固定窗口为当前窗口 / 小时 / 当天结束的时间 (按记录的窗口 key 计算)，
+// 漏桶 / 令牌桶为腾出足够容量所需的时间
+func checkChannelRateLimitInfo(info *ChannelRateLimitInfo, channelID int, keyIndex int, rpmLimit int, rpdLimit int, cost int, now time.Time) (bool, string, int) {
+	rpmResetAt, rpdResetAt := rateLimitResetTimes(info, now)
+
+	// 检查 RPM 限制 (令牌桶模式下无可用令牌时拒绝，漏桶模式下桶满时拒绝，均允许短时突发)
+	if info.TokenBucket && info.RefillRate > 0 {
+		if need := float64(rateLimitCostWithin(cost, info.BurstSize)); info.Tokens < need {
+			return false, fmt.Sprintf("%s 请求过于频繁 (令牌桶 %.1f/%d，每分钟补充 %d)", rateLimitSubject(channelID, keyIndex, info.Model), info.Tokens, info.BurstSize, rpmLimit),
+				ceilRateLimitSeconds((need - info.Tokens) / info.RefillRate)
+		}
+	} else if info.LeakyBucket && info.LeakRate > 0 {
+		if overflow := info.BucketLevel + float64(rateLimitCostWithin(cost, info.BucketSize)) - float64(info.BucketSize); overflow > 0 {
+			return false, fmt.Sprintf("%s 请求过于频繁 (漏桶 %.1f/%d，每分钟漏出 %d)", rateLimitSubject(channelID, keyIndex, info.Model), info.BucketLevel, info.BucketSize, info.LeakRate),
+				ceilRateLimitSeconds(overflow * 60 / float64(info.LeakRate))
+		}
+	} else if rpmLimit > 0 && info.RPMCount+rateLimitCostWithin(cost, rpmLimit) > rpmLimit {
+		return false, fmt.Sprintf("%s 已达到%s请求限制 (%d/%d)", rateLimitSubject(channelID, keyIndex, info.Model), describeRateLimitWindow(info.WindowSeconds), info.RPMCount, rpmLimit),
+			rateLimitRetryAfter(rpmResetAt, now)
+	}
 
-	// 检查 RPM 限制
-	if rpmLimit > 0 && info.RPMCount >= rpmLimit {
-		return false, fmt.Sprintf("渠道 %d (key %d) 已达到每分钟请求限制 (%d/%d)", channelID, keyIndex, info.RPMCount, rpmLimit)
+	// 检查 RPH 限制
+	if info.RPHLimit > 0 && info.RPHCount+rateLimitCostWithin(cost, info.RPHLimit) > info.RPHLimit {
+		return false, fmt.Sprintf("%s 已达到每小时请求限制 (%d/%d)", rateLimitSubject(channelID, keyIndex, info.Model), info.RPHCount, info.RPHLimit),
+			rateLimitRetryAfter(rateLimitHourResetAt(info, now), now)
 	}
 
 	// 检查 RPD 限制
-	if rpdLimit > 0 && info.RPDCount >= rpdLimit {
-		return false, fmt.Sprintf("渠道 %d (key %d) 已达到每天请求限制 (%d/%d)", channelID, keyIndex, info.RPDCount, rpdLimit)
+	if rpdLimit > 0 && info.RPDCount+rateLimitCostWithin(cost, rpdLimit) > rpdLimit {
+		return false, fmt.Sprintf("%s 已达到每天请求限制 (%d/%d)", rateLimitSubject(channelID, keyIndex, info.Model), info.RPDCount, rpdLimit),
+			rateLimitRetryAfter(rpdResetAt, now)
 	}
 
-	return true, ""
+	return true, "", 0
 }
 
-// IncrementChannelRateLimit 增加渠道请求计数
-func IncrementChannelRateLimit(channelID int, keyIndex int, rpmLimit int, rpdLimit int) {
-	key := getChannelRateLimitKey(channelID, keyIndex)
-	currentMinute := time.Now().Format("2006-01-02-15-04")
-	currentDay := time.Now().Format("2006-01-02")
+// rateLimitHourResetAt 根据记录的小时 key 计算小时计数的重置时间，key 无法解析时使用 now 所在小时
+func rateLimitHourResetAt(info *ChannelRateLimitInfo, now time.Time) int64 {
+	hourStart, err := time.ParseInLocation("2006-01-02-15", info.LastHourKey, now.Location())
+	if err != nil {
+		hourStart = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	}
+	return hourStart.Add(time.Hour).Unix()
+}
+
+// rateLimitRetryAfter 距离 resetAt 的秒数 (向上取整，至少 1 秒)
+func rateLimitRetryAfter(resetAt int64, now time.Time) int {
+	return ceilRateLimitSeconds(time.Unix(resetAt, 0).Sub(now).Seconds())
+}
+
+// ceilRateLimitSeconds 秒数向上取整，至少 1 秒
+func ceilRateLimitSeconds(seconds float64) int {
+	if n := int(math.Ceil(seconds)); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// CheckChannelRateLimit 检查渠道是否超过速率限制 (只读，不计数；实际放行请求请使用 AcquireChannelRateLimit)
+// 返回: (是否允许, 错误信息, 拒绝时建议的重试等待秒数)
+func CheckChannelRateLimit(channelID int, keyIndex int, rpmLimit int, rpdLimit int, opts ...ChannelRateLimitOption) (bool, string, int) {
+	o := buildChannelRateLimitOptions(opts)
+	if rpmLimit <= 0 && rpdLimit <= 0 && o.rphLimit <= 0 {
+		return true, "", 0 // 没有限制
+	}
+
+	info := GetChannelRateLimitInfo(channelID, keyIndex, rpmLimit, rpdLimit, opts...)
+	return checkChannelRateLimitInfo(info, channelID, keyIndex, rpmLimit, rpdLimit, o.cost, rateLimitNow())
+}
+
+// IncrementChannelRateLimit 增加渠道请求计数 (按 RateLimitOptionWithCost 设置的权重，默认为 1)
+func IncrementChannelRateLimit(channelID int, keyIndex int, rpmLimit int, rpdLimit int, opts ...ChannelRateLimitOption) {
+	o := buildChannelRateLimitOptions(opts)
+	key := channelRateLimitKey(channelID, keyIndex, o)
+	w := currentRateLimitWindow(o)
+	redisRPM, redisRPH, redisRPD, useRedis := incrRedisRateLimitCounts(key, w.minute, w.hour, w.day, o.windowSeconds, o.cost)
 
 	channelRateLimitMutex.Lock()
 	defer channelRateLimitMutex.Unlock()
 
-	info, exists := channelRateLimitStore[key]
-	if !exists {
-		info = &ChannelRateLimitInfo{
-			ChannelID:     channelID,
-			KeyIndex:      keyIndex,
-			RPMCount:      0,
-			RPDCount:      0,
-			RPMLimit:      rpmLimit,
-			RPDLimit:      rpdLimit,
-			LastMinuteKey: currentMinute,
-			LastDayKey:    currentDay,
-		}
-		channelRateLimitStore[key] = info
+	info := lockedChannelRateLimitInfo(key, channelID, keyIndex, rpmLimit, rpdLimit, w, o)
+
+	// 增加计数
+	if useRedis {
+		info.RPMCount, info.RPHCount, info.RPDCount = redisRPM, redisRPH, redisRPD
+	} else {
+		info.RPMCount += o.cost
+		info.RPHCount += o.cost
+		info.RPDCount += o.cost
 	}
+	info.WindowSeconds = o.windowSeconds
+	leakChannelRateLimitBucket(info, w.now, rpmLimit, o)
+	refillChannelRateLimitTokens(info, w.now, rpmLimit, o)
+	consumeChannelRateLimitBucket(info, o.cost)
+	recordChannelRPM(info)
 
-	// 检查是否需要重置分钟计数
-	if info.LastMinuteKey != currentMinute {
-		info.RPMCount = 0
-		info.LastMinuteKey = currentMinute
+	if common.DebugEnabled {
+		fmt.Printf("[ChannelRateLimit] Channel %d Key %d: RPM=%d/%d, RPH=%d/%d, RPD=%d/%d\n",
+			channelID, keyIndex, info.RPMCount, rpmLimit, info.RPHCount, o.rphLimit, info.RPDCount, rpdLimit)
 	}
+}
 
-	// 检查是否需要重置日计数
-	if info.LastDayKey != currentDay {
-		info.RPDCount = 0
-		info.LastDayKey = currentDay
+// AcquireChannelRateLimit 原子地检查并计入一次请求，允许时计数加一，拒绝时不计数
+// 内存存储在同一把锁内完成检查与计数；Redis 存储使用 Lua 脚本检查并增加共享计数，
+// 漏桶/令牌桶仍在本实例内存中判断，桶已满时回退本次 Redis 计数。
+// 返回: (是否允许, 错误信息, 拒绝时建议的重试等待秒数)
+func AcquireChannelRateLimit(channelID int, keyIndex int, rpmLimit int, rpdLimit int, opts ...ChannelRateLimitOption) (bool, string, int) {
+	allowed, msg, retryAfter := acquireChannelRateLimit(channelID, keyIndex, rpmLimit, rpdLimit, opts...)
+	if !allowed {
+		common.ChannelRateLimitRejectionsTotal.WithLabelValues(strconv.Itoa(channelID), strconv.Itoa(keyIndex)).Inc()
 	}
+	return allowed, msg, retryAfter
+}
 
-	// 增加计数
-	info.RPMCount++
-	info.RPDCount++
+// recordChannelRPM 更新当前窗口请求数指标，按模型单独计数的记录不计入 (调用方持有 channelRateLimitMutex)
+func recordChannelRPM(info *ChannelRateLimitInfo) {
+	if info.Model != "" {
+		return
+	}
+	common.ChannelRPMCurrent.WithLabelValues(strconv.Itoa(info.ChannelID), strconv.Itoa(info.KeyIndex)).Set(float64(info.RPMCount))
+}
 
-	if common.DebugEnabled {
-		fmt.Printf("[ChannelRateLimit] Channel %d Key %d: RPM=%d/%d, RPD=%d/%d\n",
-			channelID, keyIndex, info.RPMCount, rpmLimit, info.RPDCount, rpdLimit)
+// acquireChannelRateLimit AcquireChannelRateLimit 的检查与计数逻辑
+func acquireChannelRateLimit(channelID int, keyIndex int, rpmLimit int, rpdLimit int, opts ...ChannelRateLimitOption) (bool, string, int) {
+	o := buildChannelRateLimitOptions(opts)
+	if rpmLimit <= 0 && rpdLimit <= 0 && o.rphLimit <= 0 {
+		return true, "", 0 // 没有限制
+	}
+	key := channelRateLimitKey(channelID, keyIndex, o)
+	w := currentRateLimitWindow(o)
+
+	// 桶模式下 RPM 由桶控制，Redis 只限制 RPH / RPD
+	redisRPMLimit := rpmLimit
+	if o.leakyBucket || o.tokenBucket {
+		redisRPMLimit = 0
 	}
+	admitted, redisRPM, redisRPH, redisRPD, useRedis := acquireRedisRateLimitCounts(key, w.minute, w.hour, w.day, o.windowSeconds, redisRPMLimit, o.rphLimit, rpdLimit, o.cost)
+
+	channelRateLimitMutex.Lock()
+	defer channelRateLimitMutex.Unlock()
+
+	info := lockedChannelRateLimitInfo(key, channelID, keyIndex, rpmLimit, rpdLimit, w, o)
+	if useRedis {
+		info.RPMCount, info.RPHCount, info.RPDCount = redisRPM, redisRPH, redisRPD
+	}
+	refreshChannelRateLimitInfo(info, w.now, rpmLimit, rpdLimit, o)
+
+	if useRedis {
+		if !admitted {
+			if ok, msg, retryAfter := checkChannelRateLimitInfo(info, channelID, keyIndex, rpmLimit, rpdLimit, o.cost, w.now); !ok {
+				return false, msg, retryAfter
+			}
+			return false, fmt.Sprintf("%s 已达到请求限制", rateLimitSubject(channelID, keyIndex, info.Model)), rateLimitRetryAfter(info.RPMResetAt, w.now)
+		}
+		// Redis 已计数，按计数前的值检查漏桶/令牌桶
+		info.RPMCount, info.RPHCount, info.RPDCount = redisRPM-o.cost, redisRPH-o.cost, redisRPD-o.cost
+		ok, msg, retryAfter := checkChannelRateLimitInfo(info, channelID, keyIndex, rpmLimit, rpdLimit, o.cost, w.now)
+		if !ok {
+			rollbackRedisRateLimitCounts(key, w.minute, w.hour, w.day, o.cost)
+			return false, msg, retryAfter
+		}
+		info.RPMCount, info.RPHCount, info.RPDCount = redisRPM, redisRPH, redisRPD
+	} else {
+		if ok, msg, retryAfter := checkChannelRateLimitInfo(info, channelID, keyIndex, rpmLimit, rpdLimit, o.cost, w.now); !ok {
+			return false, msg, retryAfter
+		}
+		info.RPMCount += o.cost
+		info.RPHCount += o.cost
+		info.RPDCount += o.cost
+	}
+	consumeChannelRateLimitBucket(info, o.cost)
+	refreshChannelRateLimitInfo(info, w.now, rpmLimit, rpdLimit, o)
+	recordChannelRPM(info)
+	return true, "", 0
 }
 
 // GetAllChannelRateLimitInfo 获取所有渠道的速率限制信息
@@ -190,12 +645,33 @@ func GetChannelRateLimitInfoByChannelID(channelID int) []*ChannelRateLimitInfo {
 	return result
 }
 
-// ResetChannelRateLimit 重置渠道速率限制计数
+// ResetChannelRateLimit 重置渠道速率限制计数 (包括按模型单独计数的记录；Redis 计数按 <key>:* 一并删除)
 func ResetChannelRateLimit(channelID int, keyIndex int) {
 	key := getChannelRateLimitKey(channelID, keyIndex)
 
+	resetRedisRateLimitCounts(key)
+
 	channelRateLimitMutex.Lock()
 	defer channelRateLimitMutex.Unlock()
 
 	delete(channelRateLimitStore, key)
+	// 按模型单独计数的记录
+	for k := range channelRateLimitStore {
+		if strings.HasPrefix(k, key+":") {
+			delete(channelRateLimitStore, k)
+		}
+	}
+}
+
+// ResetAllChannelRateLimits 清空所有渠道 (及按模型计数) 的速率限制计数，使用 Redis 时同时删除共享计数
+// 返回本实例清除的计数记录数；进行中请求占用的并发名额不受影响。
+func ResetAllChannelRateLimits() int {
+	resetAllRedisRateLimitCounts()
+
+	channelRateLimitMutex.Lock()
+	defer channelRateLimitMutex.Unlock()
+
+	cleared := len(channelRateLimitStore)
+	channelRateLimitStore = make(map[string]*ChannelRateLimitInfo)
+	return cleared
 }
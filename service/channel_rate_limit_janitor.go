@@ -0,0 +1,42 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// SweepChannelRateLimitStore 清理内存中已过期的速率限制记录，返回清理的条数
+// 日期 key 早于今天的记录 (RPM 与 RPD 计数均已失效) 直接删除，下次请求时会重新创建。
+func SweepChannelRateLimitStore() int {
+	currentDay := rateLimitNow().Format("2006-01-02")
+
+	channelRateLimitMutex.Lock()
+	defer channelRateLimitMutex.Unlock()
+
+	removed := 0
+	for key, info := range channelRateLimitStore {
+		if info.LastDayKey < currentDay {
+			delete(channelRateLimitStore, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartChannelRateLimitJanitor 按 interval 定期清理过期的速率限制记录
+func StartChannelRateLimitJanitor(interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if removed := SweepChannelRateLimitStore(); removed > 0 {
+				common.SysLog(fmt.Sprintf("已清理 %d 条过期的渠道速率限制记录", removed))
+			}
+		}
+	}()
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/go-redis/redis/v8"
+)
+
+// 渠道速率限制计数的 Redis 存储
+// 配置了 Redis 时 RPM / RPD 计数使用 INCR 写入共享的 Redis key，多实例部署时所有实例共用同一份计数。
+// <key>:rpm:<窗口 key> 在窗口结束后过期，<key>:rph:<小时> 在下一小时之后过期，<key>:rpd:<日期> 在次日之后过期。
+// 未配置 Redis 或 Redis 出错时使用进程内的 channelRateLimitStore。
+// 漏桶水位仍保存在本实例内存中。
+const (
+	rateLimitRedisHourTTL = 2 * time.Hour
+	rateLimitRedisDayTTL  = 48 * time.Hour
+)
+
+// rateLimitRedisClient 速率限制使用的 Redis 客户端，未启用 Redis 时返回 nil (测试中可替换)
+var rateLimitRedisClient = func() *redis.Client {
+	if common.RedisEnabled && common.RDB != nil {
+		return common.RDB
+	}
+	return nil
+}
+
+func rateLimitRedisKeys(key string, minuteKey string, hourKey string, dayKey string) (string, string, string) {
+	return key + ":rpm:" + minuteKey, key + ":rph:" + hourKey, key + ":rpd:" + dayKey
+}
+
+// loadRedisRateLimitCounts 读取当前窗口、当前小时与当天的计数，未启用 Redis 或读取失败时返回 false
+func loadRedisRateLimitCounts(key string, minuteKey string, hourKey string, dayKey string) (int, int, int, bool) {
+	client := rateLimitRedisClient()
+	if client == nil {
+		return 0, 0, 0, false
+	}
+	rpmKey, rphKey, rpdKey := rateLimitRedisKeys(key, minuteKey, hourKey, dayKey)
+	values, err := client.MGet(context.Background(), rpmKey, rphKey, rpdKey).Result()
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to load channel rate limit from redis: %v", err))
+		return 0, 0, 0, false
+	}
+	return redisCountValue(values[0]), redisCountValue(values[1]), redisCountValue(values[2]), true
+}
+
+// incrRedisRateLimitCounts 原子地按权重增加当前窗口、当前小时与当天的计数，返回增加后的计数
+func incrRedisRateLimitCounts(key string, minuteKey string, hourKey string, dayKey string, windowSeconds int, cost int) (int, int, int, bool) {
+	client := rateLimitRedisClient()
+	if client == nil {
+		return 0, 0, 0, false
+	}
+	rpmKey, rphKey, rpdKey := rateLimitRedisKeys(key, minuteKey, hourKey, dayKey)
+	ctx := context.Background()
+	pipe := client.TxPipeline()
+	rpm := pipe.IncrBy(ctx, rpmKey, int64(cost))
+	pipe.Expire(ctx, rpmKey, time.Duration(windowSeconds)*time.Second+time.Minute)
+	rph := pipe.IncrBy(ctx, rphKey, int64(cost))
+	pipe.Expire(ctx, rphKey, rateLimitRedisHourTTL)
+	rpd := pipe.IncrBy(ctx, rpdKey, int64(cost))
+	pipe.Expire(ctx, rpdKey, rateLimitRedisDayTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError(fmt.Sprintf("failed to increment channel rate limit in redis: %v", err))
+		return 0, 0, 0, false
+	}
+	return int(rpm.Val()), int(rph.Val()), int(rpd.Val()), true
+}
+
+// acquireRateLimitScript 检查三个计数加上权重 ARGV[7] 均不超过限制 (限制 <= 0 表示不限制) 后一起增加并刷新过期时间
+// 权重大于限制时按限制计算 (与 checkChannelRateLimitInfo 一致)
+// 返回 {是否放行, RPM 计数, RPH 计数, RPD 计数}
+const acquireRateLimitScript = `
+local cost = tonumber(ARGV[7])
+local counts = {}
+for i = 1, 3 do
+	counts[i] = tonumber(redis.call("GET", KEYS[i]) or "0")
+end
+for i = 1, 3 do
+	local limit = tonumber(ARGV[i])
+	if limit > 0 and counts[i] + math.min(cost, limit) > limit then
+		return {0, counts[1], counts[2], counts[3]}
+	end
+end
+for i = 1, 3 do
+	counts[i] = redis.call("INCRBY", KEYS[i], cost)
+	redis.call("EXPIRE", KEYS[i], ARGV[3 + i])
+end
+return {1, counts[1], counts[2], counts[3]}
+`
+
+// acquireRedisRateLimitCounts 原子地检查并按权重增加当前窗口、当前小时与当天的计数
+// 返回 (是否放行, RPM 计数, RPH 计数, RPD 计数, 是否使用了 Redis)
+func acquireRedisRateLimitCounts(key string, minuteKey string, hourKey string, dayKey string, windowSeconds int, rpmLimit int, rphLimit int, rpdLimit int, cost int) (bool, int, int, int, bool) {
+	client := rateLimitRedisClient()
+	if client == nil {
+		return false, 0, 0, 0, false
+	}
+	rpmKey, rphKey, rpdKey := rateLimitRedisKeys(key, minuteKey, hourKey, dayKey)
+	rpmTTL := time.Duration(windowSeconds)*time.Second + time.Minute
+	val, err := client.Eval(context.Background(), acquireRateLimitScript, []string{rpmKey, rphKey, rpdKey},
+		rpmLimit, rphLimit, rpdLimit,
+		int64(rpmTTL/time.Second), int64(rateLimitRedisHourTTL/time.Second), int64(rateLimitRedisDayTTL/time.Second), cost).Result()
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to acquire channel rate limit in redis: %v", err))
+		return false, 0, 0, 0, false
+	}
+	parts, ok := val.([]interface{})
+	if !ok || len(parts) != 4 {
+		common.SysError(fmt.Sprintf("unexpected channel rate limit script result: %v", val))
+		return false, 0, 0, 0, false
+	}
+	counts := make([]int, 4)
+	for i, part := range parts {
+		if n, ok := part.(int64); ok {
+			counts[i] = int(n)
+		}
+	}
+	return counts[0] == 1, counts[1], counts[2], counts[3], true
+}
+
+// rollbackRedisRateLimitCounts 撤销一次 acquireRedisRateLimitCounts 增加的计数
+func rollbackRedisRateLimitCounts(key string, minuteKey string, hourKey string, dayKey string, cost int) {
+	client := rateLimitRedisClient()
+	if client == nil {
+		return
+	}
+	rpmKey, rphKey, rpdKey := rateLimitRedisKeys(key, minuteKey, hourKey, dayKey)
+	ctx := context.Background()
+	pipe := client.TxPipeline()
+	for _, k := range []string{rpmKey, rphKey, rpdKey} {
+		pipe.DecrBy(ctx, k, int64(cost))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError(fmt.Sprintf("failed to roll back channel rate limit in redis: %v", err))
+	}
+}
+
+// resetRedisRateLimitCounts 删除 key 下的所有 Redis 计数
+func resetRedisRateLimitCounts(key string) {
+	deleteRedisRateLimitKeys(key + ":*")
+}
+
+// resetAllRedisRateLimitCounts 删除所有渠道的 Redis 计数
+func resetAllRedisRateLimitCounts() {
+	deleteRedisRateLimitKeys(channelRateLimitKeyPrefix + "*")
+}
+
+// deleteRedisRateLimitKeys 删除匹配 pattern 的 Redis 计数
+func deleteRedisRateLimitKeys(pattern string) {
+	client := rateLimitRedisClient()
+	if client == nil {
+		return
+	}
+	ctx := context.Background()
+	iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		common.SysError(fmt.Sprintf("failed to scan channel rate limit keys in redis: %v", err))
+		return
+	}
+	if len(keys) > 0 {
+		if err := client.Del(ctx, keys...).Err(); err != nil {
+			common.SysError(fmt.Sprintf("failed to reset channel rate limit in redis: %v", err))
+		}
+	}
+}
+
+func redisCountValue(val interface{}) int {
+	s, ok := val.(string)
+	if !ok {
+		return 0
+	}
+	var n int
+	fmt.Sscanf(s, "%d", &n)
+	return n
+}
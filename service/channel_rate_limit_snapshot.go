@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// 渠道速率限制计数的磁盘快照
+// 单实例且未使用 Redis 时，定期将 channelRateLimitStore 写入本地文件，启动时加载，使计数在重启后保留。
+// 快照文件缺失时从空计数开始；文件损坏时记录日志并忽略，不影响启动。
+
+// rateLimitSnapshotEntry 快照中的单条记录 (额外保存漏桶的上次漏水时间与令牌桶的上次补充时间)
+type rateLimitSnapshotEntry struct {
+	ChannelRateLimitInfo
+	LastLeakAt   time.Time `json:"last_leak_at"`
+	LastRefillAt time.Time `json:"last_refill_at"`
+}
+
+type rateLimitSnapshot struct {
+	SavedAt int64                              `json:"saved_at"`
+	Entries map[string]*rateLimitSnapshotEntry `json:"entries"`
+}
+
+// SaveChannelRateLimitSnapshot 将当前计数写入快照文件 (先写临时文件再替换，避免写入中断产生半个文件)
+func SaveChannelRateLimitSnapshot(path string) error {
+	channelRateLimitMutex.RLock()
+	snapshot := rateLimitSnapshot{
+		SavedAt: rateLimitNow().Unix(),
+		Entries: make(map[string]*rateLimitSnapshotEntry, len(channelRateLimitStore)),
+	}
+	for key, info := range channelRateLimitStore {
+		snapshot.Entries[key] = &rateLimitSnapshotEntry{ChannelRateLimitInfo: *info, LastLeakAt: info.lastLeakAt, LastRefillAt: info.lastRefillAt}
+	}
+	channelRateLimitMutex.RUnlock()
+
+	data, err := common.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadChannelRateLimitSnapshot 从快照文件恢复计数，文件不存在时不做任何处理
+// 文件损坏时返回错误，内存中的计数保持不变
+func LoadChannelRateLimitSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot rateLimitSnapshot
+	if err := common.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("速率限制快照 %s 已损坏: %v", path, err)
+	}
+
+	channelRateLimitMutex.Lock()
+	defer channelRateLimitMutex.Unlock()
+	for key, entry := range snapshot.Entries {
+		if entry == nil {
+			continue
+		}
+		info := entry.ChannelRateLimitInfo
+		info.lastLeakAt = entry.LastLeakAt
+		info.lastRefillAt = entry.LastRefillAt
+		channelRateLimitStore[key] = &info
+	}
+	return nil
+}
+
+// StartChannelRateLimitSnapshot 启动时加载快照，并按 interval 定期保存
+func StartChannelRateLimitSnapshot(path string, interval time.Duration) {
+	if path == "" {
+		return
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if err := LoadChannelRateLimitSnapshot(path); err != nil {
+		common.SysError(fmt.Sprintf("加载渠道速率限制快照失败，将从空计数开始: %v", err))
+	} else {
+		common.SysLog(fmt.Sprintf("渠道速率限制快照已启用: %s (每 %v 保存)", path, interval))
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := SaveChannelRateLimitSnapshot(path); err != nil {
+				common.SysError(fmt.Sprintf("保存渠道速率限制快照失败: %v", err))
+			}
+		}
+	}()
+}
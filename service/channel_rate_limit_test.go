@@ -0,0 +1,561 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setRateLimitTime 固定速率限制使用的当前时间，测试结束后恢复
+func setRateLimitTime(t *testing.T, now *time.Time) {
+	t.Helper()
+	prev := rateLimitNow
+	rateLimitNow = func() time.Time { return *now }
+	t.Cleanup(func() { rateLimitNow = prev })
+}
+
+func TestChannelRateLimitCustomWindow(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 10, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98601
+	defer ResetChannelRateLimit(channelID, 0)
+
+	window := RateLimitOptionWithWindow(300)
+	for i := 0; i < 2; i++ {
+		if ok, msg, _ := CheckChannelRateLimit(channelID, 0, 2, 0, window); !ok {
+			t.Fatalf("request %d should pass: %s", i, msg)
+		}
+		IncrementChannelRateLimit(channelID, 0, 2, 0, window)
+	}
+
+	// 1 分钟后仍处于同一个 5 分钟窗口
+	now = now.Add(time.Minute)
+	if ok, _, _ := CheckChannelRateLimit(channelID, 0, 2, 0, window); ok {
+		t.Fatal("should still be limited inside the 300s window")
+	}
+
+	// 跨过 5 分钟窗口边界后重置
+	now = time.Date(2025, 3, 1, 10, 5, 0, 0, time.UTC)
+	if ok, msg, _ := CheckChannelRateLimit(channelID, 0, 2, 0, window); !ok {
+		t.Fatalf("should reset after window boundary: %s", msg)
+	}
+
+	info := GetChannelRateLimitInfo(channelID, 0, 2, 0, window)
+	if info.WindowSeconds != 300 || info.LastMinuteKey != "2025-03-01-10-05-00" {
+		t.Fatalf("unexpected window info: %+v", info)
+	}
+}
+
+func TestChannelRateLimitLeakyBucket(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98602
+	defer ResetChannelRateLimit(channelID, 0)
+
+	// 平均每分钟 6 次 (每 10 秒漏出 1 次)，允许 5 次突发
+	bucket := RateLimitOptionWithLeakyBucket(5, 6)
+	for i := 0; i < 5; i++ {
+		if ok, msg, _ := CheckChannelRateLimit(channelID, 0, 6, 0, bucket); !ok {
+			t.Fatalf("burst request %d should pass: %s", i, msg)
+		}
+		IncrementChannelRateLimit(channelID, 0, 6, 0, bucket)
+	}
+	if ok, _, _ := CheckChannelRateLimit(channelID, 0, 6, 0, bucket); ok {
+		t.Fatal("request beyond bucket size should be rejected")
+	}
+
+	// 持续以高于漏出速率的频率请求时，只有漏出的部分能通过
+	accepted := 0
+	for i := 0; i < 12; i++ {
+		now = now.Add(5 * time.Second)
+		if ok, _, _ := CheckChannelRateLimit(channelID, 0, 6, 0, bucket); ok {
+			IncrementChannelRateLimit(channelID, 0, 6, 0, bucket)
+			accepted++
+		}
+	}
+	if accepted != 6 {
+		t.Fatalf("expected 6 requests accepted at the leak rate over one minute, got %d", accepted)
+	}
+
+	info := GetChannelRateLimitInfo(channelID, 0, 6, 0, bucket)
+	if !info.LeakyBucket || info.BucketSize != 5 || info.BucketLevel > 5 {
+		t.Fatalf("unexpected bucket info: %+v", info)
+	}
+
+	// 空闲后桶完全漏空
+	now = now.Add(time.Minute)
+	if info := GetChannelRateLimitInfo(channelID, 0, 6, 0, bucket); info.BucketLevel != 0 {
+		t.Fatalf("bucket should drain when idle, level=%v", info.BucketLevel)
+	}
+}
+
+func TestChannelRateLimitSnapshotRoundTrip(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98603
+	defer ResetChannelRateLimit(channelID, 0)
+	defer ResetChannelRateLimit(channelID, 1)
+
+	bucket := RateLimitOptionWithLeakyBucket(5, 6)
+	for i := 0; i < 3; i++ {
+		IncrementChannelRateLimit(channelID, 0, 10, 100)
+	}
+	IncrementChannelRateLimit(channelID, 1, 6, 0, bucket)
+	path := filepath.Join(t.TempDir(), "rate_limit.json")
+	if err := SaveChannelRateLimitSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟重启: 清空内存计数后从快照恢复
+	ResetChannelRateLimit(channelID, 0)
+	ResetChannelRateLimit(channelID, 1)
+	if err := LoadChannelRateLimitSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if info := GetChannelRateLimitInfo(channelID, 0, 10, 100); info.RPMCount != 3 || info.RPDCount != 3 {
+		t.Fatalf("counters should survive the snapshot, got %+v", info)
+	}
+	now = now.Add(10 * time.Second)
+	if info := GetChannelRateLimitInfo(channelID, 1, 6, 0, bucket); info.BucketLevel != 0 {
+		t.Fatalf("bucket should keep leaking from its saved time, level=%v", info.BucketLevel)
+	}
+
+	if err := LoadChannelRateLimitSnapshot(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatalf("missing snapshot should be ignored, got %v", err)
+	}
+}
+
+func TestChannelRateLimitSnapshotCorruptFile(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98604
+	defer ResetChannelRateLimit(channelID, 0)
+	IncrementChannelRateLimit(channelID, 0, 10, 0)
+
+	path := filepath.Join(t.TempDir(), "rate_limit.json")
+	if err := os.WriteFile(path, []byte(`{"entries": {"channel_rate_limit:1:0": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadChannelRateLimitSnapshot(path); err == nil {
+		t.Fatal("corrupt snapshot should return an error")
+	}
+	if info := GetChannelRateLimitInfo(channelID, 0, 10, 0); info.RPMCount != 1 {
+		t.Fatalf("corrupt snapshot should leave in-memory counters untouched, got %+v", info)
+	}
+
+	// 下次保存会覆盖损坏的文件
+	if err := SaveChannelRateLimitSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadChannelRateLimitSnapshot(path); err != nil {
+		t.Fatalf("snapshot should be readable after being rewritten, got %v", err)
+	}
+}
+
+func TestChannelRateLimitSharedThroughRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	prev := rateLimitRedisClient
+	rateLimitRedisClient = func() *redis.Client { return client }
+	t.Cleanup(func() { rateLimitRedisClient = prev })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98605
+	defer ResetChannelRateLimit(channelID, 0)
+	key := getChannelRateLimitKey(channelID, 0)
+
+	// 模拟另一个实例: 清空本进程内存计数，只保留 Redis 中的共享计数
+	switchInstance := func() {
+		channelRateLimitMutex.Lock()
+		delete(channelRateLimitStore, key)
+		channelRateLimitMutex.Unlock()
+	}
+
+	IncrementChannelRateLimit(channelID, 0, 3, 10)
+	switchInstance()
+	IncrementChannelRateLimit(channelID, 0, 3, 10)
+	switchInstance()
+	IncrementChannelRateLimit(channelID, 0, 3, 10)
+	switchInstance()
+
+	if ok, _, _ := CheckChannelRateLimit(channelID, 0, 3, 10); ok {
+		t.Fatal("requests from all instances should count against the shared limit")
+	}
+	if info := GetChannelRateLimitInfo(channelID, 0, 3, 10); info.RPMCount != 3 || info.RPDCount != 3 {
+		t.Fatalf("expected shared counts 3/3, got %+v", info)
+	}
+
+	// 窗口切换后 RPM 重新计数，RPD 继续累计
+	now = now.Add(time.Minute)
+	if info := GetChannelRateLimitInfo(channelID, 0, 3, 10); info.RPMCount != 0 || info.RPDCount != 3 {
+		t.Fatalf("expected rpm reset in the new window, got %+v", info)
+	}
+
+	ResetChannelRateLimit(channelID, 0)
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("reset should remove redis counters, got %v", keys)
+	}
+}
+
+func TestChannelRateLimitSweepRemovesStaleEntries(t *testing.T) {
+	now := time.Date(2025, 3, 1, 23, 59, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98606
+	defer ResetChannelRateLimit(channelID, 0)
+	defer ResetChannelRateLimit(channelID, 1)
+
+	IncrementChannelRateLimit(channelID, 0, 10, 100)
+	now = now.Add(2 * time.Minute)
+	IncrementChannelRateLimit(channelID, 1, 10, 100)
+
+	SweepChannelRateLimitStore()
+	channelRateLimitMutex.RLock()
+	_, staleExists := channelRateLimitStore[getChannelRateLimitKey(channelID, 0)]
+	_, freshExists := channelRateLimitStore[getChannelRateLimitKey(channelID, 1)]
+	channelRateLimitMutex.RUnlock()
+	if staleExists {
+		t.Fatal("entry from the previous day should be reclaimed")
+	}
+	if !freshExists {
+		t.Fatal("entry from today should be kept")
+	}
+}
+
+func TestChannelRateLimitTokenBucket(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98607
+	defer ResetChannelRateLimit(channelID, 0)
+
+	// 每分钟 6 个令牌 (每 10 秒补充 1 个)，容量 4
+	bucket := RateLimitOptionWithTokenBucket(4)
+	for i := 0; i < 4; i++ {
+		if ok, msg, _ := CheckChannelRateLimit(channelID, 0, 6, 0, bucket); !ok {
+			t.Fatalf("burst request %d should pass: %s", i, msg)
+		}
+		IncrementChannelRateLimit(channelID, 0, 6, 0, bucket)
+	}
+	if ok, _, _ := CheckChannelRateLimit(channelID, 0, 6, 0, bucket); ok {
+		t.Fatal("request beyond burst size should be rejected")
+	}
+
+	// 持续高频请求时只能按补充速率通过
+	accepted := 0
+	for i := 0; i < 30; i++ {
+		now = now.Add(2 * time.Second)
+		if ok, _, _ := CheckChannelRateLimit(channelID, 0, 6, 0, bucket); ok {
+			IncrementChannelRateLimit(channelID, 0, 6, 0, bucket)
+			accepted++
+		}
+	}
+	if accepted != 6 {
+		t.Fatalf("expected 6 requests accepted at the refill rate over one minute, got %d", accepted)
+	}
+
+	// 空闲后令牌恢复到容量上限，不会超过容量
+	now = now.Add(10 * time.Minute)
+	info := GetChannelRateLimitInfo(channelID, 0, 6, 0, bucket)
+	if !info.TokenBucket || info.Tokens != 4 || info.BurstSize != 4 || info.RefillRate != 0.1 {
+		t.Fatalf("bucket should refill to capacity when idle, got %+v", info)
+	}
+	for i := 0; i < 4; i++ {
+		IncrementChannelRateLimit(channelID, 0, 6, 0, bucket)
+	}
+	if ok, _, _ := CheckChannelRateLimit(channelID, 0, 6, 0, bucket); ok {
+		t.Fatal("burst after idle should still be capped at the bucket size")
+	}
+}
+
+func TestChannelRateLimitHourly(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 58, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98608
+	defer ResetChannelRateLimit(channelID, 0)
+
+	hourly := RateLimitOptionWithRPH(3)
+	// 跨分钟仍累计到同一小时
+	for i := 0; i < 3; i++ {
+		if ok, msg, _ := CheckChannelRateLimit(channelID, 0, 0, 0, hourly); !ok {
+			t.Fatalf("request %d should pass: %s", i, msg)
+		}
+		IncrementChannelRateLimit(channelID, 0, 0, 0, hourly)
+		now = now.Add(20 * time.Second)
+	}
+	if ok, _, _ := CheckChannelRateLimit(channelID, 0, 0, 0, hourly); ok {
+		t.Fatal("should be limited within the same hour")
+	}
+	info := GetChannelRateLimitInfo(channelID, 0, 0, 0, hourly)
+	if info.RPHCount != 3 || info.RPHRemaining != 0 || info.LastHourKey != "2025-03-01-10" ||
+		info.RPHResetAt != time.Date(2025, 3, 1, 11, 0, 0, 0, time.UTC).Unix() {
+		t.Fatalf("unexpected hourly info: %+v", info)
+	}
+
+	// 跨过整点后重新计数，RPD 继续累计
+	now = time.Date(2025, 3, 1, 11, 0, 0, 0, time.UTC)
+	if ok, msg, _ := CheckChannelRateLimit(channelID, 0, 0, 0, hourly); !ok {
+		t.Fatalf("should reset after the hour boundary: %s", msg)
+	}
+	if info := GetChannelRateLimitInfo(channelID, 0, 0, 0, hourly); info.RPHCount != 0 || info.RPDCount != 3 {
+		t.Fatalf("expected hourly reset only, got %+v", info)
+	}
+
+	// RPH 为 0 表示不限制
+	if info := GetChannelRateLimitInfo(channelID, 0, 0, 0); info.RPHRemaining != -1 {
+		t.Fatalf("zero RPH limit should be unlimited, got %+v", info)
+	}
+}
+
+func TestChannelSlotConcurrencyLimit(t *testing.T) {
+	const channelID = 98609
+	for i := 0; i < 3; i++ {
+		if !AcquireChannelSlot(channelID, 0, 3) {
+			t.Fatalf("acquire %d should succeed", i)
+		}
+	}
+	if AcquireChannelSlot(channelID, 0, 3) {
+		t.Fatal("4th concurrent acquire should be rejected")
+	}
+	// 其他 key 不受影响
+	if !AcquireChannelSlot(channelID, 1, 3) {
+		t.Fatal("other key should have its own slots")
+	}
+	ReleaseChannelSlot(channelID, 1)
+
+	ReleaseChannelSlot(channelID, 0)
+	if got := GetChannelConcurrency(channelID, 0); got != 2 {
+		t.Fatalf("expected 2 in-flight after release, got %d", got)
+	}
+	if !AcquireChannelSlot(channelID, 0, 3) {
+		t.Fatal("release should free a slot")
+	}
+	for i := 0; i < 3; i++ {
+		ReleaseChannelSlot(channelID, 0)
+	}
+	if got := GetChannelConcurrency(channelID, 0); got != 0 {
+		t.Fatalf("all slots should be released, got %d", got)
+	}
+}
+
+func TestAcquireChannelRateLimitNeverOverAdmits(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+
+	run := func(t *testing.T, channelID int) {
+		defer ResetChannelRateLimit(channelID, 0)
+		const limit = 20
+		var admitted int64
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < 200; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, _, _ := AcquireChannelRateLimit(channelID, 0, limit, 0); ok {
+					mu.Lock()
+					admitted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if admitted != limit {
+			t.Fatalf("expected exactly %d admitted, got %d", limit, admitted)
+		}
+		if info := GetChannelRateLimitInfo(channelID, 0, limit, 0); info.RPMCount != limit {
+			t.Fatalf("rejected requests should not be counted, got %+v", info)
+		}
+	}
+
+	t.Run("memory", func(t *testing.T) { run(t, 98610) })
+	t.Run("redis", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		prev := rateLimitRedisClient
+		rateLimitRedisClient = func() *redis.Client { return client }
+		t.Cleanup(func() { rateLimitRedisClient = prev })
+		run(t, 98611)
+	})
+}
+
+func TestChannelRateLimitMetrics(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98611
+	defer ResetChannelRateLimit(channelID, 0)
+
+	rejections := common.ChannelRateLimitRejectionsTotal.WithLabelValues("98611", "0")
+	before := testutil.ToFloat64(rejections)
+	for i := 0; i < 3; i++ {
+		AcquireChannelRateLimit(channelID, 0, 2, 0)
+	}
+	if got := testutil.ToFloat64(rejections) - before; got != 1 {
+		t.Fatalf("rejections moved by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(common.ChannelRPMCurrent.WithLabelValues("98611", "0")); got != 2 {
+		t.Fatalf("rpm gauge = %v, want 2", got)
+	}
+}
+
+func TestChannelRateLimitPerModel(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98612
+	defer ResetChannelRateLimit(channelID, 0)
+
+	setting := dto.ChannelSettings{
+		RateLimitEnabled: true,
+		RateLimitRPM:     5,
+		RateLimitModels:  map[string]dto.ChannelModelRateLimit{"gpt-4o": {RPM: 1}},
+	}
+	acquire := func(model string) bool {
+		rpm, rpd, opts := ChannelRateLimitForModel(setting, model)
+		ok, _, _ := AcquireChannelRateLimit(channelID, 0, rpm, rpd, opts...)
+		return ok
+	}
+
+	if !acquire("gpt-4o") {
+		t.Fatal("first gpt-4o request should pass")
+	}
+	if acquire("gpt-4o") {
+		t.Fatal("gpt-4o should be throttled by its own limit")
+	}
+	rpm, rpd, opts := ChannelRateLimitForModel(setting, "gpt-4o")
+	if ok, msg, _ := CheckChannelRateLimit(channelID, 0, rpm, rpd, opts...); ok || !strings.Contains(msg, "gpt-4o") {
+		t.Fatalf("check should report the throttled model, got ok=%v msg=%q", ok, msg)
+	}
+
+	// 没有覆盖限制的模型使用渠道整体计数，不受 gpt-4o 影响
+	for i := 0; i < 5; i++ {
+		if !acquire("gpt-4o-mini") {
+			t.Fatalf("gpt-4o-mini request %d should pass under the channel limit", i)
+		}
+	}
+	if acquire("gpt-4o-mini") {
+		t.Fatal("channel-wide limit should still apply to other models")
+	}
+	if info := GetChannelRateLimitInfo(channelID, 0, 5, 0); info.RPMCount != 5 {
+		t.Fatalf("channel counter should only count models without overrides, got %d", info.RPMCount)
+	}
+
+	ResetChannelRateLimit(channelID, 0)
+	if !acquire("gpt-4o") {
+		t.Fatal("reset should clear per-model counters")
+	}
+}
+
+func TestChannelRateLimitWeightedCost(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+
+	run := func(t *testing.T, channelID int) {
+		defer ResetChannelRateLimit(channelID, 0)
+		IncrementChannelRateLimit(channelID, 0, 10, 0, RateLimitOptionWithCost(5))
+		if info := GetChannelRateLimitInfo(channelID, 0, 10, 0); info.RPMCount != 5 || info.RPMRemaining != 5 {
+			t.Fatalf("cost-5 request should advance the counter by five, got %+v", info)
+		}
+		if ok, _, _ := AcquireChannelRateLimit(channelID, 0, 10, 0, RateLimitOptionWithCost(6)); ok {
+			t.Fatal("request exceeding the remaining weighted budget should be rejected")
+		}
+		if ok, _, _ := AcquireChannelRateLimit(channelID, 0, 10, 0, RateLimitOptionWithCost(5)); !ok {
+			t.Fatal("request fitting the remaining weighted budget should pass")
+		}
+		if info := GetChannelRateLimitInfo(channelID, 0, 10, 0); info.RPMCount != 10 {
+			t.Fatalf("rejected request should not be counted, got %d", info.RPMCount)
+		}
+		if ok, _, _ := CheckChannelRateLimit(channelID, 0, 10, 0); ok {
+			t.Fatal("limit should be reached after weighted requests")
+		}
+
+		// 权重大于限制时按限制计算，新窗口内仍可放行
+		now = now.Add(time.Minute)
+		if ok, _, _ := AcquireChannelRateLimit(channelID, 0, 10, 0, RateLimitOptionWithCost(20)); !ok {
+			t.Fatal("request heavier than the limit should pass in an empty window")
+		}
+	}
+
+	t.Run("memory", func(t *testing.T) { run(t, 98613) })
+	t.Run("redis", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		prev := rateLimitRedisClient
+		rateLimitRedisClient = func() *redis.Client { return client }
+		t.Cleanup(func() { rateLimitRedisClient = prev })
+		run(t, 98614)
+	})
+
+	// 渠道按模型设置的权重由 ChannelRateLimitForModel 带上
+	setting := dto.ChannelSettings{RateLimitEnabled: true, RateLimitRPM: 10, RateLimitModelWeights: map[string]int{"gpt-4-32k": 5}}
+	const channelID = 98615
+	defer ResetChannelRateLimit(channelID, 0)
+	for _, model := range []string{"gpt-4-32k", "gpt-4o-mini"} {
+		rpm, rpd, opts := ChannelRateLimitForModel(setting, model)
+		IncrementChannelRateLimit(channelID, 0, rpm, rpd, opts...)
+	}
+	if info := GetChannelRateLimitInfo(channelID, 0, 10, 0); info.RPMCount != 6 {
+		t.Fatalf("weighted model should count as five requests, got %d", info.RPMCount)
+	}
+}
+
+func TestChannelRateLimitRetryAfter(t *testing.T) {
+	now := time.Date(2025, 3, 1, 23, 50, 15, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	const channelID = 98616
+	defer ResetChannelRateLimit(channelID, 0)
+	defer ResetChannelRateLimit(channelID, 1)
+
+	// RPM 超限: 等到当前分钟结束
+	AcquireChannelRateLimit(channelID, 0, 1, 100)
+	if ok, _, retryAfter := AcquireChannelRateLimit(channelID, 0, 1, 100); ok || retryAfter != 45 {
+		t.Fatalf("rpm breach should retry at the end of the minute, got ok=%v retryAfter=%d", ok, retryAfter)
+	}
+
+	// RPD 超限: 等到当天结束
+	AcquireChannelRateLimit(channelID, 1, 0, 1)
+	if ok, _, retryAfter := AcquireChannelRateLimit(channelID, 1, 0, 1); ok || retryAfter != 9*60+45 {
+		t.Fatalf("rpd breach should retry at the end of the day, got ok=%v retryAfter=%d", ok, retryAfter)
+	}
+	now = now.Add(5 * time.Minute)
+	if ok, _, retryAfter := CheckChannelRateLimit(channelID, 1, 0, 1); ok || retryAfter != 4*60+45 {
+		t.Fatalf("rpd retry should count down to midnight, got ok=%v retryAfter=%d", ok, retryAfter)
+	}
+}
+
+func TestResetAllChannelRateLimits(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	prev := rateLimitRedisClient
+	rateLimitRedisClient = func() *redis.Client { return client }
+	t.Cleanup(func() { rateLimitRedisClient = prev })
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	setRateLimitTime(t, &now)
+	ResetAllChannelRateLimits()
+
+	IncrementChannelRateLimit(98617, 0, 10, 0)
+	IncrementChannelRateLimit(98617, 1, 10, 0)
+	IncrementChannelRateLimit(98618, 0, 10, 0, RateLimitOptionWithModel("gpt-4o"))
+	mr.Set("unrelated", "1")
+
+	if cleared := ResetAllChannelRateLimits(); cleared != 3 {
+		t.Fatalf("expected 3 counters cleared, got %d", cleared)
+	}
+	if len(GetAllChannelRateLimitInfo()) != 0 {
+		t.Fatal("store should be empty after reset")
+	}
+	if keys := mr.Keys(); len(keys) != 1 || keys[0] != "unrelated" {
+		t.Fatalf("reset should only remove rate limit keys from redis, got %v", keys)
+	}
+	if cleared := ResetAllChannelRateLimits(); cleared != 0 {
+		t.Fatalf("reset on an empty store should clear nothing, got %d", cleared)
+	}
+}
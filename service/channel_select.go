@@ -141,7 +141,7 @@ func CacheGetRandomSatisfiedChannel(param *RetryParam) (*model.Channel, string,
 				}
 
 				// 检查渠道速率限制
-				channelSetting := channel.GetSetting()
+				channelSetting, _ := EffectiveChannelRateLimitSetting(channel.GetSetting())
 				if channelSetting.RateLimitEnabled {
 					// 获取 key index（多 key 模式）
 					keyIndex := 0
@@ -149,7 +149,8 @@ func CacheGetRandomSatisfiedChannel(param *RetryParam) (*model.Channel, string,
 						_, idx, _ := channel.GetNextEnabledKey()
 						keyIndex = idx
 					}
-					allowed, _ := CheckChannelRateLimit(channel.Id, keyIndex, channelSetting.RateLimitRPM, channelSetting.RateLimitRPD)
+					rpmLimit, rpdLimit, opts := ChannelRateLimitForModel(channelSetting, param.ModelName)
+					allowed, _, _ := CheckChannelRateLimit(channel.Id, keyIndex, rpmLimit, rpdLimit, opts...)
 					if !allowed {
 						rateLimitedChannels[channel.Id] = true
 						logger.LogDebug(param.Ctx, "渠道 #%d 已达到速率限制，跳过选择其他渠道", channel.Id)
@@ -202,7 +203,7 @@ func CacheGetRandomSatisfiedChannel(param *RetryParam) (*model.Channel, string,
 			}
 
 			// 检查渠道速率限制
-			channelSetting := channel.GetSetting()
+			channelSetting, _ := EffectiveChannelRateLimitSetting(channel.GetSetting())
 			if channelSetting.RateLimitEnabled {
 				// 获取 key index（多 key 模式）
 				keyIndex := 0
@@ -210,7 +211,8 @@ func CacheGetRandomSatisfiedChannel(param *RetryParam) (*model.Channel, string,
 					_, idx, _ := channel.GetNextEnabledKey()
 					keyIndex = idx
 				}
-				allowed, _ := CheckChannelRateLimit(channel.Id, keyIndex, channelSetting.RateLimitRPM, channelSetting.RateLimitRPD)
+				rpmLimit, rpdLimit, opts := ChannelRateLimitForModel(channelSetting, param.ModelName)
+				allowed, _, _ := CheckChannelRateLimit(channel.Id, keyIndex, rpmLimit, rpdLimit, opts...)
 				if !allowed {
 					rateLimitedChannels[channel.Id] = true
 					logger.LogDebug(param.Ctx, "渠道 #%d 已达到速率限制，跳过选择其他渠道", channel.Id)